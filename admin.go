@@ -0,0 +1,263 @@
+package mightydns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// maxAdminBodySize caps the size of config documents accepted by the
+	// admin API.
+	maxAdminBodySize = 10 << 20
+	// adminReadHeaderTimeout and adminReadTimeout bound how long a client
+	// may take to send a request's headers and the whole request, so that
+	// slow clients cannot hold the API's connections open.
+	adminReadHeaderTimeout = 10 * time.Second
+	adminReadTimeout       = time.Minute
+)
+
+// admin is the running admin API server, if the current config enables
+// one. It is replaced along with the config, but kept running when the
+// listen address does not change so that a config loaded through the API
+// does not cut off the request that loaded it.
+var (
+	admin   *adminServer
+	adminMu sync.Mutex
+)
+
+// stopped is closed once POST /stop has stopped the config.
+var (
+	stopped  = make(chan struct{})
+	stopOnce sync.Once
+)
+
+var errNoBody = errors.New("request body is empty")
+
+// StopRequested returns a channel that is closed once the config has been
+// stopped through the admin API, telling the process to exit.
+func StopRequested() <-chan struct{} {
+	return stopped
+}
+
+type adminServer struct {
+	listen string
+	addr   string
+	server *http.Server
+}
+
+// startAdmin binds and starts serving the admin API described by cfg.
+func startAdmin(cfg *AdminConfig) (*adminServer, error) {
+	l, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", cfg.Listen, err)
+	}
+
+	a := &adminServer{
+		listen: cfg.Listen,
+		addr:   l.Addr().String(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /config", a.handleConfig)
+	mux.HandleFunc("POST /load", a.handleLoad)
+	mux.HandleFunc("POST /stop", a.handleStop)
+	mux.HandleFunc("GET /modules", a.handleModules)
+	mux.HandleFunc("POST /apps/{name}/start", a.handleStartApp)
+	mux.HandleFunc("POST /apps/{name}/stop", a.handleStopApp)
+	mux.HandleFunc("POST /apps/{name}/servers/{server}", a.handleAddServer)
+	mux.HandleFunc("PUT /apps/{name}/servers/{server}", a.handleUpdateServer)
+	mux.HandleFunc("DELETE /apps/{name}/servers/{server}", a.handleRemoveServer)
+	a.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: adminReadHeaderTimeout,
+		ReadTimeout:       adminReadTimeout,
+	}
+
+	Logger().Info("starting admin API", "addr", a.addr)
+	go func() {
+		if err := a.server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			Logger().Error("admin API error", "addr", a.addr, "error", err)
+		}
+	}()
+
+	return a, nil
+}
+
+// close shuts the admin server down in the background, so that it can be
+// called while handling an admin request, which shutting down waits for.
+func (a *adminServer) close() {
+	go func() {
+		if err := a.server.Shutdown(context.Background()); err != nil {
+			Logger().Error("stopping admin API", "addr", a.addr, "error", err)
+		}
+	}()
+}
+
+// prepareAdmin returns the admin server cfg asks for: the running one if
+// its listen address is unchanged, a newly started one otherwise, or nil
+// if the admin API is disabled. adminMu must be held.
+func prepareAdmin(cfg *AdminConfig) (*adminServer, error) {
+	if cfg == nil || cfg.Listen == "" {
+		return nil, nil
+	}
+	if admin != nil && admin.listen == cfg.Listen {
+		return admin, nil
+	}
+	return startAdmin(cfg)
+}
+
+// swapAdmin makes next the running admin server, closing the previous one
+// if it is being replaced. adminMu must be held.
+func swapAdmin(next *adminServer) {
+	if admin != nil && admin != next {
+		admin.close()
+	}
+	admin = next
+}
+
+func (a *adminServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	configMu.RLock()
+	var raw []byte
+	if currentConfig != nil {
+		raw = currentConfig.raw
+	}
+	configMu.RUnlock()
+
+	if raw == nil {
+		raw = []byte("null")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(raw)
+}
+
+// readBody reads the config document in a request's body. If it cannot be
+// read, the error is written to the client and ok is false.
+func readBody(w http.ResponseWriter, r *http.Request) (body []byte, ok bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminBodySize))
+	if err == nil && len(body) == 0 {
+		err = errNoBody
+	}
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		adminError(w, status, fmt.Errorf("reading config: %w", err))
+		return nil, false
+	}
+	return body, true
+}
+
+func (a *adminServer) handleLoad(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	if err := Load(body, true); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *adminServer) handleStop(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+
+	// Stop after the response is sent, since stopping shuts down the admin
+	// server and waits for this request to finish
+	go func() {
+		if err := Stop(); err != nil {
+			Logger().Error("stopping config", "error", err)
+		}
+		stopOnce.Do(func() { close(stopped) })
+	}()
+}
+
+func (a *adminServer) handleModules(w http.ResponseWriter, r *http.Request) {
+	modules := make(map[string][]string)
+	for namespace, infos := range ModulesByCategory() {
+		for _, info := range infos {
+			modules[namespace] = append(modules[namespace], info.ID)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(modules)
+}
+
+func (a *adminServer) handleStartApp(w http.ResponseWriter, r *http.Request) {
+	if err := StartApp(r.PathValue("name")); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *adminServer) handleStopApp(w http.ResponseWriter, r *http.Request) {
+	if err := StopApp(r.PathValue("name")); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *adminServer) handleAddServer(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	if err := AddServer(r.PathValue("name"), r.PathValue("server"), body); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *adminServer) handleUpdateServer(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	if err := UpdateServer(r.PathValue("name"), r.PathValue("server"), body); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *adminServer) handleRemoveServer(w http.ResponseWriter, r *http.Request) {
+	if err := RemoveServer(r.PathValue("name"), r.PathValue("server")); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// adminError writes err to the client as a JSON error document, including
+// the position of config syntax errors.
+func adminError(w http.ResponseWriter, status int, err error) {
+	Logger().Error("admin request failed", "status", status, "error", err)
+
+	body := map[string]interface{}{"error": err.Error()}
+	var syntaxErr *ConfigSyntaxError
+	if errors.As(err, &syntaxErr) {
+		body["offset"] = syntaxErr.Offset
+		body["line"] = syntaxErr.Line
+		body["column"] = syntaxErr.Column
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,268 @@
+package mightydns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminConfig(label string) string {
+	return fmt.Sprintf(`{
+		"admin": {"listen": "127.0.0.1:0"},
+		"logging": {"handler": "test.logger"},
+		"apps": {
+			"test.app": {"label": %q}
+		}
+	}`, label)
+}
+
+// adminURL returns the base URL of the running admin API.
+func adminURL(t *testing.T) string {
+	t.Helper()
+
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	if admin == nil {
+		t.Fatal("admin API is not running")
+	}
+	return "http://" + admin.addr
+}
+
+func adminRequest(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func TestAdmin_ConfigAndLoad(t *testing.T) {
+	defer func() { _ = Stop() }()
+
+	if err := Load([]byte(adminConfig("admin-first")), true); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	base := adminURL(t)
+
+	status, body := adminRequest(t, http.MethodGet, base+"/config", "")
+	if status != http.StatusOK || !strings.Contains(body, "admin-first") {
+		t.Fatalf("expected the running config, got %d %s", status, body)
+	}
+
+	status, body = adminRequest(t, http.MethodPost, base+"/load", adminConfig("admin-second"))
+	if status != http.StatusOK {
+		t.Fatalf("expected load to succeed, got %d %s", status, body)
+	}
+	if !isAppRunning("admin-second") || isAppRunning("admin-first") {
+		t.Error("expected the loaded config to replace the running one")
+	}
+	if adminURL(t) != base {
+		t.Error("expected the admin API to keep running on the same address")
+	}
+
+	status, body = adminRequest(t, http.MethodGet, base+"/config", "")
+	if status != http.StatusOK || !strings.Contains(body, "admin-second") {
+		t.Errorf("expected the loaded config, got %d %s", status, body)
+	}
+}
+
+func TestAdmin_LoadErrors(t *testing.T) {
+	defer func() { _ = Stop() }()
+
+	if err := Load([]byte(adminConfig("admin-errors")), true); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	base := adminURL(t)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantLine   int
+		wantOffset int64
+	}{
+		{name: "empty body", body: "", wantStatus: http.StatusBadRequest},
+		{name: "syntax error", body: "{\n  \"apps\": {,\n}", wantStatus: http.StatusBadRequest, wantLine: 2, wantOffset: 14},
+		{name: "failing app", body: `{"logging": {"handler": "test.logger"}, "apps": {"test.app": {"label": "admin-bad", "fail": true}}}`, wantStatus: http.StatusBadRequest},
+		{name: "too large", body: `{"pad": "` + strings.Repeat("x", maxAdminBodySize) + `"}`, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := adminRequest(t, http.MethodPost, base+"/load", tt.body)
+			if status != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d %s", tt.wantStatus, status, body)
+			}
+
+			var errBody struct {
+				Error  string `json:"error"`
+				Line   int    `json:"line"`
+				Offset int64  `json:"offset"`
+			}
+			if err := json.Unmarshal([]byte(body), &errBody); err != nil || errBody.Error == "" {
+				t.Fatalf("expected a JSON error, got %s", body)
+			}
+			if errBody.Line != tt.wantLine {
+				t.Errorf("expected error line %d, got %d", tt.wantLine, errBody.Line)
+			}
+			if errBody.Offset != tt.wantOffset {
+				t.Errorf("expected error offset %d, got %d", tt.wantOffset, errBody.Offset)
+			}
+		})
+	}
+
+	if !isAppRunning("admin-errors") {
+		t.Error("expected failed loads to leave the running config untouched")
+	}
+}
+
+func TestAdmin_Modules(t *testing.T) {
+	defer func() { _ = Stop() }()
+
+	if err := Load([]byte(adminConfig("admin-modules")), true); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	status, body := adminRequest(t, http.MethodGet, adminURL(t)+"/modules", "")
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+
+	var modules map[string][]string
+	if err := json.Unmarshal([]byte(body), &modules); err != nil {
+		t.Fatalf("failed to parse modules: %v", err)
+	}
+	found := false
+	for _, id := range modules["test"] {
+		found = found || id == "test.app"
+	}
+	if !found {
+		t.Errorf("expected test.app in the test namespace, got %v", modules)
+	}
+}
+
+func TestAdmin_AppLifecycle(t *testing.T) {
+	defer func() { _ = Stop() }()
+
+	if err := Load([]byte(adminConfig("admin-apps")), true); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	base := adminURL(t)
+
+	if status, body := adminRequest(t, http.MethodPost, base+"/apps/test.app/stop", ""); status != http.StatusOK {
+		t.Fatalf("expected app stop to succeed, got %d %s", status, body)
+	}
+	if isAppRunning("admin-apps") {
+		t.Error("expected the app to be stopped")
+	}
+
+	if status, body := adminRequest(t, http.MethodPost, base+"/apps/test.app/start", ""); status != http.StatusOK {
+		t.Fatalf("expected app start to succeed, got %d %s", status, body)
+	}
+	if !isAppRunning("admin-apps") {
+		t.Error("expected the app to be running again")
+	}
+
+	if status, _ := adminRequest(t, http.MethodPost, base+"/apps/missing/stop", ""); status != http.StatusBadRequest {
+		t.Errorf("expected unknown app to fail with 400, got %d", status)
+	}
+}
+
+func TestAdmin_Servers(t *testing.T) {
+	defer func() { _ = Stop() }()
+
+	if err := Load([]byte(adminConfig("admin-servers")), true); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	base := adminURL(t)
+	servers := func() map[string]json.RawMessage {
+		t.Helper()
+		_, body := adminRequest(t, http.MethodGet, base+"/config", "")
+		var cfg struct {
+			Apps map[string]struct {
+				Servers map[string]json.RawMessage `json:"servers"`
+			} `json:"apps"`
+		}
+		if err := json.Unmarshal([]byte(body), &cfg); err != nil {
+			t.Fatalf("failed to decode config: %v", err)
+		}
+		return cfg.Apps["test.app"].Servers
+	}
+
+	if status, body := adminRequest(t, http.MethodPost, base+"/apps/test.app/servers/main", `{"listen": ["a"]}`); status != http.StatusOK {
+		t.Fatalf("expected adding a server to succeed, got %d %s", status, body)
+	}
+	if status, _ := adminRequest(t, http.MethodPost, base+"/apps/test.app/servers/main", `{}`); status != http.StatusBadRequest {
+		t.Errorf("expected adding an existing server to fail with 400, got %d", status)
+	}
+	if got := string(servers()["main"]); got != `{"listen":["a"]}` {
+		t.Errorf("expected the added server in the config, got %s", got)
+	}
+
+	if status, body := adminRequest(t, http.MethodPut, base+"/apps/test.app/servers/main", `{"listen": ["b"]}`); status != http.StatusOK {
+		t.Fatalf("expected updating the server to succeed, got %d %s", status, body)
+	}
+	if got := string(servers()["main"]); got != `{"listen":["b"]}` {
+		t.Errorf("expected the updated server in the config, got %s", got)
+	}
+
+	if status, body := adminRequest(t, http.MethodDelete, base+"/apps/test.app/servers/main", ""); status != http.StatusOK {
+		t.Fatalf("expected removing the server to succeed, got %d %s", status, body)
+	}
+	if _, exists := servers()["main"]; exists {
+		t.Error("expected the removed server to be dropped from the config")
+	}
+
+	if status, _ := adminRequest(t, http.MethodDelete, base+"/apps/test.app/servers/main", ""); status != http.StatusBadRequest {
+		t.Errorf("expected removing a missing server to fail with 400, got %d", status)
+	}
+	if status, _ := adminRequest(t, http.MethodPut, base+"/apps/missing/servers/main", `{}`); status != http.StatusBadRequest {
+		t.Errorf("expected an unknown app to fail with 400, got %d", status)
+	}
+	if status, _ := adminRequest(t, http.MethodPost, base+"/apps/test.app/servers/main", ""); status != http.StatusBadRequest {
+		t.Errorf("expected an empty body to fail with 400, got %d", status)
+	}
+}
+
+func TestAdmin_Stop(t *testing.T) {
+	defer func() { _ = Stop() }()
+
+	if err := Load([]byte(adminConfig("admin-stop")), true); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	if status, _ := adminRequest(t, http.MethodPost, adminURL(t)+"/stop", ""); status != http.StatusOK {
+		t.Fatalf("expected stop to succeed, got %d", status)
+	}
+
+	select {
+	case <-StopRequested():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected stop to be requested")
+	}
+	if isAppRunning("admin-stop") {
+		t.Error("expected the config to be stopped")
+	}
+
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	if admin != nil {
+		t.Error("expected the admin API to be stopped")
+	}
+}
@@ -2,32 +2,52 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
 
 	"github.com/urfave/cli/v3"
 
 	"github.com/kusold/mightydns"
+	_ "github.com/kusold/mightydns/module/standard"
 )
 
 func main() {
-	app := &cli.Command{
+	if err := newApp().Run(context.Background(), os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func newApp() *cli.Command {
+	return &cli.Command{
 		Name:    "mightydns",
 		Usage:   "A modular DNS server",
 		Version: "dev",
 		Commands: []*cli.Command{
 			{
-				Name:  "run",
-				Usage: "Start the DNS server",
-				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:    "config",
-						Aliases: []string{"c"},
-						Usage:   "Load configuration from `FILE`",
-					},
-				},
+				Name:   "run",
+				Usage:  "Start the DNS server",
+				Flags:  []cli.Flag{configFlag()},
 				Action: runServer,
 			},
+			{
+				Name:   "print-config",
+				Usage:  "Print the effective configuration, including defaults, as JSON",
+				Flags:  []cli.Flag{configFlag()},
+				Action: printConfig,
+			},
+			{
+				Name:   "validate",
+				Usage:  "Check the configuration by provisioning every module without starting any",
+				Flags:  []cli.Flag{configFlag()},
+				Action: validateConfig,
+			},
+			queryCommand(),
 			{
 				Name:   "list-modules",
 				Usage:  "List all registered modules",
@@ -36,23 +56,52 @@ func main() {
 		},
 		DefaultCommand: "run",
 	}
+}
 
-	if err := app.Run(context.Background(), os.Args); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+func configFlag() cli.Flag {
+	return &cli.StringSliceFlag{
+		Name:    "config",
+		Aliases: []string{"c"},
+		Usage:   "Load configuration from `FILE`; repeat to merge several files in order",
 	}
 }
 
-func runServer(ctx context.Context, cmd *cli.Command) error {
-	configFile := cmd.String("config")
+// readConfig reads and merges the config files given with --config. It
+// returns nil if none were given.
+func readConfig(cmd *cli.Command) ([]byte, error) {
+	configFiles := cmd.StringSlice("config")
+	if len(configFiles) == 0 {
+		return nil, nil
+	}
 
-	if configFile != "" {
+	var docs [][]byte
+	for _, configFile := range configFiles {
 		// #nosec G304 - intentionally reading user-specified config file
-		configData, err := os.ReadFile(configFile)
+		data, err := os.ReadFile(configFile)
 		if err != nil {
-			return fmt.Errorf("reading config file %s: %w", configFile, err)
+			return nil, fmt.Errorf("reading config file %s: %w", configFile, err)
 		}
+		docs = append(docs, data)
+	}
 
+	if len(docs) == 1 {
+		return docs[0], nil
+	}
+
+	merged, err := mightydns.MergeConfigs(docs...)
+	if err != nil {
+		return nil, fmt.Errorf("merging config files: %w", err)
+	}
+	return merged, nil
+}
+
+func runServer(ctx context.Context, cmd *cli.Command) error {
+	configData, err := readConfig(cmd)
+	if err != nil {
+		return err
+	}
+
+	if configData != nil {
 		// Load the provided config
 		if err := mightydns.Load(configData, true); err != nil {
 			return err
@@ -64,15 +113,112 @@ func runServer(ctx context.Context, cmd *cli.Command) error {
 		}
 	}
 
-	// Keep the server running
-	select {}
+	// Keep the server running until it is interrupted or stopped through
+	// the admin API, then stop the apps so that servers drain their
+	// in-flight queries and modules release what they hold
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case <-ctx.Done():
+	case <-mightydns.StopRequested():
+	}
+	return mightydns.Stop()
+}
+
+func printConfig(ctx context.Context, cmd *cli.Command) error {
+	configData, err := readConfig(cmd)
+	if err != nil {
+		return err
+	}
+
+	var cfg *mightydns.Config
+	if configData != nil {
+		cfg, err = mightydns.LoadConfig(configData)
+		if err != nil {
+			return fmt.Errorf("parsing config: %w", err)
+		}
+	}
+
+	effective, err := mightydns.EffectiveConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(cmd.Root().Writer, string(effective))
+	return err
+}
+
+func validateConfig(ctx context.Context, cmd *cli.Command) error {
+	configData, err := readConfig(cmd)
+	if err != nil {
+		return err
+	}
+	if configData == nil {
+		return fmt.Errorf("no config given; use --config")
+	}
+
+	cfg, err := mightydns.LoadConfig(configData)
+	if err != nil {
+		return fmt.Errorf("parsing config: %w", err)
+	}
+
+	if err := mightydns.Validate(cfg); err != nil {
+		problems := flattenErrors(err)
+		for _, problem := range problems {
+			_, _ = fmt.Fprintf(cmd.Root().ErrWriter, "- %s\n", problem)
+		}
+		return fmt.Errorf("config is invalid: %d error(s) found", len(problems))
+	}
+
+	_, err = fmt.Fprintln(cmd.Root().Writer, "Valid configuration")
+	return err
+}
+
+// flattenErrors splits an error tree built with errors.Join into one
+// message per underlying error, each keeping the context, such as the app
+// and server names, that wraps it.
+func flattenErrors(err error) []string {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var msgs []string
+		for _, e := range joined.Unwrap() {
+			msgs = append(msgs, flattenErrors(e)...)
+		}
+		return msgs
+	}
+
+	inner := errors.Unwrap(err)
+	if inner == nil {
+		return []string{err.Error()}
+	}
+	innerMsgs := flattenErrors(inner)
+	if len(innerMsgs) == 1 {
+		return []string{err.Error()}
+	}
+
+	prefix, found := strings.CutSuffix(err.Error(), inner.Error())
+	if !found {
+		return []string{err.Error()}
+	}
+	for i, msg := range innerMsgs {
+		innerMsgs[i] = prefix + msg
+	}
+	return innerMsgs
 }
 
 func listModules(ctx context.Context, cmd *cli.Command) error {
-	modules := mightydns.GetModules()
+	categories := mightydns.ModulesByCategory()
+	namespaces := make([]string, 0, len(categories))
+	for ns := range categories {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
 	fmt.Println("Registered modules:")
-	for id := range modules {
-		fmt.Printf("  %s\n", id)
+	for _, ns := range namespaces {
+		for _, info := range categories[ns] {
+			fmt.Printf("  %s\n", info.ID)
+		}
 	}
 	return nil
 }
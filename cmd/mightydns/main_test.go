@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrintConfig_Default(t *testing.T) {
+	var out bytes.Buffer
+	app := newApp()
+	app.Writer = &out
+
+	if err := app.Run(context.Background(), []string{"mightydns", "print-config"}); err != nil {
+		t.Fatalf("print-config failed: %v", err)
+	}
+
+	var cfg struct {
+		Logging struct {
+			Level   string `json:"level"`
+			Handler string `json:"handler"`
+		} `json:"logging"`
+		Apps struct {
+			DNS struct {
+				Servers map[string]struct {
+					Listen   []string `json:"listen"`
+					Protocol []string `json:"protocol"`
+					Handler  struct {
+						Handler   string   `json:"handler"`
+						Upstreams []string `json:"upstreams"`
+						Timeout   string   `json:"timeout"`
+					} `json:"handler"`
+				} `json:"servers"`
+			} `json:"dns"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &cfg); err != nil {
+		t.Fatalf("print-config did not emit JSON: %v\n%s", err, out.String())
+	}
+
+	if cfg.Logging.Handler != "logger.text" {
+		t.Errorf("expected default logging handler logger.text, got %q", cfg.Logging.Handler)
+	}
+
+	server, ok := cfg.Apps.DNS.Servers["main"]
+	if !ok {
+		t.Fatalf("expected the default dns server, got:\n%s", out.String())
+	}
+	if len(server.Listen) != 1 || server.Listen[0] != ":53" {
+		t.Errorf("expected default server to listen on :53, got %v", server.Listen)
+	}
+	if server.Handler.Handler != "dns.resolver.upstream" {
+		t.Errorf("expected default handler dns.resolver.upstream, got %q", server.Handler.Handler)
+	}
+	// Defaults filled in by the handler module are included
+	if len(server.Handler.Upstreams) == 0 || server.Handler.Timeout != "5s" {
+		t.Errorf("expected the resolver's default upstreams and timeout, got %+v", server.Handler)
+	}
+}
+
+func TestPrintConfig_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{
+		"apps": {
+			"dns": {
+				"servers": {
+					"local": {
+						"listen": ["127.0.0.1:5353"],
+						"handler": {"handler": "dns.resolver.upstream", "upstreams": ["192.0.2.53:53"]}
+					}
+				}
+			}
+		}
+	}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	var out bytes.Buffer
+	app := newApp()
+	app.Writer = &out
+
+	if err := app.Run(context.Background(), []string{"mightydns", "print-config", "-c", path}); err != nil {
+		t.Fatalf("print-config failed: %v", err)
+	}
+
+	var cfg struct {
+		Apps struct {
+			DNS struct {
+				Servers map[string]struct {
+					Protocol []string `json:"protocol"`
+				} `json:"servers"`
+			} `json:"dns"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &cfg); err != nil {
+		t.Fatalf("print-config did not emit JSON: %v\n%s", err, out.String())
+	}
+
+	local, ok := cfg.Apps.DNS.Servers["local"]
+	if !ok {
+		t.Fatalf("expected the configured server, got:\n%s", out.String())
+	}
+	if len(local.Protocol) != 2 {
+		t.Errorf("expected the default protocols to be filled in, got %v", local.Protocol)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     string
+		wantErr    bool
+		wantErrors []string
+	}{
+		{
+			name: "valid config",
+			config: `{
+				"apps": {
+					"dns": {
+						"servers": {
+							"main": {
+								"listen": ["127.0.0.1:5353"],
+								"handler": {"handler": "dns.resolver.upstream"}
+							}
+						}
+					}
+				}
+			}`,
+		},
+		{
+			name: "every error reported",
+			config: `{
+				"apps": {
+					"dns": {
+						"servers": {
+							"bad-protocol": {
+								"protocol": ["sctp"],
+								"handler": {"handler": "dns.resolver.upstream"}
+							},
+							"bad-handler": {
+								"handler": {"handler": "dns.resolver.missing"}
+							}
+						}
+					},
+					"missing": {}
+				}
+			}`,
+			wantErr: true,
+			wantErrors: []string{
+				"- loading app dns: provisioning module dns: failed to provision server bad-handler: unknown handler module: dns.resolver.missing",
+				"- loading app dns: provisioning module dns: failed to provision server bad-protocol: invalid listener",
+				"- loading app missing:",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+
+			var out, errOut bytes.Buffer
+			app := newApp()
+			app.Writer = &out
+			app.ErrWriter = &errOut
+
+			err := app.Run(context.Background(), []string{"mightydns", "validate", "-c", path})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate error = %v, wantErr %v\n%s", err, tt.wantErr, errOut.String())
+			}
+			if !tt.wantErr {
+				if !strings.Contains(out.String(), "Valid configuration") {
+					t.Errorf("expected success message, got %q", out.String())
+				}
+				return
+			}
+
+			lines := strings.Split(strings.TrimSpace(errOut.String()), "\n")
+			if len(lines) != len(tt.wantErrors) {
+				t.Fatalf("expected %d errors, got:\n%s", len(tt.wantErrors), errOut.String())
+			}
+			for i, want := range tt.wantErrors {
+				if !strings.HasPrefix(lines[i], want) {
+					t.Errorf("expected error %d to start with %q, got %q", i, want, lines[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRun_StopsOnCancel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	adminAddr := l.Addr().String()
+	_ = l.Close()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := fmt.Sprintf(`{"admin": {"listen": %q}, "logging": {"level": "ERROR"}}`, adminAddr)
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	// A signal cancels the run command's context in the same way
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- newApp().Run(ctx, []string{"mightydns", "run", "-c", path})
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + adminAddr + "/config")
+		if err == nil {
+			_ = resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected run to return once its context is cancelled")
+	}
+
+	// Stopping the config shuts the admin API down in the background
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", adminAddr)
+		if err != nil {
+			break
+		}
+		_ = conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("expected the config to be stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
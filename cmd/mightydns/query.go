@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/urfave/cli/v3"
+)
+
+func queryCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "query",
+		Usage:     "Send a DNS query and print the response",
+		ArgsUsage: "<name> [type] [@server]",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "protocol",
+				Aliases: []string{"p"},
+				Value:   "udp",
+				Usage:   "Transport to query over: udp, tcp, tls or https",
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Value: 5 * time.Second,
+				Usage: "How long to wait for a response",
+			},
+			&cli.BoolFlag{
+				Name:  "insecure",
+				Usage: "Skip certificate verification for tls and https",
+			},
+		},
+		Action: runQuery,
+	}
+}
+
+func runQuery(ctx context.Context, cmd *cli.Command) error {
+	name, qtype, server, err := parseQueryArgs(cmd.Args().Slice())
+	if err != nil {
+		return err
+	}
+
+	protocol := cmd.String("protocol")
+	server, err = queryServer(server, protocol)
+	if err != nil {
+		return err
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+
+	timeout := cmd.Duration("timeout")
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cmd.Bool("insecure"), // #nosec G402 - opted into with --insecure
+	}
+
+	var (
+		resp *dns.Msg
+		rtt  time.Duration
+	)
+	switch protocol {
+	case "udp", "tcp":
+		client := &dns.Client{Net: protocol, Timeout: timeout}
+		resp, rtt, err = client.ExchangeContext(ctx, req, server)
+	case "tls":
+		client := &dns.Client{Net: "tcp-tls", Timeout: timeout, TLSConfig: tlsConfig}
+		resp, rtt, err = client.ExchangeContext(ctx, req, server)
+	case "https":
+		resp, rtt, err = exchangeHTTPS(ctx, req, server, timeout, tlsConfig)
+	}
+	if err != nil {
+		return fmt.Errorf("querying %s over %s: %w", server, protocol, err)
+	}
+
+	w := cmd.Root().Writer
+	_, _ = fmt.Fprintln(w, resp.String())
+	_, _ = fmt.Fprintf(w, ";; Query time: %v\n", rtt.Round(time.Microsecond))
+	_, _ = fmt.Fprintf(w, ";; SERVER: %s (%s)\n", server, protocol)
+	_, _ = fmt.Fprintf(w, ";; MSG SIZE rcvd: %d\n", resp.Len())
+	return nil
+}
+
+// parseQueryArgs parses the query command's arguments: a name, followed by
+// an optional record type and an optional @server in either order.
+func parseQueryArgs(args []string) (name string, qtype uint16, server string, err error) {
+	if len(args) == 0 {
+		return "", 0, "", fmt.Errorf("missing name to query")
+	}
+
+	name, qtype = args[0], dns.TypeA
+	for _, arg := range args[1:] {
+		if strings.HasPrefix(arg, "@") {
+			server = strings.TrimPrefix(arg, "@")
+			continue
+		}
+		t, ok := dns.StringToType[strings.ToUpper(arg)]
+		if !ok {
+			return "", 0, "", fmt.Errorf("unknown record type: %s", arg)
+		}
+		qtype = t
+	}
+
+	return name, qtype, server, nil
+}
+
+// queryServer returns the address to send the query to for the given
+// protocol: the system's first configured nameserver if none was given,
+// with the protocol's default port, or for https an endpoint URL.
+func queryServer(server, protocol string) (string, error) {
+	var port string
+	switch protocol {
+	case "udp", "tcp":
+		port = "53"
+	case "tls":
+		port = "853"
+	case "https":
+		if strings.HasPrefix(server, "https://") {
+			return server, nil
+		}
+		if server == "" {
+			return "", fmt.Errorf("https queries need an @server")
+		}
+		return "https://" + server + "/dns-query", nil
+	default:
+		return "", fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+
+	if server == "" {
+		conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil || len(conf.Servers) == 0 {
+			server = "127.0.0.1"
+		} else {
+			server = conf.Servers[0]
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), port)
+	}
+	return server, nil
+}
+
+// exchangeHTTPS sends a query to a DNS-over-HTTPS endpoint as an RFC 8484
+// POST request.
+func exchangeHTTPS(ctx context.Context, req *dns.Msg, endpoint string, timeout time.Duration, tlsConfig *tls.Config) (*dns.Msg, time.Duration, error) {
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	httpReq.Header.Set("Content-Type", "application/dns-message")
+	httpReq.Header.Set("Accept", "application/dns-message")
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   tlsConfig,
+			ForceAttemptHTTP2: true,
+		},
+	}
+
+	start := time.Now()
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = httpResp.Body.Close() }()
+
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize+1))
+	rtt := time.Since(start)
+	if err != nil {
+		return nil, rtt, err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, rtt, fmt.Errorf("unexpected status %s", httpResp.Status)
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, rtt, fmt.Errorf("unpacking response: %w", err)
+	}
+	return resp, rtt, nil
+}
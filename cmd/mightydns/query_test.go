@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// answerA answers a query with a fixed A record.
+func answerA(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 1),
+	})
+	return m
+}
+
+func startTestDNSServer(t *testing.T, network string) string {
+	t.Helper()
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		Net:  network,
+		Addr: "127.0.0.1:0",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			_ = w.WriteMsg(answerA(r))
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go func() { _ = server.ListenAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	if network == "udp" {
+		return server.PacketConn.LocalAddr().String()
+	}
+	return server.Listener.Addr().String()
+}
+
+func TestQuery(t *testing.T) {
+	udpAddr := startTestDNSServer(t, "udp")
+	tcpAddr := startTestDNSServer(t, "tcp")
+
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		packed, _ := io.ReadAll(req.Body)
+		r := new(dns.Msg)
+		if req.URL.Path != "/dns-query" || r.Unpack(packed) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		resp, _ := answerA(r).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(resp)
+	}))
+	defer doh.Close()
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "udp", args: []string{"example.com", "@" + udpAddr}},
+		{name: "tcp", args: []string{"-p", "tcp", "example.com", "a", "@" + tcpAddr}},
+		{name: "https", args: []string{"-p", "https", "--insecure", "example.com", "@" + strings.TrimPrefix(doh.URL, "https://")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			app := newApp()
+			app.Writer = &out
+
+			args := append([]string{"mightydns", "query"}, tt.args...)
+			if err := app.Run(context.Background(), args); err != nil {
+				t.Fatalf("query failed: %v", err)
+			}
+			if !strings.Contains(out.String(), "192.0.2.1") {
+				t.Errorf("expected the answer in the output, got:\n%s", out.String())
+			}
+			if !strings.Contains(out.String(), "("+tt.name+")") {
+				t.Errorf("expected the protocol in the output, got:\n%s", out.String())
+			}
+		})
+	}
+}
+
+func TestParseQueryArgs(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantType   uint16
+		wantServer string
+		wantErr    bool
+	}{
+		{name: "name only", args: []string{"example.com"}, wantType: dns.TypeA},
+		{name: "type and server", args: []string{"example.com", "mx", "@1.1.1.1"}, wantType: dns.TypeMX, wantServer: "1.1.1.1"},
+		{name: "server before type", args: []string{"example.com", "@::1", "AAAA"}, wantType: dns.TypeAAAA, wantServer: "::1"},
+		{name: "unknown type", args: []string{"example.com", "bogus"}, wantErr: true},
+		{name: "no name", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, qtype, server, err := parseQueryArgs(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseQueryArgs error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if qtype != tt.wantType || server != tt.wantServer {
+				t.Errorf("expected type %d and server %q, got %d and %q", tt.wantType, tt.wantServer, qtype, server)
+			}
+		})
+	}
+}
+
+func TestQueryServer(t *testing.T) {
+	tests := []struct {
+		server, protocol, want string
+	}{
+		{"1.1.1.1", "udp", "1.1.1.1:53"},
+		{"::1", "tcp", "[::1]:53"},
+		{"1.1.1.1", "tls", "1.1.1.1:853"},
+		{"1.1.1.1:5353", "udp", "1.1.1.1:5353"},
+		{"dns.example", "https", "https://dns.example/dns-query"},
+		{"https://dns.example/custom", "https", "https://dns.example/custom"},
+	}
+
+	for _, tt := range tests {
+		got, err := queryServer(tt.server, tt.protocol)
+		if err != nil {
+			t.Fatalf("queryServer(%q, %q) failed: %v", tt.server, tt.protocol, err)
+		}
+		if got != tt.want {
+			t.Errorf("queryServer(%q, %q) = %q, want %q", tt.server, tt.protocol, got, tt.want)
+		}
+	}
+
+	if _, err := queryServer("1.1.1.1", "quic"); err == nil {
+		t.Error("expected an unsupported protocol to fail")
+	}
+}
@@ -2,6 +2,8 @@ package mightydns
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 )
 
 type AdminConfig struct {
@@ -20,7 +22,92 @@ func (c *Config) Validate() error {
 func LoadConfig(data []byte) (*Config, error) {
 	var cfg Config
 	if err := json.Unmarshal(data, &cfg); err != nil {
-		return nil, err
+		return nil, configSyntaxError(data, err)
 	}
 	return &cfg, cfg.Validate()
 }
+
+// MergeConfigs deep-merges JSON config documents in order, so that keys in
+// later documents override the same keys in earlier ones. Objects are merged
+// recursively; any other value, including arrays, is replaced outright. An
+// object whose "handler" changes between documents is replaced rather than
+// merged, since its fields belong to a different module.
+func MergeConfigs(docs ...[]byte) ([]byte, error) {
+	merged := map[string]interface{}{}
+	for i, doc := range docs {
+		var next map[string]interface{}
+		if err := json.Unmarshal(doc, &next); err != nil {
+			return nil, fmt.Errorf("parsing config %d: %w", i+1, configSyntaxError(doc, err))
+		}
+		merged = mergeObjects(merged, next)
+	}
+	return json.Marshal(merged)
+}
+
+func mergeObjects(base, overlay map[string]interface{}) map[string]interface{} {
+	baseID, _ := base["handler"].(string)
+	overlayID, _ := overlay["handler"].(string)
+	if baseID != "" && overlayID != "" && baseID != overlayID {
+		return overlay
+	}
+
+	for key, value := range overlay {
+		baseObj, baseIsObj := base[key].(map[string]interface{})
+		overlayObj, overlayIsObj := value.(map[string]interface{})
+		if baseIsObj && overlayIsObj {
+			base[key] = mergeObjects(baseObj, overlayObj)
+			continue
+		}
+		base[key] = value
+	}
+	return base
+}
+
+// ConfigSyntaxError reports where in a config document JSON decoding failed,
+// so that truncated or malformed configs can be located and fixed.
+type ConfigSyntaxError struct {
+	// Offset is the number of bytes read before the error.
+	Offset int64
+	// Line and Column locate the point decoding stopped, just past the
+	// offending byte. Both start at 1.
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *ConfigSyntaxError) Error() string {
+	return fmt.Sprintf("line %d, column %d (byte offset %d): %v", e.Line, e.Column, e.Offset, e.Err)
+}
+
+func (e *ConfigSyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// configSyntaxError adds the position of a JSON syntax or type error in
+// data to err. Other errors are returned unchanged.
+func configSyntaxError(data []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return err
+	}
+
+	offset = min(offset, int64(len(data)))
+	line, column := 1, 1
+	for _, b := range data[:offset] {
+		if b == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+
+	return &ConfigSyntaxError{Offset: offset, Line: line, Column: column, Err: err}
+}
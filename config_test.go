@@ -1,6 +1,9 @@
 package mightydns
 
 import (
+	"encoding/json"
+	"errors"
+	"reflect"
 	"testing"
 )
 
@@ -50,3 +53,157 @@ func TestLoadConfigInvalidJSON(t *testing.T) {
 		t.Error("expected error for invalid JSON")
 	}
 }
+
+func TestMergeConfigs(t *testing.T) {
+	base := `{
+		"logging": {"level": "info", "handler": "logger.text"},
+		"apps": {
+			"dns": {
+				"servers": {
+					"main": {
+						"listen": [":53"],
+						"protocol": ["udp", "tcp"],
+						"handler": {
+							"handler": "dns.resolver.upstream",
+							"upstreams": ["8.8.8.8:53"],
+							"timeout": "5s"
+						}
+					}
+				}
+			}
+		}
+	}`
+	overlay := `{
+		"logging": {"level": "debug"},
+		"apps": {
+			"dns": {
+				"servers": {
+					"main": {
+						"listen": [":5353"],
+						"handler": {
+							"handler": "dns.resolver.upstream",
+							"upstreams": ["1.1.1.1:53"]
+						}
+					},
+					"local": {"listen": ["127.0.0.1:53"]}
+				}
+			}
+		}
+	}`
+
+	merged, err := MergeConfigs([]byte(base), []byte(overlay))
+	if err != nil {
+		t.Fatalf("failed to merge configs: %v", err)
+	}
+
+	want := `{
+		"logging": {"level": "debug", "handler": "logger.text"},
+		"apps": {
+			"dns": {
+				"servers": {
+					"main": {
+						"listen": [":5353"],
+						"protocol": ["udp", "tcp"],
+						"handler": {
+							"handler": "dns.resolver.upstream",
+							"upstreams": ["1.1.1.1:53"],
+							"timeout": "5s"
+						}
+					},
+					"local": {"listen": ["127.0.0.1:53"]}
+				}
+			}
+		}
+	}`
+	assertJSONEqual(t, merged, want)
+}
+
+func TestMergeConfigsReplacesChangedModule(t *testing.T) {
+	base := `{"apps": {"dns": {"servers": {"main": {"handler": {
+		"handler": "dns.resolver.upstream",
+		"upstreams": ["8.8.8.8:53"]
+	}}}}}}`
+	overlay := `{"apps": {"dns": {"servers": {"main": {"handler": {
+		"handler": "test.handler",
+		"rcode": 3
+	}}}}}}`
+
+	merged, err := MergeConfigs([]byte(base), []byte(overlay))
+	if err != nil {
+		t.Fatalf("failed to merge configs: %v", err)
+	}
+
+	want := `{"apps": {"dns": {"servers": {"main": {"handler": {
+		"handler": "test.handler",
+		"rcode": 3
+	}}}}}}`
+	assertJSONEqual(t, merged, want)
+}
+
+func TestMergeConfigsInvalidJSON(t *testing.T) {
+	if _, err := MergeConfigs([]byte(`{}`), []byte(`{invalid json`)); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+}
+
+func assertJSONEqual(t *testing.T, got []byte, want string) {
+	t.Helper()
+
+	var gotValue, wantValue interface{}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("failed to parse result: %v", err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatalf("failed to parse expected JSON: %v", err)
+	}
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestLoadConfigSyntaxErrorPosition(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     string
+		wantLine   int
+		wantColumn int
+		wantOffset int64
+	}{
+		{
+			name:       "truncated",
+			config:     "{\n\t\"apps\": {\n\t\t\"dns\": {",
+			wantLine:   3,
+			wantColumn: 11,
+			wantOffset: 23,
+		},
+		{
+			name:       "malformed",
+			config:     "{\n\t\"admin\": {\"listen\": :2019}\n}",
+			wantLine:   2,
+			wantColumn: 23,
+			wantOffset: 24,
+		},
+		{
+			name:       "wrong type",
+			config:     "{\n\t\"admin\": {\"listen\": 2019}\n}",
+			wantLine:   2,
+			wantColumn: 26,
+			wantOffset: 27,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig([]byte(tt.config))
+
+			var syntaxErr *ConfigSyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("expected a ConfigSyntaxError, got %v", err)
+			}
+			if syntaxErr.Line != tt.wantLine || syntaxErr.Column != tt.wantColumn || syntaxErr.Offset != tt.wantOffset {
+				t.Errorf("expected line %d, column %d, offset %d, got line %d, column %d, offset %d",
+					tt.wantLine, tt.wantColumn, tt.wantOffset, syntaxErr.Line, syntaxErr.Column, syntaxErr.Offset)
+			}
+		})
+	}
+}
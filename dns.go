@@ -2,6 +2,8 @@ package mightydns
 
 import (
 	"context"
+	"fmt"
+	"sync"
 
 	"github.com/miekg/dns"
 )
@@ -13,3 +15,100 @@ type DNSHandler interface {
 type DNSMiddleware interface {
 	ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, next DNSHandler) error
 }
+
+// EnabledHandler returns the handler config to load in place of cfg. A
+// handler can be switched off without removing it from the config by
+// setting its "enabled" field to false, in which case the handler it wraps,
+// given by its "next" field, is loaded instead.
+func EnabledHandler(cfg map[string]interface{}) (map[string]interface{}, error) {
+	for {
+		switch enabled := cfg["enabled"]; enabled {
+		case nil, true:
+			return cfg, nil
+		case false:
+		default:
+			return nil, fmt.Errorf("handler %v: enabled must be true or false, got %v", cfg["handler"], enabled)
+		}
+
+		next, ok := cfg["next"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("handler %v is disabled but has no next handler to use instead", cfg["handler"])
+		}
+		cfg = next
+	}
+}
+
+type resolutionPathKey struct{}
+
+// ResolutionPath records the ordered stages (handlers, zones, upstreams)
+// that took part in answering a query, for debugging routing decisions.
+type ResolutionPath struct {
+	mu     sync.Mutex
+	stages []string
+}
+
+// WithResolutionPath returns a context that records the resolution path of
+// a query, along with the path itself.
+func WithResolutionPath(ctx context.Context) (context.Context, *ResolutionPath) {
+	path := &ResolutionPath{}
+	return context.WithValue(ctx, resolutionPathKey{}, path), path
+}
+
+// ResolutionPathFromContext returns the resolution path carried by ctx, if
+// it is being recorded.
+func ResolutionPathFromContext(ctx context.Context) (*ResolutionPath, bool) {
+	path, ok := ctx.Value(resolutionPathKey{}).(*ResolutionPath)
+	return path, ok
+}
+
+// AddResolutionStage appends a stage to the resolution path carried by ctx.
+// It does nothing if the query's path is not being recorded.
+func AddResolutionStage(ctx context.Context, stage string) {
+	path, ok := ctx.Value(resolutionPathKey{}).(*ResolutionPath)
+	if !ok {
+		return
+	}
+
+	path.mu.Lock()
+	defer path.mu.Unlock()
+	path.stages = append(path.stages, stage)
+}
+
+// Stages returns the recorded stages in order.
+func (p *ResolutionPath) Stages() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.stages...)
+}
+
+type transportKey struct{}
+
+// WithTransport returns a context recording the transport a query was
+// received over: "udp", "tcp", "dot" (DNS over TLS) or "doh" (DNS over
+// HTTPS).
+func WithTransport(ctx context.Context, transport string) context.Context {
+	return context.WithValue(ctx, transportKey{}, transport)
+}
+
+// TransportFromContext returns the transport recorded in ctx, if any.
+func TransportFromContext(ctx context.Context) (string, bool) {
+	transport, ok := ctx.Value(transportKey{}).(string)
+	return transport, ok
+}
+
+// TSIGKey is a shared secret for signing DNS messages with TSIG (RFC 8945).
+type TSIGKey struct {
+	// Name is the key's name as a fully qualified domain name.
+	Name string
+	// Algorithm is the key's HMAC algorithm, e.g. dns.HmacSHA256.
+	Algorithm string
+	// Secret is the base64-encoded shared secret.
+	Secret string
+}
+
+// TSIGKeyring is implemented by the Context that DNS handlers are
+// provisioned with, giving them access to the TSIG keys configured on the
+// dns app.
+type TSIGKeyring interface {
+	TSIGKey(name string) (TSIGKey, bool)
+}
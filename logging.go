@@ -25,40 +25,47 @@ func SetupLogging(config *LoggingConfig) error {
 
 	level := parseLevel(config.Level)
 
-	var handler slog.Handler
+	logHandler, err := newLogHandler(config, &basicContext{})
+	if err != nil {
+		return err
+	}
+
+	// Wrap with level filtering
+	handler := &levelHandler{
+		handler: logHandler,
+		level:   level,
+	}
+
+	defaultLogger = slog.New(handler)
+	slog.SetDefault(defaultLogger)
+
+	return nil
+}
+
+// newLogHandler loads and provisions the log handler module named in config.
+func newLogHandler(config *LoggingConfig, ctx Context) (LogHandler, error) {
 	if config.Handler == "" {
 		config.Handler = "logger.text"
 	}
 
 	moduleInfo, exists := GetModule(config.Handler)
 	if !exists {
-		return fmt.Errorf("unknown logging handler: %s", config.Handler)
+		return nil, fmt.Errorf("unknown logging handler: %s", config.Handler)
 	}
 
 	module := moduleInfo.New()
 	logHandler, ok := module.(LogHandler)
 	if !ok {
-		return fmt.Errorf("module %s does not implement LogHandler interface", config.Handler)
+		return nil, fmt.Errorf("module %s does not implement LogHandler interface", config.Handler)
 	}
 
-	// Create a basic context for provisioning
-	ctx := &basicContext{}
 	if provisioner, ok := logHandler.(Provisioner); ok {
 		if err := provisioner.Provision(ctx); err != nil {
-			return fmt.Errorf("failed to provision logging handler: %w", err)
+			return nil, fmt.Errorf("failed to provision logging handler: %w", err)
 		}
 	}
 
-	// Wrap with level filtering
-	handler = &levelHandler{
-		handler: logHandler,
-		level:   level,
-	}
-
-	defaultLogger = slog.New(handler)
-	slog.SetDefault(defaultLogger)
-
-	return nil
+	return logHandler, nil
 }
 
 func Logger() *slog.Logger {
@@ -111,7 +118,9 @@ func (h *levelHandler) WithGroup(name string) slog.Handler {
 	}
 }
 
-type basicContext struct{}
+type basicContext struct {
+	dryRun bool
+}
 
 func (c *basicContext) App(name string) (interface{}, error) {
 	return nil, fmt.Errorf("no app available during logging setup")
@@ -124,3 +133,7 @@ func (c *basicContext) Logger() *slog.Logger {
 func (c *basicContext) LoadModule(cfg interface{}, fieldName string) (interface{}, error) {
 	return nil, fmt.Errorf("module loading not supported during logging setup")
 }
+
+func (c *basicContext) DryRun() bool {
+	return c.dryRun
+}
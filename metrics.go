@@ -0,0 +1,389 @@
+package mightydns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram buckets, in seconds, used for latencies
+// when no others are given. They match the Prometheus client defaults.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metrics is the process-wide registry that modules record metrics in.
+// Metrics outlive config reloads, so counters keep increasing across them
+// as Prometheus expects.
+var metrics = newMetricsRegistry()
+
+// NewCounter returns the counter named name with the given label names,
+// registering it on first use. Registering the same name again returns the
+// existing counter, so modules can declare their metrics at package level.
+// It panics if name is already registered with a different type or labels.
+func NewCounter(name, help string, labels ...string) *CounterVec {
+	return metrics.counter(name, help, labels)
+}
+
+// NewHistogram returns the histogram named name with the given bucket upper
+// bounds and label names, registering it on first use. Nil buckets use
+// DefaultBuckets. It panics if name is already registered with a different
+// type or labels.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return metrics.histogram(name, help, buckets, labels)
+}
+
+// WriteMetrics writes every registered metric to w in the Prometheus text
+// exposition format.
+func WriteMetrics(w io.Writer) error {
+	return metrics.write(w)
+}
+
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// metric is a registered counter or histogram.
+type metric interface {
+	describe() (help, kind string)
+	write(w *bufio.Writer, name string)
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{metrics: make(map[string]metric)}
+}
+
+func (r *metricsRegistry) counter(name, help string, labels []string) *CounterVec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.metrics[name]; ok {
+		counter, isCounter := existing.(*CounterVec)
+		if !isCounter || !slices.Equal(counter.labels, labels) {
+			panic(fmt.Sprintf("metric %s already registered with a different definition", name))
+		}
+		return counter
+	}
+
+	counter := &CounterVec{
+		help:   help,
+		labels: slices.Clone(labels),
+		series: make(map[string]*counterSeries),
+	}
+	r.metrics[name] = counter
+	return counter
+}
+
+func (r *metricsRegistry) histogram(name, help string, buckets []float64, labels []string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.metrics[name]; ok {
+		histogram, isHistogram := existing.(*HistogramVec)
+		if !isHistogram || !slices.Equal(histogram.labels, labels) || !slices.Equal(histogram.buckets, buckets) {
+			panic(fmt.Sprintf("metric %s already registered with a different definition", name))
+		}
+		return histogram
+	}
+
+	histogram := &HistogramVec{
+		help:    help,
+		buckets: slices.Clone(buckets),
+		labels:  slices.Clone(labels),
+		series:  make(map[string]*histogramSeries),
+	}
+	r.metrics[name] = histogram
+	return histogram
+}
+
+func (r *metricsRegistry) write(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	registered := make(map[string]metric, len(r.metrics))
+	for name, m := range r.metrics {
+		registered[name] = m
+	}
+	r.mu.Unlock()
+	slices.Sort(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		help, kind := registered[name].describe()
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, escapeHelp(help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, kind)
+		registered[name].write(bw, name)
+	}
+	return bw.Flush()
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	help   string
+	labels []string
+
+	mu     sync.RWMutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+	mu          sync.Mutex
+}
+
+// Inc increments the counter for the given label values by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter for the given label values by v, which must
+// not be negative.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("counter cannot decrease")
+	}
+	s := c.get(labelValues)
+	s.mu.Lock()
+	s.value += v
+	s.mu.Unlock()
+}
+
+// Value returns the current value of the counter for the given label
+// values.
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mu.RLock()
+	s, ok := c.series[seriesKey(labelValues)]
+	c.mu.RUnlock()
+	if !ok {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.value
+}
+
+func (c *CounterVec) get(labelValues []string) *counterSeries {
+	checkLabelValues(c.labels, labelValues)
+	key := seriesKey(labelValues)
+
+	c.mu.RLock()
+	s, ok := c.series[key]
+	c.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.series[key]; ok {
+		return s
+	}
+	s = &counterSeries{labelValues: slices.Clone(labelValues)}
+	c.series[key] = s
+	return s
+}
+
+func (c *CounterVec) describe() (string, string) {
+	return c.help, "counter"
+}
+
+func (c *CounterVec) write(w *bufio.Writer, name string) {
+	c.mu.RLock()
+	keys := sortedKeys(c.series)
+	series := make([]*counterSeries, len(keys))
+	for i, key := range keys {
+		series[i] = c.series[key]
+	}
+	c.mu.RUnlock()
+
+	for _, s := range series {
+		s.mu.Lock()
+		value := s.value
+		s.mu.Unlock()
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(c.labels, s.labelValues, "", ""), formatFloat(value))
+	}
+}
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct {
+	help    string
+	buckets []float64
+	labels  []string
+
+	mu     sync.RWMutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+	mu          sync.Mutex
+}
+
+// Observe records v in the histogram for the given label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	s := h.get(labelValues)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// Count returns the number of observations recorded for the given label
+// values.
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	h.mu.RLock()
+	s, ok := h.series[seriesKey(labelValues)]
+	h.mu.RUnlock()
+	if !ok {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+func (h *HistogramVec) get(labelValues []string) *histogramSeries {
+	checkLabelValues(h.labels, labelValues)
+	key := seriesKey(labelValues)
+
+	h.mu.RLock()
+	s, ok := h.series[key]
+	h.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[key]; ok {
+		return s
+	}
+	s = &histogramSeries{
+		labelValues: slices.Clone(labelValues),
+		counts:      make([]uint64, len(h.buckets)),
+	}
+	h.series[key] = s
+	return s
+}
+
+func (h *HistogramVec) describe() (string, string) {
+	return h.help, "histogram"
+}
+
+func (h *HistogramVec) write(w *bufio.Writer, name string) {
+	h.mu.RLock()
+	keys := sortedKeys(h.series)
+	series := make([]*histogramSeries, len(keys))
+	for i, key := range keys {
+		series[i] = h.series[key]
+	}
+	h.mu.RUnlock()
+
+	for _, s := range series {
+		s.mu.Lock()
+		counts := slices.Clone(s.counts)
+		count, sum := s.count, s.sum
+		s.mu.Unlock()
+
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(h.labels, s.labelValues, "le", formatFloat(bound)), counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(h.labels, s.labelValues, "le", "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(h.labels, s.labelValues, "", ""), formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(h.labels, s.labelValues, "", ""), count)
+	}
+}
+
+// checkLabelValues panics if the number of label values does not match
+// the metric's labels, which is always a programming error.
+func checkLabelValues(labels, values []string) {
+	if len(labels) != len(values) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(labels), len(values)))
+	}
+}
+
+// seriesKey identifies the series for a set of label values.
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// formatLabels renders a label set, with an optional extra label such as a
+// histogram bucket's "le".
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(values[i]))
+		b.WriteByte('"')
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extraName)
+		b.WriteString(`="`)
+		b.WriteString(extraValue)
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(v string) string { return labelValueEscaper.Replace(v) }
+func escapeHelp(v string) string       { return helpEscaper.Replace(v) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
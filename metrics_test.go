@@ -0,0 +1,87 @@
+package mightydns
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetricsRegistry_Write(t *testing.T) {
+	registry := newMetricsRegistry()
+
+	queries := registry.counter("test_queries_total", "Queries.\nBy type.", []string{"qtype"})
+	queries.Inc("A")
+	queries.Add(2, "AAAA")
+	queries.Inc(`we"ird\`)
+
+	latency := registry.histogram("test_latency_seconds", "Latency.", []float64{0.1, 1}, nil)
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	var out strings.Builder
+	if err := registry.write(&out); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	want := `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 5.55
+test_latency_seconds_count 3
+# HELP test_queries_total Queries.\nBy type.
+# TYPE test_queries_total counter
+test_queries_total{qtype="A"} 1
+test_queries_total{qtype="AAAA"} 2
+test_queries_total{qtype="we\"ird\\"} 1
+`
+	if out.String() != want {
+		t.Errorf("unexpected exposition:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	if got := queries.Value("AAAA"); got != 2 {
+		t.Errorf("expected counter value 2, got %v", got)
+	}
+	if got := latency.Count(); got != 3 {
+		t.Errorf("expected 3 observations, got %d", got)
+	}
+}
+
+func TestMetricsRegistry_Reregister(t *testing.T) {
+	registry := newMetricsRegistry()
+
+	first := registry.counter("test_total", "Test.", []string{"server"})
+	if again := registry.counter("test_total", "Test.", []string{"server"}); again != first {
+		t.Error("expected registering the same counter twice to return the existing one")
+	}
+
+	tests := []struct {
+		name     string
+		register func()
+	}{
+		{
+			name:     "different labels",
+			register: func() { registry.counter("test_total", "Test.", []string{"upstream"}) },
+		},
+		{
+			name:     "different type",
+			register: func() { registry.histogram("test_total", "Test.", nil, []string{"server"}) },
+		},
+		{
+			name:     "wrong number of label values",
+			register: func() { first.Inc("a", "b") },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected a panic")
+				}
+			}()
+			tt.register()
+		})
+	}
+}
@@ -3,9 +3,12 @@ package mightydns
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 type Config struct {
@@ -13,7 +16,12 @@ type Config struct {
 	Logging *LoggingConfig `json:"logging,omitempty"`
 	Apps    ModuleMap      `json:"apps,omitempty"`
 
+	// Notifications sends events such as config loads to webhooks.
+	Notifications *NotificationsConfig `json:"notifications,omitempty"`
+
 	// Internal fields
+	raw        []byte
+	generation uint64
 	apps       map[string]App
 	cancelFunc context.CancelFunc
 	logger     *slog.Logger
@@ -24,10 +32,21 @@ type App interface {
 	Stop() error
 }
 
+// ServerManager is implemented by apps whose servers, configured in the
+// "servers" object of the app's config, can be added, replaced and removed
+// while the app is running.
+type ServerManager interface {
+	AddServer(name string, cfg json.RawMessage) error
+	UpdateServer(name string, cfg json.RawMessage) error
+	RemoveServer(name string) error
+}
+
 // Global state
 var (
 	currentConfig *Config
 	configMu      sync.RWMutex
+	// generations counts the configs started, to number each one
+	generations atomic.Uint64
 )
 
 // Run runs the given config, replacing any existing config.
@@ -52,24 +71,58 @@ func Load(cfgJSON []byte, forceReload bool) error {
 	// Parse the configuration
 	var newCfg Config
 	if err := json.Unmarshal(cfgJSON, &newCfg); err != nil {
-		return fmt.Errorf("parsing config: %w", err)
+		return fmt.Errorf("parsing config: %w", configSyntaxError(cfgJSON, err))
 	}
 
-	// Stop any existing configuration
+	newCfg.raw = cfgJSON
+
 	configMu.Lock()
 	defer configMu.Unlock()
+	adminMu.Lock()
+	defer adminMu.Unlock()
 
-	if currentConfig != nil {
-		stopConfig(currentConfig)
+	nextNotifier, err := newNotifier(newCfg.Notifications)
+	if err != nil {
+		return fmt.Errorf("setting up notifications: %w", err)
 	}
 
-	// Start the new configuration
-	err := startConfig(&newCfg)
+	nextAdmin, err := prepareAdmin(newCfg.Admin)
 	if err != nil {
+		if nextNotifier != nil {
+			nextNotifier.close()
+		}
+		return fmt.Errorf("starting admin API: %w", err)
+	}
+
+	// Start the new configuration alongside the existing one before
+	// stopping it, so that apps can hand over resources such as listeners
+	// without a gap in service. If the new config fails to start, the old
+	// one is left running untouched.
+	oldCfg := currentConfig
+	if err := startConfig(&newCfg); err != nil {
+		stopConfig(&newCfg)
+		if nextAdmin != nil && nextAdmin != admin {
+			nextAdmin.close()
+		}
+		if nextNotifier != nil {
+			nextNotifier.close()
+		}
+		if oldCfg != nil {
+			if logErr := SetupLogging(oldCfg.Logging); logErr != nil {
+				return fmt.Errorf("starting config: %w (restoring logging failed: %v)", err, logErr)
+			}
+		}
 		return fmt.Errorf("starting config: %w", err)
 	}
 
+	if oldCfg != nil {
+		stopConfig(oldCfg)
+	}
+	swapAdmin(nextAdmin)
+	swapNotifier(nextNotifier)
+
 	currentConfig = &newCfg
+	Notify(EventConfigLoaded, map[string]any{"apps": appNames(newCfg.apps)})
 	return nil
 }
 
@@ -106,6 +159,7 @@ func startConfig(cfg *Config) error {
 
 	cfg.logger = Logger()
 	cfg.apps = make(map[string]App)
+	cfg.generation = generations.Add(1)
 
 	// Create a cancellable context for this config
 	ctx, cancel := context.WithCancel(context.Background())
@@ -118,40 +172,233 @@ func startConfig(cfg *Config) error {
 		ctx:    ctx,
 	}
 
-	// Load and provision each app
-	for appName, appConfigRaw := range cfg.Apps {
-		cfg.logger.Info("loading app", "name", appName)
+	if err := loadApps(appCtx); err != nil {
+		return err
+	}
 
-		// Parse the app config to get the module type
-		var appConfig map[string]interface{}
-		if err := json.Unmarshal(appConfigRaw, &appConfig); err != nil {
-			return fmt.Errorf("parsing app config for %s: %w", appName, err)
+	// Start all apps
+	for appName, app := range cfg.apps {
+		cfg.logger.Info("starting app", "name", appName)
+		if err := app.Start(); err != nil {
+			return fmt.Errorf("starting app %s: %w", appName, err)
 		}
+	}
+
+	cfg.logger.Info("all apps started successfully", summaryArgs(cfg.apps)...)
+	return nil
+}
+
+// summaryArgs builds the attributes of the startup summary log line: the
+// names of the started apps, followed by the details of each app that
+// describes itself by implementing slog.LogValuer.
+func summaryArgs(apps map[string]App) []any {
+	names := appNames(apps)
+	args := []any{"apps", names}
+	for _, name := range names {
+		if valuer, ok := apps[name].(slog.LogValuer); ok {
+			args = append(args, slog.Any("app."+name, valuer))
+		}
+	}
+	return args
+}
+
+// appNames returns the names of apps in sorted order.
+func appNames(apps map[string]App) []string {
+	names := make([]string, 0, len(apps))
+	for name := range apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadApps loads and provisions each app in the context's configuration,
+// adding them to the configuration's apps as they are provisioned
+func loadApps(appCtx *appContext) error {
+	cfg := appCtx.config
 
-		// Load the app module (app name is the module ID)
-		appModule, err := LoadModule(appCtx, appConfig, "", appName)
+	for appName, appConfigRaw := range cfg.Apps {
+		app, err := loadApp(appCtx, appName, appConfigRaw)
 		if err != nil {
-			return fmt.Errorf("loading app %s: %w", appName, err)
+			return err
 		}
+		cfg.apps[appName] = app
+	}
+
+	return nil
+}
+
+// loadApp loads and provisions a single app from its raw config.
+func loadApp(appCtx *appContext, appName string, appConfigRaw json.RawMessage) (App, error) {
+	appCtx.logger.Info("loading app", "name", appName)
+
+	// Parse the app config to get the module type
+	var appConfig map[string]interface{}
+	if err := json.Unmarshal(appConfigRaw, &appConfig); err != nil {
+		return nil, fmt.Errorf("parsing app config for %s: %w", appName, err)
+	}
 
-		app, ok := appModule.(App)
-		if !ok {
-			return fmt.Errorf("module %s does not implement App interface", appName)
+	moduleID := appModuleID(appName, appConfig)
+	appModule, err := LoadModule(appCtx, appConfig, "", moduleID)
+	if err != nil {
+		return nil, fmt.Errorf("loading app %s: %w", appName, err)
+	}
+
+	app, ok := appModule.(App)
+	if !ok {
+		return nil, fmt.Errorf("module %s does not implement App interface", appName)
+	}
+
+	return app, nil
+}
+
+// appModuleID returns the module ID of an app. An app's name is its module
+// ID unless its config names a module in a "module" field, which allows
+// several independent instances of the same app, e.g. "dns" and
+// "dns-internal" both using the "dns" module.
+func appModuleID(appName string, appConfig map[string]interface{}) string {
+	if moduleID, ok := appConfig["module"].(string); ok && moduleID != "" {
+		return moduleID
+	}
+	return appName
+}
+
+// Validate provisions every module in the configuration in dry-run mode,
+// without starting any apps, and returns the errors found, joined with
+// errors.Join. Every app is checked even if an earlier one fails. Modules
+// skip side effects such as binding sockets while in dry-run mode.
+func Validate(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	var errs []error
+
+	logging := LoggingConfig{}
+	if cfg.Logging != nil {
+		logging = *cfg.Logging
+	}
+	if _, err := newLogHandler(&logging, &basicContext{dryRun: true}); err != nil {
+		errs = append(errs, fmt.Errorf("setting up logging: %w", err))
+	}
+
+	if n, err := newNotifier(cfg.Notifications); err != nil {
+		errs = append(errs, fmt.Errorf("setting up notifications: %w", err))
+	} else if n != nil {
+		n.close()
+	}
+
+	if _, err := dryRunApps(cfg, Logger()); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// EffectiveConfig returns the config that would run for cfg as indented
+// JSON: the default config if cfg is nil, including the defaults that
+// logging and each app fill in while provisioning. Apps are provisioned in
+// dry-run mode and never started.
+func EffectiveConfig(cfg *Config) ([]byte, error) {
+	if cfg == nil {
+		cfg = getDefaultConfig()
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	logging := LoggingConfig{}
+	if cfg.Logging != nil {
+		logging = *cfg.Logging
+	}
+	logging.Level = parseLevel(logging.Level).String()
+	if _, err := newLogHandler(&logging, &basicContext{dryRun: true}); err != nil {
+		return nil, fmt.Errorf("setting up logging: %w", err)
+	}
+
+	n, err := newNotifier(cfg.Notifications)
+	if err != nil {
+		return nil, fmt.Errorf("setting up notifications: %w", err)
+	}
+	if n != nil {
+		n.close()
+	}
+
+	apps, err := dryRunApps(cfg, slog.New(slog.DiscardHandler))
+	if err != nil {
+		return nil, err
+	}
+
+	effective := Config{
+		Admin:         cfg.Admin,
+		Logging:       &logging,
+		Apps:          make(ModuleMap, len(apps)),
+		Notifications: cfg.Notifications,
+	}
+	for name, app := range apps {
+		appJSON, err := json.Marshal(app)
+		if err != nil {
+			return nil, fmt.Errorf("encoding app %s: %w", name, err)
 		}
 
-		cfg.apps[appName] = app
+		var appConfig map[string]interface{}
+		if err := json.Unmarshal(cfg.Apps[name], &appConfig); err != nil {
+			return nil, fmt.Errorf("parsing app config for %s: %w", name, err)
+		}
+		if moduleID := appModuleID(name, appConfig); moduleID != name {
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(appJSON, &fields); err != nil {
+				return nil, fmt.Errorf("encoding app %s: %w", name, err)
+			}
+			fields["module"], _ = json.Marshal(moduleID)
+			if appJSON, err = json.Marshal(fields); err != nil {
+				return nil, fmt.Errorf("encoding app %s: %w", name, err)
+			}
+		}
+
+		effective.Apps[name] = appJSON
 	}
 
-	// Start all apps
-	for appName, app := range cfg.apps {
-		cfg.logger.Info("starting app", "name", appName)
-		if err := app.Start(); err != nil {
-			return fmt.Errorf("starting app %s: %w", appName, err)
+	return json.MarshalIndent(effective, "", "  ")
+}
+
+// dryRunApps loads and provisions the apps in cfg without starting them,
+// telling modules to skip side effects. Every app is checked even if an
+// earlier one fails, and the errors found are joined with errors.Join.
+func dryRunApps(cfg *Config, logger *slog.Logger) (map[string]App, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	appCtx := &appContext{
+		config: &Config{
+			Apps: cfg.Apps,
+			apps: make(map[string]App),
+		},
+		logger: logger,
+		ctx:    ctx,
+		dryRun: true,
+	}
+
+	names := make([]string, 0, len(cfg.Apps))
+	for name := range cfg.Apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		app, err := loadApp(appCtx, name, cfg.Apps[name])
+		if err != nil {
+			errs = append(errs, err)
+			continue
 		}
+		appCtx.config.apps[name] = app
 	}
 
-	cfg.logger.Info("all apps started successfully")
-	return nil
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return appCtx.config.apps, nil
 }
 
 // stopConfig stops all apps and cleans up the configuration
@@ -172,6 +419,13 @@ func stopConfig(cfg *Config) {
 		if err := app.Stop(); err != nil && cfg.logger != nil {
 			cfg.logger.Error("error stopping app", "name", appName, "error", err)
 		}
+		// The config is discarded, so the app's modules can release what
+		// they hold
+		if cleaner, ok := app.(CleanerUpper); ok {
+			if err := cleaner.Cleanup(); err != nil && cfg.logger != nil {
+				cfg.logger.Error("error cleaning up app", "name", appName, "error", err)
+			}
+		}
 	}
 
 	// Cancel the context to clean up modules
@@ -190,14 +444,155 @@ func Stop() error {
 		currentConfig = nil
 	}
 
+	adminMu.Lock()
+	swapAdmin(nil)
+	adminMu.Unlock()
+	swapNotifier(nil)
+
+	return nil
+}
+
+// StartApp starts a single app of the running config, such as one stopped
+// with StopApp. Other apps are not affected.
+func StartApp(name string) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	app, err := runningApp(name)
+	if err != nil {
+		return err
+	}
+
+	currentConfig.logger.Info("starting app", "name", name)
+	if err := app.Start(); err != nil {
+		return fmt.Errorf("starting app %s: %w", name, err)
+	}
+	return nil
+}
+
+// StopApp stops a single app of the running config, leaving the other apps
+// running. The app stays part of the config and can be started again with
+// StartApp.
+func StopApp(name string) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	app, err := runningApp(name)
+	if err != nil {
+		return err
+	}
+
+	currentConfig.logger.Info("stopping app", "name", name)
+	if err := app.Stop(); err != nil {
+		return fmt.Errorf("stopping app %s: %w", name, err)
+	}
+	return nil
+}
+
+// AddServer adds a server to an app of the running config and records it
+// in the config, so that it is kept by a reload of the config.
+func AddServer(appName, name string, cfg json.RawMessage) error {
+	return changeServer(appName, name, cfg, "adding", func(m ServerManager) error {
+		return m.AddServer(name, cfg)
+	})
+}
+
+// UpdateServer replaces the config of a server of an app of the running
+// config.
+func UpdateServer(appName, name string, cfg json.RawMessage) error {
+	return changeServer(appName, name, cfg, "updating", func(m ServerManager) error {
+		return m.UpdateServer(name, cfg)
+	})
+}
+
+// RemoveServer removes a server from an app of the running config.
+func RemoveServer(appName, name string) error {
+	return changeServer(appName, name, nil, "removing", func(m ServerManager) error {
+		return m.RemoveServer(name)
+	})
+}
+
+// changeServer applies change to the named app of the running config, then
+// records cfg as the server's config, or the server's removal if cfg is
+// nil, in the running config.
+func changeServer(appName, name string, cfg json.RawMessage, action string, change func(ServerManager) error) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	app, err := runningApp(appName)
+	if err != nil {
+		return err
+	}
+	manager, ok := app.(ServerManager)
+	if !ok {
+		return fmt.Errorf("app %s does not manage servers", appName)
+	}
+
+	currentConfig.logger.Info(action+" server", "app", appName, "server", name)
+	if err := change(manager); err != nil {
+		return fmt.Errorf("%s server %s of app %s: %w", action, name, appName, err)
+	}
+
+	appConfig, err := setJSONField(currentConfig.Apps[appName], cfg, "servers", name)
+	if err != nil {
+		return fmt.Errorf("recording server %s in the config: %w", name, err)
+	}
+	raw, err := setJSONField(currentConfig.raw, cfg, "apps", appName, "servers", name)
+	if err != nil {
+		return fmt.Errorf("recording server %s in the config: %w", name, err)
+	}
+	currentConfig.Apps[appName] = appConfig
+	currentConfig.raw = raw
 	return nil
 }
 
+// setJSONField sets the field at path in the JSON object doc to value,
+// creating the objects along the path as needed, or deletes it if value
+// is nil.
+func setJSONField(doc []byte, value json.RawMessage, path ...string) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	if len(doc) > 0 && string(doc) != "null" {
+		if err := json.Unmarshal(doc, &fields); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(path) == 1 {
+		if value == nil {
+			delete(fields, path[0])
+		} else {
+			fields[path[0]] = value
+		}
+	} else {
+		field, err := setJSONField(fields[path[0]], value, path[1:]...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path[0], err)
+		}
+		fields[path[0]] = field
+	}
+
+	return json.Marshal(fields)
+}
+
+// runningApp returns the named app of the current config. configMu must be
+// held.
+func runningApp(name string) (App, error) {
+	if currentConfig == nil {
+		return nil, fmt.Errorf("no config is running")
+	}
+	app, exists := currentConfig.apps[name]
+	if !exists {
+		return nil, fmt.Errorf("app %s not found", name)
+	}
+	return app, nil
+}
+
 // appContext implements the Context interface for app provisioning
 type appContext struct {
 	config *Config
 	logger *slog.Logger
 	ctx    context.Context
+	dryRun bool
 }
 
 func (c *appContext) App(name string) (interface{}, error) {
@@ -228,3 +623,12 @@ func (c *appContext) LoadModule(cfg interface{}, fieldName string) (interface{},
 	}
 	return nil, fmt.Errorf("cannot determine module ID for field %s", fieldName)
 }
+
+func (c *appContext) DryRun() bool {
+	return c.dryRun
+}
+
+// Generation implements ConfigGeneration.
+func (c *appContext) Generation() uint64 {
+	return c.config.generation
+}
@@ -0,0 +1,325 @@
+package mightydns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+func init() {
+	RegisterModule(&testLogHandler{})
+	RegisterModule(&testApp{})
+}
+
+// testLogHandler is a logging handler module that discards all output.
+type testLogHandler struct {
+	slog.Handler
+}
+
+func (testLogHandler) MightyModule() ModuleInfo {
+	return ModuleInfo{
+		ID:  "test.logger",
+		New: func() Module { return &testLogHandler{Handler: slog.DiscardHandler} },
+	}
+}
+
+// testApp is an app module that records which instances are running.
+type testApp struct {
+	Label   string                     `json:"label,omitempty"`
+	Fail    bool                       `json:"fail,omitempty"`
+	Servers map[string]json.RawMessage `json:"servers,omitempty"`
+}
+
+var (
+	runningApps   = make(map[string]bool)
+	runningAppsMu sync.Mutex
+)
+
+func (testApp) MightyModule() ModuleInfo {
+	return ModuleInfo{
+		ID:  "test.app",
+		New: func() Module { return new(testApp) },
+	}
+}
+
+func (a *testApp) Start() error {
+	if a.Fail {
+		return fmt.Errorf("test app %s failed to start", a.Label)
+	}
+	runningAppsMu.Lock()
+	defer runningAppsMu.Unlock()
+	runningApps[a.Label] = true
+	return nil
+}
+
+func (a *testApp) Stop() error {
+	runningAppsMu.Lock()
+	defer runningAppsMu.Unlock()
+	delete(runningApps, a.Label)
+	return nil
+}
+
+func (a *testApp) AddServer(name string, cfg json.RawMessage) error {
+	if _, exists := a.Servers[name]; exists {
+		return fmt.Errorf("server %s already exists", name)
+	}
+	if a.Servers == nil {
+		a.Servers = make(map[string]json.RawMessage)
+	}
+	a.Servers[name] = cfg
+	return nil
+}
+
+func (a *testApp) UpdateServer(name string, cfg json.RawMessage) error {
+	if _, exists := a.Servers[name]; !exists {
+		return fmt.Errorf("server %s not found", name)
+	}
+	a.Servers[name] = cfg
+	return nil
+}
+
+func (a *testApp) RemoveServer(name string) error {
+	if _, exists := a.Servers[name]; !exists {
+		return fmt.Errorf("server %s not found", name)
+	}
+	delete(a.Servers, name)
+	return nil
+}
+
+func (a *testApp) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("label", a.Label))
+}
+
+// plainApp is an app that does not describe itself in the startup summary.
+type plainApp struct{}
+
+func (plainApp) Start() error { return nil }
+func (plainApp) Stop() error  { return nil }
+
+func isAppRunning(label string) bool {
+	runningAppsMu.Lock()
+	defer runningAppsMu.Unlock()
+	return runningApps[label]
+}
+
+func testAppConfig(label string, fail bool) []byte {
+	return []byte(fmt.Sprintf(`{
+		"logging": {"handler": "test.logger"},
+		"apps": {
+			"test.app": {"label": %q, "fail": %t}
+		}
+	}`, label, fail))
+}
+
+func TestLoad_RollsBackOnFailedReload(t *testing.T) {
+	defer func() { _ = Stop() }()
+
+	if err := Load(testAppConfig("old", false), true); err != nil {
+		t.Fatalf("failed to load initial config: %v", err)
+	}
+	if !isAppRunning("old") {
+		t.Fatal("expected initial app to be running")
+	}
+
+	if err := Load(testAppConfig("new", true), true); err == nil {
+		t.Fatal("expected failing config to return an error")
+	}
+
+	if !isAppRunning("old") {
+		t.Error("expected old app to be running again after rollback")
+	}
+	if isAppRunning("new") {
+		t.Error("expected failed app not to be running")
+	}
+
+	configMu.RLock()
+	app, ok := currentConfig.apps["test.app"].(*testApp)
+	configMu.RUnlock()
+	if !ok || app.Label != "old" {
+		t.Errorf("expected current config to remain the old config")
+	}
+}
+
+func TestLoad_TruncatedConfigReportsPosition(t *testing.T) {
+	defer func() { _ = Stop() }()
+
+	if err := Load(testAppConfig("old", false), true); err != nil {
+		t.Fatalf("failed to load initial config: %v", err)
+	}
+
+	truncated := testAppConfig("new", false)
+	truncated = truncated[:len(truncated)/2]
+
+	err := Load(truncated, true)
+	var syntaxErr *ConfigSyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("expected a ConfigSyntaxError, got %v", err)
+	}
+	if syntaxErr.Offset != int64(len(truncated)) {
+		t.Errorf("expected error at offset %d, got %d", len(truncated), syntaxErr.Offset)
+	}
+
+	if !isAppRunning("old") {
+		t.Error("expected the running config to be unchanged")
+	}
+}
+
+func TestLoad_FailedInitialLoadLeavesNothingRunning(t *testing.T) {
+	defer func() { _ = Stop() }()
+
+	if err := Load(testAppConfig("broken", true), true); err == nil {
+		t.Fatal("expected failing config to return an error")
+	}
+
+	configMu.RLock()
+	defer configMu.RUnlock()
+	if currentConfig != nil {
+		t.Error("expected no current config after a failed initial load")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{
+			name:   "valid config",
+			config: string(testAppConfig("validate", false)),
+		},
+		{
+			name:    "unknown app",
+			config:  `{"logging": {"handler": "test.logger"}, "apps": {"does.not.exist": {}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown logging handler",
+			config:  `{"logging": {"handler": "does.not.exist"}}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfig([]byte(tt.config))
+			if err != nil {
+				t.Fatalf("failed to load config: %v", err)
+			}
+
+			err = Validate(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if isAppRunning("validate") {
+				t.Error("expected Validate not to start any apps")
+			}
+		})
+	}
+}
+
+func TestSummaryArgs(t *testing.T) {
+	apps := map[string]App{
+		"test.app": &testApp{Label: "summarized"},
+		"plain":    plainApp{},
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	logger.Info("all apps started successfully", summaryArgs(apps)...)
+
+	var entry struct {
+		Apps    []string          `json:"apps"`
+		TestApp map[string]string `json:"app.test.app"`
+		Plain   interface{}       `json:"app.plain"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("failed to parse summary log line %q: %v", buf.String(), err)
+	}
+
+	if len(entry.Apps) != 2 || entry.Apps[0] != "plain" || entry.Apps[1] != "test.app" {
+		t.Errorf("expected apps [plain test.app], got %v", entry.Apps)
+	}
+	if entry.TestApp["label"] != "summarized" {
+		t.Errorf("expected test.app summary with its label, got %v", entry.TestApp)
+	}
+	if entry.Plain != nil {
+		t.Errorf("expected no summary for an app without one, got %v", entry.Plain)
+	}
+}
+
+func TestLoad_MultipleAppInstances(t *testing.T) {
+	defer func() { _ = Stop() }()
+
+	config := `{
+		"logging": {"handler": "test.logger"},
+		"apps": {
+			"primary": {"module": "test.app", "label": "primary"},
+			"secondary": {"module": "test.app", "label": "secondary"}
+		}
+	}`
+	if err := Load([]byte(config), true); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if !isAppRunning("primary") || !isAppRunning("secondary") {
+		t.Fatal("expected both app instances to be running")
+	}
+
+	if err := StopApp("primary"); err != nil {
+		t.Fatalf("failed to stop app: %v", err)
+	}
+	if isAppRunning("primary") {
+		t.Error("expected the stopped instance not to be running")
+	}
+	if !isAppRunning("secondary") {
+		t.Error("expected the other instance to keep running")
+	}
+
+	if err := StartApp("primary"); err != nil {
+		t.Fatalf("failed to start app: %v", err)
+	}
+	if !isAppRunning("primary") {
+		t.Error("expected the restarted instance to be running")
+	}
+
+	if err := StopApp("missing"); err == nil {
+		t.Error("expected error stopping an unknown app")
+	}
+}
+
+func TestEffectiveConfig_KeepsAppModule(t *testing.T) {
+	cfg, err := LoadConfig([]byte(`{
+		"logging": {"handler": "test.logger"},
+		"apps": {
+			"primary": {"module": "test.app", "label": "primary"},
+			"test.app": {"label": "plain"}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+
+	effective, err := EffectiveConfig(cfg)
+	if err != nil {
+		t.Fatalf("failed to build effective config: %v", err)
+	}
+
+	var out struct {
+		Apps map[string]map[string]interface{} `json:"apps"`
+	}
+	if err := json.Unmarshal(effective, &out); err != nil {
+		t.Fatalf("failed to parse effective config: %v", err)
+	}
+
+	if out.Apps["primary"]["module"] != "test.app" || out.Apps["primary"]["label"] != "primary" {
+		t.Errorf("expected the primary instance with its module, got %v", out.Apps["primary"])
+	}
+	if _, ok := out.Apps["test.app"]["module"]; ok {
+		t.Errorf("expected no module field for an app named after its module, got %v", out.Apps["test.app"])
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
 )
 
 type ModuleInfo struct {
@@ -11,6 +14,26 @@ type ModuleInfo struct {
 	New func() Module
 }
 
+// Namespace returns the category of the module: its ID without the last
+// dot-separated label, e.g. "dns.resolver" for "dns.resolver.upstream".
+// Top-level modules such as apps have an empty namespace.
+func (mi ModuleInfo) Namespace() string {
+	if i := strings.LastIndex(mi.ID, "."); i >= 0 {
+		return mi.ID[:i]
+	}
+	return ""
+}
+
+// ConfigType returns the struct type that the module's JSON config is
+// unmarshaled into, for tools that build configs or UIs from it.
+func (mi ModuleInfo) ConfigType() reflect.Type {
+	typ := reflect.TypeOf(mi.New())
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	return typ
+}
+
 type Module interface {
 	MightyModule() ModuleInfo
 }
@@ -27,6 +50,18 @@ type Context interface {
 	App(name string) (interface{}, error)
 	Logger() *slog.Logger
 	LoadModule(cfg interface{}, fieldName string) (interface{}, error)
+	// DryRun reports whether modules are being provisioned only to validate
+	// their configuration. Modules should skip side effects such as binding
+	// sockets, opening files or starting goroutines when it returns true.
+	DryRun() bool
+}
+
+// ConfigGeneration is implemented by the Context that apps are provisioned
+// with. Every config that is started gets a higher generation than the one
+// before it, so an app can tell a resource held by the config it is
+// replacing, which it may take over, from one held by its own config.
+type ConfigGeneration interface {
+	Generation() uint64
 }
 
 // ModuleMap is a map that can unmarshal JSON into modules
@@ -55,6 +90,30 @@ func GetModules() map[string]ModuleInfo {
 	return result
 }
 
+// ModulesByCategory returns the registered modules grouped by namespace,
+// each group sorted by module ID.
+func ModulesByCategory() map[string][]ModuleInfo {
+	result := make(map[string][]ModuleInfo)
+	for _, info := range modules {
+		ns := info.Namespace()
+		result[ns] = append(result[ns], info)
+	}
+	for _, infos := range result {
+		sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	}
+	return result
+}
+
+// NewModule returns a new instance of the module with the given ID. The
+// instance is neither configured nor provisioned.
+func NewModule(id string) (Module, error) {
+	info, exists := GetModule(id)
+	if !exists {
+		return nil, fmt.Errorf("unknown module: %s", id)
+	}
+	return info.New(), nil
+}
+
 // LoadModule loads a module by ID from the given configuration
 func LoadModule(ctx Context, cfg interface{}, fieldName string, moduleID string) (interface{}, error) {
 	moduleInfo, exists := GetModule(moduleID)
@@ -1,12 +1,17 @@
 package dns
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 
@@ -21,9 +26,18 @@ func init() {
 type DNSApp struct {
 	Servers map[string]*DNSServer `json:"servers,omitempty"`
 
-	ctx    mightydns.Context
-	logger *slog.Logger
-	mu     sync.RWMutex
+	// TSIGKeys is the keyring of TSIG keys by key name. Servers verify
+	// queries signed with any of them and sign their responses; queries
+	// signed with an unknown key or an invalid signature are answered
+	// NOTAUTH.
+	TSIGKeys map[string]*TSIGKeyConfig `json:"tsig_keys,omitempty"`
+
+	ctx        mightydns.Context
+	generation uint64
+	tsig       tsigKeyring
+	logger     *slog.Logger
+	started    bool
+	mu         sync.RWMutex
 }
 
 func (app *DNSApp) MightyModule() mightydns.ModuleInfo {
@@ -34,20 +48,49 @@ func (app *DNSApp) MightyModule() mightydns.ModuleInfo {
 }
 
 func (app *DNSApp) Provision(ctx mightydns.Context) error {
-	app.ctx = ctx
 	app.logger = ctx.Logger()
+	if gen, ok := ctx.(mightydns.ConfigGeneration); ok {
+		app.generation = gen.Generation()
+	}
+
+	keyring, err := newTSIGKeyring(app.TSIGKeys)
+	if err != nil {
+		return fmt.Errorf("invalid tsig_keys: %w", err)
+	}
+	app.tsig = keyring
+	app.ctx = ctx
 
 	if app.Servers == nil {
 		app.Servers = make(map[string]*DNSServer)
 	}
 
-	for name, server := range app.Servers {
-		if err := server.provision(ctx, app.logger.With("server", name)); err != nil {
-			return fmt.Errorf("failed to provision server %s: %w", name, err)
+	// Provision every server, so that all invalid servers are reported at
+	// once
+	names := make([]string, 0, len(app.Servers))
+	for name := range app.Servers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var errs []error
+	for _, name := range names {
+		server := app.Servers[name]
+		server.name = name
+		server.tsig = app.tsig
+		server.generation = app.generation
+		if err := server.provision(app.ctx, app.logger.With("server", name)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to provision server %s: %w", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		// The app is discarded, so release what the servers that did
+		// provision have opened
+		for _, server := range app.Servers {
+			_ = server.cleanup()
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
 func (app *DNSApp) Start() error {
@@ -55,6 +98,10 @@ func (app *DNSApp) Start() error {
 	defer app.mu.Unlock()
 
 	for name, server := range app.Servers {
+		if !server.enabled() {
+			app.logger.Info("DNS server disabled, not starting", "server", name)
+			continue
+		}
 		if err := server.start(); err != nil {
 			app.logger.Error("failed to start DNS server", "server", name, "error", err)
 			return fmt.Errorf("failed to start server %s: %w", name, err)
@@ -62,6 +109,7 @@ func (app *DNSApp) Start() error {
 		app.logger.Info("DNS server started", "server", name, "listeners", server.Listen, "protocols", server.Protocol)
 	}
 
+	app.started = true
 	return nil
 }
 
@@ -79,6 +127,8 @@ func (app *DNSApp) Stop() error {
 		}
 	}
 
+	app.started = false
+
 	if len(errs) > 0 {
 		return fmt.Errorf("failed to stop servers: %s", strings.Join(errs, "; "))
 	}
@@ -86,23 +136,274 @@ func (app *DNSApp) Stop() error {
 	return nil
 }
 
+// Cleanup stops the app and cleans up the handlers of its servers, once
+// the app is discarded.
 func (app *DNSApp) Cleanup() error {
-	return app.Stop()
+	err := app.Stop()
+
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	for name, server := range app.Servers {
+		if cleanupErr := server.cleanup(); cleanupErr != nil {
+			app.logger.Error("failed to clean up DNS server", "server", name, "error", cleanupErr)
+		}
+	}
+
+	return err
+}
+
+// LogValue summarizes the app's servers for the startup summary log.
+func (app *DNSApp) LogValue() slog.Value {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+
+	names := make([]string, 0, len(app.Servers))
+	for name := range app.Servers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	attrs := make([]slog.Attr, 0, len(names))
+	for _, name := range names {
+		attrs = append(attrs, slog.Any(name, app.Servers[name]))
+	}
+	return slog.GroupValue(slog.Any("servers", slog.GroupValue(attrs...)))
+}
+
+// AddServer provisions a new server from its JSON config and adds it to the
+// app. If the app is running the server is started immediately; servers
+// that are already running are left untouched.
+func (app *DNSApp) AddServer(name string, cfg json.RawMessage) error {
+	server := new(DNSServer)
+	if err := json.Unmarshal(cfg, server); err != nil {
+		return fmt.Errorf("failed to unmarshal server %s: %w", name, err)
+	}
+
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	if app.ctx == nil {
+		return fmt.Errorf("app is not provisioned")
+	}
+	if _, exists := app.Servers[name]; exists {
+		return fmt.Errorf("server %s already exists", name)
+	}
+
+	server.name = name
+	server.tsig = app.tsig
+	server.generation = app.generation
+	if err := server.provision(app.ctx, app.logger.With("server", name)); err != nil {
+		_ = server.cleanup()
+		return fmt.Errorf("failed to provision server %s: %w", name, err)
+	}
+
+	if app.started && server.enabled() {
+		if err := server.start(); err != nil {
+			_ = server.cleanup()
+			return fmt.Errorf("failed to start server %s: %w", name, err)
+		}
+		app.logger.Info("DNS server started", "server", name, "listeners", server.Listen, "protocols", server.Protocol)
+	}
+
+	app.Servers[name] = server
+	return nil
+}
+
+// UpdateServer replaces the config of an existing server. If only the
+// handler changed, the newly provisioned handler is swapped in place
+// without touching the server's sockets. Otherwise the updated server is
+// started before the old one is stopped, taking over the listen addresses
+// they share.
+func (app *DNSApp) UpdateServer(name string, cfg json.RawMessage) error {
+	updated := new(DNSServer)
+	if err := json.Unmarshal(cfg, updated); err != nil {
+		return fmt.Errorf("failed to unmarshal server %s: %w", name, err)
+	}
+
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	if app.ctx == nil {
+		return fmt.Errorf("app is not provisioned")
+	}
+	server, exists := app.Servers[name]
+	if !exists {
+		return fmt.Errorf("server %s not found", name)
+	}
+
+	updated.name = name
+	updated.tsig = app.tsig
+	updated.generation = app.generation
+	updated.replaces = server
+	if err := updated.provision(app.ctx, app.logger.With("server", name)); err != nil {
+		_ = updated.cleanup()
+		return fmt.Errorf("failed to provision server %s: %w", name, err)
+	}
+
+	if server.sameSettings(updated) {
+		server.replaceHandler(updated)
+		if err := updated.cleanup(); err != nil {
+			app.logger.Error("failed to clean up replaced DNS handler", "server", name, "error", err)
+		}
+		app.logger.Info("DNS server handler replaced", "server", name)
+		return nil
+	}
+
+	if app.started {
+		if updated.enabled() {
+			if err := updated.start(); err != nil {
+				_ = updated.cleanup()
+				return fmt.Errorf("failed to start server %s: %w", name, err)
+			}
+		}
+		if err := server.stop(); err != nil {
+			app.logger.Error("failed to stop DNS server", "server", name, "error", err)
+		}
+		updated.replaces = nil
+		app.logger.Info("DNS server restarted", "server", name, "listeners", updated.Listen, "protocols", updated.Protocol)
+	}
+	if err := server.cleanup(); err != nil {
+		app.logger.Error("failed to clean up DNS server", "server", name, "error", err)
+	}
+
+	app.Servers[name] = updated
+	return nil
+}
+
+// RemoveServer shuts down a single server and removes it from the app. In
+// flight queries on its listeners are allowed to finish; other servers keep
+// serving.
+func (app *DNSApp) RemoveServer(name string) error {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	server, exists := app.Servers[name]
+	if !exists {
+		return fmt.Errorf("server %s not found", name)
+	}
+
+	delete(app.Servers, name)
+
+	stopErr := server.stop()
+	if err := server.cleanup(); err != nil {
+		app.logger.Error("failed to clean up DNS server", "server", name, "error", err)
+	}
+	if stopErr != nil {
+		app.logger.Error("failed to stop DNS server", "server", name, "error", stopErr)
+		return fmt.Errorf("failed to stop server %s: %w", name, stopErr)
+	}
+	app.logger.Info("DNS server removed", "server", name)
+
+	return nil
 }
 
 type DNSServer struct {
-	Listen   []string        `json:"listen,omitempty"`
-	Protocol []string        `json:"protocol,omitempty"`
-	Handler  json.RawMessage `json:"handler,omitempty"`
+	Listen   []string `json:"listen,omitempty"`
+	Protocol []string `json:"protocol,omitempty"`
+	// Handler is the handler that answers the server's queries. Any
+	// handler in its chain can be switched off with "enabled": false, which
+	// passes its queries on to its next handler.
+	Handler json.RawMessage `json:"handler,omitempty"`
+
+	// Enabled can be set to false to keep a server in the config without
+	// starting it. Defaults to true.
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// SlowQueryThreshold logs a warning for any query that takes at least
+	// this long to answer. Disabled when empty.
+	SlowQueryThreshold string `json:"slow_query_threshold,omitempty"`
+
+	// Rcodes maps rcode names (e.g. "NXDOMAIN") to the log level and
+	// metrics label used for responses with that rcode. Unlisted rcodes are
+	// logged at debug and labelled with their lowercased name.
+	Rcodes map[string]*RcodePolicy `json:"rcodes,omitempty"`
+
+	// ResolutionTrace returns the resolution path of each query to
+	// trusted clients as an EDNS0 option. Disabled when unset.
+	ResolutionTrace *ResolutionTrace `json:"resolution_trace,omitempty"`
+
+	// DedupeRecords removes exact-duplicate records from responses before
+	// they are sent.
+	DedupeRecords bool `json:"dedupe_records,omitempty"`
+
+	// EDNS configures EDNS0 options such as NSID and padding that the
+	// server adds to responses, and the UDP payload size it advertises.
+	EDNS *EDNSOptions `json:"edns,omitempty"`
+
+	// DoH additionally serves DNS-over-HTTPS queries through the server's
+	// handler. Disabled when unset.
+	DoH *DoHOptions `json:"doh,omitempty"`
+
+	// DrainTimeout is how long a stopping server waits for in-flight
+	// queries to be answered before closing its listeners. Listeners that
+	// a reloaded config keeps using are handed over without draining.
+	// Defaults to 5s.
+	DrainTimeout string `json:"drain_timeout,omitempty"`
+
+	name       string
+	tsig       tsigKeyring
+	generation uint64
+	// replaces is the server this one is taking over from, whose
+	// listeners it may share until that server is stopped
+	replaces     *DNSServer
+	listeners    []*sharedListener
+	dohListeners []*dohListener
+	handler      mightydns.DNSHandler
+	handlerID    string
+	// modules are the handler modules provisioned for the server, in the
+	// order they were loaded, to be cleaned up with it
+	modules            []interface{}
+	responses          *responseStats
+	slowQueryThreshold time.Duration
+	drainTimeout       time.Duration
+	logger             *slog.Logger
+	mu                 sync.RWMutex
+}
+
+// MarshalJSON encodes the server's config. Once the server is provisioned,
+// its handler is encoded from the provisioned module, so that the defaults
+// the handler filled in are included.
+func (s *DNSServer) MarshalJSON() ([]byte, error) {
+	type plain DNSServer
 
-	servers []*dns.Server
-	handler mightydns.DNSHandler
-	logger  *slog.Logger
-	mu      sync.RWMutex
+	s.mu.RLock()
+	handler, handlerID, handlerJSON := s.handler, s.handlerID, s.Handler
+	s.mu.RUnlock()
+
+	if handler != nil && handlerID != "" {
+		var err error
+		handlerJSON, err = moduleJSON(handlerID, handler)
+		if err != nil {
+			return nil, fmt.Errorf("encoding handler: %w", err)
+		}
+	}
+
+	return json.Marshal(struct {
+		*plain
+		Handler json.RawMessage `json:"handler,omitempty"`
+	}{(*plain)(s), handlerJSON})
+}
+
+// moduleJSON encodes a handler module's config along with the "handler"
+// field naming its module ID.
+func moduleJSON(id string, module interface{}) (json.RawMessage, error) {
+	data, err := json.Marshal(module)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	fields["handler"], _ = json.Marshal(id)
+
+	return json.Marshal(fields)
 }
 
 func (s *DNSServer) provision(ctx mightydns.Context, logger *slog.Logger) error {
 	s.logger = logger
+	ctx = &serverContext{keyringContext: keyringContext{Context: ctx, keys: s.tsig}, server: s}
 
 	// Set defaults
 	if len(s.Listen) == 0 {
@@ -112,12 +413,73 @@ func (s *DNSServer) provision(ctx mightydns.Context, logger *slog.Logger) error
 		s.Protocol = []string{"udp", "tcp"}
 	}
 
+	for _, addr := range s.Listen {
+		for _, proto := range s.Protocol {
+			if err := checkListen(proto, addr); err != nil {
+				return fmt.Errorf("invalid listener %s/%s: %w", addr, proto, err)
+			}
+		}
+	}
+
+	if s.SlowQueryThreshold != "" {
+		threshold, err := time.ParseDuration(s.SlowQueryThreshold)
+		if err != nil {
+			return fmt.Errorf("invalid slow_query_threshold duration: %w", err)
+		}
+		s.slowQueryThreshold = threshold
+	}
+
+	if s.DrainTimeout == "" {
+		s.DrainTimeout = "5s"
+	}
+	drainTimeout, err := time.ParseDuration(s.DrainTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid drain_timeout duration: %w", err)
+	}
+	if drainTimeout <= 0 {
+		return fmt.Errorf("drain_timeout must be positive: %s", s.DrainTimeout)
+	}
+	s.drainTimeout = drainTimeout
+
+	responses, err := newResponseStats(s.Rcodes)
+	if err != nil {
+		return fmt.Errorf("invalid rcodes: %w", err)
+	}
+	responses.server = s.name
+	s.responses = responses
+
+	if s.ResolutionTrace != nil {
+		if err := s.ResolutionTrace.provision(); err != nil {
+			return fmt.Errorf("invalid resolution_trace: %w", err)
+		}
+	}
+
+	if s.EDNS != nil {
+		if err := s.EDNS.provision(); err != nil {
+			return fmt.Errorf("invalid edns: %w", err)
+		}
+	}
+
+	if s.DoH != nil {
+		if err := s.DoH.provision(); err != nil {
+			return fmt.Errorf("invalid doh: %w", err)
+		}
+	}
+
 	// Provision handler if specified
 	if len(s.Handler) > 0 {
 		var handlerConfig map[string]interface{}
 		if err := json.Unmarshal(s.Handler, &handlerConfig); err != nil {
 			return fmt.Errorf("failed to unmarshal handler config: %w", err)
 		}
+		handlerConfig, err = mightydns.EnabledHandler(handlerConfig)
+		if err != nil {
+			return err
+		}
+		handlerJSON, err := json.Marshal(handlerConfig)
+		if err != nil {
+			return fmt.Errorf("failed to marshal handler config: %w", err)
+		}
 
 		handlerType, exists := handlerConfig["handler"].(string)
 		if !exists {
@@ -130,7 +492,7 @@ func (s *DNSServer) provision(ctx mightydns.Context, logger *slog.Logger) error
 		}
 
 		handlerModule := moduleInfo.New()
-		if err := json.Unmarshal(s.Handler, handlerModule); err != nil {
+		if err := json.Unmarshal(handlerJSON, handlerModule); err != nil {
 			return fmt.Errorf("failed to unmarshal handler config: %w", err)
 		}
 
@@ -139,60 +501,237 @@ func (s *DNSServer) provision(ctx mightydns.Context, logger *slog.Logger) error
 				return fmt.Errorf("failed to provision handler: %w", err)
 			}
 		}
+		s.modules = append(s.modules, handlerModule)
 
 		var isHandler bool
 		s.handler, isHandler = handlerModule.(mightydns.DNSHandler)
 		if !isHandler {
 			return fmt.Errorf("handler module %s does not implement DNSHandler", handlerType)
 		}
+		s.handlerID = handlerType
 	}
 
 	return nil
 }
 
-func (s *DNSServer) start() error {
+// cleanup cleans up the server's handler modules, the ones loaded last
+// first, once the server is discarded. The server must not be serving.
+func (s *DNSServer) cleanup() error {
+	s.mu.Lock()
+	modules := s.modules
+	s.modules = nil
+	s.mu.Unlock()
+
+	var errs []error
+	for i := len(modules) - 1; i >= 0; i-- {
+		if cleaner, ok := modules[i].(mightydns.CleanerUpper); ok {
+			if err := cleaner.Cleanup(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// serverContext is the Context a server's handlers are provisioned with.
+// Along with the app's TSIG keys, it records each module the handlers load
+// so that they are cleaned up with the server.
+type serverContext struct {
+	keyringContext
+	server *DNSServer
+}
+
+// LoadModule loads the module named by the "handler" field of cfg.
+func (c *serverContext) LoadModule(cfg interface{}, fieldName string) (interface{}, error) {
+	configMap, _ := cfg.(map[string]interface{})
+	moduleID, ok := configMap["handler"].(string)
+	if !ok {
+		return nil, fmt.Errorf("cannot determine module ID for field %s", fieldName)
+	}
+
+	module, err := mightydns.LoadModule(c, cfg, fieldName, moduleID)
+	if err != nil {
+		return nil, err
+	}
+	c.server.modules = append(c.server.modules, module)
+	return module, nil
+}
+
+// enabled reports whether the server should be started.
+func (s *DNSServer) enabled() bool {
+	return s.Enabled == nil || *s.Enabled
+}
+
+// sameSettings reports whether s and other are configured the same apart
+// from their handlers.
+func (s *DNSServer) sameSettings(other *DNSServer) bool {
+	type plain DNSServer
+	settings := func(s *DNSServer) ([]byte, error) {
+		return json.Marshal(struct {
+			*plain
+			Handler json.RawMessage `json:"handler,omitempty"`
+		}{plain: (*plain)(s)})
+	}
+
+	a, err := settings(s)
+	if err != nil {
+		return false
+	}
+	b, err := settings(other)
+	return err == nil && bytes.Equal(a, b)
+}
+
+// replaceHandler moves the handler of updated, a server provisioned with
+// the same settings, into s. The modules of the handler it replaces are
+// handed to updated, so that cleaning up updated releases them.
+func (s *DNSServer) replaceHandler(updated *DNSServer) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.handler == nil {
+	s.handler, updated.handler = updated.handler, s.handler
+	s.handlerID, updated.handlerID = updated.handlerID, s.handlerID
+	s.Handler, updated.Handler = updated.Handler, s.Handler
+	s.modules, updated.modules = updated.modules, s.modules
+}
+
+func (s *DNSServer) start() error {
+	s.mu.RLock()
+	handler := s.handler
+	s.mu.RUnlock()
+
+	if handler == nil {
 		return fmt.Errorf("no handler configured")
 	}
 
-	// Create DNS servers for each listen address and protocol combination
+	// Acquire every listen address and protocol combination up front so
+	// that bind failures are reported to the caller rather than lost in a
+	// goroutine
+	var acquired []*sharedListener
 	for _, addr := range s.Listen {
 		for _, proto := range s.Protocol {
-			server := &dns.Server{
-				Addr:    addr,
-				Net:     proto,
-				Handler: s,
+			l, err := listeners.acquire(proto, addr, s)
+			if err != nil {
+				_ = releaseListeners(acquired, s)
+				return fmt.Errorf("listening on %s/%s: %w", addr, proto, err)
 			}
+			acquired = append(acquired, l)
+		}
+	}
 
-			s.servers = append(s.servers, server)
-
-			go func(srv *dns.Server) {
-				s.logger.Info("starting DNS listener", "addr", srv.Addr, "protocol", srv.Net)
-				if err := srv.ListenAndServe(); err != nil {
-					s.logger.Error("DNS server error", "addr", srv.Addr, "protocol", srv.Net, "error", err)
-				}
-			}(server)
+	var doh []*dohListener
+	if s.DoH != nil {
+		for _, addr := range s.DoH.Listen {
+			l, err := listeners.acquireDoH(addr, s)
+			if err != nil {
+				_ = releaseDoHListeners(doh, s)
+				_ = releaseListeners(acquired, s)
+				return fmt.Errorf("listening on %s/doh: %w", addr, err)
+			}
+			doh = append(doh, l)
 		}
 	}
 
+	s.mu.Lock()
+	s.listeners = append(s.listeners, acquired...)
+	s.dohListeners = append(s.dohListeners, doh...)
+	s.mu.Unlock()
+
 	return nil
 }
 
+// listenAddrs returns the bound address of every active listener.
+func (s *DNSServer) listenAddrs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	addrs := make([]string, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.server.Addr)
+	}
+	return addrs
+}
+
+// LogValue summarizes the server's listeners and handler chain. Running
+// servers report their bound addresses; others report their configuration.
+func (s *DNSServer) LogValue() slog.Value {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var listen []string
+	for _, l := range s.listeners {
+		listen = append(listen, l.server.Net+"://"+l.server.Addr)
+	}
+	for _, l := range s.dohListeners {
+		listen = append(listen, l.scheme()+"://"+l.addr+s.DoH.Path)
+	}
+	if listen == nil {
+		for _, addr := range s.Listen {
+			for _, proto := range s.Protocol {
+				listen = append(listen, proto+"://"+addr)
+			}
+		}
+		if s.DoH != nil {
+			scheme := "https"
+			if s.DoH.tlsConfig == nil {
+				scheme = "http"
+			}
+			for _, addr := range s.DoH.Listen {
+				listen = append(listen, scheme+"://"+addr+s.DoH.Path)
+			}
+		}
+	}
+
+	attrs := []slog.Attr{
+		slog.Any("listen", listen),
+		slog.Bool("enabled", s.enabled()),
+	}
+	if valuer, ok := s.handler.(slog.LogValuer); ok {
+		attrs = append(attrs, slog.Any("handler", valuer))
+	} else {
+		attrs = append(attrs, slog.String("handler", s.handlerID))
+	}
+	return slog.GroupValue(attrs...)
+}
+
 func (s *DNSServer) stop() error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	acquired, doh := s.listeners, s.dohListeners
+	s.listeners, s.dohListeners = nil, nil
+	s.mu.Unlock()
+
+	// Release without holding the lock, since in-flight queries need it
+	// to finish and shutting down a listener waits for them
+	dohErr := releaseDoHListeners(doh, s)
+	if err := releaseListeners(acquired, s); err != nil {
+		return err
+	}
+	return dohErr
+}
 
+// releaseDoHListeners releases each DoH listener held by s.
+func releaseDoHListeners(doh []*dohListener, s *DNSServer) error {
 	var errs []string
-	for _, server := range s.servers {
-		if err := server.Shutdown(); err != nil {
-			errs = append(errs, fmt.Sprintf("%s/%s: %v", server.Addr, server.Net, err))
+	for _, l := range doh {
+		if err := listeners.releaseDoH(l, s); err != nil {
+			errs = append(errs, fmt.Sprintf("%s/doh: %v", l.addr, err))
 		}
 	}
 
-	s.servers = nil
+	if len(errs) > 0 {
+		return fmt.Errorf("shutdown errors: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// releaseListeners releases each listener held by s.
+func releaseListeners(acquired []*sharedListener, s *DNSServer) error {
+	var errs []string
+	for _, l := range acquired {
+		if err := listeners.release(l, s); err != nil {
+			errs = append(errs, fmt.Sprintf("%s/%s: %v", l.server.Addr, l.server.Net, err))
+		}
+	}
 
 	if len(errs) > 0 {
 		return fmt.Errorf("shutdown errors: %s", strings.Join(errs, "; "))
@@ -203,29 +742,138 @@ func (s *DNSServer) stop() error {
 
 // ServeDNS implements dns.Handler to route requests to the configured handler
 func (s *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	start := time.Now()
+	transport := queryTransport(w)
+
+	// The handler and its ID are read together, since an update may
+	// replace both while the query is being answered
 	s.mu.RLock()
-	handler := s.handler
+	handler, handlerID := s.handler, s.handlerID
 	s.mu.RUnlock()
 
 	if handler == nil {
 		s.logger.Error("no handler available for DNS request")
 		m := new(dns.Msg)
-		m.SetReply(r)
 		m.SetRcode(r, dns.RcodeServerFailure)
 		if err := w.WriteMsg(m); err != nil {
-			s.logger.Error("failed to write DNS response", "error", err)
+			s.writeFailed(w, r, err)
 		}
 		return
 	}
 
-	ctx := context.Background()
-	if err := handler.ServeDNS(ctx, w, r); err != nil {
+	if s.slowQueryThreshold > 0 {
+		defer s.logSlowQuery(w, r, handlerID, start)
+	}
+
+	if t := r.IsTsig(); t != nil {
+		var ok bool
+		if w, r, ok = s.verifyTSIG(w, r, t); !ok {
+			return
+		}
+	}
+
+	udpSize := uint16(defaultUDPSize)
+	if s.EDNS != nil {
+		udpSize = uint16(s.EDNS.UDPSize) // #nosec G115 - validated in provision
+	}
+	w = &optWriter{ResponseWriter: w, query: r.IsEdns0(), udpSize: udpSize}
+
+	ctx := mightydns.WithTransport(context.Background(), transport)
+	if opt := r.IsEdns0(); opt != nil && s.EDNS != nil {
+		w = &ednsWriter{ResponseWriter: w, options: s.EDNS, query: opt}
+	}
+	if opt := r.IsEdns0(); opt != nil && s.ResolutionTrace != nil && s.ResolutionTrace.allows(w.RemoteAddr()) {
+		var path *mightydns.ResolutionPath
+		ctx, path = mightydns.WithResolutionPath(ctx)
+		mightydns.AddResolutionStage(ctx, "handler:"+handlerID)
+		w = &traceWriter{
+			ResponseWriter: w,
+			path:           path,
+			code:           s.ResolutionTrace.OptionCode,
+			udpSize:        opt.UDPSize(),
+		}
+	}
+
+	recorder := &responseRecorder{ResponseWriter: w}
+	w = &sizeLimitWriter{ResponseWriter: recorder, logger: s.logger}
+	if s.DedupeRecords {
+		w = &dedupeWriter{ResponseWriter: w}
+	}
+
+	var err error
+	if m := checkOPT(r); m != nil {
+		err = w.WriteMsg(m)
+	} else {
+		err = handler.ServeDNS(ctx, w, r)
+	}
+	switch {
+	case recorder.err != nil:
+		// The handler's response could not be sent, so there is no point
+		// answering SERVFAIL even if it passed the error on
+		s.writeFailed(w, r, recorder.err)
+	case err != nil:
 		s.logger.Error("handler error", "error", err, "question", r.Question)
 		m := new(dns.Msg)
-		m.SetReply(r)
 		m.SetRcode(r, dns.RcodeServerFailure)
 		if err := w.WriteMsg(m); err != nil {
-			s.logger.Error("failed to write DNS response", "error", err)
+			s.writeFailed(w, r, err)
 		}
 	}
+
+	if s.responses != nil {
+		s.responses.record(ctx, s.logger, recorder, r)
+	}
+	requestDuration.Observe(time.Since(start).Seconds(), s.name)
+}
+
+// queryTransport returns the transport a query written back through w was
+// received over, as recorded by mightydns.WithTransport.
+func queryTransport(w dns.ResponseWriter) string {
+	if _, ok := w.(*dohResponseWriter); ok {
+		return "doh"
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		return "udp"
+	}
+	if cs, ok := w.(dns.ConnectionStater); ok && cs.ConnectionState() != nil {
+		return "dot"
+	}
+	return "tcp"
+}
+
+// writeFailed logs and counts a response that could not be written. This
+// is usually the client going away rather than a server error, so it is
+// logged at debug.
+func (s *DNSServer) writeFailed(w dns.ResponseWriter, r *dns.Msg, err error) {
+	s.logger.Debug("failed to write DNS response",
+		"query_id", r.Id,
+		"client", w.RemoteAddr(),
+		"error", err)
+
+	writeFailuresTotal.Inc(s.name)
+}
+
+// logSlowQuery logs a warning if the query, answered by the handler with
+// the given module ID, took longer than the configured slow query
+// threshold.
+func (s *DNSServer) logSlowQuery(w dns.ResponseWriter, r *dns.Msg, handlerID string, start time.Time) {
+	duration := time.Since(start)
+	if duration < s.slowQueryThreshold {
+		return
+	}
+
+	var qname, qtype string
+	if len(r.Question) > 0 {
+		qname = r.Question[0].Name
+		qtype = dns.TypeToString[r.Question[0].Qtype]
+	}
+
+	s.logger.Warn("slow DNS query",
+		"query_id", r.Id,
+		"query_name", qname,
+		"query_type", qtype,
+		"client", w.RemoteAddr(),
+		"handler", handlerID,
+		"duration", duration,
+		"threshold", s.slowQueryThreshold)
 }
@@ -1,16 +1,31 @@
 package dns
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
 )
 
+func init() {
+	mightydns.RegisterModule(&testHandler{})
+}
+
 type mockContext struct{}
 
 func (mockContext) App(name string) (interface{}, error) { return nil, nil }
@@ -18,6 +33,7 @@ func (mockContext) Logger() *slog.Logger                 { return slog.Default()
 func (mockContext) LoadModule(cfg interface{}, fieldName string) (interface{}, error) {
 	return nil, fmt.Errorf("module loading not supported in mock context")
 }
+func (mockContext) DryRun() bool { return false }
 
 type mockDNSHandler struct{}
 
@@ -28,6 +44,44 @@ func (mockDNSHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns
 	return w.WriteMsg(m)
 }
 
+// testHandler is a registered handler module that answers every query
+// locally, so servers can be exercised end to end without an upstream.
+type testHandler struct {
+	Rcode int `json:"rcode,omitempty"`
+	// Answers and TXTRecords synthesize that many A records and 255-byte
+	// TXT records in the answer, to produce large responses.
+	Answers    int `json:"answers,omitempty"`
+	TXTRecords int `json:"txt_records,omitempty"`
+}
+
+func (testHandler) MightyModule() mightydns.ModuleInfo {
+	return mightydns.ModuleInfo{
+		ID:  "test.handler",
+		New: func() mightydns.Module { return new(testHandler) },
+	}
+}
+
+func (h *testHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	m := new(dns.Msg)
+	m.SetRcode(r, h.Rcode)
+
+	name := r.Question[0].Name
+	for i := 0; i < h.Answers; i++ {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)),
+		})
+	}
+	for i := 0; i < h.TXTRecords; i++ {
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+			Txt: []string{fmt.Sprintf("%03d%s", i, strings.Repeat("x", 252))},
+		})
+	}
+
+	return w.WriteMsg(m)
+}
+
 func TestDNSApp_ModuleInfo(t *testing.T) {
 	app := &DNSApp{}
 	info := app.MightyModule()
@@ -100,6 +154,20 @@ func TestDNSServer_Provision(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "slow query threshold",
+			config: &DNSServer{
+				SlowQueryThreshold: "100ms",
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid slow query threshold",
+			config: &DNSServer{
+				SlowQueryThreshold: "invalid",
+			},
+			wantErr: true,
+		},
 		{
 			name: "invalid handler config",
 			config: &DNSServer{
@@ -175,6 +243,54 @@ func TestDNSServer_ServeDNS(t *testing.T) {
 	}
 }
 
+func TestDNSServer_SlowQueryLog(t *testing.T) {
+	tests := []struct {
+		name     string
+		delay    time.Duration
+		wantWarn bool
+	}{
+		{name: "slow query", delay: 30 * time.Millisecond, wantWarn: true},
+		{name: "fast query", delay: 0, wantWarn: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			server := &DNSServer{
+				handler:            &slowDNSHandler{delay: tt.delay},
+				handlerID:          "test.slow",
+				slowQueryThreshold: 20 * time.Millisecond,
+				logger:             slog.New(slog.NewTextHandler(&buf, nil)),
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("slow.example.com.", dns.TypeA)
+			server.ServeDNS(&mockResponseWriter{}, req)
+
+			logged := strings.Contains(buf.String(), "slow DNS query")
+			if logged != tt.wantWarn {
+				t.Fatalf("Expected slow query logged = %v, got log %q", tt.wantWarn, buf.String())
+			}
+			if logged {
+				for _, want := range []string{"level=WARN", "query_name=slow.example.com.", "handler=test.slow"} {
+					if !strings.Contains(buf.String(), want) {
+						t.Errorf("Expected slow query log to contain %q, got %q", want, buf.String())
+					}
+				}
+			}
+		})
+	}
+}
+
+type slowDNSHandler struct {
+	delay time.Duration
+}
+
+func (h *slowDNSHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	time.Sleep(h.delay)
+	return mockDNSHandler{}.ServeDNS(ctx, w, r)
+}
+
 // Mock response writer for testing
 type mockResponseWriter struct {
 	writeCalled bool
@@ -193,3 +309,591 @@ func (m *mockResponseWriter) Close() error              { return nil }
 func (m *mockResponseWriter) TsigStatus() error         { return nil }
 func (m *mockResponseWriter) TsigTimersOnly(bool)       {}
 func (m *mockResponseWriter) Hijack()                   {}
+
+func TestDNSServer_StartReportsBindError(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func() { _ = pc.Close() }()
+
+	server := &DNSServer{
+		Listen:   []string{pc.LocalAddr().String()},
+		Protocol: []string{"udp"},
+		Handler:  json.RawMessage(`{"handler": "test.handler"}`),
+	}
+	if err := server.provision(mockContext{}, slog.Default()); err != nil {
+		t.Fatalf("provision failed: %v", err)
+	}
+
+	if err := server.start(); err == nil {
+		_ = server.stop()
+		t.Fatal("Expected start to fail on an address already in use")
+	}
+}
+
+func TestBindError(t *testing.T) {
+	denied := &net.OpError{
+		Op:  "listen",
+		Net: "udp",
+		Err: os.NewSyscallError("bind", syscall.EACCES),
+	}
+
+	err := bindError(":53", denied)
+	if !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Expected the permission error to be preserved, got %v", err)
+	}
+	for _, want := range []string{"port 53", "CAP_NET_BIND_SERVICE", ":5353"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to mention %q, got: %v", want, err)
+		}
+	}
+
+	inUse := &net.OpError{Op: "listen", Net: "udp", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}
+	if err := bindError(":53", inUse); err != inUse {
+		t.Errorf("Expected other bind errors to be returned unchanged, got %v", err)
+	}
+}
+
+func TestDNSApp_AddServer(t *testing.T) {
+	app := &DNSApp{
+		Servers: map[string]*DNSServer{
+			"main": newTestServer(),
+		},
+	}
+	if err := app.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if err := app.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer func() { _ = app.Stop() }()
+
+	mainAddr := app.Servers["main"].listenAddrs()[0]
+	assertAnswers(t, mainAddr)
+
+	cfg := json.RawMessage(`{
+		"listen": ["127.0.0.1:0"],
+		"protocol": ["udp"],
+		"handler": {"handler": "test.handler"}
+	}`)
+	if err := app.AddServer("extra", cfg); err != nil {
+		t.Fatalf("AddServer failed: %v", err)
+	}
+
+	extra, exists := app.Servers["extra"]
+	if !exists {
+		t.Fatal("Expected extra server to be added")
+	}
+	assertAnswers(t, extra.listenAddrs()[0])
+
+	// The existing server keeps its original listener
+	if got := app.Servers["main"].listenAddrs()[0]; got != mainAddr {
+		t.Errorf("Expected main server to keep listening on %s, got %s", mainAddr, got)
+	}
+	assertAnswers(t, mainAddr)
+
+	if err := app.AddServer("extra", cfg); err == nil {
+		t.Error("Expected error adding a duplicate server")
+	}
+}
+
+func TestDNSApp_RemoveServer(t *testing.T) {
+	app := &DNSApp{
+		Servers: map[string]*DNSServer{
+			"keep":   newTestServer(),
+			"remove": newTestServer(),
+		},
+	}
+	if err := app.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if err := app.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer func() { _ = app.Stop() }()
+
+	keepAddr := app.Servers["keep"].listenAddrs()[0]
+	removeAddr := app.Servers["remove"].listenAddrs()[0]
+
+	if err := app.RemoveServer("remove"); err != nil {
+		t.Fatalf("RemoveServer failed: %v", err)
+	}
+
+	if _, exists := app.Servers["remove"]; exists {
+		t.Error("Expected removed server to be deleted from the app")
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	client := &dns.Client{Net: "udp", Timeout: 200 * time.Millisecond}
+	if _, _, err := client.Exchange(req, removeAddr); err == nil {
+		t.Error("Expected removed server to stop answering")
+	}
+
+	assertAnswers(t, keepAddr)
+
+	if err := app.RemoveServer("remove"); err == nil {
+		t.Error("Expected error removing an unknown server")
+	}
+}
+
+func TestDNSApp_UpdateServerUnderLoad(t *testing.T) {
+	server := func(rcode int) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(`{
+			"listen": ["127.0.0.1:0"],
+			"protocol": ["udp"],
+			"slow_query_threshold": "1ns",
+			"resolution_trace": {"clients": ["127.0.0.0/8"]},
+			"handler": {"handler": "test.handler", "rcode": %d}
+		}`, rcode))
+	}
+
+	var main DNSServer
+	if err := json.Unmarshal(server(dns.RcodeSuccess), &main); err != nil {
+		t.Fatalf("failed to unmarshal server: %v", err)
+	}
+	app := &DNSApp{Servers: map[string]*DNSServer{"main": &main}}
+	if err := app.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	app.logger = slog.New(slog.DiscardHandler)
+	main.logger = app.logger
+	if err := app.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer func() { _ = app.Cleanup() }()
+
+	addr := main.listenAddrs()[0]
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	var rcodes []int
+	var failed int
+	go func() {
+		defer close(done)
+		client := &dns.Client{Net: "udp", Timeout: time.Second}
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			resp, _, err := client.Exchange(req, addr)
+			if err != nil {
+				failed++
+				continue
+			}
+			rcodes = append(rcodes, resp.Rcode)
+		}
+	}()
+
+	// Updates alternate the handler while queries are being answered
+	for i := 0; i < 20; i++ {
+		time.Sleep(2 * time.Millisecond)
+		rcode := dns.RcodeSuccess
+		if i%2 == 0 {
+			rcode = dns.RcodeNameError
+		}
+		if err := app.UpdateServer("main", server(rcode)); err != nil {
+			t.Fatalf("UpdateServer failed: %v", err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	<-done
+
+	if app.Servers["main"] != &main {
+		t.Error("Expected handler-only updates to keep the running server")
+	}
+	if failed > 0 {
+		t.Errorf("Expected no failed queries across the updates, got %d", failed)
+	}
+	if len(rcodes) == 0 || rcodes[len(rcodes)-1] != dns.RcodeSuccess {
+		t.Errorf("Expected queries after the last update to be answered by its handler, got %v", rcodes)
+	}
+	if got := main.listenAddrs()[0]; got != addr {
+		t.Errorf("Expected listener to be unchanged, got %s want %s", got, addr)
+	}
+}
+
+func TestDNSApp_UpdateServer(t *testing.T) {
+	app := &DNSApp{
+		Servers: map[string]*DNSServer{
+			"main": newTestServer(),
+		},
+	}
+	if err := app.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if err := app.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer func() { _ = app.Stop() }()
+
+	original := app.Servers["main"]
+	addr := original.listenAddrs()[0]
+
+	cfg := json.RawMessage(`{
+		"listen": ["127.0.0.1:0"],
+		"protocol": ["udp"],
+		"handler": {"handler": "test.handler", "rcode": 3}
+	}`)
+	if err := app.UpdateServer("main", cfg); err != nil {
+		t.Fatalf("UpdateServer failed: %v", err)
+	}
+
+	if app.Servers["main"] != original {
+		t.Error("Expected handler-only update to keep the running server")
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	client := &dns.Client{Net: "udp", Timeout: time.Second}
+	resp, _, err := client.Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("Expected server to keep answering, got error: %v", err)
+	}
+	if resp.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected updated handler to answer NXDOMAIN, got %s", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestDNSServer_DisabledHandlers(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     string
+		wantModules int
+		wantErr     bool
+	}{
+		{
+			name:        "disabled root",
+			handler:     `{"handler": "dns.middleware.querylog", "enabled": false, "next": {"handler": "test.handler"}}`,
+			wantModules: 1,
+		},
+		{
+			name: "disabled middleware in the chain",
+			handler: `{"handler": "dns.middleware.querylog", "output": "stderr", "next": {
+				"handler": "dns.middleware.querylog", "enabled": false, "next": {"handler": "test.handler"}
+			}}`,
+			wantModules: 2,
+		},
+		{
+			name:    "disabled without next",
+			handler: `{"handler": "test.handler", "enabled": false}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid enabled",
+			handler: `{"handler": "test.handler", "enabled": "no"}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer()
+			server.Handler = json.RawMessage(tt.handler)
+			err := server.provision(mockContext{}, slog.New(slog.DiscardHandler))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer func() { _ = server.cleanup() }()
+
+			if len(server.modules) != tt.wantModules {
+				t.Errorf("Expected the disabled handler to be skipped, got modules %v", server.modules)
+			}
+			if _, ok := server.modules[0].(*testHandler); !ok {
+				t.Errorf("Expected the handler after the disabled one to be loaded, got %T", server.modules[0])
+			}
+		})
+	}
+}
+
+func TestDNSApp_UpdateServerSettings(t *testing.T) {
+	addr := freeUDPAddr(t)
+	logPath := filepath.Join(t.TempDir(), "query.log")
+	app := &DNSApp{
+		Servers: map[string]*DNSServer{
+			"main": {
+				Listen:   []string{addr},
+				Protocol: []string{"udp"},
+				Handler: json.RawMessage(fmt.Sprintf(`{
+					"handler": "dns.middleware.querylog",
+					"output": %q,
+					"next": {"handler": "test.handler"}
+				}`, logPath)),
+			},
+		},
+	}
+	if err := app.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if err := app.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer func() { _ = app.Cleanup() }()
+
+	original := app.Servers["main"]
+	update := func(settings string) {
+		t.Helper()
+		cfg := json.RawMessage(fmt.Sprintf(`{
+			"listen": [%q],
+			"protocol": ["udp"],
+			%s
+			"handler": {"handler": "test.handler"}
+		}`, addr, settings))
+		if err := app.UpdateServer("main", cfg); err != nil {
+			t.Fatalf("UpdateServer failed: %v", err)
+		}
+	}
+
+	update("")
+	if app.Servers["main"] != original {
+		t.Fatal("Expected a handler-only update to keep the running server")
+	}
+	if _, err := os.Stat("/proc/self/fd"); err == nil && isFileOpen(t, logPath) {
+		t.Error("Expected the replaced handler's query log to be closed")
+	}
+
+	update(`"dedupe_records": true,`)
+	updated := app.Servers["main"]
+	if updated == original {
+		t.Fatal("Expected a settings change to replace the server")
+	}
+	if !updated.DedupeRecords {
+		t.Error("Expected the updated server to dedupe records")
+	}
+	assertAnswers(t, addr)
+}
+
+func TestDNSApp_DisabledServer(t *testing.T) {
+	disabledAddr := freeUDPAddr(t)
+	disabled := false
+
+	app := &DNSApp{
+		Servers: map[string]*DNSServer{
+			"enabled": newTestServer(),
+			"disabled": {
+				Listen:   []string{disabledAddr},
+				Protocol: []string{"udp"},
+				Handler:  json.RawMessage(`{"handler": "test.handler"}`),
+				Enabled:  &disabled,
+			},
+		},
+	}
+	if err := app.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if err := app.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer func() { _ = app.Stop() }()
+
+	assertAnswers(t, app.Servers["enabled"].listenAddrs()[0])
+
+	if addrs := app.Servers["disabled"].listenAddrs(); len(addrs) != 0 {
+		t.Errorf("Expected disabled server to have no listeners, got %v", addrs)
+	}
+
+	// The disabled server's address must still be free
+	pc, err := net.ListenPacket("udp", disabledAddr)
+	if err != nil {
+		t.Fatalf("Expected disabled server not to bind %s: %v", disabledAddr, err)
+	}
+	_ = pc.Close()
+}
+
+// newTestServer returns a server config listening on a random local UDP
+// port and answering from test.handler.
+func TestDNSApp_LogValue(t *testing.T) {
+	disabled := false
+	app := &DNSApp{
+		Servers: map[string]*DNSServer{
+			"main": newTestServer(),
+			"forwarder": {
+				Listen:   []string{"127.0.0.1:5353"},
+				Protocol: []string{"udp", "tcp"},
+				Handler:  json.RawMessage(`{"handler": "dns.resolver.upstream", "upstreams": ["1.1.1.1:53"]}`),
+				Enabled:  &disabled,
+			},
+		},
+	}
+	if err := app.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if err := app.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer func() { _ = app.Stop() }()
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	logger.Info("summary", "dns", app)
+
+	type serverSummary struct {
+		Listen  []string        `json:"listen"`
+		Enabled bool            `json:"enabled"`
+		Handler json.RawMessage `json:"handler"`
+	}
+	var entry struct {
+		DNS struct {
+			Servers map[string]serverSummary `json:"servers"`
+		} `json:"dns"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Failed to parse summary %q: %v", buf.String(), err)
+	}
+
+	main, ok := entry.DNS.Servers["main"]
+	if !ok {
+		t.Fatalf("Expected main server in summary, got %s", buf.String())
+	}
+	wantListen := "udp://" + app.Servers["main"].listenAddrs()[0]
+	if len(main.Listen) != 1 || main.Listen[0] != wantListen {
+		t.Errorf("Expected main server to report %s, got %v", wantListen, main.Listen)
+	}
+	if string(main.Handler) != `"test.handler"` {
+		t.Errorf("Expected main handler test.handler, got %s", main.Handler)
+	}
+
+	forwarder, ok := entry.DNS.Servers["forwarder"]
+	if !ok {
+		t.Fatalf("Expected forwarder server in summary, got %s", buf.String())
+	}
+	if forwarder.Enabled {
+		t.Error("Expected forwarder server to be reported as disabled")
+	}
+	if want := []string{"udp://127.0.0.1:5353", "tcp://127.0.0.1:5353"}; !slices.Equal(forwarder.Listen, want) {
+		t.Errorf("Expected forwarder listeners %v, got %v", want, forwarder.Listen)
+	}
+
+	var handler struct {
+		Module    string   `json:"module"`
+		Upstreams []string `json:"upstreams"`
+	}
+	if err := json.Unmarshal(forwarder.Handler, &handler); err != nil {
+		t.Fatalf("Failed to parse forwarder handler %s: %v", forwarder.Handler, err)
+	}
+	if handler.Module != "dns.resolver.upstream" || !slices.Equal(handler.Upstreams, []string{"1.1.1.1:53"}) {
+		t.Errorf("Expected upstream resolver chain, got %+v", handler)
+	}
+}
+
+func newTestServer() *DNSServer {
+	return &DNSServer{
+		Listen:   []string{"127.0.0.1:0"},
+		Protocol: []string{"udp"},
+		Handler:  json.RawMessage(`{"handler": "test.handler"}`),
+	}
+}
+
+// assertAnswers sends a query to addr and fails the test if no response is
+// received.
+func assertAnswers(t *testing.T, addr string) {
+	t.Helper()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	client := &dns.Client{Net: "udp", Timeout: time.Second}
+	resp, _, err := client.Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("Expected %s to answer, got error: %v", addr, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected NOERROR from %s, got %s", addr, dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestDNSServer_DrainTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		delay        time.Duration
+		drainTimeout string
+		wantAnswer   bool
+		wantWarning  bool
+	}{
+		{
+			name:         "in-flight query finishes",
+			delay:        200 * time.Millisecond,
+			drainTimeout: "5s",
+			wantAnswer:   true,
+		},
+		{
+			name:         "deadline cuts off slow query",
+			delay:        3 * time.Second,
+			drainTimeout: "100ms",
+			wantWarning:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf syncBuffer
+			logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+			server := newTestServer()
+			server.DrainTimeout = tt.drainTimeout
+			if err := server.provision(mockContext{}, logger); err != nil {
+				t.Fatalf("provision failed: %v", err)
+			}
+			server.handler = &slowDNSHandler{delay: tt.delay}
+			if err := server.start(); err != nil {
+				t.Fatalf("start failed: %v", err)
+			}
+			addr := server.listenAddrs()[0]
+
+			answered := make(chan bool, 1)
+			go func() {
+				req := new(dns.Msg)
+				req.SetQuestion("example.com.", dns.TypeA)
+				client := &dns.Client{Net: "udp", Timeout: 5 * time.Second}
+				resp, _, err := client.Exchange(req, addr)
+				answered <- err == nil && resp.Rcode == dns.RcodeSuccess
+			}()
+			// Give the query time to reach the handler
+			time.Sleep(50 * time.Millisecond)
+
+			start := time.Now()
+			if err := server.stop(); err != nil {
+				t.Fatalf("stop failed: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("expected stop to return within the drain timeout, took %v", elapsed)
+			}
+
+			if got := strings.Contains(buf.String(), "drain timeout reached"); got != tt.wantWarning {
+				t.Errorf("expected drain warning %v, got log: %s", tt.wantWarning, buf.String())
+			}
+			if tt.wantAnswer && !<-answered {
+				t.Error("expected the in-flight query to be answered while draining")
+			}
+		})
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writes from handlers
+// still running after a test stops its server.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
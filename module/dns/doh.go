@@ -0,0 +1,393 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// dohContentType is the media type of DNS messages carried over HTTPS,
+	// as defined by RFC 8484.
+	dohContentType = "application/dns-message"
+
+	// dohReadHeaderTimeout and dohReadTimeout bound how long a client may
+	// take to send a query, and dohIdleTimeout how long a keep-alive
+	// connection may wait for the next one, so that idle or slow clients
+	// cannot exhaust the listener's connections.
+	dohReadHeaderTimeout = 5 * time.Second
+	dohReadTimeout       = 10 * time.Second
+	dohIdleTimeout       = 2 * time.Minute
+)
+
+// DoHOptions configures a DNS-over-HTTPS (RFC 8484) listener for a server.
+// Queries received over HTTPS go through the same handler pipeline as those
+// received over UDP and TCP.
+type DoHOptions struct {
+	// Listen is the list of addresses to serve DoH on. Defaults to ":443".
+	Listen []string `json:"listen,omitempty"`
+
+	// Path is the URL path queries are served on. Defaults to "/dns-query".
+	Path string `json:"path,omitempty"`
+
+	// CertFile and KeyFile are the TLS certificate and key to serve with.
+	// When both are empty queries are served over plaintext HTTP, including
+	// HTTP/2 with prior knowledge, for use behind a TLS-terminating proxy.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+
+	tlsConfig *tls.Config
+}
+
+func (o *DoHOptions) provision() error {
+	if len(o.Listen) == 0 {
+		o.Listen = []string{":443"}
+	}
+	if o.Path == "" {
+		o.Path = "/dns-query"
+	}
+
+	for _, addr := range o.Listen {
+		if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+			return fmt.Errorf("invalid listen address %s: %w", addr, err)
+		}
+	}
+
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be set together")
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading certificate: %w", err)
+		}
+		o.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+			NextProtos:   []string{"h2", "http/1.1"},
+		}
+	}
+
+	return nil
+}
+
+// dohListener serves DoH queries on a single address. Like a
+// sharedListener, it is held by every running server listening on its
+// address and dispatches to the most recent one, so that a reload keeping
+// the same address hands the socket over without closing it.
+type dohListener struct {
+	key    string
+	addr   string
+	tls    bool
+	server *http.Server
+
+	holders []*DNSServer
+	mu      sync.RWMutex
+}
+
+// acquireDoH returns the DoH listener for addr, binding it if no running
+// server holds it yet. Like acquire, it only shares a listener with a
+// server that replaces all of its holders.
+func (p *listenerPool) acquireDoH(addr string, s *DNSServer) (*dohListener, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := "doh/" + addr
+	if l, exists := p.doh[key]; exists && !isEphemeral(addr) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if err := takeOver(l.holders, s); err != nil {
+			return nil, err
+		}
+		if l.tls != (s.DoH.tlsConfig != nil) {
+			return nil, fmt.Errorf("cannot switch a running DoH listener between TLS and plaintext")
+		}
+		l.holders = append(l.holders, s)
+		return l, nil
+	}
+
+	l, err := listenDoH(addr, s)
+	if err != nil {
+		return nil, err
+	}
+
+	if isEphemeral(addr) {
+		key = "doh/" + l.addr
+	}
+	l.key = key
+	p.doh[key] = l
+
+	return l, nil
+}
+
+// releaseDoH drops s as a holder of l, shutting the listener down once no
+// server holds it.
+func (p *listenerPool) releaseDoH(l *dohListener, s *DNSServer) error {
+	p.mu.Lock()
+	l.mu.Lock()
+	if len(l.holders) > 1 {
+		for i, holder := range l.holders {
+			if holder == s {
+				l.holders = append(l.holders[:i], l.holders[i+1:]...)
+				break
+			}
+		}
+		l.mu.Unlock()
+		p.mu.Unlock()
+		return nil
+	}
+	l.mu.Unlock()
+	delete(p.doh, l.key)
+	p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+	if err := l.server.Shutdown(ctx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			s.logger.Warn("drain timeout reached, dropping in-flight DoH queries",
+				"addr", l.addr, "drain_timeout", s.drainTimeout)
+			return l.server.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// active returns the server queries are currently dispatched to.
+func (l *dohListener) active() *DNSServer {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.holders[len(l.holders)-1]
+}
+
+// listenDoH binds addr and starts serving DoH queries on it.
+func listenDoH(addr string, s *DNSServer) (*dohListener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, bindError(addr, err)
+	}
+
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+
+	l := &dohListener{
+		addr:    ln.Addr().String(),
+		tls:     s.DoH.tlsConfig != nil,
+		holders: []*DNSServer{s},
+	}
+	l.server = &http.Server{
+		Handler:           l,
+		Protocols:         protocols,
+		ReadHeaderTimeout: dohReadHeaderTimeout,
+		ReadTimeout:       dohReadTimeout,
+		IdleTimeout:       dohIdleTimeout,
+		ErrorLog:          slog.NewLogLogger(s.logger.Handler(), slog.LevelDebug),
+	}
+
+	serve := func() error { return l.server.Serve(ln) }
+	if l.tls {
+		// The certificate is taken from the active server on every
+		// handshake, so a reload can replace it
+		l.server.TLSConfig = &tls.Config{
+			NextProtos: []string{"h2", "http/1.1"},
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return l.active().DoH.tlsConfig, nil
+			},
+		}
+		serve = func() error { return l.server.ServeTLS(ln, "", "") }
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+
+	s.logger.Info("starting DoH listener", "addr", l.addr, "path", s.DoH.Path, "scheme", l.scheme())
+	go func() {
+		if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("DoH server error", "addr", l.addr, "error", err)
+		}
+	}()
+
+	return l, nil
+}
+
+// scheme returns the URL scheme queries are served over.
+func (l *dohListener) scheme() string {
+	if l.tls {
+		return "https"
+	}
+	return "http"
+}
+
+// ServeHTTP decodes RFC 8484 requests and answers them through the active
+// server's handler pipeline.
+func (l *dohListener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s := l.active()
+	if req.URL.Path != s.DoH.Path {
+		http.NotFound(w, req)
+		return
+	}
+
+	var (
+		packed []byte
+		err    error
+	)
+	switch req.Method {
+	case http.MethodGet:
+		param := req.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns query parameter", http.StatusBadRequest)
+			return
+		}
+		packed, err = base64.RawURLEncoding.DecodeString(param)
+		if err != nil {
+			http.Error(w, "invalid dns query parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		packed, err = io.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize+1))
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if len(packed) > dns.MaxMsgSize {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(packed); err != nil {
+		http.Error(w, "invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	// RFC 8484 recommends a message ID of 0 so that GET responses cache
+	// well, but clients are free to use any ID and expect it echoed back
+	dw := &dohResponseWriter{
+		http:   w,
+		local:  tcpAddr(req.Context().Value(http.LocalAddrContextKey)),
+		remote: parseTCPAddr(req.RemoteAddr),
+		tsig:   s.tsig,
+	}
+	if t := r.IsTsig(); t != nil {
+		dw.tsigStatus = dns.TsigVerifyWithProvider(packed, s.tsig, "", false)
+		dw.tsigRequestMAC = t.MAC
+	}
+	s.ServeDNS(dw, r)
+
+	if !dw.written {
+		http.Error(w, "no response", http.StatusInternalServerError)
+	}
+}
+
+// dohResponseWriter adapts an HTTP response to a dns.ResponseWriter. The
+// client is reported as a TCP address, so no response is ever truncated.
+type dohResponseWriter struct {
+	http    http.ResponseWriter
+	local   net.Addr
+	remote  net.Addr
+	written bool
+
+	tsig           dns.TsigProvider
+	tsigStatus     error
+	tsigRequestMAC string
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	var (
+		packed []byte
+		err    error
+	)
+	if m.IsTsig() != nil {
+		packed, _, err = dns.TsigGenerateWithProvider(m, w.tsig, w.tsigRequestMAC, false)
+	} else {
+		packed, err = m.Pack()
+	}
+	if err != nil {
+		return err
+	}
+
+	if ttl, ok := minTTL(m); ok {
+		w.http.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	}
+	_, err = w.Write(packed)
+	return err
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	if w.written {
+		return 0, fmt.Errorf("response already written")
+	}
+	w.written = true
+
+	w.http.Header().Set("Content-Type", dohContentType)
+	w.http.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	return w.http.Write(b)
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return w.tsigStatus }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
+
+// minTTL returns the smallest TTL of the records in m, which bounds how
+// long an HTTP cache may keep the response.
+func minTTL(m *dns.Msg) (uint32, bool) {
+	var (
+		ttl   uint32
+		found bool
+	)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// tcpAddr returns addr if it is a TCP address, or the zero TCP address.
+// Handlers expect a dns.ResponseWriter's addresses to never be nil.
+func tcpAddr(addr interface{}) net.Addr {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a
+	}
+	return &net.TCPAddr{}
+}
+
+// parseTCPAddr parses an HTTP request's remote address, falling back to the
+// zero TCP address if it is not an IP and port.
+func parseTCPAddr(addr string) net.Addr {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return a
+}
@@ -0,0 +1,321 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+func TestDoHOptions_Provision(t *testing.T) {
+	tests := []struct {
+		name    string
+		options DoHOptions
+		wantErr string
+	}{
+		{name: "defaults"},
+		{
+			name:    "invalid listen address",
+			options: DoHOptions{Listen: []string{"not-an-address"}},
+			wantErr: "invalid listen address",
+		},
+		{
+			name:    "cert without key",
+			options: DoHOptions{CertFile: "cert.pem"},
+			wantErr: "must be set together",
+		},
+		{
+			name:    "missing certificate",
+			options: DoHOptions{CertFile: "missing.pem", KeyFile: "missing.key"},
+			wantErr: "loading certificate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.options.provision()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if tt.options.Listen[0] != ":443" || tt.options.Path != "/dns-query" {
+					t.Errorf("expected defaults, got listen %v path %q", tt.options.Listen, tt.options.Path)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestDNSServer_DoH(t *testing.T) {
+	server := newTestServer()
+	server.Handler = json.RawMessage(`{"handler": "test.handler", "answers": 1}`)
+	server.DoH = &DoHOptions{Listen: []string{"127.0.0.1:0"}}
+
+	app := &DNSApp{Servers: map[string]*DNSServer{"main": server}}
+	if err := app.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if err := app.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer func() { _ = app.Stop() }()
+
+	url := "http://" + server.dohListeners[0].addr + "/dns-query"
+	responses := responsesTotal.Value("main", "noerror", "A")
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Id = 0
+	packed, err := req.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+
+	h2c := new(http.Protocols)
+	h2c.SetUnencryptedHTTP2(true)
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		do     func(client *http.Client) (*http.Response, error)
+	}{
+		{
+			name:   "GET",
+			client: http.DefaultClient,
+			do: func(client *http.Client) (*http.Response, error) {
+				return client.Get(url + "?dns=" + base64.RawURLEncoding.EncodeToString(packed))
+			},
+		},
+		{
+			name:   "POST",
+			client: http.DefaultClient,
+			do: func(client *http.Client) (*http.Response, error) {
+				return client.Post(url, dohContentType, bytes.NewReader(packed))
+			},
+		},
+		{
+			name:   "POST over HTTP/2",
+			client: &http.Client{Transport: &http.Transport{Protocols: h2c}},
+			do: func(client *http.Client) (*http.Response, error) {
+				return client.Post(url, dohContentType, bytes.NewReader(packed))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.do(tt.client)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Content-Type"); got != dohContentType {
+				t.Errorf("expected content type %s, got %s", dohContentType, got)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != "max-age=300" {
+				t.Errorf("expected Cache-Control max-age=300, got %q", got)
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			m := new(dns.Msg)
+			if err := m.Unpack(body); err != nil {
+				t.Fatalf("failed to unpack response: %v", err)
+			}
+			if len(m.Answer) != 1 {
+				t.Errorf("expected 1 answer, got %d", len(m.Answer))
+			}
+		})
+	}
+
+	if got := responsesTotal.Value("main", "noerror", "A") - responses; got != float64(len(tests)) {
+		t.Errorf("expected %d recorded responses, got %v", len(tests), got)
+	}
+}
+
+func TestDoHHandler_BadRequests(t *testing.T) {
+	server := newTestServer()
+	server.DoH = &DoHOptions{Listen: []string{"127.0.0.1:0"}}
+
+	app := &DNSApp{Servers: map[string]*DNSServer{"main": server}}
+	if err := app.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if err := app.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer func() { _ = app.Stop() }()
+
+	url := "http://" + server.dohListeners[0].addr + "/dns-query"
+
+	tests := []struct {
+		name        string
+		method      string
+		query       string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{name: "GET without query", method: http.MethodGet, wantStatus: http.StatusBadRequest},
+		{name: "GET with invalid base64", method: http.MethodGet, query: "?dns=!!!", wantStatus: http.StatusBadRequest},
+		{name: "GET with invalid message", method: http.MethodGet, query: "?dns=AAAA", wantStatus: http.StatusBadRequest},
+		{name: "POST with wrong content type", method: http.MethodPost, contentType: "text/plain", body: "x", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "PUT", method: http.MethodPut, wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, url+tt.query, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("failed to build request: %v", err)
+			}
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+// addrHandler records the addresses a query was received on.
+type addrHandler struct {
+	local, remote string
+}
+
+func (h *addrHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	h.local, h.remote = w.LocalAddr().String(), w.RemoteAddr().String()
+	m := new(dns.Msg)
+	m.SetReply(r)
+	return w.WriteMsg(m)
+}
+
+func TestDoHHandler_UnparseableAddresses(t *testing.T) {
+	server := newTestServer()
+	server.DoH = &DoHOptions{Listen: []string{"127.0.0.1:0"}}
+
+	app := &DNSApp{Servers: map[string]*DNSServer{"main": server}}
+	if err := app.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	handler := &addrHandler{}
+	server.handler = handler
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	packed, err := q.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+
+	// A request served over a Unix socket, or built by a proxy, carries no
+	// IP address for either end
+	req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packed))
+	req.Header.Set("Content-Type", dohContentType)
+	req.RemoteAddr = "@"
+	rec := httptest.NewRecorder()
+
+	l := &dohListener{holders: []*DNSServer{server}}
+	l.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if handler.local == "" || handler.remote == "" {
+		t.Errorf("expected non-empty addresses, got local %q remote %q", handler.local, handler.remote)
+	}
+}
+
+// transportHandler records the transport of the last query it answered.
+type transportHandler struct {
+	mu        sync.Mutex
+	transport string
+}
+
+func (h *transportHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	transport, _ := mightydns.TransportFromContext(ctx)
+	h.mu.Lock()
+	h.transport = transport
+	h.mu.Unlock()
+	return mockDNSHandler{}.ServeDNS(ctx, w, r)
+}
+
+func (h *transportHandler) last() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.transport
+}
+
+func TestDNSServer_Transport(t *testing.T) {
+	server := newTestServer()
+	server.Protocol = []string{"udp", "tcp"}
+	server.DoH = &DoHOptions{Listen: []string{"127.0.0.1:0"}}
+
+	app := &DNSApp{Servers: map[string]*DNSServer{"main": server}}
+	if err := app.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	handler := &transportHandler{}
+	server.handler = handler
+	if err := app.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer func() { _ = app.Stop() }()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	addrs := server.listenAddrs()
+
+	for i, proto := range server.Protocol {
+		client := &dns.Client{Net: proto, Timeout: time.Second}
+		if _, _, err := client.Exchange(req, addrs[i]); err != nil {
+			t.Fatalf("%s query failed: %v", proto, err)
+		}
+		if got := handler.last(); got != proto {
+			t.Errorf("expected transport %s, got %q", proto, got)
+		}
+	}
+
+	packed, err := req.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+	url := "http://" + server.dohListeners[0].addr + "/dns-query"
+	resp, err := http.Post(url, dohContentType, bytes.NewReader(packed))
+	if err != nil {
+		t.Fatalf("DoH query failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if got := handler.last(); got != "doh" {
+		t.Errorf("expected transport doh, got %q", got)
+	}
+}
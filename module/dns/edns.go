@@ -0,0 +1,173 @@
+package dns
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// defaultUDPSize is the EDNS UDP payload size advertised when none is
+// configured. It is the size DNS Flag Day 2020 settled on to avoid IP
+// fragmentation.
+const defaultUDPSize = 1232
+
+// EDNSOptions configures the EDNS0 options the server adds to responses.
+// Options are only added for clients that signal support for them in the
+// OPT record of their query.
+type EDNSOptions struct {
+	// NSID is the name server identifier (RFC 5001) returned to clients
+	// that request it, useful to tell which anycast node answered. The
+	// value "hostname" uses the host name of the machine.
+	NSID string `json:"nsid,omitempty"`
+	// Padding pads responses to a multiple of this many bytes (RFC 7830)
+	// for clients that pad their queries. RFC 8467 recommends 468.
+	Padding int `json:"padding,omitempty"`
+	// UDPSize is the UDP payload size advertised to EDNS clients, and the
+	// largest UDP response sent to them. Defaults to 1232.
+	UDPSize int `json:"udp_size,omitempty"`
+
+	nsid string
+}
+
+func (e *EDNSOptions) provision() error {
+	if e.UDPSize == 0 {
+		e.UDPSize = defaultUDPSize
+	}
+	if e.UDPSize < dns.MinMsgSize || e.UDPSize > dns.MaxMsgSize {
+		return fmt.Errorf("udp_size must be between %d and %d", dns.MinMsgSize, dns.MaxMsgSize)
+	}
+
+	if e.Padding < 0 || e.Padding > dns.MaxMsgSize {
+		return fmt.Errorf("padding must be between 0 and %d", dns.MaxMsgSize)
+	}
+
+	nsid := e.NSID
+	if nsid == "hostname" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("resolving hostname for nsid: %w", err)
+		}
+		nsid = hostname
+	}
+	e.nsid = hex.EncodeToString([]byte(nsid))
+
+	return nil
+}
+
+// ednsWriter adds the configured EDNS0 options to responses.
+type ednsWriter struct {
+	dns.ResponseWriter
+	options *EDNSOptions
+	query   *dns.OPT
+}
+
+func (w *ednsWriter) WriteMsg(m *dns.Msg) error {
+	wantNSID, wantPadding := false, false
+	for _, option := range w.query.Option {
+		switch option.Option() {
+		case dns.EDNS0NSID:
+			wantNSID = w.options.nsid != ""
+		case dns.EDNS0PADDING:
+			wantPadding = w.options.Padding > 0
+		}
+	}
+	if !wantNSID && !wantPadding {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(w.query.UDPSize(), w.query.Do())
+		opt = m.IsEdns0()
+	}
+
+	if wantNSID {
+		// Identify this server rather than an upstream that answered
+		opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool {
+			return o.Option() == dns.EDNS0NSID
+		})
+		opt.Option = append(opt.Option, &dns.EDNS0_NSID{
+			Code: dns.EDNS0NSID,
+			Nsid: w.options.nsid,
+		})
+	}
+
+	// Padding goes last, once the size of the rest of the response is known
+	if wantPadding {
+		padding := &dns.EDNS0_PADDING{}
+		opt.Option = append(opt.Option, padding)
+		if remainder := m.Len() % w.options.Padding; remainder != 0 {
+			padding.Padding = make([]byte, w.options.Padding-remainder)
+		}
+	}
+
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// checkOPT validates the OPT record of a query, returning the error
+// response to send if it is unacceptable: FORMERR for more than one OPT
+// record, and BADVERS for an EDNS version other than 0 (RFC 6891 section
+// 6.1.1 and 6.1.3).
+func checkOPT(r *dns.Msg) *dns.Msg {
+	opts := 0
+	for _, rr := range r.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opts++
+		}
+	}
+
+	switch {
+	case opts > 1:
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		return m
+	case opts == 1 && r.IsEdns0().Version() != 0:
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeBadVers)
+		return m
+	}
+	return nil
+}
+
+// optWriter makes the OPT record of responses match the query's: it is
+// removed from responses to queries without one, and otherwise advertises
+// the server's UDP payload size and EDNS version 0, with the DO bit echoed
+// from the query and the other flags cleared. UDP responses larger than
+// the client can receive are truncated with the TC bit set.
+type optWriter struct {
+	dns.ResponseWriter
+	query   *dns.OPT
+	udpSize uint16
+}
+
+func (w *optWriter) WriteMsg(m *dns.Msg) error {
+	if w.query == nil {
+		m.Extra = slices.DeleteFunc(m.Extra, func(rr dns.RR) bool {
+			return rr.Header().Rrtype == dns.TypeOPT
+		})
+	} else {
+		opt := m.IsEdns0()
+		if opt == nil {
+			m.SetEdns0(w.udpSize, false)
+			opt = m.IsEdns0()
+		}
+		opt.SetUDPSize(w.udpSize)
+		opt.SetVersion(0)
+		opt.SetZ(0)
+		opt.SetDo(w.query.Do())
+	}
+
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if w.query != nil {
+			size = int(min(max(w.query.UDPSize(), dns.MinMsgSize), w.udpSize))
+		}
+		m.Truncate(size)
+	}
+
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,327 @@
+package dns
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestEDNSOptions_Provision(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  EDNSOptions
+		wantErr bool
+	}{
+		{
+			name:   "nsid and padding",
+			config: EDNSOptions{NSID: "node-1", Padding: 468},
+		},
+		{
+			name:   "hostname nsid",
+			config: EDNSOptions{NSID: "hostname"},
+		},
+		{
+			name:    "negative padding",
+			config:  EDNSOptions{Padding: -1},
+			wantErr: true,
+		},
+		{
+			name:    "padding larger than a message",
+			config:  EDNSOptions{Padding: dns.MaxMsgSize + 1},
+			wantErr: true,
+		},
+		{
+			name:    "udp size below the minimum",
+			config:  EDNSOptions{UDPSize: 256},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.provision()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("EDNSOptions.provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDNSServer_EDNSOptions(t *testing.T) {
+	server := newTestServer()
+	server.EDNS = &EDNSOptions{NSID: "node-1", Padding: 128}
+	if err := server.provision(mockContext{}, slog.Default()); err != nil {
+		t.Fatalf("provision failed: %v", err)
+	}
+	if err := server.start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	defer func() { _ = server.stop() }()
+
+	tests := []struct {
+		name        string
+		options     []dns.EDNS0
+		wantNSID    string
+		wantPadding bool
+	}{
+		{
+			name:     "nsid requested",
+			options:  []dns.EDNS0{&dns.EDNS0_NSID{Code: dns.EDNS0NSID}},
+			wantNSID: "node-1",
+		},
+		{
+			name:        "padding requested",
+			options:     []dns.EDNS0{&dns.EDNS0_PADDING{Padding: make([]byte, 8)}},
+			wantPadding: true,
+		},
+		{
+			name: "nothing requested",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, tt.options...)
+
+			client := &dns.Client{Net: "udp", Timeout: time.Second}
+			resp, _, err := client.Exchange(req, server.listenAddrs()[0])
+			if err != nil {
+				t.Fatalf("query failed: %v", err)
+			}
+
+			var nsid string
+			var padded bool
+			if opt := resp.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					switch o := o.(type) {
+					case *dns.EDNS0_NSID:
+						data, err := hex.DecodeString(o.Nsid)
+						if err != nil {
+							t.Fatalf("invalid NSID %q: %v", o.Nsid, err)
+						}
+						nsid = string(data)
+					case *dns.EDNS0_PADDING:
+						padded = true
+					}
+				}
+			}
+
+			if nsid != tt.wantNSID {
+				t.Errorf("Expected NSID %q, got %q", tt.wantNSID, nsid)
+			}
+			if padded != tt.wantPadding {
+				t.Errorf("Expected padding %t, got %t", tt.wantPadding, padded)
+			}
+			if tt.wantPadding {
+				packed, err := resp.Pack()
+				if err != nil {
+					t.Fatalf("failed to pack response: %v", err)
+				}
+				if len(packed)%128 != 0 {
+					t.Errorf("Expected response padded to a multiple of 128 bytes, got %d", len(packed))
+				}
+			}
+		})
+	}
+}
+
+func TestEDNSOptions_HostnameNSID(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skipf("host name unavailable: %v", err)
+	}
+
+	options := &EDNSOptions{NSID: "hostname"}
+	if err := options.provision(); err != nil {
+		t.Fatalf("provision failed: %v", err)
+	}
+
+	if want := hex.EncodeToString([]byte(hostname)); options.nsid != want {
+		t.Errorf("Expected NSID %q, got %q", want, options.nsid)
+	}
+}
+
+func TestEDNSWriter_ReplacesUpstreamNSID(t *testing.T) {
+	options := &EDNSOptions{NSID: "node-1"}
+	if err := options.provision(); err != nil {
+		t.Fatalf("provision failed: %v", err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	req.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_NSID{Code: dns.EDNS0NSID}}
+
+	// A forwarded response carrying the upstream's own identifier
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.SetEdns0(dns.DefaultMsgSize, false)
+	resp.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_NSID{
+		Code: dns.EDNS0NSID,
+		Nsid: hex.EncodeToString([]byte("upstream")),
+	}}
+
+	mock := &mockResponseWriter{}
+	w := &ednsWriter{ResponseWriter: mock, options: options, query: req.IsEdns0()}
+	if err := w.WriteMsg(resp); err != nil {
+		t.Fatalf("WriteMsg failed: %v", err)
+	}
+
+	var nsids []string
+	for _, o := range mock.msg.IsEdns0().Option {
+		if nsid, ok := o.(*dns.EDNS0_NSID); ok {
+			nsids = append(nsids, nsid.Nsid)
+		}
+	}
+	if want := hex.EncodeToString([]byte("node-1")); len(nsids) != 1 || nsids[0] != want {
+		t.Errorf("Expected only NSID %q, got %v", want, nsids)
+	}
+}
+
+func TestDNSServer_EDNSNegotiation(t *testing.T) {
+	tests := []struct {
+		name        string
+		serverSize  int
+		clientSize  uint16
+		wantTC      bool
+		wantMaxSize int
+		wantUDPSize uint16
+	}{
+		{
+			name:        "no edns",
+			wantTC:      true,
+			wantMaxSize: dns.MinMsgSize,
+		},
+		{
+			name:        "client size above default server size",
+			clientSize:  dns.DefaultMsgSize,
+			wantTC:      true,
+			wantMaxSize: defaultUDPSize,
+			wantUDPSize: defaultUDPSize,
+		},
+		{
+			name:        "client size below server size",
+			serverSize:  dns.DefaultMsgSize,
+			clientSize:  1400,
+			wantTC:      true,
+			wantMaxSize: 1400,
+			wantUDPSize: dns.DefaultMsgSize,
+		},
+		{
+			name:        "fits both sizes",
+			serverSize:  dns.DefaultMsgSize,
+			clientSize:  dns.DefaultMsgSize,
+			wantMaxSize: dns.DefaultMsgSize,
+			wantUDPSize: dns.DefaultMsgSize,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer()
+			// About 1.6KB of answers
+			server.Handler = json.RawMessage(`{"handler": "test.handler", "answers": 100}`)
+			if tt.serverSize > 0 {
+				server.EDNS = &EDNSOptions{UDPSize: tt.serverSize}
+			}
+			if err := server.provision(mockContext{}, slog.Default()); err != nil {
+				t.Fatalf("provision failed: %v", err)
+			}
+			if err := server.start(); err != nil {
+				t.Fatalf("start failed: %v", err)
+			}
+			defer func() { _ = server.stop() }()
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			if tt.clientSize > 0 {
+				req.SetEdns0(tt.clientSize, true)
+			}
+
+			client := &dns.Client{Net: "udp", Timeout: time.Second, UDPSize: dns.MaxMsgSize}
+			resp, _, err := client.Exchange(req, server.listenAddrs()[0])
+			if err != nil {
+				t.Fatalf("query failed: %v", err)
+			}
+
+			if resp.Truncated != tt.wantTC {
+				t.Errorf("Expected TC %t, got %t", tt.wantTC, resp.Truncated)
+			}
+			// The response was compressed on the wire
+			resp.Compress = true
+			if size := resp.Len(); size > tt.wantMaxSize {
+				t.Errorf("Expected a response of at most %d bytes, got %d", tt.wantMaxSize, size)
+			}
+
+			opt := resp.IsEdns0()
+			switch {
+			case tt.clientSize == 0 && opt != nil:
+				t.Error("Expected no OPT record in the response to a query without one")
+			case tt.clientSize > 0 && opt == nil:
+				t.Fatal("Expected an OPT record in the response")
+			case opt != nil:
+				if opt.UDPSize() != tt.wantUDPSize {
+					t.Errorf("Expected advertised UDP size %d, got %d", tt.wantUDPSize, opt.UDPSize())
+				}
+				if !opt.Do() {
+					t.Error("Expected the DO bit to be echoed")
+				}
+			}
+		})
+	}
+}
+
+func TestDNSServer_InvalidOPT(t *testing.T) {
+	server := newTestServer()
+	if err := server.provision(mockContext{}, slog.Default()); err != nil {
+		t.Fatalf("provision failed: %v", err)
+	}
+	if err := server.start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	defer func() { _ = server.stop() }()
+
+	badVersion := new(dns.Msg)
+	badVersion.SetQuestion("example.com.", dns.TypeA)
+	badVersion.SetEdns0(dns.DefaultMsgSize, false)
+	badVersion.IsEdns0().SetVersion(1)
+
+	twoOPTs := new(dns.Msg)
+	twoOPTs.SetQuestion("example.com.", dns.TypeA)
+	twoOPTs.SetEdns0(dns.DefaultMsgSize, false)
+	twoOPTs.Extra = append(twoOPTs.Extra, dns.Copy(twoOPTs.Extra[0]))
+
+	tests := []struct {
+		name      string
+		req       *dns.Msg
+		wantRcode int
+	}{
+		{name: "unsupported version", req: badVersion, wantRcode: dns.RcodeBadVers},
+		{name: "multiple OPT records", req: twoOPTs, wantRcode: dns.RcodeFormatError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &dns.Client{Net: "udp", Timeout: time.Second}
+			resp, _, err := client.Exchange(tt.req, server.listenAddrs()[0])
+			if err != nil {
+				t.Fatalf("query failed: %v", err)
+			}
+			if resp.Rcode != tt.wantRcode {
+				t.Errorf("Expected rcode %s, got %s", dns.RcodeToString[tt.wantRcode], dns.RcodeToString[resp.Rcode])
+			}
+			if opt := resp.IsEdns0(); opt == nil || opt.Version() != 0 {
+				t.Error("Expected an OPT record with version 0 in the response")
+			}
+		})
+	}
+}
@@ -1,12 +1,26 @@
 package dns
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
 	// Import the upstream resolver module so it's registered
+	_ "github.com/kusold/mightydns/module/dns/middleware"
 	_ "github.com/kusold/mightydns/module/dns/resolver"
+	_ "github.com/kusold/mightydns/module/log/handler"
 )
 
 func TestDNSServer_WithUpstreamHandler(t *testing.T) {
@@ -29,3 +43,382 @@ func TestDNSServer_WithUpstreamHandler(t *testing.T) {
 		t.Error("Expected handler to be set after provision")
 	}
 }
+
+func TestLoad_FailedReloadKeepsOldServersAnswering(t *testing.T) {
+	defer func() { _ = mightydns.Stop() }()
+
+	addr := freeUDPAddr(t)
+	good := fmt.Sprintf(`{
+		"logging": {"level": "ERROR"},
+		"apps": {
+			"dns": {
+				"servers": {
+					"main": {
+						"listen": [%q],
+						"protocol": ["udp"],
+						"handler": {"handler": "test.handler"}
+					}
+				}
+			}
+		}
+	}`, addr)
+	if err := mightydns.Load([]byte(good), true); err != nil {
+		t.Fatalf("failed to load initial config: %v", err)
+	}
+	assertAnswers(t, addr)
+
+	bad := `{
+		"logging": {"level": "ERROR"},
+		"apps": {
+			"dns": {
+				"servers": {
+					"main": {
+						"listen": ["127.0.0.1:0"],
+						"protocol": ["udp"],
+						"handler": {"handler": "does.not.exist"}
+					}
+				}
+			}
+		}
+	}`
+	if err := mightydns.Load([]byte(bad), true); err == nil {
+		t.Fatal("expected reload with unknown handler to fail")
+	}
+
+	assertAnswers(t, addr)
+}
+
+func TestLoad_ReloadDropsNoQueries(t *testing.T) {
+	defer func() { _ = mightydns.Stop() }()
+
+	addr := freeUDPAddr(t)
+	cfg := []byte(fmt.Sprintf(`{
+		"logging": {"level": "ERROR"},
+		"apps": {
+			"dns": {
+				"servers": {
+					"main": {
+						"listen": [%q],
+						"protocol": ["udp"],
+						"handler": {"handler": "test.handler"}
+					}
+				}
+			}
+		}
+	}`, addr))
+	if err := mightydns.Load(cfg, true); err != nil {
+		t.Fatalf("failed to load initial config: %v", err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	var sent, failed int
+	go func() {
+		defer close(done)
+		client := &dns.Client{Net: "udp", Timeout: time.Second}
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			sent++
+			if resp, _, err := client.Exchange(req, addr); err != nil || resp.Rcode != dns.RcodeSuccess {
+				failed++
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if err := mightydns.Load(cfg, true); err != nil {
+			t.Fatalf("reload %d failed: %v", i, err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	<-done
+
+	if sent == 0 {
+		t.Fatal("expected queries to be sent during reload")
+	}
+	if failed > 0 {
+		t.Errorf("expected no failed queries across reloads, got %d of %d", failed, sent)
+	}
+}
+
+func TestLoad_ReloadClosesQueryLog(t *testing.T) {
+	defer func() { _ = mightydns.Stop() }()
+
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("open files cannot be listed on this platform")
+	}
+
+	dir := t.TempDir()
+	addr := freeUDPAddr(t)
+	config := func(output string) []byte {
+		return []byte(fmt.Sprintf(`{
+			"logging": {"level": "ERROR"},
+			"apps": {
+				"dns": {
+					"servers": {
+						"main": {
+							"listen": [%q],
+							"protocol": ["udp"],
+							"handler": {
+								"handler": "dns.middleware.querylog",
+								"output": %q,
+								"next": {"handler": "test.handler"}
+							}
+						}
+					}
+				}
+			}
+		}`, addr, output))
+	}
+
+	oldLog := filepath.Join(dir, "old.log")
+	if err := mightydns.Load(config(oldLog), true); err != nil {
+		t.Fatalf("failed to load initial config: %v", err)
+	}
+	if !isFileOpen(t, oldLog) {
+		t.Fatal("expected the query log to be open")
+	}
+
+	if err := mightydns.Load(config(filepath.Join(dir, "new.log")), true); err != nil {
+		t.Fatalf("failed to reload config: %v", err)
+	}
+	if isFileOpen(t, oldLog) {
+		t.Error("expected the reload to close the old query log")
+	}
+	assertAnswers(t, addr)
+}
+
+// isFileOpen reports whether the process has path open.
+func isFileOpen(t *testing.T, path string) bool {
+	t.Helper()
+
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatalf("listing open files: %v", err)
+	}
+	for _, entry := range entries {
+		if target, err := os.Readlink(filepath.Join("/proc/self/fd", entry.Name())); err == nil && target == path {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLoad_ReloadKeepsDoHListener(t *testing.T) {
+	defer func() { _ = mightydns.Stop() }()
+
+	addr := freeTCPAddr(t)
+	cfg := func(answers int) []byte {
+		return []byte(fmt.Sprintf(`{
+			"logging": {"level": "ERROR"},
+			"apps": {
+				"dns": {
+					"servers": {
+						"main": {
+							"listen": ["127.0.0.1:0"],
+							"protocol": ["udp"],
+							"doh": {"listen": [%q]},
+							"handler": {"handler": "test.handler", "answers": %d}
+						}
+					}
+				}
+			}
+		}`, addr, answers))
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	packed, err := req.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+	url := "http://" + addr + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(packed)
+
+	for answers := 1; answers <= 3; answers++ {
+		if err := mightydns.Load(cfg(answers), true); err != nil {
+			t.Fatalf("failed to load config %d: %v", answers, err)
+		}
+
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("DoH query failed after load %d: %v", answers, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+
+		m := new(dns.Msg)
+		if err := m.Unpack(body); err != nil {
+			t.Fatalf("failed to unpack response: %v", err)
+		}
+		if len(m.Answer) != answers {
+			t.Errorf("expected the reloaded handler's %d answers, got %d", answers, len(m.Answer))
+		}
+	}
+}
+
+func TestLoad_DuplicateListenAddressFails(t *testing.T) {
+	defer func() { _ = mightydns.Stop() }()
+
+	udp := freeUDPAddr(t)
+	tcp := freeTCPAddr(t)
+	server := func(listen string) string {
+		return fmt.Sprintf(`{"listen": [%q], "protocol": ["udp"], "handler": {"handler": "test.handler"}}`, listen)
+	}
+	dohServer := fmt.Sprintf(`{"listen": ["127.0.0.1:0"], "protocol": ["udp"], "doh": {"listen": [%q]}, "handler": {"handler": "test.handler"}}`, tcp)
+
+	tests := []struct {
+		name string
+		apps string
+	}{
+		{
+			name: "same app",
+			apps: fmt.Sprintf(`"dns": {"servers": {"a": %s, "b": %s}}`, server(udp), server(udp)),
+		},
+		{
+			name: "different apps",
+			apps: fmt.Sprintf(`"dns": {"servers": {"a": %s}}, "dns-internal": {"module": "dns", "servers": {"b": %s}}`,
+				server(udp), server(udp)),
+		},
+		{
+			name: "doh",
+			apps: fmt.Sprintf(`"dns": {"servers": {"a": %s, "b": %s}}`, dohServer, dohServer),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := fmt.Sprintf(`{"logging": {"level": "ERROR"}, "apps": {%s}}`, tt.apps)
+			err := mightydns.Load([]byte(cfg), true)
+			if err == nil {
+				t.Fatal("expected a config listening twice on the same address to fail")
+			}
+			if !strings.Contains(err.Error(), "already in use") {
+				t.Errorf("expected an address in use error, got %v", err)
+			}
+		})
+	}
+
+	// A reload of the same address is still handed over
+	cfg := fmt.Sprintf(`{"logging": {"level": "ERROR"}, "apps": {"dns": {"servers": {"a": %s}}}}`, server(udp))
+	for i := 0; i < 2; i++ {
+		if err := mightydns.Load([]byte(cfg), true); err != nil {
+			t.Fatalf("load %d failed: %v", i, err)
+		}
+	}
+	assertAnswers(t, udp)
+}
+
+func TestServerManagement(t *testing.T) {
+	defer func() { _ = mightydns.Stop() }()
+
+	cfg := fmt.Sprintf(`{"logging": {"level": "ERROR"}, "apps": {"dns": {"servers": {"main": {
+		"listen": [%q], "protocol": ["udp"], "handler": {"handler": "test.handler"}
+	}}}}}`, freeUDPAddr(t))
+	if err := mightydns.Load([]byte(cfg), true); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	addr := freeUDPAddr(t)
+	server := json.RawMessage(fmt.Sprintf(`{"listen": [%q], "protocol": ["udp"], "handler": {"handler": "test.handler"}}`, addr))
+	if err := mightydns.AddServer("dns", "extra", server); err != nil {
+		t.Fatalf("AddServer failed: %v", err)
+	}
+	assertAnswers(t, addr)
+
+	if err := mightydns.RemoveServer("dns", "extra"); err != nil {
+		t.Fatalf("RemoveServer failed: %v", err)
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("expected the removed server to release %s: %v", addr, err)
+	}
+	_ = pc.Close()
+}
+
+func TestValidate_DoesNotBind(t *testing.T) {
+	addr := freeUDPAddr(t)
+
+	tests := []struct {
+		name     string
+		protocol string
+		wantErr  bool
+	}{
+		{name: "valid server", protocol: "udp"},
+		{name: "unsupported protocol", protocol: "sctp", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := mightydns.LoadConfig([]byte(fmt.Sprintf(`{
+				"apps": {
+					"dns": {
+						"servers": {
+							"main": {
+								"listen": [%q],
+								"protocol": [%q],
+								"handler": {"handler": "test.handler"}
+							}
+						}
+					}
+				}
+			}`, addr, tt.protocol)))
+			if err != nil {
+				t.Fatalf("failed to load config: %v", err)
+			}
+
+			err = mightydns.Validate(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			pc, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				t.Fatalf("expected %s to remain unbound after validation: %v", addr, err)
+			}
+			_ = pc.Close()
+		})
+	}
+}
+
+// freeTCPAddr returns a local TCP address that was free at the time of the
+// call, for configs that need a fixed listen address.
+func freeTCPAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := l.Addr().String()
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to close listener: %v", err)
+	}
+	return addr
+}
+
+// freeUDPAddr returns a local UDP address that was free at the time of the
+// call, for configs that need a fixed listen address.
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := pc.LocalAddr().String()
+	if err := pc.Close(); err != nil {
+		t.Fatalf("failed to close listener: %v", err)
+	}
+	return addr
+}
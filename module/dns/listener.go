@@ -0,0 +1,260 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// listeners holds every socket bound by a running server, so that a config
+// reload which keeps the same listen addresses can take over the existing
+// sockets instead of closing and rebinding them. Queries keep flowing
+// through the cutover because the socket never stops being read.
+var listeners = &listenerPool{
+	listeners: make(map[string]*sharedListener),
+	doh:       make(map[string]*dohListener),
+}
+
+type listenerPool struct {
+	mu        sync.Mutex
+	listeners map[string]*sharedListener
+	doh       map[string]*dohListener
+}
+
+// sharedListener is a bound socket that dispatches queries to the most
+// recent server holding it.
+type sharedListener struct {
+	key    string
+	server *dns.Server
+
+	holders []*DNSServer
+	mu      sync.RWMutex
+}
+
+// acquire returns the listener for proto and addr, binding it if no running
+// server holds it yet. The caller becomes the listener's active server
+// until it releases it or a newer server acquires it.
+//
+// A listener is only shared to hand it over to a server that replaces all
+// of its holders: one from a newer config, or one updated in place of
+// them. Any other server asking for the same address gets an error, as it
+// would if the address were bound by another process.
+func (p *listenerPool) acquire(proto, addr string, s *DNSServer) (*sharedListener, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := proto + "/" + addr
+	if l, exists := p.listeners[key]; exists && !isEphemeral(addr) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if err := takeOver(l.holders, s); err != nil {
+			return nil, err
+		}
+		l.holders = append(l.holders, s)
+		return l, nil
+	}
+
+	server, err := listen(proto, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &sharedListener{
+		server:  server,
+		holders: []*DNSServer{s},
+	}
+	server.Handler = l
+	server.TsigProvider = l
+
+	if err := serve(server, s.logger); err != nil {
+		closeListener(server)
+		return nil, err
+	}
+
+	// Listeners on an ephemeral port are never shared, so key them by the
+	// address actually bound
+	if isEphemeral(addr) {
+		key = proto + "/" + server.Addr
+	}
+	l.key = key
+	p.listeners[key] = l
+
+	return l, nil
+}
+
+// release drops s as a holder of l. The socket is shut down once no server
+// holds it, waiting up to the server's drain timeout for in-flight queries
+// to finish.
+func (p *listenerPool) release(l *sharedListener, s *DNSServer) error {
+	p.mu.Lock()
+	l.mu.Lock()
+	if len(l.holders) > 1 {
+		for i, holder := range l.holders {
+			if holder == s {
+				l.holders = append(l.holders[:i], l.holders[i+1:]...)
+				break
+			}
+		}
+		l.mu.Unlock()
+		p.mu.Unlock()
+		return nil
+	}
+	// The last holder is kept so that queries already read from the socket
+	// still have a server to answer them while it shuts down
+	l.mu.Unlock()
+	delete(p.listeners, l.key)
+	p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+	if err := l.server.ShutdownContext(ctx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			s.logger.Warn("drain timeout reached, dropping in-flight queries",
+				"addr", l.server.Addr, "protocol", l.server.Net, "drain_timeout", s.drainTimeout)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// takeOver returns an error unless s replaces every one of holders, which
+// are about to be stopped.
+func takeOver(holders []*DNSServer, s *DNSServer) error {
+	for _, holder := range holders {
+		if holder.generation < s.generation || holder == s.replaces {
+			continue
+		}
+		return fmt.Errorf("listen address already in use by server %s", holder.name)
+	}
+	return nil
+}
+
+// active returns the server queries are currently dispatched to.
+func (l *sharedListener) active() *DNSServer {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.holders[len(l.holders)-1]
+}
+
+// ServeDNS implements dns.Handler by dispatching to the active server.
+func (l *sharedListener) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	l.active().ServeDNS(w, r)
+}
+
+// Generate implements dns.TsigProvider with the active server's keyring,
+// so that a reload can change the keys of a listener it keeps.
+func (l *sharedListener) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	return l.active().tsig.Generate(msg, t)
+}
+
+// Verify implements dns.TsigProvider with the active server's keyring.
+func (l *sharedListener) Verify(msg []byte, t *dns.TSIG) error {
+	return l.active().tsig.Verify(msg, t)
+}
+
+// checkListen validates a listen address and protocol without binding it.
+func checkListen(proto, addr string) error {
+	var err error
+	switch proto {
+	case "udp", "udp4", "udp6":
+		_, err = net.ResolveUDPAddr(proto, addr)
+	case "tcp", "tcp4", "tcp6":
+		_, err = net.ResolveTCPAddr(proto, addr)
+	default:
+		return fmt.Errorf("unsupported protocol: %s", proto)
+	}
+	return err
+}
+
+// listen binds a single listener and returns a dns.Server ready to serve on it.
+func listen(proto, addr string) (*dns.Server, error) {
+	server := &dns.Server{
+		Net: proto,
+	}
+
+	switch proto {
+	case "udp", "udp4", "udp6":
+		pc, err := net.ListenPacket(proto, addr)
+		if err != nil {
+			return nil, bindError(addr, err)
+		}
+		server.PacketConn = pc
+		server.Addr = pc.LocalAddr().String()
+		// Queries from EDNS clients may be larger than the 512 bytes
+		// the server reads by default
+		server.UDPSize = dns.DefaultMsgSize
+	case "tcp", "tcp4", "tcp6":
+		l, err := net.Listen(proto, addr)
+		if err != nil {
+			return nil, bindError(addr, err)
+		}
+		server.Listener = l
+		server.Addr = l.Addr().String()
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %s", proto)
+	}
+
+	return server, nil
+}
+
+// bindError adds advice on how to fix the common bind failures to err.
+func bindError(addr string, err error) error {
+	if !errors.Is(err, os.ErrPermission) {
+		return err
+	}
+
+	port := addr
+	if _, p, splitErr := net.SplitHostPort(addr); splitErr == nil {
+		port = p
+	}
+	return fmt.Errorf("%w: binding to port %s is not permitted; ports below 1024 "+
+		"need root or the CAP_NET_BIND_SERVICE capability (e.g. setcap "+
+		"cap_net_bind_service=+ep on the binary), or listen on a higher port "+
+		"such as :5353", err, port)
+}
+
+// serve starts serving on a bound listener and waits until it is accepting
+// queries.
+func serve(server *dns.Server, logger *slog.Logger) error {
+	started := make(chan struct{})
+	failed := make(chan error, 1)
+	server.NotifyStartedFunc = func() { close(started) }
+
+	go func() {
+		logger.Info("starting DNS listener", "addr", server.Addr, "protocol", server.Net)
+		if err := server.ActivateAndServe(); err != nil {
+			logger.Error("DNS server error", "addr", server.Addr, "protocol", server.Net, "error", err)
+			failed <- err
+		}
+	}()
+
+	select {
+	case <-started:
+		return nil
+	case err := <-failed:
+		return err
+	}
+}
+
+// closeListener closes the socket of a server that never started serving.
+func closeListener(server *dns.Server) {
+	if server.PacketConn != nil {
+		_ = server.PacketConn.Close()
+	}
+	if server.Listener != nil {
+		_ = server.Listener.Close()
+	}
+}
+
+// isEphemeral reports whether addr asks for a system-assigned port.
+func isEphemeral(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port == "0"
+}
@@ -0,0 +1,358 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+const (
+	// blockedTTL is the TTL of the records in blocked responses.
+	blockedTTL = 60
+	// maxBlocklistSize caps the size of a single list source.
+	maxBlocklistSize = 64 << 20
+	// blocklistFetchTimeout bounds downloading a list from a URL.
+	blocklistFetchTimeout = 30 * time.Second
+)
+
+var blockedTotal = mightydns.NewCounter("mightydns_blocklist_blocked_total",
+	"Queries answered by a blocklist instead of the next handler.")
+
+// hostsAliases are names found in most hosts files that point at the local
+// machine rather than at anything that should be blocked.
+var hostsAliases = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+	"ip6-localnet.":          true,
+	"ip6-mcastprefix.":       true,
+	"ip6-allnodes.":          true,
+	"ip6-allrouters.":        true,
+	"ip6-allhosts.":          true,
+	"0.0.0.0.":               true,
+}
+
+func init() {
+	mightydns.RegisterModule(&Blocklist{})
+}
+
+// Blocklist answers queries for listed domains itself, so that they never
+// reach the next handler. Lists are loaded once, when the module is
+// provisioned, from local files or http(s) URLs. Each line may be in any of
+// the supported formats:
+//
+//   - hosts: "0.0.0.0 ads.example.com" blocks the listed names
+//   - AdBlock: "||ads.example.com^" blocks the domain and its subdomains,
+//     and "@@||ads.example.com^" exempts them again
+//   - a bare domain name, blocked like a hosts entry
+//
+// Comments ("#" or "!") and AdBlock rules that do not apply to whole
+// domains are ignored.
+type Blocklist struct {
+	// Sources are the lists to load: file paths or http(s) URLs.
+	Sources []string `json:"sources,omitempty"`
+	// Domains are blocked along with their subdomains, in addition to the
+	// lists.
+	Domains []string `json:"domains,omitempty"`
+	// Allow lists domains, and their subdomains, that are never blocked
+	// even if a list contains them.
+	Allow []string `json:"allow,omitempty"`
+	// Action is how blocked queries are answered: "nxdomain" (the
+	// default), "null" to answer A and AAAA queries with 0.0.0.0 and ::
+	// and other types with an empty answer, or "refused".
+	Action string          `json:"action,omitempty"`
+	Next   json.RawMessage `json:"next,omitempty"`
+
+	rules  *blockRules
+	next   mightydns.DNSHandler
+	logger *slog.Logger
+}
+
+// blockRules holds the parsed lists. Exact rules match a single name;
+// domain rules also match every name below it.
+type blockRules struct {
+	exact   map[string]bool
+	domains map[string]bool
+	allow   map[string]bool
+}
+
+func newBlockRules() *blockRules {
+	return &blockRules{
+		exact:   make(map[string]bool),
+		domains: make(map[string]bool),
+		allow:   make(map[string]bool),
+	}
+}
+
+func (*Blocklist) MightyModule() mightydns.ModuleInfo {
+	return mightydns.ModuleInfo{
+		ID:  "dns.handler.blocklist",
+		New: func() mightydns.Module { return new(Blocklist) },
+	}
+}
+
+func (b *Blocklist) Provision(ctx mightydns.Context) error {
+	b.logger = ctx.Logger().With("module", "dns.handler.blocklist")
+
+	switch b.Action {
+	case "":
+		b.Action = "nxdomain"
+	case "nxdomain", "null", "refused":
+	default:
+		return fmt.Errorf("invalid action %q: must be nxdomain, null or refused", b.Action)
+	}
+
+	b.rules = newBlockRules()
+	for _, domain := range b.Domains {
+		name, ok := parseDomain(domain)
+		if !ok {
+			return fmt.Errorf("invalid domain %q", domain)
+		}
+		b.rules.domains[name] = true
+	}
+	for _, domain := range b.Allow {
+		name, ok := parseDomain(domain)
+		if !ok {
+			return fmt.Errorf("invalid allowed domain %q", domain)
+		}
+		b.rules.allow[name] = true
+	}
+
+	for _, source := range b.Sources {
+		if ctx.DryRun() {
+			if err := checkBlocklistSource(source); err != nil {
+				return fmt.Errorf("invalid source %s: %w", source, err)
+			}
+			continue
+		}
+		if err := b.load(source); err != nil {
+			return fmt.Errorf("loading source %s: %w", source, err)
+		}
+	}
+
+	next, err := loadNext(ctx, b.Next)
+	if err != nil {
+		return err
+	}
+	b.next = next
+
+	return nil
+}
+
+// checkBlocklistSource checks that a source looks loadable without reading
+// it.
+func checkBlocklistSource(source string) error {
+	if isURLSource(source) {
+		_, err := url.ParseRequestURI(source)
+		return err
+	}
+	_, err := os.Stat(source)
+	return err
+}
+
+func isURLSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// load reads a list from a file or URL and adds its rules.
+func (b *Blocklist) load(source string) error {
+	var r io.ReadCloser
+	if isURLSource(source) {
+		client := &http.Client{Timeout: blocklistFetchTimeout}
+		resp, err := client.Get(source)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		r = f
+	}
+	defer func() { _ = r.Close() }()
+
+	before := b.rules.len()
+	limited := &io.LimitedReader{R: r, N: maxBlocklistSize + 1}
+	if err := b.rules.parse(limited); err != nil {
+		return err
+	}
+	if limited.N <= 0 {
+		return fmt.Errorf("list is larger than %d bytes", maxBlocklistSize)
+	}
+
+	b.logger.Info("loaded blocklist", "source", source, "rules", b.rules.len()-before)
+	return nil
+}
+
+// parse adds the rules of a list in any supported format.
+func (rules *blockRules) parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		if rule, ok := strings.CutPrefix(line, "@@||"); ok {
+			if name, ok := parseAdBlockDomain(rule); ok {
+				rules.allow[name] = true
+			}
+			continue
+		}
+		if rule, ok := strings.CutPrefix(line, "||"); ok {
+			if name, ok := parseAdBlockDomain(rule); ok {
+				rules.domains[name] = true
+			}
+			continue
+		}
+
+		// Hosts files and bare domain lists, with optional trailing comments
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		} else if len(fields) != 1 {
+			continue
+		}
+		for _, field := range fields {
+			if name, ok := parseDomain(field); ok && !hostsAliases[name] {
+				rules.exact[name] = true
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// parseAdBlockDomain returns the domain of an AdBlock rule following "||",
+// if the rule applies to the whole domain: "example.com^", optionally with
+// options after a "$".
+func parseAdBlockDomain(rule string) (string, bool) {
+	rule, _, _ = strings.Cut(rule, "$")
+	domain, ok := strings.CutSuffix(rule, "^")
+	if !ok {
+		domain = rule
+	}
+	if strings.ContainsAny(domain, "/*^|") {
+		return "", false
+	}
+	return parseDomain(domain)
+}
+
+// parseDomain returns domain as a lowercased fully qualified name, if it is
+// a valid domain name.
+func parseDomain(domain string) (string, bool) {
+	if domain == "" || net.ParseIP(domain) != nil {
+		return "", false
+	}
+	name := dns.CanonicalName(domain)
+	if _, ok := dns.IsDomainName(name); !ok || name == "." {
+		return "", false
+	}
+	return name, true
+}
+
+func (rules *blockRules) len() int {
+	return len(rules.exact) + len(rules.domains)
+}
+
+// blocked reports whether name is blocked and not allowed.
+func (rules *blockRules) blocked(name string) bool {
+	name = dns.CanonicalName(name)
+
+	blocked := rules.exact[name]
+	for candidate := name; !blocked; {
+		if rules.domains[candidate] {
+			blocked = true
+		}
+		i, end := dns.NextLabel(candidate, 0)
+		if end {
+			break
+		}
+		candidate = candidate[i:]
+	}
+	if !blocked {
+		return false
+	}
+
+	for candidate := name; ; {
+		if rules.allow[candidate] {
+			return false
+		}
+		i, end := dns.NextLabel(candidate, 0)
+		if end {
+			return true
+		}
+		candidate = candidate[i:]
+	}
+}
+
+// LogValue summarizes the middleware and the handler it wraps for the
+// startup summary log.
+func (b *Blocklist) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("module", "dns.handler.blocklist"),
+		slog.Int("rules", b.rules.len()),
+		slog.String("action", b.Action),
+	}
+	if valuer, ok := b.next.(slog.LogValuer); ok {
+		attrs = append(attrs, slog.Any("next", valuer))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+func (b *Blocklist) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	if len(r.Question) == 0 || !b.rules.blocked(r.Question[0].Name) {
+		return b.next.ServeDNS(ctx, w, r)
+	}
+
+	q := r.Question[0]
+	b.logger.Debug("blocking query",
+		"query_id", r.Id,
+		"query_name", q.Name,
+		"query_type", dns.TypeToString[q.Qtype],
+		"action", b.Action)
+
+	mightydns.AddResolutionStage(ctx, "blocklist")
+	blockedTotal.Inc()
+
+	m := new(dns.Msg)
+	switch b.Action {
+	case "refused":
+		m.SetRcode(r, dns.RcodeRefused)
+	case "null":
+		m.SetReply(r)
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: blockedTTL}
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+		}
+	default:
+		m.SetRcode(r, dns.RcodeNameError)
+	}
+	m.RecursionAvailable = true
+	return w.WriteMsg(m)
+}
@@ -0,0 +1,235 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+const testBlocklist = `# hosts style
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # trailing comment
+::1 ip6-localhost
+
+! AdBlock style
+[Adblock Plus 2.0]
+||adnetwork.example^
+||cdn.example.net^$third-party
+@@||ok.adnetwork.example^
+/banner/*.png
+||example.org/path^
+
+bare.example.com
+`
+
+// writeTestFile writes contents to a file in a temporary directory and
+// returns its path.
+func writeTestFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("writing test file: %v", err)
+	}
+	return path
+}
+
+func TestBlocklist_Registered(t *testing.T) {
+	info, exists := mightydns.GetModule("dns.handler.blocklist")
+	if !exists {
+		t.Fatal("Expected the blocklist to be registered as dns.handler.blocklist")
+	}
+	if _, ok := info.New().(*Blocklist); !ok {
+		t.Errorf("Expected dns.handler.blocklist to create a *Blocklist, got %T", info.New())
+	}
+}
+
+func TestBlocklist_Provision(t *testing.T) {
+	next := json.RawMessage(`{"handler": "test.handler"}`)
+	path := writeTestFile(t, testBlocklist)
+
+	tests := []struct {
+		name    string
+		config  *Blocklist
+		wantErr bool
+	}{
+		{
+			name:   "file source",
+			config: &Blocklist{Sources: []string{path}, Next: next},
+		},
+		{
+			name:   "inline domains",
+			config: &Blocklist{Domains: []string{"example.com"}, Action: "null", Next: next},
+		},
+		{
+			name:    "missing file",
+			config:  &Blocklist{Sources: []string{filepath.Join(t.TempDir(), "missing.txt")}, Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "invalid action",
+			config:  &Blocklist{Action: "drop", Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "invalid domain",
+			config:  &Blocklist{Domains: []string{"192.0.2.1"}, Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "missing next handler",
+			config:  &Blocklist{Domains: []string{"example.com"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Provision(mockContext{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Blocklist.Provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBlocklist_Blocked(t *testing.T) {
+	rules := newBlockRules()
+	if err := rules.parse(strings.NewReader(testBlocklist)); err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "ads.example.com.", want: true},
+		{name: "ADS.Example.COM.", want: true},
+		{name: "tracker.example.com.", want: true},
+		{name: "bare.example.com.", want: true},
+		{name: "sub.ads.example.com.", want: false},
+		{name: "example.com.", want: false},
+		{name: "localhost.", want: false},
+		{name: "adnetwork.example.", want: true},
+		{name: "deep.sub.adnetwork.example.", want: true},
+		{name: "ok.adnetwork.example.", want: false},
+		{name: "www.ok.adnetwork.example.", want: false},
+		{name: "cdn.example.net.", want: true},
+		{name: "example.org.", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules.blocked(tt.name); got != tt.want {
+				t.Errorf("blocked(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlocklist_ServeDNS(t *testing.T) {
+	tests := []struct {
+		name        string
+		action      string
+		qtype       uint16
+		wantRcode   int
+		wantAnswers int
+	}{
+		{name: "nxdomain", action: "", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+		{name: "refused", action: "refused", qtype: dns.TypeA, wantRcode: dns.RcodeRefused},
+		{name: "null A", action: "null", qtype: dns.TypeA, wantAnswers: 1},
+		{name: "null AAAA", action: "null", qtype: dns.TypeAAAA, wantAnswers: 1},
+		{name: "null other type", action: "null", qtype: dns.TypeMX},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Blocklist{
+				Domains: []string{"blocked.example"},
+				Action:  tt.action,
+				Next:    json.RawMessage(`{"handler": "test.handler"}`),
+			}
+			if err := b.Provision(mockContext{}); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+			next := b.next.(*testHandler)
+
+			req := new(dns.Msg)
+			req.SetQuestion("www.blocked.example.", tt.qtype)
+			w := &mockResponseWriter{}
+			if err := b.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+			if next.calls != 0 {
+				t.Errorf("Expected blocked query not to reach the next handler")
+			}
+			if w.msg.Rcode != tt.wantRcode {
+				t.Errorf("Expected rcode %s, got %s", dns.RcodeToString[tt.wantRcode], dns.RcodeToString[w.msg.Rcode])
+			}
+			if len(w.msg.Answer) != tt.wantAnswers {
+				t.Fatalf("Expected %d answers, got %d", tt.wantAnswers, len(w.msg.Answer))
+			}
+			for _, rr := range w.msg.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					if !rr.A.IsUnspecified() {
+						t.Errorf("Expected 0.0.0.0, got %s", rr.A)
+					}
+				case *dns.AAAA:
+					if !rr.AAAA.IsUnspecified() {
+						t.Errorf("Expected ::, got %s", rr.AAAA)
+					}
+				}
+			}
+
+			req = new(dns.Msg)
+			req.SetQuestion("allowed.example.", dns.TypeA)
+			w = &mockResponseWriter{}
+			if err := b.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+			if next.calls != 1 {
+				t.Errorf("Expected unblocked query to reach the next handler")
+			}
+		})
+	}
+}
+
+func TestBlocklist_URLSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/list.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = fmt.Fprintln(w, "||ads.example^")
+	}))
+	defer server.Close()
+
+	b := &Blocklist{
+		Sources: []string{server.URL + "/list.txt"},
+		Next:    json.RawMessage(`{"handler": "test.handler"}`),
+	}
+	if err := b.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if !b.rules.blocked("www.ads.example.") {
+		t.Error("Expected rules from the URL source to be loaded")
+	}
+
+	missing := &Blocklist{
+		Sources: []string{server.URL + "/missing.txt"},
+		Next:    json.RawMessage(`{"handler": "test.handler"}`),
+	}
+	if err := missing.Provision(mockContext{}); err == nil {
+		t.Error("Expected an error for a source that returns 404")
+	}
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+func init() {
+	mightydns.RegisterModule(&Delay{})
+}
+
+// Delay holds every query for a configurable time before passing it to the
+// next handler. It is meant for testing client timeout handling and for
+// chaos testing, not for production use.
+type Delay struct {
+	// Delay is the fixed latency added to every query.
+	Delay string `json:"delay,omitempty"`
+	// Jitter adds a further random latency between zero and this duration.
+	Jitter string          `json:"jitter,omitempty"`
+	Next   json.RawMessage `json:"next,omitempty"`
+
+	delay  time.Duration
+	jitter time.Duration
+	next   mightydns.DNSHandler
+	logger *slog.Logger
+}
+
+func (Delay) MightyModule() mightydns.ModuleInfo {
+	return mightydns.ModuleInfo{
+		ID:  "dns.middleware.delay",
+		New: func() mightydns.Module { return new(Delay) },
+	}
+}
+
+func (d *Delay) Provision(ctx mightydns.Context) error {
+	d.logger = ctx.Logger().With("module", "dns.middleware.delay")
+
+	if d.Delay != "" {
+		delay, err := time.ParseDuration(d.Delay)
+		if err != nil {
+			return fmt.Errorf("invalid delay duration: %w", err)
+		}
+		d.delay = delay
+	}
+
+	if d.Jitter != "" {
+		jitter, err := time.ParseDuration(d.Jitter)
+		if err != nil {
+			return fmt.Errorf("invalid jitter duration: %w", err)
+		}
+		d.jitter = jitter
+	}
+
+	if d.delay < 0 || d.jitter < 0 {
+		return fmt.Errorf("delay and jitter must not be negative")
+	}
+
+	next, err := loadNext(ctx, d.Next)
+	if err != nil {
+		return err
+	}
+	d.next = next
+
+	return nil
+}
+
+// LogValue summarizes the middleware and the handler it wraps for the
+// startup summary log.
+func (d *Delay) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("module", "dns.middleware.delay"),
+		slog.Duration("delay", d.delay),
+		slog.Duration("jitter", d.jitter),
+	}
+	if valuer, ok := d.next.(slog.LogValuer); ok {
+		attrs = append(attrs, slog.Any("next", valuer))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+func (d *Delay) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	wait := d.delay
+	if d.jitter > 0 {
+		wait += rand.N(d.jitter + 1)
+	}
+
+	d.logger.Debug("delaying query",
+		"query_id", r.Id,
+		"delay", wait)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return d.next.ServeDNS(ctx, w, r)
+}
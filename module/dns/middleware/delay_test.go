@@ -0,0 +1,190 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+func init() {
+	mightydns.RegisterModule(&testHandler{})
+}
+
+type mockContext struct{}
+
+func (mockContext) App(name string) (interface{}, error) { return nil, nil }
+func (mockContext) Logger() *slog.Logger                 { return slog.Default() }
+func (c mockContext) LoadModule(cfg interface{}, fieldName string) (interface{}, error) {
+	handlerID, _ := cfg.(map[string]interface{})["handler"].(string)
+	return mightydns.LoadModule(c, cfg, fieldName, handlerID)
+}
+func (mockContext) DryRun() bool { return false }
+
+// testHandler is a registered handler module that answers every query
+// locally and counts how many it has seen.
+type testHandler struct {
+	Rcode int `json:"rcode,omitempty"`
+
+	calls int
+}
+
+func (testHandler) MightyModule() mightydns.ModuleInfo {
+	return mightydns.ModuleInfo{
+		ID:  "test.handler",
+		New: func() mightydns.Module { return new(testHandler) },
+	}
+}
+
+func (h *testHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	h.calls++
+	m := new(dns.Msg)
+	m.SetRcode(r, h.Rcode)
+	return w.WriteMsg(m)
+}
+
+func TestDelay_Provision(t *testing.T) {
+	next := json.RawMessage(`{"handler": "test.handler"}`)
+
+	tests := []struct {
+		name    string
+		config  Delay
+		wantErr bool
+	}{
+		{
+			name:   "fixed delay",
+			config: Delay{Delay: "10ms", Next: next},
+		},
+		{
+			name:   "jittered delay",
+			config: Delay{Delay: "10ms", Jitter: "5ms", Next: next},
+		},
+		{
+			name:    "invalid delay",
+			config:  Delay{Delay: "invalid", Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "negative jitter",
+			config:  Delay{Jitter: "-5ms", Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "missing next handler",
+			config:  Delay{Delay: "10ms"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown next handler",
+			config:  Delay{Next: json.RawMessage(`{"handler": "does.not.exist"}`)},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Provision(mockContext{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Delay.Provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDelay_ServeDNS(t *testing.T) {
+	tests := []struct {
+		name   string
+		delay  string
+		jitter string
+		min    time.Duration
+		max    time.Duration
+	}{
+		{name: "fixed", delay: "50ms", min: 50 * time.Millisecond, max: 150 * time.Millisecond},
+		{name: "jittered", delay: "20ms", jitter: "30ms", min: 20 * time.Millisecond, max: 150 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Delay{
+				Delay:  tt.delay,
+				Jitter: tt.jitter,
+				Next:   json.RawMessage(`{"handler": "test.handler"}`),
+			}
+			if err := d.Provision(mockContext{}); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			w := &mockResponseWriter{}
+
+			start := time.Now()
+			if err := d.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+			elapsed := time.Since(start)
+
+			if elapsed < tt.min || elapsed > tt.max {
+				t.Errorf("Expected delay between %v and %v, got %v", tt.min, tt.max, elapsed)
+			}
+			if w.msg == nil {
+				t.Error("Expected the next handler to answer")
+			}
+		})
+	}
+}
+
+func TestDelay_ContextCancelled(t *testing.T) {
+	d := &Delay{
+		Delay: "1s",
+		Next:  json.RawMessage(`{"handler": "test.handler"}`),
+	}
+	if err := d.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := &mockResponseWriter{}
+
+	if err := d.ServeDNS(ctx, w, req); err == nil {
+		t.Error("Expected an error when the context is cancelled")
+	}
+	if w.msg != nil {
+		t.Error("Expected no response after the context is cancelled")
+	}
+}
+
+// Mock response writer for testing
+type mockResponseWriter struct {
+	msg    *dns.Msg
+	writes int
+	remote net.Addr
+}
+
+func (m *mockResponseWriter) LocalAddr() net.Addr { return nil }
+func (m *mockResponseWriter) RemoteAddr() net.Addr {
+	if m.remote != nil {
+		return m.remote
+	}
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+}
+func (m *mockResponseWriter) WriteMsg(msg *dns.Msg) error {
+	m.msg = msg
+	m.writes++
+	return nil
+}
+func (m *mockResponseWriter) Write([]byte) (int, error) { return 0, nil }
+func (m *mockResponseWriter) Close() error              { return nil }
+func (m *mockResponseWriter) TsigStatus() error         { return nil }
+func (m *mockResponseWriter) TsigTimersOnly(bool)       {}
+func (m *mockResponseWriter) Hijack()                   {}
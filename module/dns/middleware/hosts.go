@@ -0,0 +1,298 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+const (
+	defaultHostsTTL            = 60
+	defaultHostsReloadInterval = 5 * time.Second
+)
+
+func init() {
+	mightydns.RegisterModule(&Hosts{})
+}
+
+// Hosts answers A, AAAA and PTR queries from hosts files in /etc/hosts
+// format, ahead of the next handler. A and AAAA queries for a name listed
+// in the files are always answered from them, with an empty answer if the
+// name has no address of that family; everything else is passed to the
+// next handler.
+//
+// The files are checked for changes at most once per reload interval, as
+// queries arrive, and reloaded when their modification time changes.
+type Hosts struct {
+	// Files are the hosts files to read. Defaults to /etc/hosts.
+	Files []string `json:"files,omitempty"`
+	// TTL is the TTL of the answers, in seconds. Defaults to 60.
+	TTL uint32 `json:"ttl,omitempty"`
+	// ReloadInterval is how often the files are checked for changes.
+	// Defaults to 5s.
+	ReloadInterval string          `json:"reload_interval,omitempty"`
+	Next           json.RawMessage `json:"next,omitempty"`
+
+	interval time.Duration
+	entries  atomic.Pointer[hostsEntries]
+	modTimes map[string]time.Time
+	checked  time.Time
+	reload   sync.Mutex
+	now      func() time.Time
+	next     mightydns.DNSHandler
+	logger   *slog.Logger
+}
+
+// hostsEntries are the parsed contents of the hosts files.
+type hostsEntries struct {
+	// addrs maps lowercased names to their addresses.
+	addrs map[string][]net.IP
+	// names maps reverse lookup names to the canonical names of the
+	// address.
+	names map[string][]string
+}
+
+func (*Hosts) MightyModule() mightydns.ModuleInfo {
+	return mightydns.ModuleInfo{
+		ID:  "dns.middleware.hosts",
+		New: func() mightydns.Module { return new(Hosts) },
+	}
+}
+
+func (h *Hosts) Provision(ctx mightydns.Context) error {
+	h.logger = ctx.Logger().With("module", "dns.middleware.hosts")
+
+	if len(h.Files) == 0 {
+		h.Files = []string{"/etc/hosts"}
+	}
+	if h.TTL == 0 {
+		h.TTL = defaultHostsTTL
+	}
+
+	h.interval = defaultHostsReloadInterval
+	if h.ReloadInterval != "" {
+		interval, err := time.ParseDuration(h.ReloadInterval)
+		if err != nil {
+			return fmt.Errorf("invalid reload_interval duration: %w", err)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("reload_interval must be positive")
+		}
+		h.interval = interval
+	}
+
+	if ctx.DryRun() {
+		for _, file := range h.Files {
+			if _, err := os.Stat(file); err != nil {
+				return fmt.Errorf("invalid hosts file: %w", err)
+			}
+		}
+	} else if err := h.load(); err != nil {
+		return err
+	}
+
+	next, err := loadNext(ctx, h.Next)
+	if err != nil {
+		return err
+	}
+	h.next = next
+
+	if h.now == nil {
+		h.now = time.Now
+	}
+	h.checked = h.now()
+
+	return nil
+}
+
+// load reads all of the hosts files and replaces the current entries.
+func (h *Hosts) load() error {
+	entries := &hostsEntries{
+		addrs: make(map[string][]net.IP),
+		names: make(map[string][]string),
+	}
+	modTimes := make(map[string]time.Time, len(h.Files))
+
+	for _, file := range h.Files {
+		f, err := os.Open(file)
+		if err != nil {
+			return fmt.Errorf("reading hosts file: %w", err)
+		}
+		info, err := f.Stat()
+		if err == nil {
+			err = entries.parse(f)
+		}
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("reading hosts file %s: %w", file, err)
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	h.entries.Store(entries)
+	h.modTimes = modTimes
+	return nil
+}
+
+// parse adds the entries of a hosts file.
+func (e *hostsEntries) parse(f *os.File) error {
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		// Zone indexes such as fe80::1%eth0 cannot be answered in DNS
+		addr, _, _ := strings.Cut(fields[0], "%")
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		var canonical string
+		for _, field := range fields[1:] {
+			name := dns.CanonicalName(field)
+			if _, ok := dns.IsDomainName(name); !ok {
+				continue
+			}
+			if canonical == "" {
+				canonical = name
+			}
+			e.addrs[name] = append(e.addrs[name], ip)
+		}
+		if canonical == "" {
+			continue
+		}
+
+		reverse, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+		e.names[reverse] = append(e.names[reverse], canonical)
+	}
+	return scanner.Err()
+}
+
+// checkReload reloads the files if any has changed since they were last
+// read, at most once per interval. Only one query checks at a time; the
+// others carry on with the current entries.
+func (h *Hosts) checkReload() {
+	if !h.reload.TryLock() {
+		return
+	}
+	defer h.reload.Unlock()
+
+	now := h.now()
+	if now.Sub(h.checked) < h.interval {
+		return
+	}
+	h.checked = now
+
+	changed := false
+	for _, file := range h.Files {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(h.modTimes[file]) {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return
+	}
+
+	if err := h.load(); err != nil {
+		h.logger.Warn("failed to reload hosts files, keeping previous entries", "error", err)
+		return
+	}
+	h.logger.Info("reloaded hosts files", "files", h.Files)
+}
+
+// LogValue summarizes the middleware and the handler it wraps for the
+// startup summary log.
+func (h *Hosts) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("module", "dns.middleware.hosts"),
+		slog.Any("files", h.Files),
+	}
+	if entries := h.entries.Load(); entries != nil {
+		attrs = append(attrs, slog.Int("names", len(entries.addrs)))
+	}
+	if valuer, ok := h.next.(slog.LogValuer); ok {
+		attrs = append(attrs, slog.Any("next", valuer))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+func (h *Hosts) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	if len(r.Question) == 0 {
+		return h.next.ServeDNS(ctx, w, r)
+	}
+
+	h.checkReload()
+	entries := h.entries.Load()
+	if entries == nil {
+		return h.next.ServeDNS(ctx, w, r)
+	}
+
+	q := r.Question[0]
+	name := dns.CanonicalName(q.Name)
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: h.TTL}
+
+	var answer []dns.RR
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		addrs, ok := entries.addrs[name]
+		if !ok {
+			return h.next.ServeDNS(ctx, w, r)
+		}
+		for _, ip := range addrs {
+			switch {
+			case q.Qtype == dns.TypeA && len(ip) == net.IPv4len:
+				answer = append(answer, &dns.A{Hdr: hdr, A: ip})
+			case q.Qtype == dns.TypeAAAA && len(ip) == net.IPv6len:
+				answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	case dns.TypePTR:
+		names, ok := entries.names[name]
+		if !ok {
+			return h.next.ServeDNS(ctx, w, r)
+		}
+		for _, target := range names {
+			answer = append(answer, &dns.PTR{Hdr: hdr, Ptr: target})
+		}
+	default:
+		return h.next.ServeDNS(ctx, w, r)
+	}
+
+	h.logger.Debug("answering from hosts files",
+		"query_id", r.Id,
+		"query_name", q.Name,
+		"query_type", dns.TypeToString[q.Qtype],
+		"answers", len(answer))
+
+	mightydns.AddResolutionStage(ctx, "hosts")
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.RecursionAvailable = true
+	m.Answer = answer
+	return w.WriteMsg(m)
+}
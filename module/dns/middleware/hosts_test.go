@@ -0,0 +1,182 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testHostsFile = `# Static hosts
+127.0.0.1   localhost
+192.168.1.10 nas.lan nas   # storage
+192.168.1.11 printer.lan
+fe80::1%eth0 router.lan
+2001:db8::10 nas.lan
+not-an-ip    broken.lan
+`
+
+func TestHosts_Provision(t *testing.T) {
+	next := json.RawMessage(`{"handler": "test.handler"}`)
+	path := writeTestFile(t, testHostsFile)
+
+	tests := []struct {
+		name    string
+		config  *Hosts
+		wantErr bool
+	}{
+		{
+			name:   "hosts file",
+			config: &Hosts{Files: []string{path}, TTL: 300, ReloadInterval: "1m", Next: next},
+		},
+		{
+			name:    "missing file",
+			config:  &Hosts{Files: []string{filepath.Join(t.TempDir(), "hosts")}, Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "invalid reload interval",
+			config:  &Hosts{Files: []string{path}, ReloadInterval: "often", Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "missing next handler",
+			config:  &Hosts{Files: []string{path}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Provision(mockContext{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Hosts.Provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHosts_ServeDNS(t *testing.T) {
+	h := &Hosts{
+		Files: []string{writeTestFile(t, testHostsFile)},
+		// The next handler answers NXDOMAIN, so any other rcode proves
+		// the hosts files answered
+		Next: json.RawMessage(`{"handler": "test.handler", "rcode": 3}`),
+	}
+	if err := h.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		wantRcode int
+		want      []string
+	}{
+		{name: "A", qname: "nas.lan.", qtype: dns.TypeA, want: []string{"192.168.1.10"}},
+		{name: "alias", qname: "NAS.", qtype: dns.TypeA, want: []string{"192.168.1.10"}},
+		{name: "AAAA", qname: "nas.lan.", qtype: dns.TypeAAAA, want: []string{"2001:db8::10"}},
+		{name: "no address of family", qname: "printer.lan.", qtype: dns.TypeAAAA},
+		{name: "zone index", qname: "router.lan.", qtype: dns.TypeAAAA, want: []string{"fe80::1"}},
+		{name: "PTR", qname: "10.1.168.192.in-addr.arpa.", qtype: dns.TypePTR, want: []string{"nas.lan."}},
+		{name: "IPv6 PTR", qname: "0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", qtype: dns.TypePTR, want: []string{"nas.lan."}},
+		{name: "other type", qname: "nas.lan.", qtype: dns.TypeMX, wantRcode: dns.RcodeNameError},
+		{name: "unlisted name", qname: "other.lan.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+		{name: "invalid address", qname: "broken.lan.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tt.qname, tt.qtype)
+			w := &mockResponseWriter{}
+			if err := h.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+
+			if w.msg.Rcode != tt.wantRcode {
+				t.Fatalf("Expected rcode %s, got %s", dns.RcodeToString[tt.wantRcode], dns.RcodeToString[w.msg.Rcode])
+			}
+			var got []string
+			for _, rr := range w.msg.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					got = append(got, rr.A.String())
+				case *dns.AAAA:
+					got = append(got, rr.AAAA.String())
+				case *dns.PTR:
+					got = append(got, rr.Ptr)
+				}
+				if rr.Header().Name != tt.qname {
+					t.Errorf("Expected answer owner %s, got %s", tt.qname, rr.Header().Name)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Expected answers %v, got %v", tt.want, got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Expected answers %v, got %v", tt.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestHosts_Reload(t *testing.T) {
+	path := writeTestFile(t, "192.168.1.10 nas.lan\n")
+	now := time.Unix(1700000000, 0)
+	h := &Hosts{
+		Files: []string{path},
+		Next:  json.RawMessage(`{"handler": "test.handler", "rcode": 3}`),
+		now:   func() time.Time { return now },
+	}
+	if err := h.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	lookup := func() string {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion("nas.lan.", dns.TypeA)
+		w := &mockResponseWriter{}
+		if err := h.ServeDNS(context.Background(), w, req); err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+		if len(w.msg.Answer) != 1 {
+			t.Fatalf("Expected one answer, got %v", w.msg.Answer)
+		}
+		return w.msg.Answer[0].(*dns.A).A.String()
+	}
+
+	if err := os.WriteFile(path, []byte("192.168.1.20 nas.lan\n"), 0o600); err != nil {
+		t.Fatalf("rewriting hosts file: %v", err)
+	}
+	modified := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatalf("touching hosts file: %v", err)
+	}
+
+	if got := lookup(); got != "192.168.1.10" {
+		t.Errorf("Expected the old address before the reload interval, got %s", got)
+	}
+
+	now = now.Add(defaultHostsReloadInterval)
+	if got := lookup(); got != "192.168.1.20" {
+		t.Errorf("Expected the new address after the reload interval, got %s", got)
+	}
+
+	// A broken reload keeps the previous entries
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("removing hosts file: %v", err)
+	}
+	now = now.Add(defaultHostsReloadInterval)
+	if got := lookup(); got != "192.168.1.20" {
+		t.Errorf("Expected the previous entries to be kept, got %s", got)
+	}
+}
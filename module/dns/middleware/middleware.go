@@ -0,0 +1,39 @@
+// Package middleware provides DNS handlers that wrap another handler,
+// configured through their "next" field, to alter how queries reach it.
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/kusold/mightydns"
+)
+
+// loadNext loads and provisions the handler a middleware wraps, skipping
+// over handlers that are disabled.
+func loadNext(ctx mightydns.Context, raw json.RawMessage) (mightydns.DNSHandler, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("next handler is required")
+	}
+
+	var cfg map[string]interface{}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal next handler config: %w", err)
+	}
+	cfg, err := mightydns.EnabledHandler(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load next handler: %w", err)
+	}
+
+	module, err := ctx.LoadModule(cfg, "next")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load next handler: %w", err)
+	}
+
+	next, ok := module.(mightydns.DNSHandler)
+	if !ok {
+		return nil, fmt.Errorf("next handler %v does not implement DNSHandler", cfg["handler"])
+	}
+
+	return next, nil
+}
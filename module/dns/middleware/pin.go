@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+func init() {
+	mightydns.RegisterModule(&Pin{})
+}
+
+// Pin answers queries for a small set of pinned records directly, ahead of
+// the next handler, so a name can be pinned to a fixed answer without
+// touching the resolver or zone config behind it. Only queries whose name
+// and type both match a pinned record are answered; everything else is
+// passed to the next handler.
+type Pin struct {
+	// Records are the pinned records in zone file format, e.g.
+	// "example.com. 60 IN A 192.0.2.1".
+	Records []string        `json:"records,omitempty"`
+	Next    json.RawMessage `json:"next,omitempty"`
+
+	pins   map[pinKey][]dns.RR
+	next   mightydns.DNSHandler
+	logger *slog.Logger
+}
+
+type pinKey struct {
+	name  string
+	qtype uint16
+}
+
+func (*Pin) MightyModule() mightydns.ModuleInfo {
+	return mightydns.ModuleInfo{
+		ID:  "dns.middleware.pin",
+		New: func() mightydns.Module { return new(Pin) },
+	}
+}
+
+func (p *Pin) Provision(ctx mightydns.Context) error {
+	p.logger = ctx.Logger().With("module", "dns.middleware.pin")
+
+	p.pins = make(map[pinKey][]dns.RR)
+	for _, record := range p.Records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return fmt.Errorf("invalid pinned record %q: %w", record, err)
+		}
+		if rr == nil {
+			return fmt.Errorf("invalid pinned record %q: empty record", record)
+		}
+		key := pinKey{name: strings.ToLower(rr.Header().Name), qtype: rr.Header().Rrtype}
+		p.pins[key] = append(p.pins[key], rr)
+	}
+
+	next, err := loadNext(ctx, p.Next)
+	if err != nil {
+		return err
+	}
+	p.next = next
+
+	return nil
+}
+
+// LogValue summarizes the middleware and the handler it wraps for the
+// startup summary log.
+func (p *Pin) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("module", "dns.middleware.pin"),
+		slog.Int("records", len(p.Records)),
+	}
+	if valuer, ok := p.next.(slog.LogValuer); ok {
+		attrs = append(attrs, slog.Any("next", valuer))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+func (p *Pin) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	if len(r.Question) == 0 {
+		return p.next.ServeDNS(ctx, w, r)
+	}
+
+	q := r.Question[0]
+	pinned, ok := p.pins[pinKey{name: strings.ToLower(q.Name), qtype: q.Qtype}]
+	if !ok {
+		return p.next.ServeDNS(ctx, w, r)
+	}
+
+	p.logger.Debug("answering pinned query",
+		"query_id", r.Id,
+		"query_name", q.Name,
+		"query_type", dns.TypeToString[q.Qtype])
+
+	mightydns.AddResolutionStage(ctx, "pin")
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.RecursionAvailable = true
+	for _, rr := range pinned {
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		m.Answer = append(m.Answer, rr)
+	}
+	return w.WriteMsg(m)
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPin_Provision(t *testing.T) {
+	next := json.RawMessage(`{"handler": "test.handler"}`)
+
+	tests := []struct {
+		name    string
+		config  *Pin
+		wantErr bool
+	}{
+		{
+			name:   "pinned records",
+			config: &Pin{Records: []string{"example.com. 60 IN A 192.0.2.1", "example.com. 60 IN AAAA 2001:db8::1"}, Next: next},
+		},
+		{
+			name:    "invalid record",
+			config:  &Pin{Records: []string{"example.com. IN A not-an-ip"}, Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "missing next handler",
+			config:  &Pin{Records: []string{"example.com. 60 IN A 192.0.2.1"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Provision(mockContext{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Pin.Provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPin_ServeDNS(t *testing.T) {
+	p := &Pin{
+		Records: []string{
+			"pinned.example.com. 60 IN A 192.0.2.1",
+			"pinned.example.com. 60 IN A 192.0.2.2",
+		},
+		// The next handler answers NXDOMAIN, so any answer proves the pin
+		// short-circuited the chain
+		Next: json.RawMessage(`{"handler": "test.handler", "rcode": 3}`),
+	}
+	if err := p.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		qname       string
+		qtype       uint16
+		wantRcode   int
+		wantAnswers int
+	}{
+		{name: "pinned name and type", qname: "pinned.example.com.", qtype: dns.TypeA, wantAnswers: 2},
+		{name: "pinned name in other case", qname: "PINNED.example.com.", qtype: dns.TypeA, wantAnswers: 2},
+		{name: "pinned name with other type", qname: "pinned.example.com.", qtype: dns.TypeAAAA, wantRcode: dns.RcodeNameError},
+		{name: "unpinned name", qname: "other.example.com.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tt.qname, tt.qtype)
+			w := &mockResponseWriter{}
+
+			if err := p.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+
+			if w.msg.Rcode != tt.wantRcode {
+				t.Errorf("Expected rcode %s, got %s", dns.RcodeToString[tt.wantRcode], dns.RcodeToString[w.msg.Rcode])
+			}
+			if len(w.msg.Answer) != tt.wantAnswers {
+				t.Fatalf("Expected %d answers, got %v", tt.wantAnswers, w.msg.Answer)
+			}
+			for _, rr := range w.msg.Answer {
+				if rr.Header().Name != tt.qname {
+					t.Errorf("Expected answer owner %s, got %s", tt.qname, rr.Header().Name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+// queryLogFields are the fields a query log entry can contain, in the
+// order they are written.
+var queryLogFields = []string{
+	"time", "client", "protocol", "qname", "qtype", "rcode", "answers", "latency", "upstream",
+}
+
+func init() {
+	mightydns.RegisterModule(&QueryLog{})
+}
+
+// QueryLog writes a JSON line for every query that passes through it,
+// separately from the application log, so that query history can be kept,
+// rotated and shipped on its own.
+type QueryLog struct {
+	// Output is "stdout" (the default), "stderr" or the path of a file to
+	// append to.
+	Output string `json:"output,omitempty"`
+	// RollSizeMB rotates the output file once it reaches this many
+	// megabytes. Disabled when zero.
+	RollSizeMB int `json:"roll_size_mb,omitempty"`
+	// RollKeep is how many rotated files are kept. Defaults to 5.
+	RollKeep int `json:"roll_keep,omitempty"`
+	// Fields lists the fields written for each query: time, client,
+	// protocol (udp, tcp, dot or doh), qname, qtype, rcode, answers,
+	// latency (in milliseconds) and upstream. Defaults to all of them.
+	Fields []string        `json:"fields,omitempty"`
+	Next   json.RawMessage `json:"next,omitempty"`
+
+	next   mightydns.DNSHandler
+	writer io.Writer
+	mu     sync.Mutex
+}
+
+func (*QueryLog) MightyModule() mightydns.ModuleInfo {
+	return mightydns.ModuleInfo{
+		ID:  "dns.middleware.querylog",
+		New: func() mightydns.Module { return new(QueryLog) },
+	}
+}
+
+func (q *QueryLog) Provision(ctx mightydns.Context) error {
+	if len(q.Fields) == 0 {
+		q.Fields = slices.Clone(queryLogFields)
+	}
+	for _, field := range q.Fields {
+		if !slices.Contains(queryLogFields, field) {
+			return fmt.Errorf("unknown field %q: must be one of %s", field, strings.Join(queryLogFields, ", "))
+		}
+	}
+
+	if q.RollSizeMB < 0 {
+		return fmt.Errorf("roll_size_mb must not be negative")
+	}
+	if q.RollKeep == 0 {
+		q.RollKeep = 5
+	}
+	if q.RollKeep < 0 {
+		return fmt.Errorf("roll_keep must not be negative")
+	}
+
+	next, err := loadNext(ctx, q.Next)
+	if err != nil {
+		return err
+	}
+	q.next = next
+
+	switch q.Output {
+	case "", "stdout":
+		q.Output = "stdout"
+		q.writer = os.Stdout
+	case "stderr":
+		q.writer = os.Stderr
+	default:
+		if ctx.DryRun() {
+			info, err := os.Stat(filepath.Dir(q.Output))
+			if err != nil {
+				return fmt.Errorf("query log output directory: %w", err)
+			}
+			if !info.IsDir() {
+				return fmt.Errorf("query log output directory %s is not a directory", filepath.Dir(q.Output))
+			}
+			return nil
+		}
+		writer, err := openRollingFile(q.Output, int64(q.RollSizeMB)<<20, q.RollKeep)
+		if err != nil {
+			return fmt.Errorf("opening query log: %w", err)
+		}
+		q.writer = writer
+	}
+
+	return nil
+}
+
+func (q *QueryLog) Cleanup() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if file, ok := q.writer.(*rollingFile); ok {
+		return file.Close()
+	}
+	return nil
+}
+
+// LogValue summarizes the middleware and the handler it wraps for the
+// startup summary log.
+func (q *QueryLog) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("module", "dns.middleware.querylog"),
+		slog.String("output", q.Output),
+	}
+	if valuer, ok := q.next.(slog.LogValuer); ok {
+		attrs = append(attrs, slog.Any("next", valuer))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+func (q *QueryLog) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	path, ok := mightydns.ResolutionPathFromContext(ctx)
+	if !ok {
+		ctx, path = mightydns.WithResolutionPath(ctx)
+	}
+
+	recorder := &queryLogRecorder{ResponseWriter: w}
+	start := time.Now()
+	err := q.next.ServeDNS(ctx, recorder, r)
+	latency := time.Since(start)
+
+	rcode := dns.RcodeServerFailure
+	answers := 0
+	if recorder.msg != nil {
+		rcode = recorder.msg.Rcode
+		answers = len(recorder.msg.Answer)
+	}
+
+	q.write(func(field string) any {
+		switch field {
+		case "time":
+			return start.UTC().Format(time.RFC3339Nano)
+		case "client":
+			if host, _, err := net.SplitHostPort(w.RemoteAddr().String()); err == nil {
+				return host
+			}
+			return w.RemoteAddr().String()
+		case "protocol":
+			if transport, ok := mightydns.TransportFromContext(ctx); ok {
+				return transport
+			}
+			if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+				return "udp"
+			}
+			return "tcp"
+		case "qname":
+			if len(r.Question) > 0 {
+				return r.Question[0].Name
+			}
+		case "qtype":
+			if len(r.Question) > 0 {
+				return dns.TypeToString[r.Question[0].Qtype]
+			}
+		case "rcode":
+			return dns.RcodeToString[rcode]
+		case "answers":
+			return answers
+		case "latency":
+			return float64(latency.Microseconds()) / 1000
+		case "upstream":
+			stages := path.Stages()
+			for i := len(stages) - 1; i >= 0; i-- {
+				if upstream, ok := strings.CutPrefix(stages[i], "upstream:"); ok {
+					return upstream
+				}
+			}
+		}
+		return nil
+	})
+
+	return err
+}
+
+// write encodes the configured fields as a JSON line, skipping those
+// without a value, and writes it to the output.
+func (q *QueryLog) write(value func(field string) any) {
+	var line bytes.Buffer
+	line.WriteByte('{')
+	for _, field := range q.Fields {
+		v := value(field)
+		if v == nil {
+			continue
+		}
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		if line.Len() > 1 {
+			line.WriteByte(',')
+		}
+		fmt.Fprintf(&line, "%q:", field)
+		line.Write(encoded)
+	}
+	line.WriteString("}\n")
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, _ = q.writer.Write(line.Bytes())
+}
+
+// queryLogRecorder remembers the response written through it.
+type queryLogRecorder struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *queryLogRecorder) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// rollingFile is a file that is rotated once it grows past a size, keeping
+// a number of old files alongside it as path.1 (the newest), path.2, and
+// so on.
+type rollingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	file *os.File
+	size int64
+}
+
+func openRollingFile(path string, maxSize int64, keep int) (*rollingFile, error) {
+	f := &rollingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rollingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends b to the file, rotating it first if b would take it past
+// its maximum size. Callers serialize writes.
+func (f *rollingFile) Write(b []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the old files along, dropping the oldest, and starts a new
+// file.
+func (f *rollingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	_ = os.Remove(fmt.Sprintf("%s.%d", f.path, f.keep))
+	for i := f.keep - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		// Carry on appending to the current file rather than leaving it
+		// closed, so that a later write can try rotating it again
+		return errors.Join(err, f.open())
+	}
+
+	return f.open()
+}
+
+func (f *rollingFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,282 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+func TestQueryLog_Provision(t *testing.T) {
+	next := json.RawMessage(`{"handler": "test.handler"}`)
+
+	tests := []struct {
+		name    string
+		config  *QueryLog
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			config: &QueryLog{Next: next},
+		},
+		{
+			name:   "file with rotation",
+			config: &QueryLog{Output: filepath.Join(t.TempDir(), "queries.log"), RollSizeMB: 10, Fields: []string{"qname", "rcode"}, Next: next},
+		},
+		{
+			name:    "unknown field",
+			config:  &QueryLog{Fields: []string{"qname", "colour"}, Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "negative roll size",
+			config:  &QueryLog{RollSizeMB: -1, Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "missing directory",
+			config:  &QueryLog{Output: filepath.Join(t.TempDir(), "missing", "queries.log"), Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "missing next handler",
+			config:  &QueryLog{},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Provision(mockContext{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("QueryLog.Provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			_ = tt.config.Cleanup()
+		})
+	}
+}
+
+// upstreamStageHandler answers like an upstream resolver would, recording
+// its resolution stage.
+type upstreamStageHandler struct{}
+
+func (upstreamStageHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	mightydns.AddResolutionStage(ctx, "upstream:192.0.2.53:53")
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNameError)
+	return w.WriteMsg(m)
+}
+
+func TestQueryLog_ServeDNS(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "queries.log")
+	q := &QueryLog{
+		Output: output,
+		Next:   json.RawMessage(`{"handler": "test.handler"}`),
+	}
+	if err := q.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	defer func() { _ = q.Cleanup() }()
+	q.next = upstreamStageHandler{}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeAAAA)
+	w := &mockResponseWriter{}
+	if err := q.ServeDNS(context.Background(), w, req); err != nil {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+	if w.msg == nil || w.msg.Rcode != dns.RcodeNameError {
+		t.Fatal("Expected the next handler's response to be passed on")
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("reading query log: %v", err)
+	}
+	var entry map[string]any
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("query log line %q is not JSON: %v", data, err)
+	}
+
+	want := map[string]any{
+		"client":   "127.0.0.1",
+		"protocol": "udp",
+		"qname":    "example.com.",
+		"qtype":    "AAAA",
+		"rcode":    "NXDOMAIN",
+		"answers":  float64(0),
+		"upstream": "192.0.2.53:53",
+	}
+	for field, value := range want {
+		if entry[field] != value {
+			t.Errorf("Expected %s %v, got %v", field, value, entry[field])
+		}
+	}
+	for _, field := range []string{"time", "latency"} {
+		if _, ok := entry[field]; !ok {
+			t.Errorf("Expected field %s in %s", field, data)
+		}
+	}
+}
+
+func TestQueryLog_Fields(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "queries.log")
+	q := &QueryLog{
+		Output: output,
+		Fields: []string{"qname", "rcode"},
+		Next:   json.RawMessage(`{"handler": "test.handler"}`),
+	}
+	if err := q.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	defer func() { _ = q.Cleanup() }()
+
+	for _, name := range []string{"a.example.", "b.example."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		if err := q.ServeDNS(context.Background(), &mockResponseWriter{}, req); err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("reading query log: %v", err)
+	}
+	want := `{"qname":"a.example.","rcode":"NOERROR"}` + "\n" + `{"qname":"b.example.","rcode":"NOERROR"}` + "\n"
+	if string(data) != want {
+		t.Errorf("Expected query log %q, got %q", want, data)
+	}
+}
+
+func TestQueryLog_Protocol(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "queries.log")
+	q := &QueryLog{
+		Output: output,
+		Fields: []string{"protocol"},
+		Next:   json.RawMessage(`{"handler": "test.handler"}`),
+	}
+	if err := q.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	defer func() { _ = q.Cleanup() }()
+
+	// The transport recorded by the server is logged over the one guessed
+	// from the client's address
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	ctx := mightydns.WithTransport(context.Background(), "doh")
+	if err := q.ServeDNS(ctx, &mockResponseWriter{}, req); err != nil {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("reading query log: %v", err)
+	}
+	if want := `{"protocol":"doh"}` + "\n"; string(data) != want {
+		t.Errorf("Expected query log %q, got %q", want, data)
+	}
+}
+
+func TestRollingFile_Rotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.log")
+	f, err := openRollingFile(path, 20, 2)
+	if err != nil {
+		t.Fatalf("openRollingFile failed: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	// Each line fills a file, so every write after the first rotates
+	for _, line := range []string{"first line 0123456\n", "second line 012345\n", "third line 0123456\n", "fourth line 012345\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	files := map[string]string{
+		path:        "fourth",
+		path + ".1": "third",
+		path + ".2": "second",
+	}
+	for file, want := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading %s: %v", file, err)
+		}
+		if !strings.HasPrefix(string(data), want) {
+			t.Errorf("Expected %s to hold the %s line, got %q", filepath.Base(file), want, data)
+		}
+		if lines := countLines(t, file); lines != 1 {
+			t.Errorf("Expected 1 line in %s, got %d", filepath.Base(file), lines)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Expected only roll_keep old files to be kept")
+	}
+}
+
+func TestRollingFile_RotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.log")
+	f, err := openRollingFile(path, 20, 1)
+	if err != nil {
+		t.Fatalf("openRollingFile failed: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	// A non-empty directory in the way of the rotated file makes the
+	// rotation fail
+	blocker := filepath.Join(path+".1", "blocker")
+	if err := os.MkdirAll(blocker, 0o700); err != nil {
+		t.Fatalf("creating %s: %v", blocker, err)
+	}
+
+	if _, err := f.Write([]byte("first line 0123456\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := f.Write([]byte("second line 012345\n")); err == nil {
+		t.Fatal("Expected the rotation to fail")
+	}
+
+	// Once the obstacle is gone the file is still open for writing, and
+	// rotates as usual
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatalf("removing %s.1: %v", path, err)
+	}
+	if _, err := f.Write([]byte("third line 0123456\n")); err != nil {
+		t.Fatalf("Write after failed rotation failed: %v", err)
+	}
+
+	for file, want := range map[string]string{path: "third", path + ".1": "first"} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading %s: %v", file, err)
+		}
+		if !strings.HasPrefix(string(data), want) {
+			t.Errorf("Expected %s to hold the %s line, got %q", filepath.Base(file), want, data)
+		}
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
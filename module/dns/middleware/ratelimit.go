@@ -0,0 +1,214 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+var throttledTotal = mightydns.NewCounter("mightydns_ratelimit_throttled_total",
+	"Queries rejected by a rate limit, by action.", "action")
+
+func init() {
+	mightydns.RegisterModule(&RateLimit{})
+}
+
+// RateLimit limits the queries each client may send, using a token bucket
+// per source address: a client may send Burst queries at once, and then
+// QueriesPerSecond on average. Queries above the limit are refused or
+// dropped without reaching the next handler.
+//
+// Unlike RRL it keys on the client alone, so it applies to every transport
+// and to any mix of questions.
+type RateLimit struct {
+	// QueriesPerSecond is the sustained rate each client may query at.
+	QueriesPerSecond float64 `json:"queries_per_second,omitempty"`
+	// Burst is the number of queries a client may send at once after being
+	// idle. Defaults to QueriesPerSecond, rounded up.
+	Burst int `json:"burst,omitempty"`
+	// IPv4Prefix and IPv6Prefix set the size of the client networks that
+	// share a limit. They default to 32 and 128, a limit per address.
+	IPv4Prefix int `json:"ipv4_prefix,omitempty"`
+	IPv6Prefix int `json:"ipv6_prefix,omitempty"`
+	// Action is what happens to queries above the limit: "refused"
+	// (default) replies with REFUSED, and "drop" sends nothing.
+	Action string          `json:"action,omitempty"`
+	Next   json.RawMessage `json:"next,omitempty"`
+
+	next    mightydns.DNSHandler
+	logger  *slog.Logger
+	now     func() time.Time
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// tokenBucket holds a client's remaining queries as of last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (*RateLimit) MightyModule() mightydns.ModuleInfo {
+	return mightydns.ModuleInfo{
+		ID:  "dns.middleware.ratelimit",
+		New: func() mightydns.Module { return new(RateLimit) },
+	}
+}
+
+func (rl *RateLimit) Provision(ctx mightydns.Context) error {
+	rl.logger = ctx.Logger().With("module", "dns.middleware.ratelimit")
+
+	if rl.QueriesPerSecond <= 0 {
+		return fmt.Errorf("queries_per_second must be positive")
+	}
+	if rl.Burst == 0 {
+		rl.Burst = int(rl.QueriesPerSecond)
+		if float64(rl.Burst) < rl.QueriesPerSecond {
+			rl.Burst++
+		}
+	}
+	if rl.Burst < 0 {
+		return fmt.Errorf("burst must be positive")
+	}
+
+	if rl.IPv4Prefix == 0 {
+		rl.IPv4Prefix = 32
+	}
+	if rl.IPv4Prefix < 0 || rl.IPv4Prefix > 32 {
+		return fmt.Errorf("ipv4_prefix must be between 0 and 32")
+	}
+	if rl.IPv6Prefix == 0 {
+		rl.IPv6Prefix = 128
+	}
+	if rl.IPv6Prefix < 0 || rl.IPv6Prefix > 128 {
+		return fmt.Errorf("ipv6_prefix must be between 0 and 128")
+	}
+
+	switch rl.Action {
+	case "":
+		rl.Action = "refused"
+	case "refused", "drop":
+	default:
+		return fmt.Errorf("invalid action %q: must be refused or drop", rl.Action)
+	}
+
+	next, err := loadNext(ctx, rl.Next)
+	if err != nil {
+		return err
+	}
+	rl.next = next
+
+	if rl.now == nil {
+		rl.now = time.Now
+	}
+	rl.buckets = make(map[string]*tokenBucket)
+
+	return nil
+}
+
+// LogValue summarizes the middleware and the handler it wraps for the
+// startup summary log.
+func (rl *RateLimit) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("module", "dns.middleware.ratelimit"),
+		slog.Float64("queries_per_second", rl.QueriesPerSecond),
+		slog.Int("burst", rl.Burst),
+		slog.String("action", rl.Action),
+	}
+	if valuer, ok := rl.next.(slog.LogValuer); ok {
+		attrs = append(attrs, slog.Any("next", valuer))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+func (rl *RateLimit) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	client := rl.clientKey(w.RemoteAddr())
+	if rl.allow(client) {
+		return rl.next.ServeDNS(ctx, w, r)
+	}
+
+	rl.logger.Debug("query rate limited",
+		"client", w.RemoteAddr().String(),
+		"query_id", r.Id,
+		"action", rl.Action)
+
+	mightydns.AddResolutionStage(ctx, "ratelimit")
+	throttledTotal.Inc(rl.Action)
+
+	if rl.Action == "drop" {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeRefused)
+	return w.WriteMsg(m)
+}
+
+// allow takes a token from the given client's bucket, reporting whether
+// one was available.
+func (rl *RateLimit) allow(key string) bool {
+	now := rl.now()
+	refill := time.Duration(float64(rl.Burst) / rl.QueriesPerSecond * float64(time.Second))
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	// Forget clients whose buckets have refilled, at most once per refill
+	// period
+	if now.Sub(rl.swept) >= refill {
+		for k, b := range rl.buckets {
+			if now.Sub(b.last) >= refill {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.swept = now
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(rl.Burst), last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = min(float64(rl.Burst), b.tokens+now.Sub(b.last).Seconds()*rl.QueriesPerSecond)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// clientKey returns the client network a source address belongs to.
+func (rl *RateLimit) clientKey(addr net.Addr) string {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return addr.String()
+		}
+		ip = net.ParseIP(host)
+		if ip == nil {
+			return host
+		}
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(rl.IPv4Prefix, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(rl.IPv6Prefix, 128)).String()
+}
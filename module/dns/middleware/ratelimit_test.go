@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRateLimit_Provision(t *testing.T) {
+	next := json.RawMessage(`{"handler": "test.handler"}`)
+
+	tests := []struct {
+		name      string
+		config    *RateLimit
+		wantErr   bool
+		wantBurst int
+	}{
+		{
+			name:      "defaults",
+			config:    &RateLimit{QueriesPerSecond: 2.5, Next: next},
+			wantBurst: 3,
+		},
+		{
+			name:      "drop action with burst",
+			config:    &RateLimit{QueriesPerSecond: 10, Burst: 50, Action: "drop", Next: next},
+			wantBurst: 50,
+		},
+		{
+			name:    "missing rate",
+			config:  &RateLimit{Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "negative burst",
+			config:  &RateLimit{QueriesPerSecond: 10, Burst: -1, Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "invalid ipv6 prefix",
+			config:  &RateLimit{QueriesPerSecond: 10, IPv6Prefix: 129, Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "invalid action",
+			config:  &RateLimit{QueriesPerSecond: 10, Action: "truncate", Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "missing next handler",
+			config:  &RateLimit{QueriesPerSecond: 10},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Provision(mockContext{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RateLimit.Provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tt.config.Burst != tt.wantBurst {
+				t.Errorf("Expected burst %d, got %d", tt.wantBurst, tt.config.Burst)
+			}
+		})
+	}
+}
+
+func TestRateLimit_ThrottlesClients(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	rl := &RateLimit{
+		QueriesPerSecond: 2,
+		Burst:            3,
+		Next:             json.RawMessage(`{"handler": "test.handler"}`),
+		now:              func() time.Time { return now },
+	}
+	if err := rl.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	query := func(remote net.Addr) int {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		w := &mockResponseWriter{remote: remote}
+		if err := rl.ServeDNS(context.Background(), w, req); err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+		return w.msg.Rcode
+	}
+
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5300}
+	sameHostTCP := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 41000}
+	neighbour := &net.UDPAddr{IP: net.ParseIP("192.0.2.20"), Port: 5300}
+
+	for i := 0; i < 3; i++ {
+		if rcode := query(client); rcode != dns.RcodeSuccess {
+			t.Fatalf("Expected query %d within the burst to be answered, got %s", i+1, dns.RcodeToString[rcode])
+		}
+	}
+
+	// The bucket is empty, whichever transport the client uses
+	for _, remote := range []net.Addr{client, sameHostTCP} {
+		if rcode := query(remote); rcode != dns.RcodeRefused {
+			t.Errorf("Expected query from %s over the limit to be refused, got %s", remote, dns.RcodeToString[rcode])
+		}
+	}
+
+	// Other addresses have their own buckets
+	if rcode := query(neighbour); rcode != dns.RcodeSuccess {
+		t.Error("Expected a query from another client to be answered")
+	}
+
+	// Tokens refill at the configured rate
+	now = now.Add(500 * time.Millisecond)
+	if rcode := query(client); rcode != dns.RcodeSuccess {
+		t.Error("Expected a query to be answered after a token refilled")
+	}
+	if rcode := query(client); rcode != dns.RcodeRefused {
+		t.Error("Expected the refilled token to be used up")
+	}
+
+	if got := throttledTotal.Value("refused"); got < 3 {
+		t.Errorf("Expected throttled queries to be counted, got %v", got)
+	}
+}
+
+func TestRateLimit_DropAction(t *testing.T) {
+	rl := &RateLimit{
+		QueriesPerSecond: 1,
+		Action:           "drop",
+		Next:             json.RawMessage(`{"handler": "test.handler"}`),
+	}
+	if err := rl.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := &mockResponseWriter{}
+	for i := 0; i < 3; i++ {
+		if err := rl.ServeDNS(context.Background(), w, req); err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+	}
+
+	if w.writes != 1 {
+		t.Errorf("Expected excess queries to be dropped, got %d writes", w.writes)
+	}
+}
@@ -0,0 +1,230 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+const (
+	defaultRRLWindow     = time.Second
+	defaultRRLIPv4Prefix = 24
+	defaultRRLIPv6Prefix = 56
+)
+
+func init() {
+	mightydns.RegisterModule(&RRL{})
+}
+
+// RRL implements response rate limiting, as in BIND: identical responses
+// sent to the same client network are limited to a number per window, so
+// that the server cannot be used to amplify reflection attacks with spoofed
+// source addresses. Unlike query rate limiting it keys on the response, so a
+// client asking many different questions is not throttled.
+//
+// Only UDP responses are limited, since TCP clients cannot spoof their
+// source address.
+type RRL struct {
+	// ResponsesPerWindow is the number of identical responses a client
+	// network may receive per window before excess responses are limited.
+	ResponsesPerWindow int `json:"responses_per_window,omitempty"`
+	// Window is the period over which responses are counted. Defaults to 1s.
+	Window string `json:"window,omitempty"`
+	// IPv4Prefix and IPv6Prefix set the size of the client networks that
+	// share a limit. They default to 24 and 56.
+	IPv4Prefix int `json:"ipv4_prefix,omitempty"`
+	IPv6Prefix int `json:"ipv6_prefix,omitempty"`
+	// Action is what happens to excess responses: "truncate" (default)
+	// replies with an empty truncated response so legitimate clients retry
+	// over TCP, and "drop" sends nothing.
+	Action string          `json:"action,omitempty"`
+	Next   json.RawMessage `json:"next,omitempty"`
+
+	window  time.Duration
+	next    mightydns.DNSHandler
+	logger  *slog.Logger
+	now     func() time.Time
+	mu      sync.Mutex
+	buckets map[string]*rrlBucket
+	swept   time.Time
+}
+
+// rrlBucket counts identical responses within the current window.
+type rrlBucket struct {
+	start time.Time
+	count int
+}
+
+func (*RRL) MightyModule() mightydns.ModuleInfo {
+	return mightydns.ModuleInfo{
+		ID:  "dns.middleware.rrl",
+		New: func() mightydns.Module { return new(RRL) },
+	}
+}
+
+func (rl *RRL) Provision(ctx mightydns.Context) error {
+	rl.logger = ctx.Logger().With("module", "dns.middleware.rrl")
+
+	if rl.ResponsesPerWindow <= 0 {
+		return fmt.Errorf("responses_per_window must be positive")
+	}
+
+	rl.window = defaultRRLWindow
+	if rl.Window != "" {
+		window, err := time.ParseDuration(rl.Window)
+		if err != nil {
+			return fmt.Errorf("invalid window duration: %w", err)
+		}
+		if window <= 0 {
+			return fmt.Errorf("window must be positive")
+		}
+		rl.window = window
+	}
+
+	if rl.IPv4Prefix == 0 {
+		rl.IPv4Prefix = defaultRRLIPv4Prefix
+	}
+	if rl.IPv4Prefix < 0 || rl.IPv4Prefix > 32 {
+		return fmt.Errorf("ipv4_prefix must be between 0 and 32")
+	}
+	if rl.IPv6Prefix == 0 {
+		rl.IPv6Prefix = defaultRRLIPv6Prefix
+	}
+	if rl.IPv6Prefix < 0 || rl.IPv6Prefix > 128 {
+		return fmt.Errorf("ipv6_prefix must be between 0 and 128")
+	}
+
+	switch rl.Action {
+	case "":
+		rl.Action = "truncate"
+	case "truncate", "drop":
+	default:
+		return fmt.Errorf("invalid action %q: must be truncate or drop", rl.Action)
+	}
+
+	next, err := loadNext(ctx, rl.Next)
+	if err != nil {
+		return err
+	}
+	rl.next = next
+
+	if rl.now == nil {
+		rl.now = time.Now
+	}
+	rl.buckets = make(map[string]*rrlBucket)
+
+	return nil
+}
+
+// LogValue summarizes the middleware and the handler it wraps for the
+// startup summary log.
+func (rl *RRL) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("module", "dns.middleware.rrl"),
+		slog.Int("responses_per_window", rl.ResponsesPerWindow),
+		slog.Duration("window", rl.window),
+		slog.String("action", rl.Action),
+	}
+	if valuer, ok := rl.next.(slog.LogValuer); ok {
+		attrs = append(attrs, slog.Any("next", valuer))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+func (rl *RRL) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+		return rl.next.ServeDNS(ctx, w, r)
+	}
+	return rl.next.ServeDNS(ctx, &rrlWriter{ResponseWriter: w, rrl: rl}, r)
+}
+
+// allow records a response for the given key and reports whether it is
+// within the limit.
+func (rl *RRL) allow(key string) bool {
+	now := rl.now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	// Forget clients whose windows have ended, at most once per window
+	if now.Sub(rl.swept) >= rl.window {
+		for k, b := range rl.buckets {
+			if now.Sub(b.start) >= rl.window {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.swept = now
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok || now.Sub(b.start) >= rl.window {
+		b = &rrlBucket{start: now}
+		rl.buckets[key] = b
+	}
+	b.count++
+
+	return b.count <= rl.ResponsesPerWindow
+}
+
+// responseKey identifies identical responses to one client network.
+func (rl *RRL) responseKey(addr net.Addr, m *dns.Msg) string {
+	var network string
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		if ip4 := udpAddr.IP.To4(); ip4 != nil {
+			network = ip4.Mask(net.CIDRMask(rl.IPv4Prefix, 32)).String()
+		} else {
+			network = udpAddr.IP.Mask(net.CIDRMask(rl.IPv6Prefix, 128)).String()
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(network)
+	b.WriteByte('|')
+	b.WriteString(dns.RcodeToString[m.Rcode])
+	if len(m.Question) > 0 {
+		q := m.Question[0]
+		b.WriteByte('|')
+		b.WriteString(strings.ToLower(q.Name))
+		b.WriteByte('|')
+		b.WriteString(dns.TypeToString[q.Qtype])
+	}
+	return b.String()
+}
+
+// rrlWriter applies the response rate limit to the responses written by the
+// next handler.
+type rrlWriter struct {
+	dns.ResponseWriter
+	rrl *RRL
+}
+
+func (w *rrlWriter) WriteMsg(m *dns.Msg) error {
+	key := w.rrl.responseKey(w.RemoteAddr(), m)
+	if w.rrl.allow(key) {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+
+	w.rrl.logger.Debug("response rate limited",
+		"client", w.RemoteAddr().String(),
+		"query_id", m.Id,
+		"action", w.rrl.Action)
+
+	if w.rrl.Action == "drop" {
+		return nil
+	}
+
+	truncated := new(dns.Msg)
+	truncated.SetReply(m)
+	truncated.Rcode = m.Rcode
+	truncated.Truncated = true
+	return w.ResponseWriter.WriteMsg(truncated)
+}
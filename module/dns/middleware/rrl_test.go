@@ -0,0 +1,170 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRRL_Provision(t *testing.T) {
+	next := json.RawMessage(`{"handler": "test.handler"}`)
+
+	tests := []struct {
+		name    string
+		config  *RRL
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			config: &RRL{ResponsesPerWindow: 5, Next: next},
+		},
+		{
+			name:   "drop action",
+			config: &RRL{ResponsesPerWindow: 5, Window: "10s", Action: "drop", Next: next},
+		},
+		{
+			name:    "missing limit",
+			config:  &RRL{Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "invalid window",
+			config:  &RRL{ResponsesPerWindow: 5, Window: "invalid", Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "invalid ipv4 prefix",
+			config:  &RRL{ResponsesPerWindow: 5, IPv4Prefix: 33, Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "invalid action",
+			config:  &RRL{ResponsesPerWindow: 5, Action: "block", Next: next},
+			wantErr: true,
+		},
+		{
+			name:    "missing next handler",
+			config:  &RRL{ResponsesPerWindow: 5},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Provision(mockContext{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RRL.Provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRRL_ThrottlesIdenticalResponses(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	rl := &RRL{
+		ResponsesPerWindow: 2,
+		Next:               json.RawMessage(`{"handler": "test.handler"}`),
+		now:                func() time.Time { return now },
+	}
+	if err := rl.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	query := func(name string, remote net.Addr) *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		w := &mockResponseWriter{remote: remote}
+		if err := rl.ServeDNS(context.Background(), w, req); err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+		return w.msg
+	}
+
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5300}
+	neighbour := &net.UDPAddr{IP: net.ParseIP("192.0.2.20"), Port: 5300}
+	other := &net.UDPAddr{IP: net.ParseIP("198.51.100.10"), Port: 5300}
+
+	for i := 0; i < 2; i++ {
+		if resp := query("example.com.", client); resp == nil || resp.Truncated {
+			t.Fatalf("Expected response %d within the limit to be sent in full", i+1)
+		}
+	}
+
+	// The same response to the same /24 is now limited
+	for _, remote := range []net.Addr{client, neighbour} {
+		resp := query("example.com.", remote)
+		if resp == nil || !resp.Truncated {
+			t.Errorf("Expected a truncated response to %s over the limit", remote)
+		}
+		if resp != nil && len(resp.Question) != 1 {
+			t.Errorf("Expected the truncated response to keep its question")
+		}
+	}
+
+	// Different responses and other networks have their own limits
+	if resp := query("other.example.com.", client); resp == nil || resp.Truncated {
+		t.Error("Expected a different response to the same client to be sent in full")
+	}
+	if resp := query("example.com.", other); resp == nil || resp.Truncated {
+		t.Error("Expected the same response to another network to be sent in full")
+	}
+
+	// A new window resets the limit
+	now = now.Add(time.Second)
+	if resp := query("example.com.", client); resp == nil || resp.Truncated {
+		t.Error("Expected the limit to reset in the next window")
+	}
+}
+
+func TestRRL_DropAction(t *testing.T) {
+	rl := &RRL{
+		ResponsesPerWindow: 1,
+		Action:             "drop",
+		Next:               json.RawMessage(`{"handler": "test.handler"}`),
+	}
+	if err := rl.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := &mockResponseWriter{}
+	for i := 0; i < 3; i++ {
+		if err := rl.ServeDNS(context.Background(), w, req); err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+	}
+
+	if w.writes != 1 {
+		t.Errorf("Expected excess responses to be dropped, got %d writes", w.writes)
+	}
+}
+
+func TestRRL_IgnoresTCP(t *testing.T) {
+	rl := &RRL{
+		ResponsesPerWindow: 1,
+		Action:             "drop",
+		Next:               json.RawMessage(`{"handler": "test.handler"}`),
+	}
+	if err := rl.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := &mockResponseWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5300}}
+	for i := 0; i < 3; i++ {
+		if err := rl.ServeDNS(context.Background(), w, req); err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+	}
+
+	if w.writes != 3 {
+		t.Errorf("Expected every TCP response to be sent, got %d writes", w.writes)
+	}
+}
@@ -0,0 +1,81 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// flightGroup coalesces identical upstream exchanges that are in flight at
+// the same time into one, so that a burst of clients asking the same
+// question sends a single query upstream.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is an exchange in progress, and its result once done is closed.
+type flight struct {
+	done    chan struct{}
+	waiters int
+
+	resp *dns.Msg
+	rtt  time.Duration
+	err  error
+}
+
+// flightKey identifies an exchange: the upstream and the query as sent,
+// ignoring its ID. Anything else that can change the answer, such as the
+// DO and CD bits or an ECS option, is part of the query.
+func flightKey(query *dns.Msg, upstream string) (string, bool) {
+	keyed := query.Copy()
+	keyed.Id = 0
+	packed, err := keyed.Pack()
+	if err != nil {
+		return "", false
+	}
+	return upstream + "|" + string(packed), true
+}
+
+// do runs exchange, unless an identical one is already in flight, in which
+// case it waits for that one's result. Every caller gets its own copy of
+// the response, as they go on to modify it. The shared exchange is not
+// cancelled when the caller that started it gives up, since others may
+// still be waiting for it.
+func (g *flightGroup) do(ctx context.Context, key string, exchange func(context.Context) (*dns.Msg, time.Duration, error)) (*dns.Msg, time.Duration, error) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		f.waiters++
+		g.mu.Unlock()
+		upstreamCoalescedTotal.Inc()
+
+		select {
+		case <-f.done:
+			if f.resp != nil {
+				return f.resp.Copy(), f.rtt, f.err
+			}
+			return nil, f.rtt, f.err
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	f.resp, f.rtt, f.err = exchange(context.WithoutCancel(ctx))
+
+	g.mu.Lock()
+	delete(g.flights, key)
+	shared := f.waiters > 0
+	g.mu.Unlock()
+	close(f.done)
+
+	if shared && f.resp != nil {
+		return f.resp.Copy(), f.rtt, f.err
+	}
+	return f.resp, f.rtt, f.err
+}
@@ -0,0 +1,97 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamResolver_Coalesce(t *testing.T) {
+	tests := []struct {
+		name        string
+		coalesce    bool
+		wantQueries int32
+	}{
+		{name: "coalesced", coalesce: true, wantQueries: 2},
+		{name: "not coalesced", coalesce: false, wantQueries: 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queries atomic.Int32
+			addr := startTestUpstream(t, answerAfter(100*time.Millisecond, dns.RcodeSuccess, "192.0.2.1", &queries))
+
+			u := &UpstreamResolver{Upstreams: []string{addr}, Coalesce: tt.coalesce}
+			if err := u.Provision(mockContext{}); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+
+			// Ten clients each ask two questions at once
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					qtype := dns.TypeA
+					if i%2 == 1 {
+						qtype = dns.TypeAAAA
+					}
+					req := new(dns.Msg)
+					req.SetQuestion("popular.example.com.", qtype)
+					w := &mockResponseWriter{}
+					if err := u.ServeDNS(context.Background(), w, req); err != nil {
+						t.Errorf("ServeDNS failed: %v", err)
+						return
+					}
+					if w.msg.Id != req.Id || w.msg.Question[0].Qtype != qtype {
+						t.Errorf("Expected a response matching query %d, got %d", req.Id, w.msg.Id)
+					}
+					if len(w.msg.Answer) != 1 {
+						t.Errorf("Expected the shared answer, got %v", w.msg.Answer)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if got := queries.Load(); got != tt.wantQueries {
+				t.Errorf("Expected %d upstream queries, got %d", tt.wantQueries, got)
+			}
+		})
+	}
+}
+
+func TestFlightGroup_WaiterCancelled(t *testing.T) {
+	g := &flightGroup{flights: make(map[string]*flight)}
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.com.", dns.TypeA)
+
+	leaderDone := make(chan *dns.Msg)
+	go func() {
+		m, _, _ := g.do(context.Background(), "key", func(context.Context) (*dns.Msg, time.Duration, error) {
+			close(started)
+			<-release
+			return resp, time.Millisecond, nil
+		})
+		leaderDone <- m
+	}()
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := g.do(ctx, "key", nil); err == nil {
+		t.Error("Expected a cancelled waiter to give up")
+	}
+
+	close(release)
+	if m := <-leaderDone; m == nil || m == resp {
+		t.Error("Expected the leader to get its own copy once the flight was shared")
+	}
+}
@@ -0,0 +1,719 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnssecStrict     = "strict"
+	dnssecPermissive = "permissive"
+)
+
+// rootTrustAnchors are the DS records of the root zone's key signing keys,
+// KSK-2017 and KSK-2024, as published by IANA.
+var rootTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	// maxKeyCacheTTL caps how long validated zone keys are cached,
+	// regardless of their TTL.
+	maxKeyCacheTTL = time.Hour
+	// minInsecureCacheTTL is the shortest time a proof that a zone is
+	// unsigned is cached for. Proofs without an SOA record have no TTL to
+	// go by and would otherwise be looked up again for every query.
+	minInsecureCacheTTL = 30 * time.Second
+	// maxKeyCacheEntries bounds the number of zones whose keys are cached.
+	maxKeyCacheEntries = 10000
+)
+
+// DNSSECValidation configures validation of upstream responses against the
+// DNSSEC chain of trust. The resolver asks upstreams for DNSSEC records,
+// follows RRSIG, DNSKEY and DS records up to a trust anchor, and sets the
+// AD bit on answers it validated. Queries with the CD bit set are passed
+// through unvalidated.
+//
+// Denial of existence is checked by requiring a validated NSEC or NSEC3
+// record that matches or covers the query name; the full closest encloser
+// proof is not checked.
+type DNSSECValidation struct {
+	// Mode is "strict" (the default) to answer SERVFAIL when a response
+	// fails validation, or "permissive" to return it without the AD bit.
+	Mode string `json:"mode,omitempty"`
+
+	// TrustAnchors are DS records, in zone file format, of the keys the
+	// chain of trust ends in. Defaults to the root zone's KSKs.
+	TrustAnchors []string `json:"trust_anchors,omitempty"`
+
+	anchors map[string][]*dns.DS
+	keys    map[string]*cachedKeys
+	mu      sync.Mutex
+}
+
+// cachedKeys are the validated keys of a zone, or a record that the zone is
+// provably unsigned.
+type cachedKeys struct {
+	keys     []*dns.DNSKEY
+	insecure bool
+	expires  time.Time
+}
+
+// errInsecure is returned while following the chain of trust when it
+// proves that a zone is unsigned.
+var errInsecure = errors.New("zone is insecure")
+
+func (v *DNSSECValidation) provision() error {
+	switch v.Mode {
+	case "":
+		v.Mode = dnssecStrict
+	case dnssecStrict, dnssecPermissive:
+	default:
+		return fmt.Errorf("unsupported mode: %s", v.Mode)
+	}
+
+	anchors := v.TrustAnchors
+	if len(anchors) == 0 {
+		anchors = rootTrustAnchors
+	}
+	v.anchors = make(map[string][]*dns.DS)
+	for _, anchor := range anchors {
+		rr, err := dns.NewRR(anchor)
+		if err != nil {
+			return fmt.Errorf("invalid trust anchor %q: %w", anchor, err)
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			return fmt.Errorf("invalid trust anchor %q: not a DS record", anchor)
+		}
+		zone := dns.CanonicalName(ds.Hdr.Name)
+		v.anchors[zone] = append(v.anchors[zone], ds)
+	}
+	v.keys = make(map[string]*cachedKeys)
+
+	return nil
+}
+
+// applyValidation validates resp, the response from upstream to r, and
+// sets its AD bit to match. It reports whether the response may be
+// returned to the client: bogus responses are only returned in permissive
+// mode.
+func (u *UpstreamResolver) applyValidation(ctx context.Context, r, resp *dns.Msg, upstream string) bool {
+	secure, err := u.validate(ctx, r, resp)
+	resp.AuthenticatedData = secure
+	if err == nil {
+		return true
+	}
+
+	u.logger.Warn("DNSSEC validation failed",
+		"query_id", r.Id,
+		"query_name", r.Question[0].Name,
+		"query_type", dns.TypeToString[r.Question[0].Qtype],
+		"upstream", upstream,
+		"mode", u.DNSSEC.Mode,
+		"error", err)
+	return u.DNSSEC.Mode == dnssecPermissive
+}
+
+// validate checks resp, the response to r, against the chain of trust. It
+// reports whether the response is secure; an error means it is bogus.
+// Responses from provably unsigned zones are neither.
+func (u *UpstreamResolver) validate(ctx context.Context, r, resp *dns.Msg) (bool, error) {
+	if len(r.Question) == 0 {
+		return false, nil
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		// Errors such as SERVFAIL carry no data to validate
+		return false, nil
+	}
+
+	secure := true
+	var wildcard bool
+	for _, set := range rrsets(resp.Answer) {
+		setSecure, expanded, err := u.validateRRset(ctx, set)
+		if err != nil {
+			return false, err
+		}
+		secure = secure && setSecure
+		wildcard = wildcard || expanded
+	}
+
+	qname, qtype := r.Question[0].Name, r.Question[0].Qtype
+	negative := resp.Rcode == dns.RcodeNameError || len(resp.Answer) == 0
+	if !secure || (!negative && !wildcard) {
+		return secure, nil
+	}
+
+	denial := denialSets(resp)
+	if len(denial) == 0 {
+		// Nothing signed was returned, which is only acceptable from an
+		// unsigned zone
+		if err := u.checkInsecure(ctx, qname); err != nil {
+			return false, fmt.Errorf("missing proof of non-existence for %s %s: %w", qname, dns.TypeToString[qtype], err)
+		}
+		return false, nil
+	}
+	for _, set := range denial {
+		setSecure, _, err := u.validateRRset(ctx, set)
+		if err != nil || !setSecure {
+			return false, err
+		}
+	}
+
+	if !deniesExistence(resp, qname, qtype, negative) {
+		return false, fmt.Errorf("missing proof of non-existence for %s %s", qname, dns.TypeToString[qtype])
+	}
+	return true, nil
+}
+
+// rrset is a set of records sharing an owner, class and type, along with
+// the signatures covering them.
+type rrset struct {
+	records []dns.RR
+	sigs    []*dns.RRSIG
+}
+
+// rrsets groups the records of the given sections into RRsets.
+func rrsets(sections ...[]dns.RR) []*rrset {
+	var sets []*rrset
+	index := make(map[string]*rrset)
+	key := func(name string, class, rrtype uint16) string {
+		return fmt.Sprintf("%s/%d/%d", dns.CanonicalName(name), class, rrtype)
+	}
+
+	for _, section := range sections {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				continue
+			}
+			k := key(rr.Header().Name, rr.Header().Class, rr.Header().Rrtype)
+			set, ok := index[k]
+			if !ok {
+				set = &rrset{}
+				index[k] = set
+				sets = append(sets, set)
+			}
+			set.records = append(set.records, rr)
+		}
+	}
+
+	for _, section := range sections {
+		for _, rr := range section {
+			sig, ok := rr.(*dns.RRSIG)
+			if !ok {
+				continue
+			}
+			if set, ok := index[key(sig.Hdr.Name, sig.Hdr.Class, sig.TypeCovered)]; ok {
+				set.sigs = append(set.sigs, sig)
+			}
+		}
+	}
+
+	return sets
+}
+
+// denialSets returns the RRsets of the authority section of resp that take
+// part in proving a negative answer. Referral NS records are left out, as
+// they are not signed.
+func denialSets(resp *dns.Msg) []*rrset {
+	var records []dns.RR
+	for _, rr := range resp.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeRRSIG:
+			records = append(records, rr)
+		}
+	}
+	return rrsets(records)
+}
+
+// validateRRset verifies the signatures of a single RRset. It reports
+// whether the RRset is secure and whether it was synthesized from a
+// wildcard.
+func (u *UpstreamResolver) validateRRset(ctx context.Context, set *rrset) (bool, bool, error) {
+	owner := set.records[0].Header().Name
+	rrtype := dns.TypeToString[set.records[0].Header().Rrtype]
+
+	if len(set.sigs) == 0 {
+		if err := u.checkInsecure(ctx, owner); err != nil {
+			return false, false, fmt.Errorf("missing signature for %s %s: %w", owner, rrtype, err)
+		}
+		return false, false, nil
+	}
+
+	return u.validateSigned(ctx, set, "")
+}
+
+// validateSigned verifies the signatures of an RRset with the keys of the
+// zones that made them. When below is set, signers must be proper
+// ancestors of it, which keeps the chain of trust moving towards the root.
+func (u *UpstreamResolver) validateSigned(ctx context.Context, set *rrset, below string) (bool, bool, error) {
+	owner := set.records[0].Header().Name
+	rrtype := dns.TypeToString[set.records[0].Header().Rrtype]
+
+	var lastErr error
+	for _, sig := range set.sigs {
+		signer := dns.CanonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, dns.CanonicalName(owner)) {
+			lastErr = fmt.Errorf("signer %s is not an ancestor of %s", signer, owner)
+			continue
+		}
+		if below != "" && (signer == below || !dns.IsSubDomain(signer, below)) {
+			lastErr = fmt.Errorf("signer %s is not a parent of %s", signer, below)
+			continue
+		}
+
+		keys, err := u.zoneKeys(ctx, signer)
+		if errors.Is(err, errInsecure) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, fmt.Errorf("validating %s %s: %w", owner, rrtype, err)
+		}
+
+		if err := verifyRRset(sig, keys, set.records); err != nil {
+			lastErr = err
+			continue
+		}
+		wildcard := int(sig.Labels) < dns.CountLabel(owner) && !strings.HasPrefix(owner, "*.")
+		return true, wildcard, nil
+	}
+
+	return false, false, fmt.Errorf("invalid signature for %s %s: %w", owner, rrtype, lastErr)
+}
+
+// verifyRRset checks sig over records with any of the keys it may have
+// been made with.
+func verifyRRset(sig *dns.RRSIG, keys []*dns.DNSKEY, records []dns.RR) error {
+	if !sig.ValidityPeriod(time.Now()) {
+		return fmt.Errorf("signature by key %d is expired or not yet valid", sig.KeyTag)
+	}
+
+	err := fmt.Errorf("no key %d for signature", sig.KeyTag)
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if err = sig.Verify(key, records); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// zoneKeys returns the validated DNSKEYs of zone, following the chain of
+// trust up to a trust anchor. It returns errInsecure if the chain proves
+// the zone is unsigned.
+func (u *UpstreamResolver) zoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, error) {
+	v := u.DNSSEC
+	v.mu.Lock()
+	cached, ok := v.keys[zone]
+	v.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		if cached.insecure {
+			return nil, errInsecure
+		}
+		return cached.keys, nil
+	}
+
+	keys, ttl, err := u.fetchZoneKeys(ctx, zone)
+	if err != nil && !errors.Is(err, errInsecure) {
+		return nil, err
+	}
+
+	v.cacheKeys(zone, keys, errors.Is(err, errInsecure), ttl)
+	return keys, err
+}
+
+// cacheKeys caches the keys of zone, or that it is insecure, for ttl
+// within the cache's bounds. Once the cache is full, an arbitrary zone is
+// evicted to make room.
+func (v *DNSSECValidation) cacheKeys(zone string, keys []*dns.DNSKEY, insecure bool, ttl time.Duration) {
+	ttl = min(ttl, maxKeyCacheTTL)
+	if insecure {
+		ttl = max(ttl, minInsecureCacheTTL)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, exists := v.keys[zone]; !exists && len(v.keys) >= maxKeyCacheEntries {
+		for evicted := range v.keys {
+			delete(v.keys, evicted)
+			break
+		}
+	}
+	v.keys[zone] = &cachedKeys{
+		keys:     keys,
+		insecure: insecure,
+		expires:  time.Now().Add(ttl),
+	}
+}
+
+// fetchZoneKeys looks up and validates the DNSKEYs of zone, returning how
+// long the result may be cached.
+func (u *UpstreamResolver) fetchZoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, time.Duration, error) {
+	ds, ttl, err := u.delegationSigners(ctx, zone)
+	if err != nil {
+		return nil, ttl, err
+	}
+
+	resp, err := u.lookup(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, fmt.Errorf("looking up DNSKEY for %s: %w", zone, err)
+	}
+
+	var keys []*dns.DNSKEY
+	var sigs []*dns.RRSIG
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			if dns.CanonicalName(rr.Hdr.Name) == zone {
+				keys = append(keys, rr)
+			}
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, 0, fmt.Errorf("no DNSKEY records for %s", zone)
+	}
+
+	// The DNSKEY RRset must be signed by a key that the parent vouches
+	// for with a DS record
+	var trusted []*dns.DNSKEY
+	for _, key := range keys {
+		if matchesDS(key, ds) {
+			trusted = append(trusted, key)
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, 0, fmt.Errorf("no DNSKEY for %s matches its DS records", zone)
+	}
+
+	records := make([]dns.RR, len(keys))
+	for i, key := range keys {
+		records[i] = key
+	}
+	err = fmt.Errorf("DNSKEY RRset for %s is not signed", zone)
+	for _, sig := range sigs {
+		if err = verifyRRset(sig, trusted, records); err == nil {
+			return keys, min(ttl, ttlDuration(keys[0].Hdr.Ttl)), nil
+		}
+	}
+	return nil, 0, fmt.Errorf("invalid DNSKEY signature for %s: %w", zone, err)
+}
+
+// delegationSigners returns the DS records vouching for zone's keys:
+// either its trust anchors or the validated DS RRset from its parent. It
+// returns errInsecure if the parent proves there are none.
+func (u *UpstreamResolver) delegationSigners(ctx context.Context, zone string) ([]*dns.DS, time.Duration, error) {
+	if anchors, ok := u.DNSSEC.anchors[zone]; ok {
+		return anchors, maxKeyCacheTTL, nil
+	}
+	if zone == "." {
+		return nil, 0, fmt.Errorf("no trust anchor for the root zone")
+	}
+
+	resp, err := u.lookup(ctx, zone, dns.TypeDS)
+	if err != nil {
+		return nil, 0, fmt.Errorf("looking up DS for %s: %w", zone, err)
+	}
+
+	var ds []*dns.DS
+	for _, rr := range resp.Answer {
+		if rr, ok := rr.(*dns.DS); ok && dns.CanonicalName(rr.Hdr.Name) == zone {
+			ds = append(ds, rr)
+		}
+	}
+
+	// Either the DS records or the proof that there are none must be
+	// signed by the parent, unless the parent is itself unsigned
+	sets := denialSets(resp)
+	if len(ds) > 0 {
+		sets = nil
+		for _, set := range rrsets(resp.Answer) {
+			if set.records[0].Header().Rrtype == dns.TypeDS {
+				sets = append(sets, set)
+			}
+		}
+	}
+	for _, set := range sets {
+		if len(set.sigs) == 0 {
+			return nil, 0, u.checkParentInsecure(ctx, zone)
+		}
+		secure, _, err := u.validateSigned(ctx, set, zone)
+		if err != nil {
+			return nil, 0, fmt.Errorf("validating DS for %s: %w", zone, err)
+		}
+		if !secure {
+			return nil, 0, errInsecure
+		}
+	}
+
+	switch {
+	case len(ds) > 0:
+		return ds, ttlDuration(ds[0].Hdr.Ttl), nil
+	case len(sets) == 0:
+		return nil, 0, u.checkParentInsecure(ctx, zone)
+	case deniesDS(resp, zone):
+		return nil, negativeTTL(resp), errInsecure
+	default:
+		return nil, 0, fmt.Errorf("missing proof that %s has no DS records", zone)
+	}
+}
+
+// checkParentInsecure returns errInsecure if the zone above zone is
+// unsigned, which is the only case where zone may lack signed DS records
+// or a signed denial of them.
+func (u *UpstreamResolver) checkParentInsecure(ctx context.Context, zone string) error {
+	parent, err := u.findZone(ctx, parentName(zone))
+	if err != nil {
+		return err
+	}
+
+	_, err = u.zoneKeys(ctx, parent)
+	switch {
+	case errors.Is(err, errInsecure):
+		return errInsecure
+	case err != nil:
+		return err
+	default:
+		return fmt.Errorf("unsigned DS response for %s from signed zone %s", zone, parent)
+	}
+}
+
+// parentName returns name without its first label.
+func parentName(name string) string {
+	labels := dns.Split(name)
+	if len(labels) < 2 {
+		return "."
+	}
+	return name[labels[1]:]
+}
+
+// checkInsecure returns nil if name is in a provably unsigned zone, which
+// is the only case where unsigned data may be accepted.
+func (u *UpstreamResolver) checkInsecure(ctx context.Context, name string) error {
+	zone, err := u.findZone(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = u.zoneKeys(ctx, zone)
+	switch {
+	case errors.Is(err, errInsecure):
+		return nil
+	case err != nil:
+		return err
+	default:
+		return fmt.Errorf("zone %s is signed", zone)
+	}
+}
+
+// findZone returns the apex of the zone name belongs to, from the SOA
+// record returned for it.
+func (u *UpstreamResolver) findZone(ctx context.Context, name string) (string, error) {
+	resp, err := u.lookup(ctx, name, dns.TypeSOA)
+	if err != nil {
+		return "", fmt.Errorf("looking up SOA for %s: %w", name, err)
+	}
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return dns.CanonicalName(soa.Hdr.Name), nil
+		}
+	}
+	return "", fmt.Errorf("no SOA record found for %s", name)
+}
+
+// lookup queries the upstreams for DNSSEC records, trying each in turn.
+// The CD bit is set so that validating upstreams return the data for this
+// resolver to check rather than failing.
+func (u *UpstreamResolver) lookup(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.CanonicalName(name), qtype)
+	query.SetEdns0(dns.DefaultMsgSize, true)
+	query.CheckingDisabled = true
+
+	var lastErr error
+	for _, upstream := range u.selector.order(u.Upstreams) {
+		resp, _, err := u.exchange(ctx, query, upstream)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("upstream %s answered %s", upstream, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// matchesDS reports whether key is vouched for by any of ds.
+func matchesDS(key *dns.DNSKEY, ds []*dns.DS) bool {
+	for _, d := range ds {
+		if key.KeyTag() != d.KeyTag || key.Algorithm != d.Algorithm {
+			continue
+		}
+		if computed := key.ToDS(d.DigestType); computed != nil && strings.EqualFold(computed.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// deniesDS reports whether the validated authority section of resp proves
+// that zone has no DS records: an NSEC or NSEC3 record for zone without
+// the DS type, or an opt-out NSEC3 record covering it.
+func deniesDS(resp *dns.Msg, zone string) bool {
+	for _, rr := range resp.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if dns.CanonicalName(rr.Hdr.Name) == zone && !slices.Contains(rr.TypeBitMap, dns.TypeDS) {
+				return true
+			}
+		case *dns.NSEC3:
+			if rr.Match(zone) && !slices.Contains(rr.TypeBitMap, dns.TypeDS) {
+				return true
+			}
+			if rr.Flags&1 == 1 && rr.Cover(zone) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deniesExistence reports whether the validated authority section of resp
+// holds an NSEC or NSEC3 record proving that qname does not exist, or has
+// no records of qtype when the response is NODATA. For a positive answer
+// synthesized from a wildcard it checks that qname itself does not exist.
+func deniesExistence(resp *dns.Msg, qname string, qtype uint16, negative bool) bool {
+	qname = dns.CanonicalName(qname)
+	nodata := negative && resp.Rcode == dns.RcodeSuccess
+
+	for _, rr := range resp.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if nodata && dns.CanonicalName(rr.Hdr.Name) == qname {
+				if !slices.Contains(rr.TypeBitMap, qtype) && !slices.Contains(rr.TypeBitMap, dns.TypeCNAME) {
+					return true
+				}
+				continue
+			}
+			if nsecCovers(rr, qname) {
+				return true
+			}
+		case *dns.NSEC3:
+			if nodata && rr.Match(qname) {
+				if !slices.Contains(rr.TypeBitMap, qtype) && !slices.Contains(rr.TypeBitMap, dns.TypeCNAME) {
+					return true
+				}
+				continue
+			}
+			if rr.Cover(qname) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nsecCovers reports whether name falls strictly between the owner and
+// next name of an NSEC record in canonical order.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner := dns.CanonicalName(nsec.Hdr.Name)
+	next := dns.CanonicalName(nsec.NextDomain)
+
+	afterOwner := compareCanonical(name, owner) > 0
+	beforeNext := compareCanonical(name, next) < 0
+	if compareCanonical(owner, next) < 0 {
+		return afterOwner && beforeNext
+	}
+	// The last NSEC record in the zone wraps around to the apex
+	return afterOwner || beforeNext
+}
+
+// compareCanonical compares two lowercased domain names in DNSSEC canonical
+// order (RFC 4034 section 6.1): label by label, starting from the root.
+func compareCanonical(a, b string) int {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// negativeTTL returns how long a negative response may be cached, from the
+// SOA record in its authority section.
+func negativeTTL(resp *dns.Msg) time.Duration {
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return ttlDuration(min(soa.Hdr.Ttl, soa.Minttl))
+		}
+	}
+	return 0
+}
+
+func ttlDuration(ttl uint32) time.Duration {
+	return time.Duration(ttl) * time.Second
+}
+
+// setDO asks for DNSSEC records by setting the DO bit on query, adding an
+// OPT record if it has none.
+func setDO(query *dns.Msg) {
+	if opt := query.IsEdns0(); opt != nil {
+		opt.SetDo()
+		return
+	}
+	query.SetEdns0(dns.DefaultMsgSize, true)
+}
+
+// stripDNSSEC removes the DNSSEC records that were only fetched for
+// validation from a response to a client that did not ask for them (RFC
+// 4035 section 3.2.1), along with the OPT record if the client sent none.
+func stripDNSSEC(r, resp *dns.Msg) {
+	opt := r.IsEdns0()
+	if (opt != nil && opt.Do()) || len(r.Question) == 0 {
+		return
+	}
+
+	qtype := r.Question[0].Qtype
+	strip := func(section []dns.RR) []dns.RR {
+		kept := section[:0]
+		for _, rr := range section {
+			switch rr.Header().Rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeDS, dns.TypeDNSKEY:
+				if rr.Header().Rrtype != qtype {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	resp.Answer = strip(resp.Answer)
+	resp.Ns = strip(resp.Ns)
+	resp.Extra = strip(resp.Extra)
+
+	if respOpt := resp.IsEdns0(); respOpt != nil {
+		if opt == nil {
+			resp.Extra = slices.DeleteFunc(resp.Extra, func(rr dns.RR) bool { return rr == respOpt })
+		} else {
+			respOpt.SetDo(false)
+		}
+	}
+}
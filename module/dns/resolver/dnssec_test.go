@@ -0,0 +1,312 @@
+package resolver
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is a zone served by a testSignedUpstream, signed when it has a
+// key.
+type testZone struct {
+	name    string
+	key     *dns.DNSKEY
+	signer  crypto.Signer
+	records []dns.RR
+	// tampered lists owners whose records are altered after signing, and
+	// unsigned those whose records are served without signatures.
+	tampered []string
+	unsigned []string
+}
+
+func newTestZone(t *testing.T, name string, signed bool, records ...string) *testZone {
+	t.Helper()
+
+	zone := &testZone{name: name}
+	zone.records = append(zone.records, mustRR(t, name+" 300 IN SOA ns.example.net. admin.example.net. 1 3600 600 86400 300"))
+	if signed {
+		zone.key = &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     257,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := zone.key.Generate(256)
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+		zone.signer = priv.(crypto.Signer)
+		zone.records = append(zone.records, zone.key)
+	}
+	for _, record := range records {
+		zone.records = append(zone.records, mustRR(t, record))
+	}
+	return zone
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("invalid record %q: %v", s, err)
+	}
+	return rr
+}
+
+// startSignedUpstream serves the given zones, answering each query from the
+// deepest zone containing it, or from the parent for DS queries at a zone
+// apex.
+func startSignedUpstream(t *testing.T, zones ...*testZone) string {
+	t.Helper()
+
+	return startTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		q := r.Question[0]
+		name := dns.CanonicalName(q.Name)
+
+		var zone, parent *testZone
+		for _, z := range zones {
+			if dns.IsSubDomain(z.name, name) && (zone == nil || dns.CountLabel(z.name) > dns.CountLabel(zone.name)) {
+				parent, zone = zone, z
+			}
+		}
+		if q.Qtype == dns.TypeDS && name == zone.name && parent != nil {
+			zone = parent
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+		var exists bool
+		for _, rr := range zone.records {
+			if dns.CanonicalName(rr.Header().Name) != name {
+				continue
+			}
+			exists = true
+			if rr.Header().Rrtype == q.Qtype {
+				m.Answer = append(m.Answer, dns.Copy(rr))
+			}
+		}
+
+		if len(m.Answer) == 0 {
+			m.Ns = append(m.Ns, dns.Copy(zone.records[0]))
+			if !exists {
+				m.Rcode = dns.RcodeNameError
+			}
+			for _, rr := range zone.records {
+				nsec, ok := rr.(*dns.NSEC)
+				if !ok {
+					continue
+				}
+				if (exists && dns.CanonicalName(nsec.Hdr.Name) == name) || (!exists && nsecCovers(nsec, name)) {
+					m.Ns = append(m.Ns, dns.Copy(nsec))
+				}
+			}
+		}
+
+		if opt := r.IsEdns0(); opt != nil && opt.Do() && zone.key != nil {
+			m.Answer = zone.sign(t, m.Answer)
+			m.Ns = zone.sign(t, m.Ns)
+		}
+		if opt := r.IsEdns0(); opt != nil {
+			m.SetEdns0(opt.UDPSize(), opt.Do())
+		}
+		_ = w.WriteMsg(m)
+	})
+}
+
+// sign appends an RRSIG for every RRset in records.
+func (z *testZone) sign(t *testing.T, records []dns.RR) []dns.RR {
+	t.Helper()
+
+	signed := slices.Clone(records)
+	for _, set := range rrsets(records) {
+		if slices.Contains(z.unsigned, set.records[0].Header().Name) {
+			continue
+		}
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: set.records[0].Header().Ttl},
+			Algorithm:  z.key.Algorithm,
+			SignerName: z.name,
+			KeyTag:     z.key.KeyTag(),
+			Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+			Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		}
+		if err := sig.Sign(z.signer, set.records); err != nil {
+			t.Fatalf("failed to sign: %v", err)
+		}
+		signed = append(signed, sig)
+	}
+
+	for _, rr := range signed {
+		if a, ok := rr.(*dns.A); ok && slices.Contains(z.tampered, a.Hdr.Name) {
+			a.A = net.IPv4(203, 0, 113, 66)
+		}
+	}
+	return signed
+}
+
+func newTestHierarchy(t *testing.T) (string, string) {
+	t.Helper()
+
+	example := newTestZone(t, "example.", true,
+		"example. 300 IN NSEC bad.example. SOA DNSKEY NSEC RRSIG",
+		"bad.example. 300 IN A 192.0.2.2",
+		"bad.example. 300 IN NSEC plain.example. A NSEC RRSIG",
+		"plain.example. 300 IN A 192.0.2.4",
+		"plain.example. 300 IN NSEC www.example. A NSEC RRSIG",
+		"www.example. 300 IN A 192.0.2.1",
+		"www.example. 300 IN NSEC example. A NSEC RRSIG",
+	)
+	example.tampered = []string{"bad.example."}
+	example.unsigned = []string{"plain.example."}
+
+	insecure := newTestZone(t, "insecure.", false,
+		"host.insecure. 300 IN A 192.0.2.3",
+	)
+
+	root := newTestZone(t, ".", true,
+		". 300 IN NSEC example. SOA DNSKEY NSEC RRSIG",
+		"example. 300 IN NSEC insecure. NS DS NSEC RRSIG",
+		"insecure. 300 IN NSEC . NS NSEC RRSIG",
+	)
+	root.records = append(root.records, example.key.ToDS(dns.SHA256))
+	root.records[len(root.records)-1].Header().Ttl = 300
+
+	addr := startSignedUpstream(t, root, example, insecure)
+	return addr, root.key.ToDS(dns.SHA256).String()
+}
+
+func TestUpstreamResolver_DNSSEC(t *testing.T) {
+	addr, anchor := newTestHierarchy(t)
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		mode      string
+		anchor    string
+		do        bool
+		cd        bool
+		wantRcode int
+		wantAD    bool
+	}{
+		{name: "secure answer", qname: "www.example.", qtype: dns.TypeA, do: true, wantRcode: dns.RcodeSuccess, wantAD: true},
+		{name: "secure answer without DO", qname: "www.example.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, wantAD: true},
+		{name: "secure NXDOMAIN", qname: "missing.example.", qtype: dns.TypeA, do: true, wantRcode: dns.RcodeNameError, wantAD: true},
+		{name: "secure NODATA", qname: "www.example.", qtype: dns.TypeAAAA, do: true, wantRcode: dns.RcodeSuccess, wantAD: true},
+		{name: "insecure delegation", qname: "host.insecure.", qtype: dns.TypeA, do: true, wantRcode: dns.RcodeSuccess},
+		{name: "bogus strict", qname: "bad.example.", qtype: dns.TypeA, do: true, wantRcode: dns.RcodeServerFailure},
+		{name: "bogus permissive", qname: "bad.example.", qtype: dns.TypeA, mode: dnssecPermissive, do: true, wantRcode: dns.RcodeSuccess},
+		{name: "missing signatures", qname: "plain.example.", qtype: dns.TypeA, do: true, wantRcode: dns.RcodeServerFailure},
+		{name: "wrong trust anchor", qname: "www.example.", qtype: dns.TypeA, anchor: ". IN DS 12345 13 2 " + strings.Repeat("AB", 32), do: true, wantRcode: dns.RcodeServerFailure},
+		{name: "bogus with CD", qname: "bad.example.", qtype: dns.TypeA, do: true, cd: true, wantRcode: dns.RcodeSuccess},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustAnchor := anchor
+			if tt.anchor != "" {
+				trustAnchor = tt.anchor
+			}
+			u := &UpstreamResolver{
+				Upstreams: []string{addr},
+				DNSSEC:    &DNSSECValidation{Mode: tt.mode, TrustAnchors: []string{trustAnchor}},
+			}
+			if err := u.Provision(mockContext{}); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion(tt.qname, tt.qtype)
+			req.CheckingDisabled = tt.cd
+			if tt.do {
+				req.SetEdns0(dns.DefaultMsgSize, true)
+			}
+
+			w := &mockResponseWriter{}
+			if err := u.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+			resp := w.msg
+
+			if resp.Rcode == dns.RcodeServerFailure {
+				if opt := resp.IsEdns0(); opt == nil || len(opt.Option) == 0 || opt.Option[0].Option() != dns.EDNS0EDE {
+					t.Errorf("expected an extended DNS error on SERVFAIL, got:\n%s", resp)
+				}
+			}
+			if resp.Rcode != tt.wantRcode {
+				t.Fatalf("expected %s, got %s", dns.RcodeToString[tt.wantRcode], dns.RcodeToString[resp.Rcode])
+			}
+			if resp.AuthenticatedData != tt.wantAD {
+				t.Errorf("expected AD=%v, got %v", tt.wantAD, resp.AuthenticatedData)
+			}
+
+			hasSigs := strings.Contains(resp.String(), "RRSIG")
+			if tt.do && tt.wantRcode == dns.RcodeSuccess && tt.qname != "host.insecure." && !hasSigs {
+				t.Errorf("expected signatures for a DO query, got:\n%s", resp)
+			}
+			if !tt.do {
+				if hasSigs || resp.IsEdns0() != nil {
+					t.Errorf("expected DNSSEC records to be stripped for a non-DO query, got:\n%s", resp)
+				}
+			}
+		})
+	}
+}
+
+func TestDNSSECValidation_KeyCache(t *testing.T) {
+	v := &DNSSECValidation{}
+	if err := v.provision(); err != nil {
+		t.Fatalf("provision failed: %v", err)
+	}
+
+	// A proof of insecurity without a TTL is still cached for a while
+	v.cacheKeys("insecure.", nil, true, 0)
+	if cached := v.keys["insecure."]; cached == nil || !time.Now().Before(cached.expires) {
+		t.Error("Expected an insecure zone to be cached despite a zero TTL")
+	}
+
+	v.cacheKeys("long.", nil, false, 24*time.Hour)
+	if cached := v.keys["long."]; time.Until(cached.expires) > maxKeyCacheTTL {
+		t.Errorf("Expected the cache TTL to be capped at %s, got %s", maxKeyCacheTTL, time.Until(cached.expires))
+	}
+
+	for i := 0; i < maxKeyCacheEntries+10; i++ {
+		v.cacheKeys(fmt.Sprintf("zone%d.", i), nil, true, time.Minute)
+	}
+	if len(v.keys) != maxKeyCacheEntries {
+		t.Errorf("Expected the cache to hold at most %d zones, got %d", maxKeyCacheEntries, len(v.keys))
+	}
+}
+
+func TestUpstreamResolver_DNSSECProvision(t *testing.T) {
+	tests := []struct {
+		name    string
+		dnssec  *DNSSECValidation
+		wantErr bool
+	}{
+		{name: "defaults", dnssec: &DNSSECValidation{}},
+		{name: "unknown mode", dnssec: &DNSSECValidation{Mode: "lenient"}, wantErr: true},
+		{name: "invalid anchor", dnssec: &DNSSECValidation{TrustAnchors: []string{"not a record"}}, wantErr: true},
+		{name: "anchor not a DS", dnssec: &DNSSECValidation{TrustAnchors: []string{". IN A 192.0.2.1"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &UpstreamResolver{DNSSEC: tt.dnssec}
+			err := u.Provision(mockContext{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Provision error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (u.DNSSEC.Mode != dnssecStrict || len(u.DNSSEC.anchors["."]) != 2) {
+				t.Errorf("expected strict mode with the root anchors, got %+v", u.DNSSEC)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohContentType is the media type of DNS messages carried over HTTPS, as
+// defined by RFC 8484.
+const dohContentType = "application/dns-message"
+
+// isDoHUpstream reports whether an upstream is a DNS-over-HTTPS endpoint
+// rather than a host:port address.
+func isDoHUpstream(upstream string) bool {
+	return strings.HasPrefix(upstream, "https://")
+}
+
+// normalizeDoHUpstream validates a DoH endpoint URL and returns it with its
+// hostname lowercased.
+func normalizeDoHUpstream(endpoint string) (string, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Hostname() == "" {
+		return "", fmt.Errorf("missing host")
+	}
+	parsed.Host = strings.ToLower(parsed.Host)
+	if parsed.Path == "" {
+		parsed.Path = "/dns-query"
+	}
+	return parsed.String(), nil
+}
+
+// newDoHClient returns the HTTP client shared by every DoH upstream, so
+// that connections to an endpoint are reused across queries. When
+// bootstrap addresses are given, endpoint hostnames are never resolved;
+// connections go to the bootstrap addresses in turn instead, keeping the
+// hostname for TLS verification.
+func newDoHClient(timeout time.Duration, bootstrap []string) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: timeout,
+	}
+	if len(bootstrap) > 0 {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+
+			var lastErr error
+			for _, ip := range bootstrap {
+				conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+				if err == nil {
+					return conn, nil
+				}
+				lastErr = err
+			}
+			return nil, lastErr
+		}
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// exchangeDoH sends a query to a DoH endpoint as an RFC 8484 POST request.
+func (u *UpstreamResolver) exchangeDoH(ctx context.Context, query *dns.Msg, endpoint string) (*dns.Msg, time.Duration, error) {
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, fmt.Errorf("packing query: %w", err)
+	}
+	// RFC 8484 recommends a message ID of 0 so that responses cache well;
+	// the client's ID is restored on the response before it is returned
+	packed[0], packed[1] = 0, 0
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	start := time.Now()
+	resp, err := u.doh.Do(req)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize+1))
+	rtt := time.Since(start)
+	if err != nil {
+		return nil, rtt, fmt.Errorf("reading response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, rtt, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if len(body) > dns.MaxMsgSize {
+		return nil, rtt, fmt.Errorf("response too large")
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(body); err != nil {
+		return nil, rtt, fmt.Errorf("unpacking response: %w", err)
+	}
+	m.Id = query.Id
+
+	return m, rtt, nil
+}
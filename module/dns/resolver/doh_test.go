@@ -0,0 +1,182 @@
+package resolver
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startTestDoHUpstream starts an HTTPS server answering RFC 8484 POST
+// queries with handler, which is also passed the client's address. It
+// returns the server, whose certificate is valid for 127.0.0.1 and
+// example.com.
+func startTestDoHUpstream(t *testing.T, handler func(remote string, r *dns.Msg) *dns.Msg) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(body); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if r.Id != 0 {
+			http.Error(w, "expected message ID 0", http.StatusBadRequest)
+			return
+		}
+
+		packed, err := handler(req.RemoteAddr, r).Pack()
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		_, _ = w.Write(packed)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// trustTestServer makes the resolver's DoH client trust server's
+// certificate.
+func trustTestServer(u *UpstreamResolver, server *httptest.Server) {
+	transport := u.doh.Transport.(*http.Transport)
+	transport.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+}
+
+func TestUpstreamResolver_DoH(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		remotes = make(map[string]bool)
+	)
+	server := startTestDoHUpstream(t, func(remote string, r *dns.Msg) *dns.Msg {
+		mu.Lock()
+		remotes[remote] = true
+		mu.Unlock()
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		return m
+	})
+
+	u := &UpstreamResolver{Upstreams: []string{server.URL + "/dns-query"}}
+	if err := u.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	trustTestServer(u, server)
+	defer func() { _ = u.Cleanup() }()
+
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+
+		w := &mockResponseWriter{}
+		if err := u.ServeDNS(context.Background(), w, req); err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+
+		if w.msg.Id != req.Id {
+			t.Errorf("Expected response ID %d, got %d", req.Id, w.msg.Id)
+		}
+		if len(w.msg.Answer) != 1 {
+			t.Fatalf("Expected 1 answer, got %d", len(w.msg.Answer))
+		}
+	}
+
+	if got := upstreamDuration.Count(u.Upstreams[0]); got != 3 {
+		t.Errorf("Expected 3 upstream latency observations, got %d", got)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := len(remotes); got != 1 {
+		t.Errorf("Expected queries to reuse a single connection, got %d connections", got)
+	}
+}
+
+func TestUpstreamResolver_DoHBootstrap(t *testing.T) {
+	server := startTestDoHUpstream(t, func(_ string, r *dns.Msg) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		return m
+	})
+
+	// example.com is only reachable through the bootstrap address, and the
+	// test certificate is valid for it
+	endpoint, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+	endpoint.Host = net.JoinHostPort("example.com", endpoint.Port())
+
+	u := &UpstreamResolver{
+		Upstreams: []string{endpoint.String()},
+		Bootstrap: []string{"127.0.0.1"},
+	}
+	if err := u.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	trustTestServer(u, server)
+	defer func() { _ = u.Cleanup() }()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	w := &mockResponseWriter{}
+	if err := u.ServeDNS(context.Background(), w, req); err != nil {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+	if w.msg.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected NOERROR through the bootstrap address, got %s", dns.RcodeToString[w.msg.Rcode])
+	}
+}
+
+func TestUpstreamResolver_DoHErrorStatus(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	u := &UpstreamResolver{Upstreams: []string{server.URL}}
+	if err := u.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	trustTestServer(u, server)
+
+	if u.Upstreams[0] != server.URL+"/dns-query" {
+		t.Errorf("Expected default path /dns-query, got %s", u.Upstreams[0])
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	w := &mockResponseWriter{}
+	if err := u.ServeDNS(context.Background(), w, req); err != nil {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+	if w.msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL, got %s", dns.RcodeToString[w.msg.Rcode])
+	}
+}
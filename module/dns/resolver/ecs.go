@@ -0,0 +1,187 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ecsForward = "forward"
+	ecsStrip   = "strip"
+	ecsRewrite = "rewrite"
+
+	defaultECSIPv4Prefix = 24
+	defaultECSIPv6Prefix = 56
+)
+
+// ClientSubnet configures EDNS Client Subnet (RFC 7871) in queries to the
+// upstreams, which lets CDNs localize their answers to the client's
+// network.
+type ClientSubnet struct {
+	// Mode is "forward" to send the client's subnet, taken from its own
+	// ECS option or else from its source address; "strip" to remove ECS
+	// so that nothing about the client is revealed; or "rewrite" to send
+	// Subnet in place of the client's.
+	Mode string `json:"mode,omitempty"`
+
+	// IPv4Prefix and IPv6Prefix limit how much of the client's address is
+	// forwarded. They default to 24 and 56, as RFC 7871 recommends.
+	IPv4Prefix int `json:"ipv4_prefix,omitempty"`
+	IPv6Prefix int `json:"ipv6_prefix,omitempty"`
+
+	// Subnet is the CIDR sent in rewrite mode, e.g. the network of the
+	// server so that answers are localized to it.
+	Subnet string `json:"subnet,omitempty"`
+
+	subnet *dns.EDNS0_SUBNET
+}
+
+func (c *ClientSubnet) provision() error {
+	switch c.Mode {
+	case ecsForward, ecsStrip:
+	case ecsRewrite:
+		_, network, err := net.ParseCIDR(c.Subnet)
+		if err != nil {
+			return fmt.Errorf("invalid subnet: %w", err)
+		}
+		ones, _ := network.Mask.Size()
+		c.subnet = newSubnetOption(network.IP, ones)
+	default:
+		return fmt.Errorf("unsupported mode %q: must be forward, strip or rewrite", c.Mode)
+	}
+
+	if c.IPv4Prefix == 0 {
+		c.IPv4Prefix = defaultECSIPv4Prefix
+	}
+	if c.IPv4Prefix < 0 || c.IPv4Prefix > 32 {
+		return fmt.Errorf("ipv4_prefix must be between 0 and 32")
+	}
+	if c.IPv6Prefix == 0 {
+		c.IPv6Prefix = defaultECSIPv6Prefix
+	}
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		return fmt.Errorf("ipv6_prefix must be between 0 and 128")
+	}
+
+	return nil
+}
+
+// apply sets the ECS option of a query to the upstreams for a client at
+// addr. The query must be a copy, as its OPT record may be modified.
+func (c *ClientSubnet) apply(query *dns.Msg, addr net.Addr) {
+	clientSubnet := findSubnet(query)
+	removeSubnet(query)
+
+	var subnet *dns.EDNS0_SUBNET
+	switch c.Mode {
+	case ecsRewrite:
+		subnet = c.subnet
+	case ecsForward:
+		switch {
+		case clientSubnet != nil && clientSubnet.SourceNetmask == 0:
+			// The client opted out of ECS (RFC 7871 section 7.1.2)
+			subnet = clientSubnet
+		case clientSubnet != nil:
+			subnet = c.truncate(clientSubnet.Address, int(clientSubnet.SourceNetmask))
+		default:
+			if ip := addrIP(addr); ip != nil {
+				subnet = c.truncate(ip, 128)
+			}
+		}
+	}
+	if subnet == nil {
+		return
+	}
+
+	opt := query.IsEdns0()
+	if opt == nil {
+		query.SetEdns0(dns.DefaultMsgSize, false)
+		opt = query.IsEdns0()
+	}
+	opt.Option = append(opt.Option, subnet)
+}
+
+// restore makes the ECS option of a response match what the client asked
+// for: it is only returned to clients that sent one and whose subnet was
+// forwarded, and the OPT record is removed if the client sent none.
+func (c *ClientSubnet) restore(r, resp *dns.Msg) {
+	if findSubnet(r) != nil && c.Mode == ecsForward {
+		return
+	}
+	removeSubnet(resp)
+
+	if opt := resp.IsEdns0(); opt != nil && r.IsEdns0() == nil {
+		resp.Extra = slices.DeleteFunc(resp.Extra, func(rr dns.RR) bool { return rr == opt })
+	}
+}
+
+// truncate returns an ECS option for ip, with at most prefix bits and no
+// more than the configured limit for its family.
+func (c *ClientSubnet) truncate(ip net.IP, prefix int) *dns.EDNS0_SUBNET {
+	limit := c.IPv6Prefix
+	if ip.To4() != nil {
+		limit = c.IPv4Prefix
+		prefix = min(prefix, 32)
+	}
+	return newSubnetOption(ip, min(prefix, limit))
+}
+
+func newSubnetOption(ip net.IP, prefix int) *dns.EDNS0_SUBNET {
+	subnet := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(prefix), // #nosec G115 - at most 128
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		subnet.Family = 1
+		subnet.Address = ip4.Mask(net.CIDRMask(prefix, 32))
+	} else {
+		subnet.Family = 2
+		subnet.Address = ip.Mask(net.CIDRMask(prefix, 128))
+	}
+	return subnet
+}
+
+// findSubnet returns the ECS option of a message, if it has one.
+func findSubnet(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// removeSubnet removes any ECS option from a message.
+func removeSubnet(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool {
+		return o.Option() == dns.EDNS0SUBNET
+	})
+}
+
+// addrIP returns the IP address of a client address.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
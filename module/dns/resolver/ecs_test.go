@@ -0,0 +1,146 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamResolver_ClientSubnet(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.123"), Port: 5300}
+	clientSubnet := func(addr string, prefix uint8) *dns.EDNS0_SUBNET {
+		return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: prefix, Address: net.ParseIP(addr).To4()}
+	}
+
+	tests := []struct {
+		name         string
+		config       *ClientSubnet
+		clientOption *dns.EDNS0_SUBNET
+		// wantForwarded is the subnet sent upstream, empty for none
+		wantForwarded string
+		wantReturned  bool
+	}{
+		{
+			name:          "forward from source address",
+			config:        &ClientSubnet{Mode: "forward"},
+			wantForwarded: "192.0.2.0/24",
+		},
+		{
+			name:          "forward client option",
+			config:        &ClientSubnet{Mode: "forward"},
+			clientOption:  clientSubnet("198.51.100.77", 32),
+			wantForwarded: "198.51.100.0/24",
+			wantReturned:  true,
+		},
+		{
+			name:          "forward narrower client option",
+			config:        &ClientSubnet{Mode: "forward", IPv4Prefix: 28},
+			clientOption:  clientSubnet("198.51.100.77", 20),
+			wantForwarded: "198.51.96.0/20",
+			wantReturned:  true,
+		},
+		{
+			name:          "forward respects opt-out",
+			config:        &ClientSubnet{Mode: "forward"},
+			clientOption:  clientSubnet("0.0.0.0", 0),
+			wantForwarded: "0.0.0.0/0",
+			wantReturned:  true,
+		},
+		{
+			name:         "strip",
+			config:       &ClientSubnet{Mode: "strip"},
+			clientOption: clientSubnet("198.51.100.77", 24),
+		},
+		{
+			name:          "rewrite",
+			config:        &ClientSubnet{Mode: "rewrite", Subnet: "203.0.113.0/24"},
+			clientOption:  clientSubnet("198.51.100.77", 24),
+			wantForwarded: "203.0.113.0/24",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwardedCh := make(chan string, 1)
+			addr := startTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+				m := new(dns.Msg)
+				m.SetReply(r)
+				forwarded := ""
+				if opt := r.IsEdns0(); opt != nil {
+					m.SetEdns0(dns.DefaultMsgSize, false)
+					for _, o := range opt.Option {
+						if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+							bits := 32
+							if subnet.Family == 2 {
+								bits = 128
+							}
+							forwarded = (&net.IPNet{IP: subnet.Address, Mask: net.CIDRMask(int(subnet.SourceNetmask), bits)}).String()
+							// Echo the option with a scope, as a CDN would
+							scoped := *subnet
+							scoped.SourceScope = subnet.SourceNetmask
+							m.IsEdns0().Option = append(m.IsEdns0().Option, &scoped)
+						}
+					}
+				}
+				forwardedCh <- forwarded
+				_ = w.WriteMsg(m)
+			})
+
+			u := &UpstreamResolver{Upstreams: []string{addr}, ClientSubnet: tt.config}
+			if err := u.Provision(mockContext{}); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("cdn.example.com.", dns.TypeA)
+			if tt.clientOption != nil {
+				req.SetEdns0(dns.DefaultMsgSize, false)
+				req.IsEdns0().Option = append(req.IsEdns0().Option, tt.clientOption)
+			}
+
+			w := &mockResponseWriter{remote: client}
+			if err := u.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+
+			if forwarded := <-forwardedCh; forwarded != tt.wantForwarded {
+				t.Errorf("Expected subnet %q forwarded, got %q", tt.wantForwarded, forwarded)
+			}
+			if returned := findSubnet(w.msg) != nil; returned != tt.wantReturned {
+				t.Errorf("Expected subnet returned to the client %v, got %v", tt.wantReturned, returned)
+			}
+			if tt.clientOption == nil && w.msg.IsEdns0() != nil {
+				t.Error("Expected no OPT record in the response to a client that sent none")
+			}
+			if tt.clientOption != nil && findSubnet(req) != tt.clientOption {
+				t.Error("Expected the client's query to be left unmodified")
+			}
+		})
+	}
+}
+
+func TestClientSubnet_Provision(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *ClientSubnet
+		wantErr bool
+	}{
+		{name: "forward", config: &ClientSubnet{Mode: "forward", IPv6Prefix: 48}},
+		{name: "strip", config: &ClientSubnet{Mode: "strip"}},
+		{name: "rewrite", config: &ClientSubnet{Mode: "rewrite", Subnet: "2001:db8::/48"}},
+		{name: "missing mode", config: &ClientSubnet{}, wantErr: true},
+		{name: "rewrite without subnet", config: &ClientSubnet{Mode: "rewrite"}, wantErr: true},
+		{name: "invalid ipv4 prefix", config: &ClientSubnet{Mode: "forward", IPv4Prefix: 33}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.provision()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ClientSubnet.provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
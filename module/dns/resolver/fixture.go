@@ -0,0 +1,194 @@
+package resolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+func init() {
+	mightydns.RegisterModule(&FixtureResolver{})
+}
+
+// FixtureResolver answers queries from responses preloaded from a fixture
+// file, so that load tests and benchmarks of the serving path are not
+// affected by upstream latency or changing answers.
+//
+// The fixture file is a JSON array of responses:
+//
+//	[{"name": "example.com.", "type": "A", "rcode": "NOERROR",
+//	  "answer": ["example.com. 300 IN A 192.0.2.1"]}]
+//
+// with optional "authority" and "additional" records in zone file format.
+type FixtureResolver struct {
+	File string `json:"file,omitempty"`
+	// UnmatchedRcode is returned for queries with no fixture. Defaults to
+	// NXDOMAIN.
+	UnmatchedRcode string `json:"unmatched_rcode,omitempty"`
+
+	fixtures  map[fixtureKey]*dns.Msg
+	unmatched int
+	logger    *slog.Logger
+}
+
+type fixtureKey struct {
+	name  string
+	qtype uint16
+}
+
+// fixture is one entry of the fixture file.
+type fixture struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Rcode      string   `json:"rcode,omitempty"`
+	Answer     []string `json:"answer,omitempty"`
+	Authority  []string `json:"authority,omitempty"`
+	Additional []string `json:"additional,omitempty"`
+}
+
+func (*FixtureResolver) MightyModule() mightydns.ModuleInfo {
+	return mightydns.ModuleInfo{
+		ID:  "dns.resolver.fixture",
+		New: func() mightydns.Module { return new(FixtureResolver) },
+	}
+}
+
+func (f *FixtureResolver) Provision(ctx mightydns.Context) error {
+	f.logger = ctx.Logger().With("module", "dns.resolver.fixture")
+
+	if f.File == "" {
+		return fmt.Errorf("file is required")
+	}
+
+	f.unmatched = dns.RcodeNameError
+	if f.UnmatchedRcode != "" {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(f.UnmatchedRcode)]
+		if !ok {
+			return fmt.Errorf("unknown unmatched_rcode: %s", f.UnmatchedRcode)
+		}
+		f.unmatched = rcode
+	}
+
+	// #nosec G304 - intentionally reading user-specified fixture file
+	data, err := os.ReadFile(f.File)
+	if err != nil {
+		return fmt.Errorf("reading fixture file: %w", err)
+	}
+
+	var fixtures []fixture
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return fmt.Errorf("parsing fixture file: %w", err)
+	}
+
+	f.fixtures = make(map[fixtureKey]*dns.Msg, len(fixtures))
+	for i, fx := range fixtures {
+		key, msg, err := fx.compile()
+		if err != nil {
+			return fmt.Errorf("fixture %d (%s %s): %w", i, fx.Name, fx.Type, err)
+		}
+		if _, exists := f.fixtures[key]; exists {
+			return fmt.Errorf("fixture %d: duplicate fixture for %s %s", i, fx.Name, fx.Type)
+		}
+		f.fixtures[key] = msg
+	}
+
+	f.logger.Debug("loaded response fixtures", "file", f.File, "count", len(f.fixtures))
+
+	return nil
+}
+
+// compile parses a fixture into the response it describes.
+func (fx fixture) compile() (fixtureKey, *dns.Msg, error) {
+	qtype, ok := dns.StringToType[strings.ToUpper(fx.Type)]
+	if !ok {
+		return fixtureKey{}, nil, fmt.Errorf("unknown type %s", fx.Type)
+	}
+	if fx.Name == "" {
+		return fixtureKey{}, nil, fmt.Errorf("name is required")
+	}
+	key := fixtureKey{name: strings.ToLower(dns.Fqdn(fx.Name)), qtype: qtype}
+
+	msg := new(dns.Msg)
+	if fx.Rcode != "" {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(fx.Rcode)]
+		if !ok {
+			return fixtureKey{}, nil, fmt.Errorf("unknown rcode %s", fx.Rcode)
+		}
+		msg.Rcode = rcode
+	}
+
+	for _, section := range []struct {
+		records []string
+		rrs     *[]dns.RR
+	}{
+		{fx.Answer, &msg.Answer},
+		{fx.Authority, &msg.Ns},
+		{fx.Additional, &msg.Extra},
+	} {
+		for _, record := range section.records {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				return fixtureKey{}, nil, fmt.Errorf("invalid record %q: %w", record, err)
+			}
+			if rr != nil {
+				*section.rrs = append(*section.rrs, rr)
+			}
+		}
+	}
+
+	return key, msg, nil
+}
+
+// LogValue summarizes the resolver's configuration for the startup summary
+// log.
+func (f *FixtureResolver) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("module", "dns.resolver.fixture"),
+		slog.String("file", f.File),
+		slog.Int("fixtures", len(f.fixtures)),
+	)
+}
+
+func (f *FixtureResolver) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	m := new(dns.Msg)
+	if len(r.Question) == 0 {
+		m.SetRcode(r, dns.RcodeFormatError)
+		return w.WriteMsg(m)
+	}
+	q := r.Question[0]
+
+	fx, ok := f.fixtures[fixtureKey{name: strings.ToLower(q.Name), qtype: q.Qtype}]
+	if !ok {
+		m.SetRcode(r, f.unmatched)
+		return w.WriteMsg(m)
+	}
+
+	mightydns.AddResolutionStage(ctx, "fixture")
+
+	m.SetRcode(r, fx.Rcode)
+	m.RecursionAvailable = true
+	m.Answer = copyRecords(fx.Answer)
+	m.Ns = copyRecords(fx.Ns)
+	m.Extra = copyRecords(fx.Extra)
+	return w.WriteMsg(m)
+}
+
+// copyRecords deep-copies rrs, so that responses can be modified further
+// along the chain without changing the fixture.
+func copyRecords(rrs []dns.RR) []dns.RR {
+	if len(rrs) == 0 {
+		return nil
+	}
+	copied := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		copied[i] = dns.Copy(rr)
+	}
+	return copied
+}
@@ -0,0 +1,164 @@
+package resolver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testFixtures = `[
+	{
+		"name": "example.com.",
+		"type": "A",
+		"answer": ["example.com. 300 IN A 192.0.2.1", "example.com. 300 IN A 192.0.2.2"]
+	},
+	{
+		"name": "example.com",
+		"type": "MX",
+		"answer": ["example.com. 300 IN MX 10 mail.example.com."],
+		"additional": ["mail.example.com. 300 IN A 192.0.2.25"]
+	},
+	{
+		"name": "gone.example.com.",
+		"type": "A",
+		"rcode": "NXDOMAIN",
+		"authority": ["example.com. 300 IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 60"]
+	}
+]`
+
+func writeFixtures(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fixtures.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write fixture file: %v", err)
+	}
+	return path
+}
+
+func TestFixtureResolver_Provision(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		config  *FixtureResolver
+		wantErr bool
+	}{
+		{
+			name:    "valid fixtures",
+			content: testFixtures,
+			config:  &FixtureResolver{UnmatchedRcode: "REFUSED"},
+		},
+		{
+			name:    "missing file",
+			config:  &FixtureResolver{File: "/nonexistent/fixtures.json"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid record",
+			content: `[{"name": "example.com.", "type": "A", "answer": ["example.com. IN A bogus"]}]`,
+			config:  &FixtureResolver{},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate fixture",
+			content: `[{"name": "example.com.", "type": "A"}, {"name": "EXAMPLE.com", "type": "a"}]`,
+			config:  &FixtureResolver{},
+			wantErr: true,
+		},
+		{
+			name:    "unknown unmatched rcode",
+			content: `[]`,
+			config:  &FixtureResolver{UnmatchedRcode: "NOTANRCODE"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.config.File == "" {
+				tt.config.File = writeFixtures(t, tt.content)
+			}
+			err := tt.config.Provision(mockContext{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FixtureResolver.Provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFixtureResolver_ServeDNS(t *testing.T) {
+	f := &FixtureResolver{File: writeFixtures(t, testFixtures)}
+	if err := f.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		wantRcode int
+		want      []string
+	}{
+		{
+			name:  "answer records",
+			qname: "example.com.",
+			qtype: dns.TypeA,
+			want:  []string{"example.com.\t300\tIN\tA\t192.0.2.1", "example.com.\t300\tIN\tA\t192.0.2.2"},
+		},
+		{
+			name:  "additional records",
+			qname: "Example.COM.",
+			qtype: dns.TypeMX,
+			want:  []string{"example.com.\t300\tIN\tMX\t10 mail.example.com.", "mail.example.com.\t300\tIN\tA\t192.0.2.25"},
+		},
+		{
+			name:      "negative fixture",
+			qname:     "gone.example.com.",
+			qtype:     dns.TypeA,
+			wantRcode: dns.RcodeNameError,
+			want:      []string{"example.com.\t300\tIN\tSOA\tns.example.com. hostmaster.example.com. 1 7200 3600 1209600 60"},
+		},
+		{
+			name:      "unmatched query",
+			qname:     "other.example.com.",
+			qtype:     dns.TypeA,
+			wantRcode: dns.RcodeNameError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tt.qname, tt.qtype)
+
+			w := &mockResponseWriter{}
+			if err := f.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+
+			if w.msg.Id != req.Id || w.msg.Question[0] != req.Question[0] {
+				t.Error("Expected the response to match the query")
+			}
+			if w.msg.Rcode != tt.wantRcode {
+				t.Errorf("Expected rcode %s, got %s", dns.RcodeToString[tt.wantRcode], dns.RcodeToString[w.msg.Rcode])
+			}
+
+			var got []string
+			for _, section := range [][]dns.RR{w.msg.Answer, w.msg.Ns, w.msg.Extra} {
+				for _, rr := range section {
+					got = append(got, rr.String())
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Expected records %q, got %q", tt.want, got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Expected record %q, got %q", tt.want[i], got[i])
+				}
+			}
+		})
+	}
+}
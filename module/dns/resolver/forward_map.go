@@ -0,0 +1,183 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+func init() {
+	mightydns.RegisterModule(&ForwardMap{})
+}
+
+// ForwardMap forwards queries to different upstreams depending on the
+// domain they are for, e.g. names under corp.example. to an internal
+// resolver and everything else to a public one. A query is forwarded by
+// the zone with the longest domain suffix matching its name, and by the
+// default resolver if no zone matches.
+type ForwardMap struct {
+	Zones []*ForwardZone `json:"zones,omitempty"`
+	// Default forwards the queries that match no zone, and those that
+	// fall through from one. Such queries are refused when it is unset.
+	Default *UpstreamResolver `json:"default,omitempty"`
+
+	zones  map[string]*ForwardZone
+	logger *slog.Logger
+}
+
+// ForwardZone forwards the queries for names under its domains. Apart
+// from Domains and Fallthrough, it takes the same options as
+// dns.resolver.upstream.
+type ForwardZone struct {
+	Domains []string `json:"domains,omitempty"`
+	// Fallthrough passes NXDOMAIN and SERVFAIL answers from the zone's
+	// upstreams on to the zone with the next longest matching suffix, or
+	// the default resolver, instead of returning them to the client.
+	Fallthrough bool `json:"fallthrough,omitempty"`
+
+	UpstreamResolver
+}
+
+func (*ForwardMap) MightyModule() mightydns.ModuleInfo {
+	return mightydns.ModuleInfo{
+		ID:  "dns.resolver.forward_map",
+		New: func() mightydns.Module { return new(ForwardMap) },
+	}
+}
+
+func (f *ForwardMap) Provision(ctx mightydns.Context) error {
+	f.logger = ctx.Logger().With("module", "dns.resolver.forward_map")
+
+	f.zones = make(map[string]*ForwardZone)
+	for i, zone := range f.Zones {
+		if zone == nil || len(zone.Domains) == 0 {
+			return fmt.Errorf("zone %d: domains are required", i)
+		}
+		if len(zone.Upstreams) == 0 {
+			return fmt.Errorf("zone %d: upstreams are required", i)
+		}
+
+		for j, domain := range zone.Domains {
+			name := dns.CanonicalName(domain)
+			if _, ok := dns.IsDomainName(name); !ok || name == "." {
+				return fmt.Errorf("zone %d: invalid domain %s", i, domain)
+			}
+			if _, ok := f.zones[name]; ok {
+				return fmt.Errorf("zone %d: domain %s is already mapped", i, domain)
+			}
+			f.zones[name] = zone
+			zone.Domains[j] = name
+		}
+
+		if err := zone.UpstreamResolver.Provision(ctx); err != nil {
+			return fmt.Errorf("zone %d: %w", i, err)
+		}
+	}
+
+	if f.Default != nil {
+		if err := f.Default.Provision(ctx); err != nil {
+			return fmt.Errorf("default: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// match returns the zones whose domains are suffixes of name, longest
+// first.
+func (f *ForwardMap) match(name string) []*ForwardZone {
+	name = dns.CanonicalName(name)
+
+	var zones []*ForwardZone
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if zone, ok := f.zones[name[off:]]; ok {
+			zones = append(zones, zone)
+		}
+	}
+	return zones
+}
+
+// LogValue summarizes the resolver's configuration for the startup summary
+// log.
+func (f *ForwardMap) LogValue() slog.Value {
+	attrs := []slog.Attr{slog.String("module", "dns.resolver.forward_map")}
+	for _, zone := range f.Zones {
+		attrs = append(attrs, slog.Group("zone",
+			slog.Any("domains", zone.Domains),
+			slog.Any("upstreams", zone.Upstreams),
+			slog.Bool("fallthrough", zone.Fallthrough)))
+	}
+	if f.Default != nil {
+		attrs = append(attrs, slog.Any("default", f.Default.Upstreams))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+func (f *ForwardMap) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	if len(r.Question) == 0 {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		return w.WriteMsg(m)
+	}
+	qname := r.Question[0].Name
+
+	for _, zone := range f.match(qname) {
+		if !zone.Fallthrough {
+			f.logger.Debug("forwarding query to zone",
+				"query_id", r.Id,
+				"query_name", qname,
+				"zone", zone.Domains)
+			return zone.ServeDNS(ctx, w, r)
+		}
+
+		buf := &bufferedWriter{ResponseWriter: w}
+		if err := zone.ServeDNS(ctx, buf, r); err != nil {
+			return err
+		}
+		if buf.msg != nil && buf.msg.Rcode != dns.RcodeNameError && buf.msg.Rcode != dns.RcodeServerFailure {
+			return w.WriteMsg(buf.msg)
+		}
+
+		f.logger.Debug("zone did not answer, falling through",
+			"query_id", r.Id,
+			"query_name", qname,
+			"zone", zone.Domains)
+	}
+
+	if f.Default == nil {
+		f.logger.Debug("no zone matches query, refusing",
+			"query_id", r.Id,
+			"query_name", qname)
+
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		return w.WriteMsg(m)
+	}
+	return f.Default.ServeDNS(ctx, w, r)
+}
+
+func (f *ForwardMap) Cleanup() error {
+	for _, zone := range f.Zones {
+		_ = zone.Cleanup()
+	}
+	if f.Default != nil {
+		_ = f.Default.Cleanup()
+	}
+	return nil
+}
+
+// bufferedWriter holds on to the message written through it instead of
+// sending it, so that it can be replaced.
+type bufferedWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *bufferedWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
@@ -0,0 +1,162 @@
+package resolver
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// answerWith returns an upstream handler answering every query with rcode
+// and, for NOERROR, an A record for ip.
+func answerWith(rcode int, ip string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		if rcode == dns.RcodeSuccess {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A " + ip)
+			m.Answer = append(m.Answer, rr)
+		}
+		_ = w.WriteMsg(m)
+	}
+}
+
+func TestForwardMap_Provision(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{
+			name: "zones and default",
+			config: `{"zones": [{"domains": ["corp.example"], "upstreams": ["10.0.0.53:53"], "fallthrough": true}],
+				"default": {"upstreams": ["1.1.1.1:53"]}}`,
+		},
+		{
+			name:   "no default",
+			config: `{"zones": [{"domains": ["corp.example."], "upstreams": ["10.0.0.53:53"]}]}`,
+		},
+		{
+			name:    "missing domains",
+			config:  `{"zones": [{"upstreams": ["10.0.0.53:53"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing upstreams",
+			config:  `{"zones": [{"domains": ["corp.example"]}]}`,
+			wantErr: true,
+		},
+		{
+			name: "duplicate domain",
+			config: `{"zones": [{"domains": ["corp.example"], "upstreams": ["10.0.0.53:53"]},
+				{"domains": ["CORP.example."], "upstreams": ["10.0.0.54:53"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid zone upstream",
+			config:  `{"zones": [{"domains": ["corp.example"], "upstreams": ["10.0.0.53"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid default",
+			config:  `{"default": {"protocol": "quic"}}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := new(ForwardMap)
+			if err := json.Unmarshal([]byte(tt.config), f); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			err := f.Provision(mockContext{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ForwardMap.Provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestForwardMap_ServeDNS(t *testing.T) {
+	corp := startTestUpstream(t, answerWith(dns.RcodeSuccess, "10.0.0.1"))
+	lab := startTestUpstream(t, answerWith(dns.RcodeNameError, ""))
+	public := startTestUpstream(t, answerWith(dns.RcodeSuccess, "192.0.2.1"))
+
+	config := `{"zones": [
+		{"domains": ["corp.example"], "upstreams": ["` + corp + `"]},
+		{"domains": ["lab.corp.example"], "upstreams": ["` + lab + `"], "fallthrough": true},
+		{"domains": ["test.corp.example"], "upstreams": ["` + lab + `"]}],
+		"default": {"upstreams": ["` + public + `"]}}`
+	f := new(ForwardMap)
+	if err := json.Unmarshal([]byte(config), f); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if err := f.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		qname     string
+		wantRcode int
+		wantIP    string
+	}{
+		{name: "zone apex", qname: "corp.example.", wantIP: "10.0.0.1"},
+		{name: "under zone", qname: "Host.Corp.Example.", wantIP: "10.0.0.1"},
+		{name: "longest suffix", qname: "host.test.corp.example.", wantRcode: dns.RcodeNameError},
+		{name: "fallthrough", qname: "host.lab.corp.example.", wantIP: "10.0.0.1"},
+		{name: "default", qname: "example.com.", wantIP: "192.0.2.1"},
+		{name: "suffix is not a label boundary", qname: "notcorp.example.", wantIP: "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tt.qname, dns.TypeA)
+			w := &mockResponseWriter{}
+			if err := f.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+
+			if w.msg.Rcode != tt.wantRcode {
+				t.Fatalf("Expected rcode %s, got %s", dns.RcodeToString[tt.wantRcode], dns.RcodeToString[w.msg.Rcode])
+			}
+			if tt.wantIP == "" {
+				return
+			}
+			if len(w.msg.Answer) != 1 {
+				t.Fatalf("Expected one answer, got %v", w.msg.Answer)
+			}
+			if got := w.msg.Answer[0].(*dns.A).A.String(); got != tt.wantIP {
+				t.Errorf("Expected %s, got %s", tt.wantIP, got)
+			}
+		})
+	}
+}
+
+func TestForwardMap_NoDefault(t *testing.T) {
+	lab := startTestUpstream(t, answerWith(dns.RcodeNameError, ""))
+
+	f := &ForwardMap{Zones: []*ForwardZone{{
+		Domains:          []string{"lab.example"},
+		Fallthrough:      true,
+		UpstreamResolver: UpstreamResolver{Upstreams: []string{lab}},
+	}}}
+	if err := f.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	for _, qname := range []string{"host.lab.example.", "example.com."} {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+		w := &mockResponseWriter{}
+		if err := f.ServeDNS(context.Background(), w, req); err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+		if w.msg.Rcode != dns.RcodeRefused {
+			t.Errorf("Expected REFUSED for %s, got %s", qname, dns.RcodeToString[w.msg.Rcode])
+		}
+	}
+}
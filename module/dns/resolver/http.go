@@ -0,0 +1,275 @@
+package resolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+const (
+	defaultHTTPNegativeTTL = 30 * time.Second
+	// httpCacheSweepInterval is how often expired answers are dropped from
+	// the cache, so that names that are no longer queried do not
+	// accumulate.
+	httpCacheSweepInterval = time.Minute
+)
+
+func init() {
+	mightydns.RegisterModule(&HTTPResolver{})
+}
+
+// HTTPResolver answers queries from an HTTP API returning JSON record data,
+// for integrating with external service discovery systems.
+//
+// The endpoint must respond with a JSON document of the form
+//
+//	{"records": [{"type": "A", "ttl": 60, "data": "192.0.2.1"}]}
+//
+// where data is the record's presentation format RDATA. Records whose type
+// does not match the query are ignored. A 404 response is answered with
+// NXDOMAIN and any other non-200 status with SERVFAIL.
+type HTTPResolver struct {
+	// Endpoint is the URL template to query. The placeholders {name} and
+	// {type} are replaced with the query name, without its trailing dot,
+	// and the query type.
+	Endpoint string `json:"endpoint,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+	// AuthHeader is sent as the Authorization header of every request.
+	AuthHeader string `json:"auth_header,omitempty"`
+	// NegativeTTL is how long empty and NXDOMAIN answers are cached.
+	// Answers with records are cached for their smallest TTL. Defaults to
+	// 30s.
+	NegativeTTL string `json:"negative_ttl,omitempty"`
+
+	client      *http.Client
+	negativeTTL time.Duration
+	logger      *slog.Logger
+	now         func() time.Time
+	mu          sync.Mutex
+	cache       map[httpCacheKey]*httpCacheEntry
+	swept       time.Time
+}
+
+type httpCacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type httpCacheEntry struct {
+	rcode   int
+	records []dns.RR
+	stored  time.Time
+	expires time.Time
+}
+
+// httpRecords is the JSON document returned by the endpoint.
+type httpRecords struct {
+	Records []struct {
+		Type string `json:"type"`
+		TTL  uint32 `json:"ttl"`
+		Data string `json:"data"`
+	} `json:"records"`
+}
+
+func (*HTTPResolver) MightyModule() mightydns.ModuleInfo {
+	return mightydns.ModuleInfo{
+		ID:  "dns.resolver.http",
+		New: func() mightydns.Module { return new(HTTPResolver) },
+	}
+}
+
+func (h *HTTPResolver) Provision(ctx mightydns.Context) error {
+	h.logger = ctx.Logger().With("module", "dns.resolver.http")
+
+	if h.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+	endpoint, err := url.Parse(strings.NewReplacer("{name}", "name", "{type}", "type").Replace(h.Endpoint))
+	if err != nil {
+		return fmt.Errorf("invalid endpoint: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return fmt.Errorf("endpoint must be an http or https URL")
+	}
+
+	timeout := 5 * time.Second
+	if h.Timeout != "" {
+		timeout, err = time.ParseDuration(h.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout duration: %w", err)
+		}
+	}
+
+	h.negativeTTL = defaultHTTPNegativeTTL
+	if h.NegativeTTL != "" {
+		h.negativeTTL, err = time.ParseDuration(h.NegativeTTL)
+		if err != nil {
+			return fmt.Errorf("invalid negative_ttl duration: %w", err)
+		}
+	}
+
+	h.client = &http.Client{Timeout: timeout}
+	if h.now == nil {
+		h.now = time.Now
+	}
+	h.cache = make(map[httpCacheKey]*httpCacheEntry)
+
+	return nil
+}
+
+// LogValue summarizes the resolver's configuration for the startup summary
+// log.
+func (h *HTTPResolver) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("module", "dns.resolver.http"),
+		slog.String("endpoint", h.Endpoint),
+	)
+}
+
+func (h *HTTPResolver) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	m := new(dns.Msg)
+	if len(r.Question) == 0 {
+		m.SetRcode(r, dns.RcodeFormatError)
+		return w.WriteMsg(m)
+	}
+	q := r.Question[0]
+
+	entry, err := h.lookup(ctx, q)
+	if err != nil {
+		h.logger.Debug("HTTP backend lookup failed, returning SERVFAIL",
+			"query_id", r.Id,
+			"query_name", q.Name,
+			"query_type", dns.TypeToString[q.Qtype],
+			"error", err)
+
+		m.SetRcode(r, dns.RcodeServerFailure)
+		return w.WriteMsg(m)
+	}
+
+	mightydns.AddResolutionStage(ctx, "http:"+h.Endpoint)
+
+	m.SetRcode(r, entry.rcode)
+	m.Authoritative = true
+	elapsed := uint32(h.now().Sub(entry.stored) / time.Second)
+	for _, rr := range entry.records {
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		rr.Header().Ttl -= min(elapsed, rr.Header().Ttl)
+		m.Answer = append(m.Answer, rr)
+	}
+	return w.WriteMsg(m)
+}
+
+// lookup returns the backend's answer for q, from the cache if it has not
+// expired.
+func (h *HTTPResolver) lookup(ctx context.Context, q dns.Question) (*httpCacheEntry, error) {
+	key := httpCacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype}
+	now := h.now()
+
+	h.mu.Lock()
+	entry, ok := h.cache[key]
+	h.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		cacheRequestsTotal.Inc("dns.resolver.http", "hit")
+		return entry, nil
+	}
+	cacheRequestsTotal.Inc("dns.resolver.http", "miss")
+
+	entry, err := h.fetch(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	if now.Sub(h.swept) >= httpCacheSweepInterval {
+		for k, e := range h.cache {
+			if !now.Before(e.expires) {
+				delete(h.cache, k)
+			}
+		}
+		h.swept = now
+	}
+	h.cache[key] = entry
+	h.mu.Unlock()
+
+	return entry, nil
+}
+
+// fetch queries the endpoint for the records of the given name and type.
+func (h *HTTPResolver) fetch(ctx context.Context, key httpCacheKey) (*httpCacheEntry, error) {
+	qtype := dns.TypeToString[key.qtype]
+	endpoint := strings.NewReplacer(
+		"{name}", url.PathEscape(strings.TrimSuffix(key.name, ".")),
+		"{type}", url.PathEscape(qtype),
+	).Replace(h.Endpoint)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if h.AuthHeader != "" {
+		req.Header.Set("Authorization", h.AuthHeader)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting %s: %w", endpoint, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	now := h.now()
+	entry := &httpCacheEntry{
+		rcode:   dns.RcodeSuccess,
+		stored:  now,
+		expires: now.Add(h.negativeTTL),
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		entry.rcode = dns.RcodeNameError
+		return entry, nil
+	default:
+		return nil, fmt.Errorf("unexpected status from %s: %s", endpoint, resp.Status)
+	}
+
+	var body httpRecords
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding response from %s: %w", endpoint, err)
+	}
+
+	var minTTL uint32
+	for _, record := range body.Records {
+		if !strings.EqualFold(record.Type, qtype) {
+			continue
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", key.name, record.TTL, qtype, record.Data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s record %q: %w", qtype, record.Data, err)
+		}
+		if rr == nil {
+			continue
+		}
+		if len(entry.records) == 0 || record.TTL < minTTL {
+			minTTL = record.TTL
+		}
+		entry.records = append(entry.records, rr)
+	}
+
+	if len(entry.records) > 0 {
+		entry.expires = now.Add(time.Duration(minTTL) * time.Second)
+	}
+
+	return entry, nil
+}
@@ -0,0 +1,156 @@
+package resolver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHTTPResolver_Provision(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *HTTPResolver
+		wantErr bool
+	}{
+		{
+			name:   "templated endpoint",
+			config: &HTTPResolver{Endpoint: "http://127.0.0.1:8080/records/{name}/{type}", Timeout: "2s"},
+		},
+		{
+			name:    "missing endpoint",
+			config:  &HTTPResolver{},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported scheme",
+			config:  &HTTPResolver{Endpoint: "ftp://127.0.0.1/{name}"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid timeout",
+			config:  &HTTPResolver{Endpoint: "http://127.0.0.1/{name}", Timeout: "invalid"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid negative ttl",
+			config:  &HTTPResolver{Endpoint: "http://127.0.0.1/{name}", NegativeTTL: "invalid"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Provision(mockContext{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("HTTPResolver.Provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPResolver_ServeDNS(t *testing.T) {
+	var requests atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/records/web.service.internal/A":
+			_, _ = w.Write([]byte(`{"records": [
+				{"type": "A", "ttl": 60, "data": "192.0.2.10"},
+				{"type": "A", "ttl": 30, "data": "192.0.2.11"},
+				{"type": "TXT", "ttl": 60, "data": "\"ignored\""}
+			]}`))
+		case "/records/broken.service.internal/A":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+
+	now := time.Unix(1700000000, 0)
+	h := &HTTPResolver{
+		Endpoint:   backend.URL + "/records/{name}/{type}",
+		AuthHeader: "Bearer secret",
+		now:        func() time.Time { return now },
+	}
+	if err := h.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	query := func(name string) *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		w := &mockResponseWriter{}
+		if err := h.ServeDNS(context.Background(), w, req); err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+		return w.msg
+	}
+
+	resp := query("web.service.internal.")
+	if resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Expected NOERROR, got %s", dns.RcodeToString[resp.Rcode])
+	}
+	if len(resp.Answer) != 2 {
+		t.Fatalf("Expected 2 A records, got %v", resp.Answer)
+	}
+	if a, ok := resp.Answer[0].(*dns.A); !ok || a.A.String() != "192.0.2.10" || a.Hdr.Ttl != 60 {
+		t.Errorf("Expected A 192.0.2.10 with TTL 60, got %v", resp.Answer[0])
+	}
+
+	if resp := query("missing.service.internal."); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN for a 404, got %s", dns.RcodeToString[resp.Rcode])
+	}
+	if resp := query("broken.service.internal."); resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL for a backend error, got %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	// Answers are cached until their smallest TTL expires, with the
+	// remaining TTL returned to clients
+	requests.Store(0)
+	now = now.Add(20 * time.Second)
+	resp = query("web.service.internal.")
+	if got := requests.Load(); got != 0 {
+		t.Errorf("Expected a cached answer, got %d backend requests", got)
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 40 {
+		t.Errorf("Expected the cached TTL to count down to 40, got %d", ttl)
+	}
+
+	now = now.Add(10 * time.Second)
+	query("web.service.internal.")
+	if got := requests.Load(); got != 1 {
+		t.Errorf("Expected the expired answer to be refetched, got %d backend requests", got)
+	}
+
+	// Expired answers are only swept once per interval, not on every miss
+	cached := func(name string) bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		_, ok := h.cache[httpCacheKey{name: name, qtype: dns.TypeA}]
+		return ok
+	}
+	h.mu.Lock()
+	h.swept = now
+	h.mu.Unlock()
+	now = now.Add(h.negativeTTL)
+	query("other.service.internal.")
+	if !cached("missing.service.internal.") {
+		t.Error("Expected expired answers to be kept until the sweep interval has passed")
+	}
+	now = now.Add(httpCacheSweepInterval)
+	query("another.service.internal.")
+	if cached("missing.service.internal.") {
+		t.Error("Expected expired answers to be swept once the interval has passed")
+	}
+}
@@ -0,0 +1,235 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+const (
+	defaultMDNSAddress = "224.0.0.251:5353"
+	defaultMDNSTimeout = time.Second
+	// mdnsMaxTTL caps the TTL of bridged answers, as responders do for
+	// one-shot queries (RFC 6762 section 5.1), since the answers are not
+	// refreshed as they would be in an mDNS cache.
+	mdnsMaxTTL = 10
+	// mdnsCacheFlush is the top bit of the class of mDNS records, which
+	// has no meaning in unicast DNS.
+	mdnsCacheFlush = 1 << 15
+)
+
+func init() {
+	mightydns.RegisterModule(&MDNSResolver{})
+}
+
+// MDNSResolver answers queries for .local names by asking the devices on
+// the LAN over multicast DNS (RFC 6762), letting clients that do not speak
+// mDNS resolve the names that printers, phones and IoT devices announce.
+//
+// Each query is sent as a one-shot mDNS query and answered with the first
+// response that has answers for it. If none arrives within the timeout,
+// the query is answered with NXDOMAIN.
+type MDNSResolver struct {
+	// Domains are the domains bridged to mDNS. Queries for other names are
+	// refused. Defaults to local. and the IPv4 link-local reverse domain,
+	// 254.169.in-addr.arpa.
+	Domains []string `json:"domains,omitempty"`
+	// Address is the multicast group and port queries are sent to.
+	// Defaults to 224.0.0.251:5353.
+	Address string `json:"address,omitempty"`
+	// Timeout is how long to wait for a response. Defaults to 1s.
+	Timeout string `json:"timeout,omitempty"`
+
+	addr    *net.UDPAddr
+	timeout time.Duration
+	logger  *slog.Logger
+}
+
+func (*MDNSResolver) MightyModule() mightydns.ModuleInfo {
+	return mightydns.ModuleInfo{
+		ID:  "dns.resolver.mdns",
+		New: func() mightydns.Module { return new(MDNSResolver) },
+	}
+}
+
+func (m *MDNSResolver) Provision(ctx mightydns.Context) error {
+	m.logger = ctx.Logger().With("module", "dns.resolver.mdns")
+
+	if len(m.Domains) == 0 {
+		m.Domains = []string{"local.", "254.169.in-addr.arpa."}
+	}
+	for i, domain := range m.Domains {
+		name := dns.CanonicalName(domain)
+		if _, ok := dns.IsDomainName(name); !ok {
+			return fmt.Errorf("invalid domain %s", domain)
+		}
+		m.Domains[i] = name
+	}
+
+	if m.Address == "" {
+		m.Address = defaultMDNSAddress
+	}
+	addr, err := net.ResolveUDPAddr("udp", m.Address)
+	if err != nil {
+		return fmt.Errorf("invalid address: %w", err)
+	}
+	m.addr = addr
+
+	m.timeout = defaultMDNSTimeout
+	if m.Timeout != "" {
+		timeout, err := time.ParseDuration(m.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout duration: %w", err)
+		}
+		m.timeout = timeout
+	}
+
+	return nil
+}
+
+// LogValue summarizes the resolver's configuration for the startup summary
+// log.
+func (m *MDNSResolver) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("module", "dns.resolver.mdns"),
+		slog.Any("domains", m.Domains),
+		slog.String("address", m.Address),
+	)
+}
+
+// bridged reports whether name is in one of the bridged domains.
+func (m *MDNSResolver) bridged(name string) bool {
+	for _, domain := range m.Domains {
+		if dns.IsSubDomain(domain, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MDNSResolver) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
+	resp := new(dns.Msg)
+	if len(r.Question) == 0 {
+		resp.SetRcode(r, dns.RcodeFormatError)
+		return w.WriteMsg(resp)
+	}
+	q := r.Question[0]
+
+	if q.Qclass != dns.ClassINET || !m.bridged(q.Name) {
+		m.logger.Debug("query is not for a bridged domain, refusing",
+			"query_id", r.Id,
+			"query_name", q.Name)
+
+		resp.SetRcode(r, dns.RcodeRefused)
+		return w.WriteMsg(resp)
+	}
+
+	answers, err := m.query(ctx, q)
+	if err != nil {
+		m.logger.Debug("mDNS query failed, returning SERVFAIL",
+			"query_id", r.Id,
+			"query_name", q.Name,
+			"query_type", dns.TypeToString[q.Qtype],
+			"error", err)
+
+		resp.SetRcode(r, dns.RcodeServerFailure)
+		return w.WriteMsg(resp)
+	}
+
+	mightydns.AddResolutionStage(ctx, "mdns")
+
+	if len(answers) == 0 {
+		resp.SetRcode(r, dns.RcodeNameError)
+		return w.WriteMsg(resp)
+	}
+	resp.SetReply(r)
+	resp.RecursionAvailable = true
+	resp.Answer = answers
+	return w.WriteMsg(resp)
+}
+
+// query sends q to the mDNS group from an ephemeral port, which makes it a
+// one-shot query that responders answer by unicast, and returns the
+// answers from the first response that has any. No answers and no error
+// means no device responded before the timeout.
+func (m *MDNSResolver) query(ctx context.Context, q dns.Question) ([]dns.RR, error) {
+	network := "udp4"
+	if m.addr.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	deadline := time.Now().Add(m.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	query := new(dns.Msg)
+	query.Id = dns.Id()
+	query.Question = []dns.Question{q}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(packed, m.addr); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf[:n]); err != nil || !resp.Response {
+			continue
+		}
+		if answers := mdnsAnswers(resp, q); len(answers) > 0 {
+			return answers, nil
+		}
+	}
+}
+
+// mdnsAnswers returns the records of an mDNS response that answer q, made
+// fit for unicast DNS.
+func mdnsAnswers(resp *dns.Msg, q dns.Question) []dns.RR {
+	var answers []dns.RR
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		if !strings.EqualFold(hdr.Name, q.Name) {
+			continue
+		}
+		if hdr.Rrtype != q.Qtype && q.Qtype != dns.TypeANY && hdr.Rrtype != dns.TypeCNAME {
+			continue
+		}
+
+		rr = dns.Copy(rr)
+		hdr = rr.Header()
+		hdr.Name = q.Name
+		hdr.Class &^= mdnsCacheFlush
+		hdr.Ttl = min(hdr.Ttl, mdnsMaxTTL)
+		answers = append(answers, rr)
+	}
+	return answers
+}
@@ -0,0 +1,108 @@
+package resolver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMDNSResolver_Provision(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *MDNSResolver
+		wantErr bool
+	}{
+		{name: "defaults", config: &MDNSResolver{}},
+		{
+			name:   "custom",
+			config: &MDNSResolver{Domains: []string{"home.arpa"}, Address: "[ff02::fb]:5353", Timeout: "500ms"},
+		},
+		{name: "invalid domain", config: &MDNSResolver{Domains: []string{"bad..local"}}, wantErr: true},
+		{name: "invalid address", config: &MDNSResolver{Address: "224.0.0.251"}, wantErr: true},
+		{name: "invalid timeout", config: &MDNSResolver{Timeout: "soon"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Provision(mockContext{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("MDNSResolver.Provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMDNSResolver_ServeDNS(t *testing.T) {
+	// Stands in for the devices on the LAN, answering like an mDNS
+	// responder with the cache-flush bit set and a long TTL
+	addr := startTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if !strings.EqualFold(r.Question[0].Name, "printer.local.") {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = []dns.RR{
+			&dns.A{
+				Hdr: dns.RR_Header{Name: "printer.local.", Rrtype: dns.TypeA, Class: dns.ClassINET | mdnsCacheFlush, Ttl: 120},
+				A:   []byte{192, 168, 1, 50},
+			},
+			&dns.TXT{
+				Hdr: dns.RR_Header{Name: "printer.local.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 120},
+				Txt: []string{"unrelated"},
+			},
+		}
+		_ = w.WriteMsg(m)
+	})
+
+	resolver := &MDNSResolver{Address: addr, Timeout: "200ms"}
+	if err := resolver.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		qname       string
+		wantRcode   int
+		wantAnswers int
+	}{
+		{name: "answered", qname: "Printer.local.", wantAnswers: 1},
+		{name: "no response", qname: "missing.local.", wantRcode: dns.RcodeNameError},
+		{name: "not bridged", qname: "printer.example.", wantRcode: dns.RcodeRefused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tt.qname, dns.TypeA)
+			w := &mockResponseWriter{}
+			if err := resolver.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+
+			if w.msg.Id != req.Id {
+				t.Errorf("Expected response ID %d, got %d", req.Id, w.msg.Id)
+			}
+			if w.msg.Rcode != tt.wantRcode {
+				t.Fatalf("Expected rcode %s, got %s", dns.RcodeToString[tt.wantRcode], dns.RcodeToString[w.msg.Rcode])
+			}
+			if len(w.msg.Answer) != tt.wantAnswers {
+				t.Fatalf("Expected %d answers, got %v", tt.wantAnswers, w.msg.Answer)
+			}
+			for _, rr := range w.msg.Answer {
+				hdr := rr.Header()
+				if hdr.Name != tt.qname {
+					t.Errorf("Expected owner %s, got %s", tt.qname, hdr.Name)
+				}
+				if hdr.Class != dns.ClassINET {
+					t.Errorf("Expected class IN, got %d", hdr.Class)
+				}
+				if hdr.Ttl != mdnsMaxTTL {
+					t.Errorf("Expected TTL capped at %d, got %d", mdnsMaxTTL, hdr.Ttl)
+				}
+			}
+		})
+	}
+}
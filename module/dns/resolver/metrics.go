@@ -0,0 +1,17 @@
+package resolver
+
+import "github.com/kusold/mightydns"
+
+var (
+	upstreamDuration = mightydns.NewHistogram("mightydns_upstream_request_duration_seconds",
+		"Round trip time of queries forwarded to upstreams, by upstream.",
+		nil, "upstream")
+	upstreamErrorsTotal = mightydns.NewCounter("mightydns_upstream_errors_total",
+		"Queries forwarded to upstreams that failed without a response, by upstream.",
+		"upstream")
+	upstreamCoalescedTotal = mightydns.NewCounter("mightydns_upstream_coalesced_total",
+		"Upstream queries saved by waiting for an identical query already in flight.")
+	cacheRequestsTotal = mightydns.NewCounter("mightydns_cache_requests_total",
+		"Cache lookups, by cache and whether they were a hit or a miss.",
+		"cache", "result")
+)
@@ -0,0 +1,120 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RaceOptions configures racing queries across upstreams. The first
+// upstream, in strategy order, is queried straight away; if it has not
+// answered within HedgeDelay, or fails before then, the query is also sent
+// to the rest of the raced upstreams. The first good answer is used and
+// the other queries are cancelled.
+type RaceOptions struct {
+	// Upstreams is how many upstreams are raced. Defaults to all of them.
+	// Any others are only tried, in turn, if every raced upstream fails.
+	Upstreams int `json:"upstreams,omitempty"`
+	// HedgeDelay is how long the first upstream has to answer before the
+	// others are queried too. Defaults to 0, querying all at once.
+	HedgeDelay string `json:"hedge_delay,omitempty"`
+
+	hedgeDelay time.Duration
+}
+
+func (o *RaceOptions) provision() error {
+	if o.Upstreams < 0 {
+		return fmt.Errorf("upstreams must not be negative")
+	}
+	if o.HedgeDelay != "" {
+		delay, err := time.ParseDuration(o.HedgeDelay)
+		if err != nil {
+			return fmt.Errorf("invalid hedge_delay duration: %w", err)
+		}
+		if delay < 0 {
+			return fmt.Errorf("hedge_delay must not be negative")
+		}
+		o.hedgeDelay = delay
+	}
+	return nil
+}
+
+// width returns how many of n upstreams are raced.
+func (o *RaceOptions) width(n int) int {
+	if o.Upstreams == 0 || o.Upstreams > n {
+		return n
+	}
+	return o.Upstreams
+}
+
+// raceResult is the outcome of a query to one raced upstream.
+type raceResult struct {
+	resp     *dns.Msg
+	upstream string
+	rtt      time.Duration
+	err      error
+}
+
+// good reports whether a result can win the race. SERVFAIL and REFUSED
+// usually mean the upstream is having trouble rather than that the answer
+// is final, so another upstream may do better.
+func (r raceResult) good() bool {
+	return r.err == nil && r.resp != nil &&
+		r.resp.Rcode != dns.RcodeServerFailure && r.resp.Rcode != dns.RcodeRefused
+}
+
+// race queries the upstreams as configured by Race and returns the first
+// good result. If none is good, it returns the last response received, or
+// the last error if there was none.
+func (u *UpstreamResolver) race(ctx context.Context, query *dns.Msg, upstreams []string) (*dns.Msg, string, time.Duration, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan raceResult, len(upstreams))
+	launched := 0
+	launch := func(n int) {
+		for _, upstream := range upstreams[launched:n] {
+			// Each exchange gets its own copy, since packing may modify it
+			go func(query *dns.Msg) {
+				resp, rtt, err := u.exchange(ctx, query, upstream)
+				results <- raceResult{resp: resp, upstream: upstream, rtt: rtt, err: err}
+			}(query.Copy())
+		}
+		launched = n
+	}
+
+	var hedge <-chan time.Time
+	if u.Race.hedgeDelay > 0 && len(upstreams) > 1 {
+		launch(1)
+		timer := time.NewTimer(u.Race.hedgeDelay)
+		defer timer.Stop()
+		hedge = timer.C
+	} else {
+		launch(len(upstreams))
+	}
+
+	var best raceResult
+	for received := 0; received < launched; {
+		select {
+		case <-hedge:
+			hedge = nil
+			launch(len(upstreams))
+		case result := <-results:
+			received++
+			if result.good() {
+				return result.resp, result.upstream, result.rtt, nil
+			}
+			if result.resp != nil || best.resp == nil {
+				best = result
+			}
+			// Don't wait out the hedge delay once the first upstream
+			// has failed
+			hedge = nil
+			launch(len(upstreams))
+		}
+	}
+
+	return best.resp, best.upstream, best.rtt, best.err
+}
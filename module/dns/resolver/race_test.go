@@ -0,0 +1,163 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// answerAfter returns an upstream handler that answers with ip after delay,
+// counting the queries it receives.
+func answerAfter(delay time.Duration, rcode int, ip string, count *atomic.Int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		count.Add(1)
+		time.Sleep(delay)
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		if ip != "" {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(ip),
+			})
+		}
+		_ = w.WriteMsg(m)
+	}
+}
+
+func TestUpstreamResolver_Race(t *testing.T) {
+	tests := []struct {
+		name         string
+		race         *RaceOptions
+		firstDelay   time.Duration
+		firstRcode   int
+		wantIP       string
+		wantSecond   int32
+		wantMaxDelay time.Duration
+	}{
+		{
+			name:         "fast first upstream wins before the hedge",
+			race:         &RaceOptions{HedgeDelay: "200ms"},
+			wantIP:       "192.0.2.1",
+			wantSecond:   0,
+			wantMaxDelay: 150 * time.Millisecond,
+		},
+		{
+			name:         "slow first upstream is hedged",
+			race:         &RaceOptions{HedgeDelay: "20ms"},
+			firstDelay:   time.Second,
+			wantIP:       "192.0.2.2",
+			wantSecond:   1,
+			wantMaxDelay: 500 * time.Millisecond,
+		},
+		{
+			name:         "all at once without a hedge delay",
+			race:         &RaceOptions{},
+			firstDelay:   time.Second,
+			wantIP:       "192.0.2.2",
+			wantSecond:   1,
+			wantMaxDelay: 500 * time.Millisecond,
+		},
+		{
+			name:         "failing first upstream skips the hedge",
+			race:         &RaceOptions{HedgeDelay: "5s"},
+			firstRcode:   dns.RcodeServerFailure,
+			wantIP:       "192.0.2.2",
+			wantSecond:   1,
+			wantMaxDelay: 500 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var firstCount, secondCount atomic.Int32
+			firstIP := "192.0.2.1"
+			if tt.firstRcode != dns.RcodeSuccess {
+				firstIP = ""
+			}
+			first := startTestUpstream(t, answerAfter(tt.firstDelay, tt.firstRcode, firstIP, &firstCount))
+			second := startTestUpstream(t, answerAfter(0, dns.RcodeSuccess, "192.0.2.2", &secondCount))
+
+			u := &UpstreamResolver{Upstreams: []string{first, second}, Race: tt.race, Timeout: "2s"}
+			if err := u.Provision(mockContext{}); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			w := &mockResponseWriter{}
+
+			start := time.Now()
+			if err := u.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > tt.wantMaxDelay {
+				t.Errorf("Expected an answer within %v, took %v", tt.wantMaxDelay, elapsed)
+			}
+
+			if len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != tt.wantIP {
+				t.Fatalf("Expected answer %s, got %v", tt.wantIP, w.msg.Answer)
+			}
+			if got := secondCount.Load(); got != tt.wantSecond {
+				t.Errorf("Expected the second upstream to be queried %d times, got %d", tt.wantSecond, got)
+			}
+		})
+	}
+}
+
+func TestUpstreamResolver_RaceWidth(t *testing.T) {
+	var counts [3]atomic.Int32
+	upstreams := []string{
+		startTestUpstream(t, answerAfter(0, dns.RcodeServerFailure, "", &counts[0])),
+		startTestUpstream(t, answerAfter(0, dns.RcodeServerFailure, "", &counts[1])),
+		startTestUpstream(t, answerAfter(0, dns.RcodeSuccess, "192.0.2.3", &counts[2])),
+	}
+
+	u := &UpstreamResolver{Upstreams: upstreams, Race: &RaceOptions{Upstreams: 2}}
+	if err := u.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := &mockResponseWriter{}
+	if err := u.ServeDNS(context.Background(), w, req); err != nil {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+
+	// Both raced upstreams answered SERVFAIL, which is a response rather
+	// than a failure, so the third is never reached
+	if w.msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL from the raced upstreams, got %s", dns.RcodeToString[w.msg.Rcode])
+	}
+	if counts[0].Load() != 1 || counts[1].Load() != 1 || counts[2].Load() != 0 {
+		t.Errorf("Expected only the first two upstreams to be raced, got %d, %d and %d queries",
+			counts[0].Load(), counts[1].Load(), counts[2].Load())
+	}
+}
+
+func TestRaceOptions_Provision(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *RaceOptions
+		wantErr bool
+	}{
+		{name: "defaults", config: &RaceOptions{}},
+		{name: "top two with hedge", config: &RaceOptions{Upstreams: 2, HedgeDelay: "50ms"}},
+		{name: "negative upstreams", config: &RaceOptions{Upstreams: -1}, wantErr: true},
+		{name: "invalid hedge delay", config: &RaceOptions{HedgeDelay: "soon"}, wantErr: true},
+		{name: "negative hedge delay", config: &RaceOptions{HedgeDelay: "-1s"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.provision()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RaceOptions.provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package resolver
+
+import (
+	"context"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// shadow sends r to each shadow upstream in the background and logs any
+// answer that differs from resp, the answer upstream gave to the client.
+func (u *UpstreamResolver) shadow(r, resp *dns.Msg, upstream string) {
+	if len(r.Question) == 0 {
+		return
+	}
+
+	query := r.Copy()
+	if u.AllowedEDNSOptions != nil {
+		u.filterEDNSOptions(query)
+	}
+	// Summarize the answer now, since resp may be modified once it is
+	// returned to the client
+	want := answerSummary(resp)
+
+	for _, shadow := range u.ShadowUpstreams {
+		u.shadows.Add(1)
+		go func() {
+			defer u.shadows.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+			defer cancel()
+
+			shadowResp, rtt, err := u.exchange(ctx, query, shadow)
+			if err != nil {
+				u.logger.Warn("shadow upstream failed",
+					"query_id", r.Id,
+					"query_name", query.Question[0].Name,
+					"shadow_upstream", shadow,
+					"error", err)
+				return
+			}
+
+			got := answerSummary(shadowResp)
+			if !slices.Equal(got, want) {
+				u.logger.Warn("shadow upstream answer differs",
+					"query_id", r.Id,
+					"query_name", query.Question[0].Name,
+					"query_type", dns.TypeToString[query.Question[0].Qtype],
+					"upstream", upstream,
+					"shadow_upstream", shadow,
+					"answer", want,
+					"shadow_answer", got,
+					"rtt", rtt)
+				return
+			}
+
+			u.logger.Debug("shadow upstream answer matches",
+				"query_id", r.Id,
+				"shadow_upstream", shadow,
+				"rtt", rtt)
+		}()
+	}
+}
+
+// answerSummary describes a response by its rcode and answer records, sorted
+// and without TTLs, so that equivalent answers compare equal.
+func answerSummary(m *dns.Msg) []string {
+	summary := make([]string, 0, len(m.Answer)+1)
+	for _, rr := range m.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		summary = append(summary, rr.String())
+	}
+	slices.Sort(summary)
+	return append([]string{dns.RcodeToString[m.Rcode]}, summary...)
+}
@@ -0,0 +1,101 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of shadow
+// queries.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestUpstreamResolver_ShadowUpstreams(t *testing.T) {
+	answer := func(ip string, queried *atomic.Int32) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			queried.Add(1)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(ip),
+			})
+			_ = w.WriteMsg(m)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		shadowIP     string
+		wantMismatch bool
+	}{
+		{name: "matching shadow", shadowIP: "192.0.2.1"},
+		{name: "mismatching shadow", shadowIP: "192.0.2.99", wantMismatch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var primaryQueries, shadowQueries atomic.Int32
+			var logs syncBuffer
+
+			u := &UpstreamResolver{
+				Upstreams:       []string{startTestUpstream(t, answer("192.0.2.1", &primaryQueries))},
+				ShadowUpstreams: []string{startTestUpstream(t, answer(tt.shadowIP, &shadowQueries))},
+			}
+			ctx := mockContext{logger: slog.New(slog.NewTextHandler(&logs, nil))}
+			if err := u.Provision(ctx); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+
+			w := &mockResponseWriter{}
+			if err := u.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+			// Wait for the shadow queries to finish
+			if err := u.Cleanup(); err != nil {
+				t.Fatalf("Cleanup failed: %v", err)
+			}
+
+			if got := w.msg.Answer[0].(*dns.A).A.String(); got != "192.0.2.1" {
+				t.Errorf("Expected the client to get the real answer 192.0.2.1, got %s", got)
+			}
+			if primaryQueries.Load() != 1 || shadowQueries.Load() != 1 {
+				t.Errorf("Expected one query to each upstream, got %d primary and %d shadow",
+					primaryQueries.Load(), shadowQueries.Load())
+			}
+
+			mismatch := strings.Contains(logs.String(), "shadow upstream answer differs")
+			if mismatch != tt.wantMismatch {
+				t.Errorf("Expected mismatch logged = %v, got logs: %s", tt.wantMismatch, logs.String())
+			}
+			if tt.wantMismatch && !strings.Contains(logs.String(), tt.shadowIP) {
+				t.Errorf("Expected the shadow answer in the mismatch log, got: %s", logs.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package resolver
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	strategySequential   = "sequential"
+	strategyRoundRobin   = "round_robin"
+	strategyRandom       = "random"
+	strategyLeastLatency = "least_latency"
+
+	// rttWeight is the weight of each new sample in the moving RTT
+	// average used by the least_latency strategy.
+	rttWeight = 0.3
+)
+
+// upstreamSelector orders the upstreams for each query according to a
+// strategy. Every upstream is still tried in turn if the earlier ones
+// fail; the strategy only decides which goes first.
+type upstreamSelector struct {
+	strategy string
+	next     atomic.Uint64
+
+	mu   sync.Mutex
+	rtts map[string]time.Duration
+}
+
+func newUpstreamSelector(strategy string) (*upstreamSelector, error) {
+	switch strategy {
+	case strategySequential, strategyRoundRobin, strategyRandom, strategyLeastLatency:
+	default:
+		return nil, fmt.Errorf("unsupported strategy: %s", strategy)
+	}
+	return &upstreamSelector{strategy: strategy, rtts: make(map[string]time.Duration)}, nil
+}
+
+// order returns the upstreams in the order to try them for one query.
+func (s *upstreamSelector) order(upstreams []string) []string {
+	switch s.strategy {
+	case strategyRoundRobin:
+		start := int((s.next.Add(1) - 1) % uint64(len(upstreams))) // #nosec G115 - bounded by len
+		return append(slices.Clone(upstreams[start:]), upstreams[:start]...)
+	case strategyRandom:
+		ordered := slices.Clone(upstreams)
+		rand.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+		return ordered
+	case strategyLeastLatency:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// Upstreams without a measurement yet sort first, so that each
+		// gets measured
+		ordered := slices.Clone(upstreams)
+		slices.SortStableFunc(ordered, func(a, b string) int {
+			return cmp.Compare(s.rtts[a], s.rtts[b])
+		})
+		return ordered
+	default:
+		return upstreams
+	}
+}
+
+// observe records the round trip time of a query to an upstream. Failed
+// queries should be recorded with the timeout, so that an upstream that
+// stops answering drops to the back.
+func (s *upstreamSelector) observe(upstream string, rtt time.Duration) {
+	if s.strategy != strategyLeastLatency {
+		return
+	}
+	if rtt <= 0 {
+		rtt = time.Microsecond
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if avg, ok := s.rtts[upstream]; ok {
+		rtt = time.Duration(rttWeight*float64(rtt) + (1-rttWeight)*float64(avg))
+	}
+	s.rtts[upstream] = rtt
+}
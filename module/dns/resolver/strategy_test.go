@@ -0,0 +1,104 @@
+package resolver
+
+import (
+	"context"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamSelector_Order(t *testing.T) {
+	upstreams := []string{"a:53", "b:53", "c:53"}
+
+	t.Run("sequential", func(t *testing.T) {
+		s, _ := newUpstreamSelector(strategySequential)
+		for i := 0; i < 3; i++ {
+			if got := s.order(upstreams); !slices.Equal(got, upstreams) {
+				t.Errorf("Expected %v, got %v", upstreams, got)
+			}
+		}
+	})
+
+	t.Run("round robin", func(t *testing.T) {
+		s, _ := newUpstreamSelector(strategyRoundRobin)
+		want := [][]string{
+			{"a:53", "b:53", "c:53"},
+			{"b:53", "c:53", "a:53"},
+			{"c:53", "a:53", "b:53"},
+			{"a:53", "b:53", "c:53"},
+		}
+		for _, w := range want {
+			if got := s.order(upstreams); !slices.Equal(got, w) {
+				t.Errorf("Expected %v, got %v", w, got)
+			}
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		s, _ := newUpstreamSelector(strategyRandom)
+		first := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			got := s.order(upstreams)
+			sorted := slices.Sorted(slices.Values(got))
+			if !slices.Equal(sorted, upstreams) {
+				t.Fatalf("Expected a permutation of %v, got %v", upstreams, got)
+			}
+			first[got[0]] = true
+		}
+		if len(first) < 2 {
+			t.Error("Expected more than one upstream to be tried first")
+		}
+	})
+
+	t.Run("least latency", func(t *testing.T) {
+		s, _ := newUpstreamSelector(strategyLeastLatency)
+		s.observe("a:53", 80*time.Millisecond)
+		s.observe("b:53", 10*time.Millisecond)
+		if got := s.order(upstreams); !slices.Equal(got, []string{"c:53", "b:53", "a:53"}) {
+			t.Errorf("Expected the unmeasured upstream first, then by RTT, got %v", got)
+		}
+
+		s.observe("c:53", 40*time.Millisecond)
+		// A run of slow answers moves the average past the others
+		for i := 0; i < 5; i++ {
+			s.observe("b:53", 200*time.Millisecond)
+		}
+		if got := s.order(upstreams); !slices.Equal(got, []string{"c:53", "a:53", "b:53"}) {
+			t.Errorf("Expected upstreams ordered by moving average RTT, got %v", got)
+		}
+	})
+}
+
+func TestUpstreamResolver_RoundRobin(t *testing.T) {
+	var firstCount, secondCount atomic.Int32
+	answer := func(count *atomic.Int32) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			count.Add(1)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			_ = w.WriteMsg(m)
+		}
+	}
+	first := startTestUpstream(t, answer(&firstCount))
+	second := startTestUpstream(t, answer(&secondCount))
+
+	u := &UpstreamResolver{Upstreams: []string{first, second}, Strategy: "round_robin"}
+	if err := u.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if err := u.ServeDNS(context.Background(), &mockResponseWriter{}, req); err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+	}
+
+	if firstCount.Load() != 2 || secondCount.Load() != 2 {
+		t.Errorf("Expected queries spread evenly, got %d and %d", firstCount.Load(), secondCount.Load())
+	}
+}
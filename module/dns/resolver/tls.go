@@ -0,0 +1,117 @@
+package resolver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+)
+
+// UpstreamTLS configures how the TLS connection to a tcp-tls upstream is
+// verified and set up.
+type UpstreamTLS struct {
+	// ServerName is the name the upstream's certificate is verified
+	// against and sent in SNI. Defaults to the upstream's host, which for
+	// an IP address requires the certificate to list that IP.
+	ServerName string `json:"server_name,omitempty"`
+
+	// SPKIPins lists base64-encoded SHA-256 digests of the
+	// SubjectPublicKeyInfo of acceptable upstream certificates. When set,
+	// the upstream's leaf certificate must match one of them in addition
+	// to being trusted.
+	SPKIPins []string `json:"spki_pins,omitempty"`
+
+	// CAFile is a PEM file of certificate authorities to trust instead of
+	// the system roots.
+	CAFile string `json:"ca_file,omitempty"`
+
+	// MinVersion is the minimum TLS version to accept: "1.2" (the
+	// default) or "1.3".
+	MinVersion string `json:"min_version,omitempty"`
+
+	// SessionResumption caches TLS sessions so that reconnecting to the
+	// upstream skips a full handshake.
+	SessionResumption bool `json:"session_resumption,omitempty"`
+}
+
+// tlsVersions maps the accepted min_version values to TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// config builds the TLS client config for connecting to upstream.
+func (t *UpstreamTLS) config(upstream string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: t.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(upstream)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ServerName = host
+	}
+
+	if t.MinVersion != "" {
+		version, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported min_version: %s", t.MinVersion)
+		}
+		cfg.MinVersion = version
+	}
+
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca_file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca_file %s", t.CAFile)
+		}
+	}
+
+	if len(t.SPKIPins) > 0 {
+		pins := make([][]byte, 0, len(t.SPKIPins))
+		for _, pin := range t.SPKIPins {
+			digest, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("invalid spki pin %s: must be a base64-encoded SHA-256 digest", pin)
+			}
+			pins = append(pins, digest)
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifySPKIPins(cs, pins)
+		}
+	}
+
+	if t.SessionResumption {
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	return cfg, nil
+}
+
+// verifySPKIPins checks that the peer's leaf certificate matches one of
+// pins. It runs on resumed sessions too, so a pin change takes effect
+// without waiting for cached sessions to expire.
+func verifySPKIPins(cs tls.ConnectionState, pins [][]byte) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("upstream presented no certificate")
+	}
+
+	digest := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if subtle.ConstantTimeCompare(digest[:], pin) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("upstream certificate public key %s matches no spki pin",
+		base64.StdEncoding.EncodeToString(digest[:]))
+}
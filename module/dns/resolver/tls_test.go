@@ -0,0 +1,259 @@
+package resolver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testTLSUpstream is a DNS-over-TLS server with a self-signed certificate
+// valid for dot.example and 127.0.0.1.
+type testTLSUpstream struct {
+	addr    string
+	caFile  string
+	pin     string
+	resumed atomic.Int32
+}
+
+func startTestTLSUpstream(t *testing.T) *testTLSUpstream {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dot.example"},
+		DNSNames:              []string{"dot.example"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+
+	upstream := &testTLSUpstream{caFile: filepath.Join(t.TempDir(), "ca.pem")}
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	upstream.pin = base64.StdEncoding.EncodeToString(digest[:])
+	if err := os.WriteFile(upstream.caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write CA file: %v", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if cs.DidResume {
+				upstream.resumed.Add(1)
+			}
+			return nil
+		},
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	upstream.addr = l.Addr().String()
+
+	server := &dns.Server{
+		Listener: l,
+		Net:      "tcp-tls",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			_ = w.WriteMsg(m)
+		}),
+	}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	return upstream
+}
+
+func TestUpstreamResolver_TLS(t *testing.T) {
+	upstream := startTestTLSUpstream(t)
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name      string
+		tls       *UpstreamTLS
+		wantRcode int
+	}{
+		{
+			name:      "trusted CA",
+			tls:       &UpstreamTLS{CAFile: upstream.caFile},
+			wantRcode: dns.RcodeSuccess,
+		},
+		{
+			name:      "untrusted certificate",
+			tls:       &UpstreamTLS{},
+			wantRcode: dns.RcodeServerFailure,
+		},
+		{
+			name:      "matching server name",
+			tls:       &UpstreamTLS{CAFile: upstream.caFile, ServerName: "dot.example"},
+			wantRcode: dns.RcodeSuccess,
+		},
+		{
+			name:      "mismatched server name",
+			tls:       &UpstreamTLS{CAFile: upstream.caFile, ServerName: "other.example"},
+			wantRcode: dns.RcodeServerFailure,
+		},
+		{
+			name:      "matching pin",
+			tls:       &UpstreamTLS{CAFile: upstream.caFile, SPKIPins: []string{wrongPin, upstream.pin}},
+			wantRcode: dns.RcodeSuccess,
+		},
+		{
+			name:      "mismatched pin",
+			tls:       &UpstreamTLS{CAFile: upstream.caFile, SPKIPins: []string{wrongPin}},
+			wantRcode: dns.RcodeServerFailure,
+		},
+		{
+			name:      "TLS 1.3 minimum",
+			tls:       &UpstreamTLS{CAFile: upstream.caFile, MinVersion: "1.3"},
+			wantRcode: dns.RcodeSuccess,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &UpstreamResolver{
+				Upstreams: []string{upstream.addr},
+				Protocol:  "tcp-tls",
+				Timeout:   "2s",
+				TLS:       map[string]*UpstreamTLS{upstream.addr: tt.tls},
+			}
+			if err := u.Provision(mockContext{}); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+
+			w := &mockResponseWriter{}
+			if err := u.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+			if w.msg.Rcode != tt.wantRcode {
+				t.Errorf("Expected %s, got %s", dns.RcodeToString[tt.wantRcode], dns.RcodeToString[w.msg.Rcode])
+			}
+		})
+	}
+}
+
+func TestUpstreamResolver_TLSSessionResumption(t *testing.T) {
+	upstream := startTestTLSUpstream(t)
+
+	u := &UpstreamResolver{
+		Upstreams: []string{upstream.addr},
+		Protocol:  "tcp-tls",
+		TLS: map[string]*UpstreamTLS{
+			upstream.addr: {CAFile: upstream.caFile, SessionResumption: true},
+		},
+	}
+	if err := u.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+
+		w := &mockResponseWriter{}
+		if err := u.ServeDNS(context.Background(), w, req); err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+		if w.msg.Rcode != dns.RcodeSuccess {
+			t.Fatalf("Expected NOERROR, got %s", dns.RcodeToString[w.msg.Rcode])
+		}
+	}
+
+	if upstream.resumed.Load() == 0 {
+		t.Error("Expected the second connection to resume the TLS session")
+	}
+}
+
+func TestUpstreamResolver_TLSProvision(t *testing.T) {
+	tests := []struct {
+		name   string
+		config UpstreamResolver
+	}{
+		{
+			name: "requires tcp-tls",
+			config: UpstreamResolver{
+				Upstreams: []string{"1.1.1.1:853"},
+				TLS:       map[string]*UpstreamTLS{"1.1.1.1:853": {}},
+			},
+		},
+		{
+			name: "unknown upstream",
+			config: UpstreamResolver{
+				Upstreams: []string{"1.1.1.1:853"},
+				Protocol:  "tcp-tls",
+				TLS:       map[string]*UpstreamTLS{"9.9.9.9:853": {}},
+			},
+		},
+		{
+			name: "invalid pin",
+			config: UpstreamResolver{
+				Upstreams: []string{"1.1.1.1:853"},
+				Protocol:  "tcp-tls",
+				TLS:       map[string]*UpstreamTLS{"1.1.1.1:853": {SPKIPins: []string{"not-a-digest"}}},
+			},
+		},
+		{
+			name: "unsupported min version",
+			config: UpstreamResolver{
+				Upstreams: []string{"1.1.1.1:853"},
+				Protocol:  "tcp-tls",
+				TLS:       map[string]*UpstreamTLS{"1.1.1.1:853": {MinVersion: "1.0"}},
+			},
+		},
+		{
+			name: "missing CA file",
+			config: UpstreamResolver{
+				Upstreams: []string{"1.1.1.1:853"},
+				Protocol:  "tcp-tls",
+				TLS:       map[string]*UpstreamTLS{"1.1.1.1:853": {CAFile: "missing.pem"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Provision(mockContext{}); err == nil {
+				t.Error("Expected Provision to fail")
+			}
+		})
+	}
+}
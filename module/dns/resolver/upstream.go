@@ -4,7 +4,12 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"math"
 	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -16,17 +21,179 @@ func init() {
 	mightydns.RegisterModule(&UpstreamResolver{})
 }
 
+const (
+	nonRecursiveRefuse  = "refuse"
+	nonRecursiveForward = "forward"
+)
+
 type UpstreamResolver struct {
+	// Upstreams are host:port addresses queried over Protocol, or
+	// "https://" URLs of DNS-over-HTTPS (RFC 8484) endpoints.
 	Upstreams []string `json:"upstreams,omitempty"`
 	Timeout   string   `json:"timeout,omitempty"`
 	Protocol  string   `json:"protocol,omitempty"`
 
+	// NonRecursive controls how queries with the RD bit cleared are
+	// handled. "forward" (the default) forwards them like any other query.
+	// "refuse" answers REFUSED without contacting any upstream, since this
+	// resolver holds no local data to answer from.
+	NonRecursive string `json:"non_recursive,omitempty"`
+
+	// Strategy decides which upstream each query is sent to first:
+	// "sequential" (the default) always starts with the first upstream,
+	// "round_robin" rotates through them, "random" picks one at random and
+	// "least_latency" prefers the one with the lowest moving average round
+	// trip time. The others are tried in turn if it fails.
+	Strategy string `json:"strategy,omitempty"`
+
+	// Coalesce shares the answer to a query with identical queries that
+	// arrive while it is in flight, instead of forwarding each of them, to
+	// protect the upstreams when many clients ask the same question at
+	// once.
+	Coalesce bool `json:"coalesce,omitempty"`
+
+	// MaxConcurrent caps the number of queries in flight to the upstreams
+	// at any one time. Zero means unlimited.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+	// MaxConcurrentWait is how long a query waits for a free slot once
+	// MaxConcurrent is reached before failing with SERVFAIL. Defaults to
+	// failing immediately.
+	MaxConcurrentWait string `json:"max_concurrent_wait,omitempty"`
+
+	// AddressFamilyPreference orders the upstreams so that those of the
+	// preferred address family are tried first: "ipv4", "ipv6" or "auto"
+	// (the default) to keep the configured order.
+	AddressFamilyPreference string `json:"address_family_preference,omitempty"`
+
+	// AllowedEDNSOptions lists the EDNS0 option codes forwarded to the
+	// upstreams and returned to clients. Other options are stripped from
+	// both the query and the response. When unset, all options pass
+	// through unchanged.
+	AllowedEDNSOptions []uint16 `json:"allowed_edns_options,omitempty"`
+
+	// RefetchIf re-queries the next upstream when a response matches any
+	// of its conditions, to work around censoring or buggy upstreams. If
+	// every upstream's response matches, the last one is returned.
+	RefetchIf *RefetchConditions `json:"refetch_if,omitempty"`
+
+	// ShadowUpstreams receive a copy of every answered query in the
+	// background, for validating a new resolver. Their answers are only
+	// compared with the one returned to the client and any discrepancy is
+	// logged; they are never returned to clients.
+	ShadowUpstreams []string `json:"shadow_upstreams,omitempty"`
+
+	// NegativeTTLMin and NegativeTTLMax clamp the negative caching TTL of
+	// NXDOMAIN and NODATA responses, taken from the SOA record in their
+	// authority section (RFC 2308). Raising the minimum reduces repeated
+	// failing lookups from misbehaving clients. Unset bounds are not
+	// applied.
+	NegativeTTLMin string `json:"negative_ttl_min,omitempty"`
+	NegativeTTLMax string `json:"negative_ttl_max,omitempty"`
+
+	// Bootstrap lists IP addresses to connect to for DNS-over-HTTPS
+	// upstreams instead of resolving their hostnames, which would otherwise
+	// need a working resolver. The hostname is still used to verify the
+	// endpoint's certificate.
+	Bootstrap []string `json:"bootstrap,omitempty"`
+
+	// TLS configures the TLS connection to individual upstreams when
+	// Protocol is "tcp-tls", keyed by upstream address. Upstreams without
+	// an entry are verified against the system roots using their host.
+	TLS map[string]*UpstreamTLS `json:"tls,omitempty"`
+
+	// TSIGKey names a key from the dns app's tsig_keys to sign queries to
+	// the upstreams with. Responses must be signed with the same key.
+	// Not supported with DNS-over-HTTPS upstreams.
+	TSIGKey string `json:"tsig_key,omitempty"`
+
+	// DNSSEC validates upstream responses against the DNSSEC chain of
+	// trust. Disabled when unset.
+	DNSSEC *DNSSECValidation `json:"dnssec,omitempty"`
+
+	// Race sends each query to several upstreams at once and uses the
+	// first good answer, to cut tail latency on unreliable links. Disabled
+	// when unset.
+	Race *RaceOptions `json:"race,omitempty"`
+
+	// ClientSubnet controls the EDNS Client Subnet option sent to the
+	// upstreams. When unset, any option from the client passes through.
+	ClientSubnet *ClientSubnet `json:"client_subnet,omitempty"`
+
+	selector *upstreamSelector
+	flights  *flightGroup
 	client   *dns.Client
+	clients  map[string]*dns.Client
+	doh      *http.Client
 	timeout  time.Duration
 	protocol string
+	sem      chan struct{}
+	semWait  time.Duration
+	shadows  *sync.WaitGroup
+	negMin   uint32
+	negMax   uint32
+	tsig     *mightydns.TSIGKey
 	logger   *slog.Logger
 }
 
+// RefetchConditions describes upstream responses that should not be
+// trusted.
+type RefetchConditions struct {
+	// Rcodes lists response codes, e.g. "NXDOMAIN", to refetch.
+	Rcodes []string `json:"rcodes,omitempty"`
+	// AnswerNetworks lists CIDRs that poisoned answers point into. A
+	// response with an A or AAAA record in any of them is refetched.
+	AnswerNetworks []string `json:"answer_networks,omitempty"`
+
+	rcodes   []int
+	networks []*net.IPNet
+}
+
+func (c *RefetchConditions) provision() error {
+	for _, name := range c.Rcodes {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(name)]
+		if !ok {
+			return fmt.Errorf("unknown rcode %s", name)
+		}
+		c.rcodes = append(c.rcodes, rcode)
+	}
+
+	for _, cidr := range c.AnswerNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid answer network %s: %w", cidr, err)
+		}
+		c.networks = append(c.networks, network)
+	}
+
+	return nil
+}
+
+// match reports whether resp meets any of the conditions, and why.
+func (c *RefetchConditions) match(resp *dns.Msg) (string, bool) {
+	if slices.Contains(c.rcodes, resp.Rcode) {
+		return "rcode " + dns.RcodeToString[resp.Rcode], true
+	}
+
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		for _, network := range c.networks {
+			if network.Contains(ip) {
+				return "answer " + ip.String() + " in " + network.String(), true
+			}
+		}
+	}
+
+	return "", false
+}
+
 func (UpstreamResolver) MightyModule() mightydns.ModuleInfo {
 	return mightydns.ModuleInfo{
 		ID:  "dns.resolver.upstream",
@@ -42,6 +209,7 @@ func (u *UpstreamResolver) Provision(ctx mightydns.Context) error {
 	}
 
 	if u.Timeout == "" {
+		u.Timeout = "5s"
 		u.timeout = 5 * time.Second
 	} else {
 		timeout, err := time.ParseDuration(u.Timeout)
@@ -57,25 +225,284 @@ func (u *UpstreamResolver) Provision(ctx mightydns.Context) error {
 	case "tcp-tls":
 		u.protocol = "tcp-tls"
 	case "udp", "":
+		u.Protocol = "udp"
 		u.protocol = "udp"
 	default:
 		return fmt.Errorf("unsupported protocol: %s", u.Protocol)
 	}
 
+	switch u.NonRecursive {
+	case nonRecursiveForward, "":
+		u.NonRecursive = nonRecursiveForward
+	case nonRecursiveRefuse:
+	default:
+		return fmt.Errorf("unsupported non_recursive mode: %s", u.NonRecursive)
+	}
+
+	if u.Strategy == "" {
+		u.Strategy = strategySequential
+	}
+	selector, err := newUpstreamSelector(u.Strategy)
+	if err != nil {
+		return err
+	}
+	u.selector = selector
+
+	if u.Coalesce {
+		u.flights = &flightGroup{flights: make(map[string]*flight)}
+	}
+
+	if u.MaxConcurrent < 0 {
+		return fmt.Errorf("max_concurrent must not be negative: %d", u.MaxConcurrent)
+	}
+	if u.MaxConcurrent > 0 {
+		u.sem = make(chan struct{}, u.MaxConcurrent)
+	}
+	if u.MaxConcurrentWait != "" {
+		wait, err := time.ParseDuration(u.MaxConcurrentWait)
+		if err != nil {
+			return fmt.Errorf("invalid max_concurrent_wait duration: %w", err)
+		}
+		u.semWait = wait
+	}
+
+	switch u.AddressFamilyPreference {
+	case "", "auto":
+		u.AddressFamilyPreference = "auto"
+	case "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("unsupported address_family_preference: %s", u.AddressFamilyPreference)
+	}
+
+	for i, upstream := range u.Upstreams {
+		normalized, err := normalizeAnyUpstream(upstream)
+		if err != nil {
+			return fmt.Errorf("invalid upstream address %s: %w", upstream, err)
+		}
+		u.Upstreams[i] = normalized
+	}
+
+	for i, upstream := range u.ShadowUpstreams {
+		normalized, err := normalizeAnyUpstream(upstream)
+		if err != nil {
+			return fmt.Errorf("invalid shadow upstream address %s: %w", upstream, err)
+		}
+		u.ShadowUpstreams[i] = normalized
+	}
+	u.shadows = new(sync.WaitGroup)
+
+	if u.AddressFamilyPreference != "auto" {
+		preferIPv6 := u.AddressFamilyPreference == "ipv6"
+		slices.SortStableFunc(u.Upstreams, func(a, b string) int {
+			return familyRank(b, preferIPv6) - familyRank(a, preferIPv6)
+		})
+	}
+
+	if u.NegativeTTLMin != "" {
+		ttl, err := parseTTL(u.NegativeTTLMin)
+		if err != nil {
+			return fmt.Errorf("invalid negative_ttl_min: %w", err)
+		}
+		u.negMin = ttl
+	}
+	if u.NegativeTTLMax != "" {
+		ttl, err := parseTTL(u.NegativeTTLMax)
+		if err != nil {
+			return fmt.Errorf("invalid negative_ttl_max: %w", err)
+		}
+		u.negMax = ttl
+		if u.negMax < u.negMin {
+			return fmt.Errorf("negative_ttl_max must not be less than negative_ttl_min")
+		}
+	}
+
+	if u.RefetchIf != nil {
+		if err := u.RefetchIf.provision(); err != nil {
+			return fmt.Errorf("invalid refetch_if: %w", err)
+		}
+	}
+
+	for _, ip := range u.Bootstrap {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid bootstrap address %s: not an IP address", ip)
+		}
+	}
+
 	u.client = &dns.Client{
 		Net:     u.protocol,
 		Timeout: u.timeout,
 	}
+	if len(u.TLS) > 0 {
+		if u.protocol != "tcp-tls" {
+			return fmt.Errorf("tls requires protocol tcp-tls, got %s", u.protocol)
+		}
+		if err := u.provisionTLS(); err != nil {
+			return err
+		}
+	}
+	if slices.ContainsFunc(u.Upstreams, isDoHUpstream) || slices.ContainsFunc(u.ShadowUpstreams, isDoHUpstream) {
+		u.doh = newDoHClient(u.timeout, u.Bootstrap)
+	}
 
-	for _, upstream := range u.Upstreams {
-		if _, _, err := net.SplitHostPort(upstream); err != nil {
-			return fmt.Errorf("invalid upstream address %s: %w", upstream, err)
+	if u.TSIGKey != "" {
+		if err := u.provisionTSIG(ctx); err != nil {
+			return err
+		}
+	}
+
+	if u.DNSSEC != nil {
+		if err := u.DNSSEC.provision(); err != nil {
+			return fmt.Errorf("invalid dnssec: %w", err)
+		}
+	}
+
+	if u.Race != nil {
+		if err := u.Race.provision(); err != nil {
+			return fmt.Errorf("invalid race: %w", err)
+		}
+	}
+
+	if u.ClientSubnet != nil {
+		if err := u.ClientSubnet.provision(); err != nil {
+			return fmt.Errorf("invalid client_subnet: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// provisionTSIG looks up the configured TSIG key in the dns app's keyring
+// and sets every client up to sign with it.
+func (u *UpstreamResolver) provisionTSIG(ctx mightydns.Context) error {
+	if u.doh != nil {
+		return fmt.Errorf("tsig_key is not supported with DNS-over-HTTPS upstreams")
+	}
+
+	keyring, ok := ctx.(mightydns.TSIGKeyring)
+	if !ok {
+		return fmt.Errorf("tsig_key requires the dns app's tsig_keys")
+	}
+	key, ok := keyring.TSIGKey(u.TSIGKey)
+	if !ok {
+		return fmt.Errorf("unknown tsig_key: %s", u.TSIGKey)
+	}
+	u.tsig = &key
+
+	secrets := map[string]string{key.Name: key.Secret}
+	u.client.TsigSecret = secrets
+	for _, client := range u.clients {
+		client.TsigSecret = secrets
+	}
+	return nil
+}
+
+// provisionTLS builds a client for each upstream with its own TLS config.
+func (u *UpstreamResolver) provisionTLS() error {
+	u.clients = make(map[string]*dns.Client, len(u.TLS))
+	normalized := make(map[string]*UpstreamTLS, len(u.TLS))
+
+	for addr, cfg := range u.TLS {
+		upstream, err := normalizeUpstream(addr)
+		if err != nil {
+			return fmt.Errorf("invalid tls upstream address %s: %w", addr, err)
 		}
+		if !slices.Contains(u.Upstreams, upstream) && !slices.Contains(u.ShadowUpstreams, upstream) {
+			return fmt.Errorf("tls configured for unknown upstream %s", addr)
+		}
+		if cfg == nil {
+			cfg = &UpstreamTLS{}
+		}
+
+		tlsConfig, err := cfg.config(upstream)
+		if err != nil {
+			return fmt.Errorf("invalid tls for upstream %s: %w", addr, err)
+		}
+		u.clients[upstream] = &dns.Client{
+			Net:       u.protocol,
+			Timeout:   u.timeout,
+			TLSConfig: tlsConfig,
+		}
+		normalized[upstream] = cfg
 	}
+	u.TLS = normalized
 
 	return nil
 }
 
+// exchange sends a query to a single upstream, sharing the answer of an
+// identical query already in flight to it when coalescing is enabled.
+func (u *UpstreamResolver) exchange(ctx context.Context, query *dns.Msg, upstream string) (*dns.Msg, time.Duration, error) {
+	if u.flights != nil {
+		if key, ok := flightKey(query, upstream); ok {
+			return u.flights.do(ctx, key, func(ctx context.Context) (*dns.Msg, time.Duration, error) {
+				return u.send(ctx, query, upstream)
+			})
+		}
+	}
+	return u.send(ctx, query, upstream)
+}
+
+// send sends a query to a single upstream over the protocol it is
+// configured for.
+func (u *UpstreamResolver) send(ctx context.Context, query *dns.Msg, upstream string) (*dns.Msg, time.Duration, error) {
+	if u.tsig != nil {
+		query = query.Copy()
+		if query.IsTsig() != nil {
+			query.Extra = query.Extra[:len(query.Extra)-1]
+		}
+		query.SetTsig(u.tsig.Name, u.tsig.Algorithm, 300, time.Now().Unix())
+	}
+
+	var (
+		resp *dns.Msg
+		rtt  time.Duration
+		err  error
+	)
+	switch client, ok := u.clients[upstream]; {
+	case isDoHUpstream(upstream):
+		resp, rtt, err = u.exchangeDoH(ctx, query, upstream)
+	case ok:
+		resp, rtt, err = client.ExchangeContext(ctx, query, upstream)
+	default:
+		resp, rtt, err = u.client.ExchangeContext(ctx, query, upstream)
+	}
+
+	if err == nil && u.tsig != nil {
+		// The client only verifies signed responses, so an unsigned one
+		// has to be rejected here. The upstream's signature is only valid
+		// between it and this resolver, so it is not passed on
+		if resp.IsTsig() == nil {
+			err = fmt.Errorf("upstream response is not TSIG-signed")
+		} else {
+			resp.Extra = resp.Extra[:len(resp.Extra)-1]
+		}
+	}
+
+	if err != nil {
+		// A query cancelled because the client went away or another
+		// upstream won a race says nothing about this upstream
+		if ctx.Err() == nil {
+			upstreamErrorsTotal.Inc(upstream)
+			u.selector.observe(upstream, u.timeout)
+		}
+		return nil, rtt, err
+	}
+	upstreamDuration.Observe(rtt.Seconds(), upstream)
+	u.selector.observe(upstream, rtt)
+	return resp, rtt, nil
+}
+
+// LogValue summarizes the resolver's configuration for the startup summary
+// log.
+func (u *UpstreamResolver) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("module", "dns.resolver.upstream"),
+		slog.Any("upstreams", u.Upstreams),
+		slog.String("protocol", u.protocol),
+		slog.String("strategy", u.Strategy),
+	)
+}
+
 func (u *UpstreamResolver) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) error {
 	// Extract query details for logging
 	var qname, qtype string
@@ -92,14 +519,80 @@ func (u *UpstreamResolver) ServeDNS(ctx context.Context, w dns.ResponseWriter, r
 		"protocol", u.protocol,
 		"timeout", u.timeout)
 
-	for i, upstream := range u.Upstreams {
-		u.logger.Debug("attempting upstream resolver",
+	if !r.RecursionDesired && u.NonRecursive == nonRecursiveRefuse {
+		u.logger.Debug("recursion not desired, refusing to forward query",
 			"query_id", r.Id,
-			"upstream", upstream,
-			"attempt", i+1,
-			"total_upstreams", len(u.Upstreams))
+			"query_name", qname,
+			"query_type", qtype)
+
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		return w.WriteMsg(m)
+	}
 
-		resp, rtt, err := u.client.ExchangeContext(ctx, r, upstream)
+	if !u.acquire(ctx) {
+		u.logger.Debug("upstream concurrency limit reached, returning SERVFAIL",
+			"query_id", r.Id,
+			"query_name", qname,
+			"query_type", qtype,
+			"max_concurrent", u.MaxConcurrent)
+
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		return w.WriteMsg(m)
+	}
+	defer u.release()
+
+	query := r
+	if u.AllowedEDNSOptions != nil || u.DNSSEC != nil || u.ClientSubnet != nil {
+		// Modify a copy, since the query is still used to build the
+		// response further up the chain
+		query = r.Copy()
+		if u.AllowedEDNSOptions != nil {
+			u.filterEDNSOptions(query)
+		}
+		if u.DNSSEC != nil {
+			setDO(query)
+		}
+		if u.ClientSubnet != nil {
+			u.ClientSubnet.apply(query, w.RemoteAddr())
+		}
+	}
+
+	// The last response rejected by RefetchIf, used if no upstream gives a
+	// better one
+	var rejected *dns.Msg
+	var rejectedBy string
+
+	upstreams := u.selector.order(u.Upstreams)
+	for attempt := 1; len(upstreams) > 0; attempt++ {
+		var (
+			resp     *dns.Msg
+			upstream string
+			rtt      time.Duration
+			err      error
+		)
+		if u.Race != nil && attempt == 1 {
+			raced := upstreams[:u.Race.width(len(upstreams))]
+			upstreams = upstreams[len(raced):]
+
+			u.logger.Debug("racing upstream resolvers",
+				"query_id", r.Id,
+				"upstreams", raced,
+				"hedge_delay", u.Race.hedgeDelay)
+
+			resp, upstream, rtt, err = u.race(ctx, query, raced)
+		} else {
+			upstream, upstreams = upstreams[0], upstreams[1:]
+
+			u.logger.Debug("attempting upstream resolver",
+				"query_id", r.Id,
+				"upstream", upstream,
+				"attempt", attempt,
+				"total_upstreams", len(u.Upstreams))
+
+			resp, rtt, err = u.exchange(ctx, query, upstream)
+		}
 		if err != nil {
 			u.logger.Debug("upstream resolver failed",
 				"query_id", r.Id,
@@ -119,8 +612,30 @@ func (u *UpstreamResolver) ServeDNS(ctx context.Context, w dns.ResponseWriter, r
 				"authority_count", len(resp.Ns),
 				"additional_count", len(resp.Extra))
 
-			resp.Id = r.Id
-			return w.WriteMsg(resp)
+			if u.DNSSEC != nil && !r.CheckingDisabled {
+				if !u.applyValidation(ctx, r, resp, upstream) {
+					m := new(dns.Msg)
+					m.SetRcode(r, dns.RcodeServerFailure)
+					if r.IsEdns0() != nil {
+						m.SetEdns0(dns.DefaultMsgSize, false)
+						m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeDNSBogus})
+					}
+					return w.WriteMsg(m)
+				}
+			}
+
+			if u.RefetchIf != nil {
+				if reason, ok := u.RefetchIf.match(resp); ok {
+					u.logger.Debug("upstream response matched refetch_if, trying next upstream",
+						"query_id", r.Id,
+						"upstream", upstream,
+						"reason", reason)
+					rejected, rejectedBy = resp, upstream
+					continue
+				}
+			}
+
+			return u.writeResponse(ctx, w, r, resp, upstream)
 		}
 
 		u.logger.Debug("upstream resolver returned nil response",
@@ -129,6 +644,10 @@ func (u *UpstreamResolver) ServeDNS(ctx context.Context, w dns.ResponseWriter, r
 			"rtt", rtt)
 	}
 
+	if rejected != nil {
+		return u.writeResponse(ctx, w, r, rejected, rejectedBy)
+	}
+
 	u.logger.Debug("all upstream resolvers failed, returning SERVFAIL",
 		"query_id", r.Id,
 		"query_name", qname,
@@ -141,6 +660,181 @@ func (u *UpstreamResolver) ServeDNS(ctx context.Context, w dns.ResponseWriter, r
 	return w.WriteMsg(m)
 }
 
+// normalizeUpstream validates a host:port upstream address and returns it in
+// canonical form. Hostnames are lowercased and stripped of any trailing dot
+// so that "DNS.Google:853" and "dns.google.:853" refer to the same upstream
+// and produce a usable TLS server name.
+func normalizeUpstream(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		return "", fmt.Errorf("missing host")
+	}
+
+	if net.ParseIP(host) == nil {
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		if host == "" {
+			return "", fmt.Errorf("missing host")
+		}
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// normalizeAnyUpstream normalizes either kind of upstream: a DoH endpoint
+// URL or a host:port address.
+func normalizeAnyUpstream(upstream string) (string, error) {
+	if isDoHUpstream(upstream) {
+		return normalizeDoHUpstream(upstream)
+	}
+	return normalizeUpstream(upstream)
+}
+
+// familyRank returns 1 if the upstream address is an IP literal of the
+// preferred family and 0 otherwise. Hostnames are never preferred, as their
+// family is unknown until they are resolved.
+func familyRank(addr string, preferIPv6 bool) int {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return 0
+	}
+	if (ip.To4() == nil) == preferIPv6 {
+		return 1
+	}
+	return 0
+}
+
+// writeResponse returns the response from upstream to the client.
+func (u *UpstreamResolver) writeResponse(ctx context.Context, w dns.ResponseWriter, r, resp *dns.Msg, upstream string) error {
+	mightydns.AddResolutionStage(ctx, "upstream:"+upstream)
+
+	if u.AllowedEDNSOptions != nil {
+		u.filterEDNSOptions(resp)
+	}
+
+	if len(u.ShadowUpstreams) > 0 {
+		u.shadow(r, resp, upstream)
+	}
+
+	if u.negMin > 0 || u.negMax > 0 {
+		u.clampNegativeTTL(resp)
+	}
+
+	if u.DNSSEC != nil {
+		stripDNSSEC(r, resp)
+	}
+
+	if u.ClientSubnet != nil {
+		u.ClientSubnet.restore(r, resp)
+	}
+
+	resp.Id = r.Id
+	// The CD bit is copied from the query so clients validating DNSSEC
+	// themselves see it honoured (RFC 4035 section 3.2.2)
+	resp.CheckingDisabled = r.CheckingDisabled
+	return w.WriteMsg(resp)
+}
+
+// clampNegativeTTL applies the configured negative TTL bounds to the SOA
+// records of a negative response. Both the SOA record's TTL and its minimum
+// field are clamped, since resolvers cache the lower of the two.
+func (u *UpstreamResolver) clampNegativeTTL(resp *dns.Msg) {
+	negative := resp.Rcode == dns.RcodeNameError ||
+		(resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0)
+	if !negative {
+		return
+	}
+
+	clamp := func(ttl uint32) uint32 {
+		if ttl < u.negMin {
+			ttl = u.negMin
+		}
+		if u.negMax > 0 && ttl > u.negMax {
+			ttl = u.negMax
+		}
+		return ttl
+	}
+
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa.Hdr.Ttl = clamp(soa.Hdr.Ttl)
+			soa.Minttl = clamp(soa.Minttl)
+		}
+	}
+}
+
+// parseTTL parses a duration into a whole number of seconds.
+func parseTTL(s string) (uint32, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 || d > math.MaxUint32*time.Second {
+		return 0, fmt.Errorf("duration %s out of range", s)
+	}
+	return uint32(d / time.Second), nil
+}
+
+// filterEDNSOptions removes the EDNS0 options that are not in the allowlist
+// from m.
+func (u *UpstreamResolver) filterEDNSOptions(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool {
+		return !slices.Contains(u.AllowedEDNSOptions, o.Option())
+	})
+}
+
+// acquire reserves an in-flight slot, waiting up to semWait for one to
+// free up. It reports whether a slot was obtained.
+func (u *UpstreamResolver) acquire(ctx context.Context) bool {
+	if u.sem == nil {
+		return true
+	}
+
+	select {
+	case u.sem <- struct{}{}:
+		return true
+	default:
+	}
+
+	if u.semWait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(u.semWait)
+	defer timer.Stop()
+
+	select {
+	case u.sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (u *UpstreamResolver) release() {
+	if u.sem != nil {
+		<-u.sem
+	}
+}
+
 func (u *UpstreamResolver) Cleanup() error {
+	if u.shadows != nil {
+		u.shadows.Wait()
+	}
+	if u.doh != nil {
+		u.doh.CloseIdleConnections()
+	}
 	return nil
 }
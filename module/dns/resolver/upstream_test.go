@@ -1,19 +1,33 @@
 package resolver
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"net"
+	"slices"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
-type mockContext struct{}
+type mockContext struct {
+	logger *slog.Logger
+}
 
 func (mockContext) App(name string) (interface{}, error) { return nil, nil }
-func (mockContext) Logger() *slog.Logger                 { return slog.Default() }
+func (c mockContext) Logger() *slog.Logger {
+	if c.logger != nil {
+		return c.logger
+	}
+	return slog.Default()
+}
 func (mockContext) LoadModule(cfg interface{}, fieldName string) (interface{}, error) {
 	return nil, fmt.Errorf("module loading not supported in mock context")
 }
+func (mockContext) DryRun() bool { return false }
 
 func TestUpstreamResolver_Provision(t *testing.T) {
 	tests := []struct {
@@ -42,6 +56,22 @@ func TestUpstreamResolver_Provision(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "doh upstream",
+			config: UpstreamResolver{
+				Upstreams: []string{"https://cloudflare-dns.com/dns-query"},
+				Bootstrap: []string{"1.1.1.1", "2606:4700:4700::1111"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid bootstrap address",
+			config: UpstreamResolver{
+				Upstreams: []string{"https://cloudflare-dns.com/dns-query"},
+				Bootstrap: []string{"cloudflare-dns.com"},
+			},
+			wantErr: true,
+		},
 		{
 			name: "invalid protocol",
 			config: UpstreamResolver{
@@ -49,6 +79,99 @@ func TestUpstreamResolver_Provision(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "invalid negative ttl",
+			config: UpstreamResolver{
+				NegativeTTLMin: "invalid",
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative ttl max below min",
+			config: UpstreamResolver{
+				NegativeTTLMin: "5m",
+				NegativeTTLMax: "1m",
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown refetch rcode",
+			config: UpstreamResolver{
+				RefetchIf: &RefetchConditions{Rcodes: []string{"NOTANRCODE"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid refetch network",
+			config: UpstreamResolver{
+				RefetchIf: &RefetchConditions{AnswerNetworks: []string{"not-a-cidr"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing upstream host",
+			config: UpstreamResolver{
+				Upstreams: []string{":53"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "refuse non-recursive queries",
+			config: UpstreamResolver{
+				NonRecursive: "refuse",
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid non-recursive mode",
+			config: UpstreamResolver{
+				NonRecursive: "invalid",
+			},
+			wantErr: true,
+		},
+		{
+			name: "concurrency limit",
+			config: UpstreamResolver{
+				MaxConcurrent:     10,
+				MaxConcurrentWait: "50ms",
+			},
+			wantErr: false,
+		},
+		{
+			name: "negative concurrency limit",
+			config: UpstreamResolver{
+				MaxConcurrent: -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid concurrency wait",
+			config: UpstreamResolver{
+				MaxConcurrentWait: "invalid",
+			},
+			wantErr: true,
+		},
+		{
+			name: "round robin strategy",
+			config: UpstreamResolver{
+				Strategy: "round_robin",
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid strategy",
+			config: UpstreamResolver{
+				Strategy: "fastest",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid address family preference",
+			config: UpstreamResolver{
+				AddressFamilyPreference: "ipx",
+			},
+			wantErr: true,
+		},
 		{
 			name: "invalid upstream address",
 			config: UpstreamResolver{
@@ -113,3 +236,529 @@ func TestUpstreamResolver_DefaultValues(t *testing.T) {
 		t.Errorf("Expected default protocol to be udp, got %s", u.protocol)
 	}
 }
+
+func TestUpstreamResolver_NormalizesUpstreams(t *testing.T) {
+	u := &UpstreamResolver{
+		Upstreams: []string{"DNS.Google:853", "dns.google.:853", "[2001:4860:4860::8888]:53", "1.1.1.1:53"},
+	}
+	if err := u.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	expected := []string{"dns.google:853", "dns.google:853", "[2001:4860:4860::8888]:53", "1.1.1.1:53"}
+	for i, want := range expected {
+		if u.Upstreams[i] != want {
+			t.Errorf("Expected upstream %d to be %s, got %s", i, want, u.Upstreams[i])
+		}
+	}
+}
+
+func TestUpstreamResolver_AddressFamilyPreference(t *testing.T) {
+	upstreams := []string{"8.8.8.8:53", "[2001:4860:4860::8888]:53", "dns.google:53", "1.1.1.1:53", "[2606:4700:4700::1111]:53"}
+
+	tests := []struct {
+		preference string
+		expected   []string
+	}{
+		{
+			preference: "auto",
+			expected:   upstreams,
+		},
+		{
+			preference: "ipv4",
+			expected:   []string{"8.8.8.8:53", "1.1.1.1:53", "[2001:4860:4860::8888]:53", "dns.google:53", "[2606:4700:4700::1111]:53"},
+		},
+		{
+			preference: "ipv6",
+			expected:   []string{"[2001:4860:4860::8888]:53", "[2606:4700:4700::1111]:53", "8.8.8.8:53", "dns.google:53", "1.1.1.1:53"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.preference, func(t *testing.T) {
+			u := &UpstreamResolver{
+				Upstreams:               append([]string(nil), upstreams...),
+				AddressFamilyPreference: tt.preference,
+			}
+			if err := u.Provision(mockContext{}); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+
+			for i, want := range tt.expected {
+				if u.Upstreams[i] != want {
+					t.Errorf("Expected upstream %d to be %s, got %s", i, want, u.Upstreams[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamResolver_NonRecursive(t *testing.T) {
+	tests := []struct {
+		name          string
+		nonRecursive  string
+		wantRcode     int
+		wantForwarded int32
+	}{
+		{
+			name:          "default forwards",
+			nonRecursive:  "",
+			wantRcode:     dns.RcodeSuccess,
+			wantForwarded: 1,
+		},
+		{
+			name:          "refuse mode refuses",
+			nonRecursive:  "refuse",
+			wantRcode:     dns.RcodeRefused,
+			wantForwarded: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded atomic.Int32
+			addr := startTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+				forwarded.Add(1)
+				m := new(dns.Msg)
+				m.SetReply(r)
+				_ = w.WriteMsg(m)
+			})
+
+			u := &UpstreamResolver{
+				Upstreams:    []string{addr},
+				NonRecursive: tt.nonRecursive,
+			}
+			if err := u.Provision(mockContext{}); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			req.RecursionDesired = false
+
+			w := &mockResponseWriter{}
+			if err := u.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+
+			if w.msg == nil {
+				t.Fatal("Expected a response to be written")
+			}
+			if w.msg.Rcode != tt.wantRcode {
+				t.Errorf("Expected rcode %s, got %s", dns.RcodeToString[tt.wantRcode], dns.RcodeToString[w.msg.Rcode])
+			}
+			if got := forwarded.Load(); got != tt.wantForwarded {
+				t.Errorf("Expected %d forwarded queries, got %d", tt.wantForwarded, got)
+			}
+		})
+	}
+}
+
+func TestUpstreamResolver_MaxConcurrent(t *testing.T) {
+	const limit = 2
+	const queries = 8
+
+	var inFlight, peak atomic.Int32
+	release := make(chan struct{})
+	addr := startTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		n := inFlight.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		<-release
+		inFlight.Add(-1)
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	})
+
+	u := &UpstreamResolver{
+		Upstreams:     []string{addr},
+		MaxConcurrent: limit,
+	}
+	if err := u.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	results := make(chan int, queries)
+	for i := 0; i < queries; i++ {
+		go func() {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			w := &mockResponseWriter{}
+			if err := u.ServeDNS(context.Background(), w, req); err != nil || w.msg == nil {
+				results <- -1
+				return
+			}
+			results <- w.msg.Rcode
+		}()
+	}
+
+	// Over-limit queries fail fast, so all but the admitted ones finish
+	// while the upstream is still blocked.
+	servfails := 0
+	for i := 0; i < queries-limit; i++ {
+		select {
+		case rcode := <-results:
+			if rcode != dns.RcodeServerFailure {
+				t.Errorf("Expected SERVFAIL for over-limit query, got %d", rcode)
+			}
+			servfails++
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for over-limit queries, got %d", servfails)
+		}
+	}
+	close(release)
+
+	for i := 0; i < limit; i++ {
+		if rcode := <-results; rcode != dns.RcodeSuccess {
+			t.Errorf("Expected NOERROR for admitted query, got %d", rcode)
+		}
+	}
+
+	if got := peak.Load(); got > limit {
+		t.Errorf("Expected at most %d concurrent upstream queries, saw %d", limit, got)
+	}
+}
+
+func TestUpstreamResolver_CheckingDisabled(t *testing.T) {
+	for _, cd := range []bool{true, false} {
+		t.Run(fmt.Sprintf("cd=%v", cd), func(t *testing.T) {
+			var forwardedCD atomic.Bool
+			addr := startTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+				forwardedCD.Store(r.CheckingDisabled)
+				m := new(dns.Msg)
+				m.SetReply(r)
+				// Simulate an upstream that doesn't echo the CD bit
+				m.CheckingDisabled = !r.CheckingDisabled
+				_ = w.WriteMsg(m)
+			})
+
+			u := &UpstreamResolver{Upstreams: []string{addr}}
+			if err := u.Provision(mockContext{}); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			req.CheckingDisabled = cd
+
+			w := &mockResponseWriter{}
+			if err := u.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+
+			if forwardedCD.Load() != cd {
+				t.Errorf("Expected upstream query CD=%v, got %v", cd, forwardedCD.Load())
+			}
+			if w.msg.CheckingDisabled != cd {
+				t.Errorf("Expected response CD=%v, got %v", cd, w.msg.CheckingDisabled)
+			}
+		})
+	}
+}
+
+func TestUpstreamResolver_AllowedEDNSOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowed     []uint16
+		wantOptions []uint16
+	}{
+		{
+			name:        "no allowlist passes everything",
+			wantOptions: []uint16{dns.EDNS0COOKIE, dns.EDNS0LOCALSTART, dns.EDNS0NSID},
+		},
+		{
+			name:        "allowlist strips unlisted options",
+			allowed:     []uint16{dns.EDNS0COOKIE},
+			wantOptions: []uint16{dns.EDNS0COOKIE},
+		},
+		{
+			name:        "empty allowlist strips everything",
+			allowed:     []uint16{},
+			wantOptions: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwardedCh := make(chan []uint16, 1)
+			addr := startTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+				m := new(dns.Msg)
+				m.SetReply(r)
+				m.SetEdns0(dns.DefaultMsgSize, false)
+				var forwarded []uint16
+				if opt := r.IsEdns0(); opt != nil {
+					for _, o := range opt.Option {
+						forwarded = append(forwarded, o.Option())
+					}
+					// Echo the query's options and add one of our own
+					m.IsEdns0().Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "6e73"})
+				}
+				forwardedCh <- forwarded
+				_ = w.WriteMsg(m)
+			})
+
+			u := &UpstreamResolver{Upstreams: []string{addr}, AllowedEDNSOptions: tt.allowed}
+			if err := u.Provision(mockContext{}); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			req.IsEdns0().Option = []dns.EDNS0{
+				&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"},
+				&dns.EDNS0_LOCAL{Code: dns.EDNS0LOCALSTART, Data: []byte("device")},
+			}
+
+			w := &mockResponseWriter{}
+			if err := u.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+
+			var returned []uint16
+			for _, o := range w.msg.IsEdns0().Option {
+				returned = append(returned, o.Option())
+			}
+			if !slices.Equal(returned, tt.wantOptions) {
+				t.Errorf("Expected options %v returned to the client, got %v", tt.wantOptions, returned)
+			}
+			for _, code := range <-forwardedCh {
+				if tt.allowed != nil && !slices.Contains(tt.allowed, code) {
+					t.Errorf("Expected option %d to be stripped before forwarding", code)
+				}
+			}
+			if len(req.IsEdns0().Option) != 2 {
+				t.Error("Expected the client's query to be left unmodified")
+			}
+		})
+	}
+}
+
+func TestUpstreamResolver_RefetchIf(t *testing.T) {
+	answer := func(ip string, rcode int) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetRcode(r, rcode)
+			if ip != "" {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP(ip),
+				})
+			}
+			_ = w.WriteMsg(m)
+		}
+	}
+
+	refetchIf := func() *RefetchConditions {
+		return &RefetchConditions{
+			Rcodes:         []string{"NXDOMAIN"},
+			AnswerNetworks: []string{"198.18.0.0/15"},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		primary   dns.HandlerFunc
+		secondary dns.HandlerFunc
+		wantIP    string
+		wantRcode int
+	}{
+		{
+			name:      "poisoned answer refetched from secondary",
+			primary:   answer("198.18.0.1", dns.RcodeSuccess),
+			secondary: answer("192.0.2.1", dns.RcodeSuccess),
+			wantIP:    "192.0.2.1",
+			wantRcode: dns.RcodeSuccess,
+		},
+		{
+			name:      "NXDOMAIN refetched from secondary",
+			primary:   answer("", dns.RcodeNameError),
+			secondary: answer("192.0.2.1", dns.RcodeSuccess),
+			wantIP:    "192.0.2.1",
+			wantRcode: dns.RcodeSuccess,
+		},
+		{
+			name:      "clean answer kept",
+			primary:   answer("192.0.2.7", dns.RcodeSuccess),
+			secondary: answer("192.0.2.1", dns.RcodeSuccess),
+			wantIP:    "192.0.2.7",
+			wantRcode: dns.RcodeSuccess,
+		},
+		{
+			name:      "last rejected answer used when every upstream matches",
+			primary:   answer("198.18.0.1", dns.RcodeSuccess),
+			secondary: answer("", dns.RcodeNameError),
+			wantRcode: dns.RcodeNameError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &UpstreamResolver{
+				Upstreams: []string{startTestUpstream(t, tt.primary), startTestUpstream(t, tt.secondary)},
+				RefetchIf: refetchIf(),
+			}
+			if err := u.Provision(mockContext{}); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+
+			w := &mockResponseWriter{}
+			if err := u.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+
+			if w.msg.Rcode != tt.wantRcode {
+				t.Errorf("Expected rcode %s, got %s", dns.RcodeToString[tt.wantRcode], dns.RcodeToString[w.msg.Rcode])
+			}
+			var gotIP string
+			if len(w.msg.Answer) > 0 {
+				gotIP = w.msg.Answer[0].(*dns.A).A.String()
+			}
+			if gotIP != tt.wantIP {
+				t.Errorf("Expected answer %q, got %q", tt.wantIP, gotIP)
+			}
+		})
+	}
+}
+
+func TestUpstreamResolver_NegativeTTL(t *testing.T) {
+	respond := func(rcode int, soaTTL, minTTL uint32, answer bool) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetRcode(r, rcode)
+			if answer {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP("192.0.2.1"),
+				})
+			}
+			m.Ns = append(m.Ns, &dns.SOA{
+				Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soaTTL},
+				Ns:     "ns.example.com.",
+				Mbox:   "hostmaster.example.com.",
+				Serial: 1,
+				Minttl: minTTL,
+			})
+			_ = w.WriteMsg(m)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		handler    dns.HandlerFunc
+		wantSOATTL uint32
+		wantMinTTL uint32
+	}{
+		{
+			name:       "NXDOMAIN stretched to the minimum",
+			handler:    respond(dns.RcodeNameError, 10, 5, false),
+			wantSOATTL: 60,
+			wantMinTTL: 60,
+		},
+		{
+			name:       "NODATA capped to the maximum",
+			handler:    respond(dns.RcodeSuccess, 86400, 3600, false),
+			wantSOATTL: 600,
+			wantMinTTL: 600,
+		},
+		{
+			name:       "NXDOMAIN within bounds unchanged",
+			handler:    respond(dns.RcodeNameError, 300, 120, false),
+			wantSOATTL: 300,
+			wantMinTTL: 120,
+		},
+		{
+			name:       "positive answer unchanged",
+			handler:    respond(dns.RcodeSuccess, 10, 5, true),
+			wantSOATTL: 10,
+			wantMinTTL: 5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &UpstreamResolver{
+				Upstreams:      []string{startTestUpstream(t, tt.handler)},
+				NegativeTTLMin: "1m",
+				NegativeTTLMax: "10m",
+			}
+			if err := u.Provision(mockContext{}); err != nil {
+				t.Fatalf("Provision failed: %v", err)
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("missing.example.com.", dns.TypeA)
+
+			w := &mockResponseWriter{}
+			if err := u.ServeDNS(context.Background(), w, req); err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+
+			soa := w.msg.Ns[0].(*dns.SOA)
+			if soa.Hdr.Ttl != tt.wantSOATTL || soa.Minttl != tt.wantMinTTL {
+				t.Errorf("Expected SOA TTL %d and minimum %d, got %d and %d",
+					tt.wantSOATTL, tt.wantMinTTL, soa.Hdr.Ttl, soa.Minttl)
+			}
+		})
+	}
+}
+
+// startTestUpstream starts a UDP DNS server on a random local port and
+// returns its address. The server is shut down when the test completes.
+func startTestUpstream(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		Handler:           handler,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	<-started
+
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+
+	return pc.LocalAddr().String()
+}
+
+// Mock response writer for testing
+type mockResponseWriter struct {
+	msg    *dns.Msg
+	remote net.Addr
+}
+
+func (m *mockResponseWriter) LocalAddr() net.Addr { return nil }
+func (m *mockResponseWriter) RemoteAddr() net.Addr {
+	if m.remote != nil {
+		return m.remote
+	}
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+}
+func (m *mockResponseWriter) WriteMsg(msg *dns.Msg) error {
+	m.msg = msg
+	return nil
+}
+func (m *mockResponseWriter) Write([]byte) (int, error) { return 0, nil }
+func (m *mockResponseWriter) Close() error              { return nil }
+func (m *mockResponseWriter) TsigStatus() error         { return nil }
+func (m *mockResponseWriter) TsigTimersOnly(bool)       {}
+func (m *mockResponseWriter) Hijack()                   {}
@@ -0,0 +1,242 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+var (
+	responsesTotal = mightydns.NewCounter("mightydns_dns_responses_total",
+		"DNS responses sent, by server, rcode label and query type.",
+		"server", "rcode", "qtype")
+	requestDuration = mightydns.NewHistogram("mightydns_dns_request_duration_seconds",
+		"Time taken to answer DNS queries, by server.",
+		nil, "server")
+	writeFailuresTotal = mightydns.NewCounter("mightydns_dns_response_write_failures_total",
+		"DNS responses that could not be sent, usually because the client went away.",
+		"server")
+)
+
+// metricQtypes are the query types responses are counted under. Any other
+// type is counted as "other", since clients choose the type and could
+// otherwise create a metric series for each of the 65536 values.
+var metricQtypes = map[uint16]bool{
+	dns.TypeA:      true,
+	dns.TypeAAAA:   true,
+	dns.TypeANY:    true,
+	dns.TypeCAA:    true,
+	dns.TypeCNAME:  true,
+	dns.TypeDNSKEY: true,
+	dns.TypeDS:     true,
+	dns.TypeHTTPS:  true,
+	dns.TypeMX:     true,
+	dns.TypeNAPTR:  true,
+	dns.TypeNS:     true,
+	dns.TypePTR:    true,
+	dns.TypeSOA:    true,
+	dns.TypeSRV:    true,
+	dns.TypeSVCB:   true,
+	dns.TypeTXT:    true,
+}
+
+// qtypeLabel returns the metrics label responses to queries of qtype are
+// counted under.
+func qtypeLabel(qtype uint16) string {
+	if !metricQtypes[qtype] {
+		return "other"
+	}
+	return dns.Type(qtype).String()
+}
+
+// RcodePolicy sets how responses with a given rcode are logged and counted.
+type RcodePolicy struct {
+	// Level is the log level for the response: debug (the default), info,
+	// warn or error.
+	Level string `json:"level,omitempty"`
+	// Label is the metrics label the response is counted under. Defaults
+	// to the lowercased rcode name, e.g. "nxdomain".
+	Label string `json:"label,omitempty"`
+
+	level slog.Level
+}
+
+func (p *RcodePolicy) provision(rcode int) error {
+	switch strings.ToUpper(p.Level) {
+	case "DEBUG", "":
+		p.level = slog.LevelDebug
+	case "INFO":
+		p.level = slog.LevelInfo
+	case "WARN":
+		p.level = slog.LevelWarn
+	case "ERROR":
+		p.level = slog.LevelError
+	default:
+		return fmt.Errorf("invalid log level: %s", p.Level)
+	}
+
+	if p.Label == "" {
+		p.Label = strings.ToLower(dns.RcodeToString[rcode])
+	}
+
+	return nil
+}
+
+// responseStats maps rcodes to their policies, which set how responses are
+// logged and counted.
+type responseStats struct {
+	server   string
+	policies map[int]*RcodePolicy
+}
+
+func newResponseStats(rcodes map[string]*RcodePolicy) (*responseStats, error) {
+	stats := &responseStats{policies: make(map[int]*RcodePolicy)}
+
+	for name, policy := range rcodes {
+		rcode, exists := dns.StringToRcode[strings.ToUpper(name)]
+		if !exists {
+			return nil, fmt.Errorf("unknown rcode: %s", name)
+		}
+		if policy == nil {
+			policy = &RcodePolicy{}
+		}
+		if err := policy.provision(rcode); err != nil {
+			return nil, fmt.Errorf("rcode %s: %w", name, err)
+		}
+		stats.policies[rcode] = policy
+	}
+
+	return stats, nil
+}
+
+// policy returns the policy for rcode, falling back to the default.
+func (rs *responseStats) policy(rcode int) *RcodePolicy {
+	if policy, exists := rs.policies[rcode]; exists {
+		return policy
+	}
+	return &RcodePolicy{
+		Label: strings.ToLower(dns.RcodeToString[rcode]),
+		level: slog.LevelDebug,
+	}
+}
+
+// record logs the response to r according to its rcode policy and counts
+// it under the policy's label.
+func (rs *responseStats) record(ctx context.Context, logger *slog.Logger, w *responseRecorder, r *dns.Msg) {
+	if w.msg == nil || w.err != nil {
+		return
+	}
+
+	var qname, qtype, qtypeMetric string
+	if len(r.Question) > 0 {
+		qname = r.Question[0].Name
+		qtype = dns.Type(r.Question[0].Qtype).String()
+		qtypeMetric = qtypeLabel(r.Question[0].Qtype)
+	}
+
+	policy := rs.policy(w.msg.Rcode)
+	responsesTotal.Inc(rs.server, policy.Label, qtypeMetric)
+
+	if !logger.Enabled(ctx, policy.level) {
+		return
+	}
+
+	logger.Log(ctx, policy.level, "DNS response",
+		"query_id", r.Id,
+		"query_name", qname,
+		"query_type", qtype,
+		"client", w.RemoteAddr(),
+		"rcode", dns.RcodeToString[w.msg.Rcode],
+		"label", policy.Label,
+		"answer_count", len(w.msg.Answer))
+}
+
+// responseRecorder remembers the last message written through it and
+// whether writing it failed.
+type responseRecorder struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+	err error
+}
+
+func (w *responseRecorder) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	w.err = w.ResponseWriter.WriteMsg(m)
+	return w.err
+}
+
+// sizeLimitWriter makes sure responses fit in a single DNS message, which is
+// limited to 64KB even over TCP. Responses too large to send uncompressed
+// are compressed, and any that still do not fit are replaced with SERVFAIL
+// rather than leaving the client without an answer.
+type sizeLimitWriter struct {
+	dns.ResponseWriter
+	logger *slog.Logger
+}
+
+func (w *sizeLimitWriter) WriteMsg(m *dns.Msg) error {
+	if m.Len() > dns.MaxMsgSize {
+		m.Compress = true
+	}
+
+	if size := m.Len(); size > dns.MaxMsgSize {
+		w.logger.Error("DNS response too large",
+			"query_id", m.Id,
+			"size", size,
+			"answers", len(m.Answer))
+
+		fail := new(dns.Msg)
+		fail.SetRcode(m, dns.RcodeServerFailure)
+		return w.ResponseWriter.WriteMsg(fail)
+	}
+
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// dedupeWriter removes exact-duplicate records from responses, which can
+// appear when answers from several sources are combined. A record is kept
+// only in the first section it appears in, with the shortest TTL of its
+// duplicates.
+type dedupeWriter struct {
+	dns.ResponseWriter
+}
+
+func (w *dedupeWriter) WriteMsg(m *dns.Msg) error {
+	seen := make(map[string]dns.RR)
+	m.Answer = dedupeRecords(m.Answer, seen)
+	m.Ns = dedupeRecords(m.Ns, seen)
+	m.Extra = dedupeRecords(m.Extra, seen)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// dedupeRecords returns rrs without the records already in seen, adding the
+// rest to it. Records are compared ignoring their TTL and the case of their
+// owner name.
+func dedupeRecords(rrs []dns.RR, seen map[string]dns.RR) []dns.RR {
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			kept = append(kept, rr)
+			continue
+		}
+
+		key := dns.Copy(rr)
+		key.Header().Ttl = 0
+		key.Header().Name = strings.ToLower(key.Header().Name)
+
+		if first, ok := seen[key.String()]; ok {
+			if rr.Header().Ttl < first.Header().Ttl {
+				first.Header().Ttl = rr.Header().Ttl
+			}
+			continue
+		}
+		seen[key.String()] = rr
+		kept = append(kept, rr)
+	}
+	return kept
+}
@@ -0,0 +1,274 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestNewResponseStats(t *testing.T) {
+	tests := []struct {
+		name    string
+		rcodes  map[string]*RcodePolicy
+		wantErr bool
+	}{
+		{
+			name:   "valid policies",
+			rcodes: map[string]*RcodePolicy{"NXDOMAIN": {Level: "debug"}, "refused": {Level: "warn", Label: "refused"}},
+		},
+		{
+			name:    "unknown rcode",
+			rcodes:  map[string]*RcodePolicy{"NOTANRCODE": {}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid level",
+			rcodes:  map[string]*RcodePolicy{"REFUSED": {Level: "loud"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newResponseStats(tt.rcodes)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newResponseStats() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDNSServer_RcodePolicies(t *testing.T) {
+	tests := []struct {
+		name      string
+		rcode     int
+		wantLevel string
+		wantLabel string
+	}{
+		{name: "configured rcode", rcode: dns.RcodeRefused, wantLevel: "level=WARN", wantLabel: "refused_queries"},
+		{name: "default rcode", rcode: dns.RcodeNameError, wantLevel: "level=DEBUG", wantLabel: "nxdomain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+			server := &DNSServer{
+				Handler: json.RawMessage(fmt.Sprintf(`{"handler": "test.handler", "rcode": %d}`, tt.rcode)),
+				Rcodes: map[string]*RcodePolicy{
+					"REFUSED": {Level: "warn", Label: "refused_queries"},
+				},
+				name: "rcode-policies/" + tt.name,
+			}
+			if err := server.provision(mockContext{}, logger); err != nil {
+				t.Fatalf("provision failed: %v", err)
+			}
+			responses := responsesTotal.Value(server.name, tt.wantLabel, "A")
+			durations := requestDuration.Count(server.name)
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			server.ServeDNS(&mockResponseWriter{}, req)
+
+			logged := buf.String()
+			if !strings.Contains(logged, "DNS response") || !strings.Contains(logged, tt.wantLevel) {
+				t.Errorf("Expected response logged with %s, got %q", tt.wantLevel, logged)
+			}
+
+			if got := responsesTotal.Value(server.name, tt.wantLabel, "A") - responses; got != 1 {
+				t.Errorf("Expected %s responses metric to grow by 1, got %v", tt.wantLabel, got)
+			}
+			if got := requestDuration.Count(server.name) - durations; got != 1 {
+				t.Errorf("Expected 1 request duration observation, got %d", got)
+			}
+		})
+	}
+}
+
+func TestDNSServer_QtypeLabels(t *testing.T) {
+	server := newTestServer()
+	server.name = "qtype-labels"
+	if err := server.provision(mockContext{}, slog.New(slog.DiscardHandler)); err != nil {
+		t.Fatalf("provision failed: %v", err)
+	}
+
+	tests := []struct {
+		qtype     uint16
+		wantLabel string
+	}{
+		{qtype: dns.TypeAAAA, wantLabel: "AAAA"},
+		{qtype: dns.TypeHTTPS, wantLabel: "HTTPS"},
+		{qtype: dns.TypeHINFO, wantLabel: "other"},
+		{qtype: 65000, wantLabel: "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(dns.Type(tt.qtype).String(), func(t *testing.T) {
+			responses := responsesTotal.Value(server.name, "noerror", tt.wantLabel)
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", tt.qtype)
+			server.ServeDNS(&mockResponseWriter{}, req)
+
+			if got := responsesTotal.Value(server.name, "noerror", tt.wantLabel) - responses; got != 1 {
+				t.Errorf("Expected the response counted under qtype %s, got %v", tt.wantLabel, got)
+			}
+		})
+	}
+}
+
+func TestDNSServer_LargeTCPResponses(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     string
+		wantRcode   int
+		wantAnswers int
+	}{
+		{
+			// About 81KB uncompressed, but fits once compressed
+			name:        "compressed to fit",
+			handler:     `{"handler": "test.handler", "answers": 3000}`,
+			wantRcode:   dns.RcodeSuccess,
+			wantAnswers: 3000,
+		},
+		{
+			// About 77KB of incompressible record data
+			name:      "too large",
+			handler:   `{"handler": "test.handler", "txt_records": 300}`,
+			wantRcode: dns.RcodeServerFailure,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &DNSServer{
+				Listen:   []string{"127.0.0.1:0"},
+				Protocol: []string{"tcp"},
+				Handler:  json.RawMessage(tt.handler),
+			}
+			if err := server.provision(mockContext{}, slog.Default()); err != nil {
+				t.Fatalf("provision failed: %v", err)
+			}
+			if err := server.start(); err != nil {
+				t.Fatalf("start failed: %v", err)
+			}
+			defer func() { _ = server.stop() }()
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+
+			client := &dns.Client{Net: "tcp", Timeout: 2 * time.Second}
+			resp, _, err := client.Exchange(req, server.listenAddrs()[0])
+			if err != nil {
+				t.Fatalf("query failed: %v", err)
+			}
+
+			if resp.Rcode != tt.wantRcode {
+				t.Errorf("Expected rcode %s, got %s", dns.RcodeToString[tt.wantRcode], dns.RcodeToString[resp.Rcode])
+			}
+			if len(resp.Answer) != tt.wantAnswers {
+				t.Errorf("Expected %d answers, got %d", tt.wantAnswers, len(resp.Answer))
+			}
+			if len(resp.Question) != 1 || resp.Id != req.Id {
+				t.Error("Expected the response to match the query")
+			}
+		})
+	}
+}
+
+func TestDedupeWriter(t *testing.T) {
+	a := func(name, ip string, ttl uint32) dns.RR {
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.ParseIP(ip),
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Answer = []dns.RR{
+		a("example.com.", "192.0.2.1", 300),
+		a("example.com.", "192.0.2.2", 300),
+		a("EXAMPLE.com.", "192.0.2.1", 60),
+	}
+	m.Extra = []dns.RR{
+		a("example.com.", "192.0.2.2", 300),
+		a("ns.example.com.", "192.0.2.53", 300),
+	}
+	m.SetEdns0(dns.DefaultMsgSize, false)
+
+	mock := &mockResponseWriter{}
+	w := &dedupeWriter{ResponseWriter: mock}
+	if err := w.WriteMsg(m); err != nil {
+		t.Fatalf("WriteMsg failed: %v", err)
+	}
+
+	if len(mock.msg.Answer) != 2 {
+		t.Fatalf("Expected 2 unique answers, got %d: %v", len(mock.msg.Answer), mock.msg.Answer)
+	}
+	if ttl := mock.msg.Answer[0].Header().Ttl; ttl != 60 {
+		t.Errorf("Expected the shortest TTL of the duplicates (60), got %d", ttl)
+	}
+	if len(mock.msg.Extra) != 2 {
+		t.Fatalf("Expected the OPT and one additional record, got %v", mock.msg.Extra)
+	}
+	if mock.msg.IsEdns0() == nil {
+		t.Error("Expected the OPT record to be kept")
+	}
+}
+
+// failingResponseWriter fails every write, as when the client has gone away.
+type failingResponseWriter struct {
+	mockResponseWriter
+	writes int
+}
+
+func (w *failingResponseWriter) WriteMsg(*dns.Msg) error {
+	w.writes++
+	return fmt.Errorf("write: connection reset by peer")
+}
+
+func TestDNSServer_WriteFailure(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	server := newTestServer()
+	if err := server.provision(mockContext{}, logger); err != nil {
+		t.Fatalf("provision failed: %v", err)
+	}
+
+	responses := responsesTotal.Value(server.name, "noerror", "A")
+	failures := writeFailuresTotal.Value(server.name)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	w := &failingResponseWriter{}
+	server.ServeDNS(w, req)
+
+	if w.writes != 1 {
+		t.Errorf("Expected a single write attempt and no SERVFAIL retry, got %d", w.writes)
+	}
+	if got := writeFailuresTotal.Value(server.name) - failures; got != 1 {
+		t.Errorf("Expected 1 write failure counted, got %v", got)
+	}
+	if got := responsesTotal.Value(server.name, "noerror", "A") - responses; got != 0 {
+		t.Errorf("Expected undelivered responses not to be counted by rcode, got %v", got)
+	}
+
+	output := logs.String()
+	if !strings.Contains(output, "level=DEBUG msg=\"failed to write DNS response\"") {
+		t.Errorf("Expected the write failure to be logged at debug, got: %s", output)
+	}
+	if strings.Contains(output, "level=ERROR") {
+		t.Errorf("Expected no error logs for a client disconnect, got: %s", output)
+	}
+}
@@ -0,0 +1,95 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+// defaultTraceOptionCode is the first EDNS0 option code in the range
+// reserved for local/experimental use (RFC 6891).
+const defaultTraceOptionCode = dns.EDNS0LOCALSTART
+
+// ResolutionTrace configures which clients receive the resolution path of
+// their queries, encoded as an EDNS0 local option in the response, so that
+// tools like dig reveal how a query was routed.
+type ResolutionTrace struct {
+	// Clients lists the CIDRs allowed to receive the resolution path.
+	Clients []string `json:"clients,omitempty"`
+	// OptionCode is the EDNS0 option code used for the path. It must be in
+	// the local/experimental range and defaults to 65001.
+	OptionCode uint16 `json:"option_code,omitempty"`
+
+	networks []*net.IPNet
+}
+
+func (t *ResolutionTrace) provision() error {
+	if t.OptionCode == 0 {
+		t.OptionCode = defaultTraceOptionCode
+	}
+	if t.OptionCode < dns.EDNS0LOCALSTART || t.OptionCode > dns.EDNS0LOCALEND {
+		return fmt.Errorf("option_code %d is outside the local EDNS0 option range", t.OptionCode)
+	}
+
+	for _, cidr := range t.Clients {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid client CIDR %s: %w", cidr, err)
+		}
+		t.networks = append(t.networks, network)
+	}
+
+	return nil
+}
+
+// allows reports whether the client at addr may receive resolution paths.
+func (t *ResolutionTrace) allows(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range t.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// traceWriter adds the recorded resolution path to the response as an EDNS0
+// local option.
+type traceWriter struct {
+	dns.ResponseWriter
+	path    *mightydns.ResolutionPath
+	code    uint16
+	udpSize uint16
+}
+
+func (w *traceWriter) WriteMsg(m *dns.Msg) error {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(w.udpSize, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: w.code,
+		Data: []byte(strings.Join(w.path.Stages(), ",")),
+	})
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// addrIP returns the IP address of a UDP or TCP address, or nil.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolutionTrace_Provision(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ResolutionTrace
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			config: ResolutionTrace{Clients: []string{"127.0.0.0/8"}},
+		},
+		{
+			name:    "invalid CIDR",
+			config:  ResolutionTrace{Clients: []string{"not-a-cidr"}},
+			wantErr: true,
+		},
+		{
+			name:    "option code outside local range",
+			config:  ResolutionTrace{OptionCode: 8},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.provision()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ResolutionTrace.provision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDNSServer_ResolutionTrace(t *testing.T) {
+	upstream := startTestUpstream(t)
+
+	tests := []struct {
+		name     string
+		clients  []string
+		wantPath string
+	}{
+		{
+			name:     "trusted client",
+			clients:  []string{"127.0.0.0/8"},
+			wantPath: "handler:dns.resolver.upstream,upstream:" + upstream,
+		},
+		{
+			name:     "untrusted client",
+			clients:  []string{"10.0.0.0/8"},
+			wantPath: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &DNSServer{
+				Listen:   []string{"127.0.0.1:0"},
+				Protocol: []string{"udp"},
+				Handler: json.RawMessage(fmt.Sprintf(`{
+					"handler": "dns.resolver.upstream",
+					"upstreams": [%q]
+				}`, upstream)),
+				ResolutionTrace: &ResolutionTrace{Clients: tt.clients},
+			}
+			if err := server.provision(mockContext{}, slog.Default()); err != nil {
+				t.Fatalf("provision failed: %v", err)
+			}
+			if err := server.start(); err != nil {
+				t.Fatalf("start failed: %v", err)
+			}
+			defer func() { _ = server.stop() }()
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			req.SetEdns0(dns.DefaultMsgSize, false)
+
+			client := &dns.Client{Net: "udp", Timeout: time.Second}
+			resp, _, err := client.Exchange(req, server.listenAddrs()[0])
+			if err != nil {
+				t.Fatalf("query failed: %v", err)
+			}
+
+			var path string
+			if opt := resp.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == defaultTraceOptionCode {
+						path = string(local.Data)
+					}
+				}
+			}
+			if path != tt.wantPath {
+				t.Errorf("Expected resolution path %q, got %q", tt.wantPath, path)
+			}
+		})
+	}
+}
+
+// startTestUpstream starts a UDP DNS server on a random local port that
+// answers every query with NOERROR, and returns its address.
+func startTestUpstream(t *testing.T) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			_ = w.WriteMsg(m)
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	<-started
+
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+
+	return pc.LocalAddr().String()
+}
@@ -0,0 +1,195 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha1" // #nosec G505 - hmac-sha1 is still a registered TSIG algorithm
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/kusold/mightydns"
+)
+
+// TSIGKeyConfig configures a named key in the app's TSIG keyring (RFC
+// 8945). Servers verify and sign queries carrying any of the app's keys,
+// and resolvers can sign their upstream queries with one.
+type TSIGKeyConfig struct {
+	// Algorithm is the HMAC algorithm: "hmac-sha1", "hmac-sha224",
+	// "hmac-sha256", "hmac-sha384" or "hmac-sha512". Defaults to
+	// "hmac-sha256".
+	Algorithm string `json:"algorithm,omitempty"`
+	// Secret is the base64-encoded shared secret.
+	Secret string `json:"secret"`
+}
+
+// tsigAlgorithms maps config algorithm names to their TSIG names.
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// tsigKeyring holds the app's TSIG keys by canonical key name. It
+// implements dns.TsigProvider, checking that messages use the algorithm
+// their key is configured with.
+type tsigKeyring map[string]mightydns.TSIGKey
+
+func newTSIGKeyring(keys map[string]*TSIGKeyConfig) (tsigKeyring, error) {
+	keyring := make(tsigKeyring, len(keys))
+	for name, cfg := range keys {
+		if cfg == nil {
+			return nil, fmt.Errorf("key %s: missing secret", name)
+		}
+
+		if cfg.Algorithm == "" {
+			cfg.Algorithm = "hmac-sha256"
+		}
+		algorithm, ok := tsigAlgorithms[strings.ToLower(cfg.Algorithm)]
+		if !ok {
+			return nil, fmt.Errorf("key %s: unsupported algorithm: %s", name, cfg.Algorithm)
+		}
+
+		if cfg.Secret == "" {
+			return nil, fmt.Errorf("key %s: missing secret", name)
+		}
+		if _, err := base64.StdEncoding.DecodeString(cfg.Secret); err != nil {
+			return nil, fmt.Errorf("key %s: secret is not valid base64: %w", name, err)
+		}
+
+		canonical := dns.CanonicalName(name)
+		if _, exists := keyring[canonical]; exists {
+			return nil, fmt.Errorf("key %s: defined more than once", name)
+		}
+		keyring[canonical] = mightydns.TSIGKey{
+			Name:      canonical,
+			Algorithm: algorithm,
+			Secret:    cfg.Secret,
+		}
+	}
+	return keyring, nil
+}
+
+// TSIGKey implements mightydns.TSIGKeyring.
+func (k tsigKeyring) TSIGKey(name string) (mightydns.TSIGKey, bool) {
+	key, ok := k[dns.CanonicalName(name)]
+	return key, ok
+}
+
+// Generate implements dns.TsigProvider.
+func (k tsigKeyring) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	key, ok := k.TSIGKey(t.Hdr.Name)
+	if !ok {
+		return nil, dns.ErrSecret
+	}
+	if dns.CanonicalName(t.Algorithm) != key.Algorithm {
+		return nil, dns.ErrKeyAlg
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(key.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	var h hash.Hash
+	switch key.Algorithm {
+	case dns.HmacSHA1:
+		h = hmac.New(sha1.New, secret)
+	case dns.HmacSHA224:
+		h = hmac.New(sha256.New224, secret)
+	case dns.HmacSHA256:
+		h = hmac.New(sha256.New, secret)
+	case dns.HmacSHA384:
+		h = hmac.New(sha512.New384, secret)
+	case dns.HmacSHA512:
+		h = hmac.New(sha512.New, secret)
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+// Verify implements dns.TsigProvider.
+func (k tsigKeyring) Verify(msg []byte, t *dns.TSIG) error {
+	mac, err := k.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	expected, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, expected) {
+		return dns.ErrSig
+	}
+	return nil
+}
+
+// keyringContext passes the app's TSIG keys on to the handlers it
+// provisions.
+type keyringContext struct {
+	mightydns.Context
+	keys tsigKeyring
+}
+
+// TSIGKey implements mightydns.TSIGKeyring.
+func (c *keyringContext) TSIGKey(name string) (mightydns.TSIGKey, bool) {
+	return c.keys.TSIGKey(name)
+}
+
+// tsigWriter signs responses to a TSIG-signed query with the query's key.
+// The signature itself is computed by the underlying writer, which holds
+// the query's MAC.
+type tsigWriter struct {
+	dns.ResponseWriter
+	key mightydns.TSIGKey
+}
+
+func (w *tsigWriter) WriteMsg(m *dns.Msg) error {
+	stripTSIG(m)
+	m.SetTsig(w.key.Name, w.key.Algorithm, 300, time.Now().Unix())
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// stripTSIG removes the TSIG record from m, if it has one.
+func stripTSIG(m *dns.Msg) {
+	if m.IsTsig() != nil {
+		m.Extra = m.Extra[:len(m.Extra)-1]
+	}
+}
+
+// verifyTSIG checks the TSIG record of a signed query. Queries that fail
+// verification are answered NOTAUTH and ok is false. Otherwise the query
+// is returned without its TSIG record, so that handlers forwarding it do
+// not pass the client's signature on, along with a writer that signs the
+// response.
+func (s *DNSServer) verifyTSIG(w dns.ResponseWriter, r *dns.Msg, t *dns.TSIG) (dns.ResponseWriter, *dns.Msg, bool) {
+	key, known := s.tsig.TSIGKey(t.Hdr.Name)
+	if err := w.TsigStatus(); err != nil || !known {
+		s.logger.Debug("rejecting query with invalid TSIG",
+			"query_id", r.Id,
+			"key", t.Hdr.Name,
+			"client", w.RemoteAddr(),
+			"error", err)
+
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNotAuth)
+		if err := w.WriteMsg(m); err != nil {
+			s.writeFailed(w, r, err)
+		}
+		return nil, nil, false
+	}
+
+	r = r.Copy()
+	stripTSIG(r)
+	return &tsigWriter{ResponseWriter: w, key: key}, r, true
+}
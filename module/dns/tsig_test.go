@@ -0,0 +1,171 @@
+package dns
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testTSIGSecret  = "c2VjcmV0LXNoYXJlZC13aXRoLWNsaWVudHM="
+	testTSIGSecret2 = "c2VjcmV0LXNoYXJlZC13aXRoLXVwc3RyZWFt"
+)
+
+func TestNewTSIGKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    map[string]*TSIGKeyConfig
+		wantErr bool
+	}{
+		{name: "default algorithm", keys: map[string]*TSIGKeyConfig{"client.": {Secret: testTSIGSecret}}},
+		{name: "explicit algorithm", keys: map[string]*TSIGKeyConfig{"client": {Algorithm: "HMAC-SHA512", Secret: testTSIGSecret}}},
+		{name: "unsupported algorithm", keys: map[string]*TSIGKeyConfig{"client": {Algorithm: "hmac-md5", Secret: testTSIGSecret}}, wantErr: true},
+		{name: "missing secret", keys: map[string]*TSIGKeyConfig{"client": {}}, wantErr: true},
+		{name: "invalid secret", keys: map[string]*TSIGKeyConfig{"client": {Secret: "not base64!"}}, wantErr: true},
+		{
+			name: "duplicate name",
+			keys: map[string]*TSIGKeyConfig{
+				"client.": {Secret: testTSIGSecret},
+				"Client":  {Secret: testTSIGSecret},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyring, err := newTSIGKeyring(tt.keys)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newTSIGKeyring error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if _, ok := keyring.TSIGKey("CLIENT"); !ok {
+				t.Error("expected key lookups to ignore case and the trailing dot")
+			}
+		})
+	}
+}
+
+// startSignedUpstream starts an upstream that only answers queries signed
+// with the given key, signing its responses.
+func startSignedUpstream(t *testing.T, keyName, secret string) string {
+	t.Helper()
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		if r.IsTsig() == nil || w.TsigStatus() != nil {
+			m.SetRcode(r, dns.RcodeNotAuth)
+			_ = w.WriteMsg(m)
+			return
+		}
+		m.SetReply(r)
+		m.SetTsig(keyName, dns.HmacSHA256, 300, time.Now().Unix())
+		_ = w.WriteMsg(m)
+	})
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		Net:               "udp",
+		Addr:              "127.0.0.1:0",
+		Handler:           handler,
+		TsigSecret:        map[string]string{keyName: secret},
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go func() { _ = server.ListenAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	return server.PacketConn.LocalAddr().String()
+}
+
+func TestDNSServer_TSIG(t *testing.T) {
+	upstream := startSignedUpstream(t, "upstream.", testTSIGSecret2)
+
+	app := &DNSApp{
+		TSIGKeys: map[string]*TSIGKeyConfig{
+			"client":   {Secret: testTSIGSecret},
+			"upstream": {Secret: testTSIGSecret2},
+		},
+		Servers: map[string]*DNSServer{
+			"main": {
+				Listen:   []string{"127.0.0.1:0"},
+				Protocol: []string{"udp"},
+				Handler: json.RawMessage(`{
+					"handler": "dns.resolver.upstream",
+					"upstreams": ["` + upstream + `"],
+					"tsig_key": "upstream"
+				}`),
+			},
+		},
+	}
+	if err := app.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if err := app.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer func() { _ = app.Stop() }()
+	addr := app.Servers["main"].listenAddrs()[0]
+
+	tests := []struct {
+		name      string
+		keyName   string
+		secret    string
+		wantRcode int
+		wantErr   bool
+	}{
+		{name: "unsigned", wantRcode: dns.RcodeSuccess},
+		{name: "signed", keyName: "client.", secret: testTSIGSecret, wantRcode: dns.RcodeSuccess},
+		{name: "wrong secret", keyName: "client.", secret: testTSIGSecret2, wantRcode: dns.RcodeNotAuth},
+		{name: "unknown key", keyName: "stranger.", secret: testTSIGSecret, wantRcode: dns.RcodeNotAuth},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			client := &dns.Client{Net: "udp", Timeout: time.Second}
+			if tt.keyName != "" {
+				req.SetTsig(tt.keyName, dns.HmacSHA256, 300, time.Now().Unix())
+				client.TsigSecret = map[string]string{tt.keyName: tt.secret}
+			}
+
+			// The client verifies signed responses, so a successful
+			// exchange means the response was signed with the query's key
+			resp, _, err := client.Exchange(req, addr)
+			if err != nil {
+				t.Fatalf("exchange failed: %v", err)
+			}
+			if resp.Rcode != tt.wantRcode {
+				t.Fatalf("expected %s, got %s", dns.RcodeToString[tt.wantRcode], dns.RcodeToString[resp.Rcode])
+			}
+
+			switch {
+			case tt.keyName != "" && tt.wantRcode == dns.RcodeSuccess:
+				if tsig := resp.IsTsig(); tsig == nil || tsig.Hdr.Name != tt.keyName {
+					t.Errorf("expected the response to be signed with %s, got %v", tt.keyName, tsig)
+				}
+			case resp.IsTsig() != nil:
+				t.Errorf("expected an unsigned response, got %v", resp.IsTsig())
+			}
+		})
+	}
+}
+
+func TestDNSServer_TSIGUnknownResolverKey(t *testing.T) {
+	app := &DNSApp{
+		Servers: map[string]*DNSServer{
+			"main": {
+				Listen:  []string{"127.0.0.1:0"},
+				Handler: json.RawMessage(`{"handler": "dns.resolver.upstream", "tsig_key": "missing"}`),
+			},
+		},
+	}
+	if err := app.Provision(mockContext{}); err == nil {
+		t.Fatal("expected an unknown tsig_key to fail provisioning")
+	}
+}
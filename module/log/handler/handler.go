@@ -1,9 +1,11 @@
 package handler
 
 import (
+	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
 )
 
 type HandlerConfig struct {
@@ -22,6 +24,23 @@ func (c *HandlerConfig) GetWriter() (io.Writer, error) {
 	}
 }
 
+// CheckWriter validates the configured output without opening it.
+func (c *HandlerConfig) CheckWriter() error {
+	switch c.Output {
+	case "stderr", "stdout", "":
+		return nil
+	default:
+		info, err := os.Stat(filepath.Dir(c.Output))
+		if err != nil {
+			return fmt.Errorf("log output directory: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("log output directory %s is not a directory", filepath.Dir(c.Output))
+		}
+		return nil
+	}
+}
+
 func (c *HandlerConfig) GetHandlerOptions() *slog.HandlerOptions {
 	return &slog.HandlerOptions{
 		AddSource: c.AddSource,
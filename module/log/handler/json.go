@@ -26,6 +26,10 @@ func (JSONHandler) MightyModule() mightydns.ModuleInfo {
 }
 
 func (h *JSONHandler) Provision(ctx mightydns.Context) error {
+	if ctx.DryRun() {
+		return h.CheckWriter()
+	}
+
 	writer, err := h.GetWriter()
 	if err != nil {
 		return err
@@ -26,6 +26,10 @@ func (TextHandler) MightyModule() mightydns.ModuleInfo {
 }
 
 func (h *TextHandler) Provision(ctx mightydns.Context) error {
+	if ctx.DryRun() {
+		return h.CheckWriter()
+	}
+
 	writer, err := h.GetWriter()
 	if err != nil {
 		return err
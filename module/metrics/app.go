@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/kusold/mightydns"
+)
+
+func init() {
+	mightydns.RegisterModule(&MetricsApp{})
+}
+
+// MetricsApp serves the metrics recorded by every module in the Prometheus
+// text exposition format.
+type MetricsApp struct {
+	// Listen is the address to serve metrics on. Defaults to ":9153".
+	Listen string `json:"listen,omitempty"`
+	// Path is the URL path metrics are served on. Defaults to "/metrics".
+	Path string `json:"path,omitempty"`
+
+	listener   *sharedListener
+	generation uint64
+	logger     *slog.Logger
+	mu         sync.Mutex
+}
+
+func (*MetricsApp) MightyModule() mightydns.ModuleInfo {
+	return mightydns.ModuleInfo{
+		ID:  "metrics",
+		New: func() mightydns.Module { return new(MetricsApp) },
+	}
+}
+
+func (app *MetricsApp) Provision(ctx mightydns.Context) error {
+	app.logger = ctx.Logger()
+	if gen, ok := ctx.(mightydns.ConfigGeneration); ok {
+		app.generation = gen.Generation()
+	}
+
+	if app.Listen == "" {
+		app.Listen = ":9153"
+	}
+	if app.Path == "" {
+		app.Path = "/metrics"
+	}
+
+	if _, err := net.ResolveTCPAddr("tcp", app.Listen); err != nil {
+		return fmt.Errorf("invalid listen address %s: %w", app.Listen, err)
+	}
+
+	return nil
+}
+
+func (app *MetricsApp) Start() error {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	l, err := listeners.acquire(app.Listen, app)
+	if err != nil {
+		return err
+	}
+	app.listener = l
+	return nil
+}
+
+func (app *MetricsApp) Stop() error {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	if app.listener == nil {
+		return nil
+	}
+	err := listeners.release(app.listener, app)
+	app.listener = nil
+	return err
+}
+
+func (app *MetricsApp) Cleanup() error {
+	return app.Stop()
+}
+
+// LogValue summarizes the app's listener for the startup summary log.
+func (app *MetricsApp) LogValue() slog.Value {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	listen := app.Listen
+	if app.listener != nil {
+		listen = app.listener.addr
+	}
+	return slog.GroupValue(
+		slog.String("listen", "http://"+listen+app.Path),
+	)
+}
+
+func (app *MetricsApp) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := mightydns.WriteMetrics(w); err != nil {
+		app.logger.Debug("failed to write metrics", "error", err)
+	}
+}
@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/kusold/mightydns"
+	_ "github.com/kusold/mightydns/module/log/handler"
+)
+
+type mockContext struct{}
+
+func (mockContext) App(name string) (interface{}, error) { return nil, nil }
+func (mockContext) Logger() *slog.Logger                 { return slog.New(slog.DiscardHandler) }
+func (mockContext) LoadModule(cfg interface{}, fieldName string) (interface{}, error) {
+	return nil, fmt.Errorf("module loading not supported in mock context")
+}
+func (mockContext) DryRun() bool { return false }
+
+func TestMetricsApp_Provision(t *testing.T) {
+	app := &MetricsApp{}
+	if err := app.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if app.Listen != ":9153" || app.Path != "/metrics" {
+		t.Errorf("expected default listen and path, got %s %s", app.Listen, app.Path)
+	}
+
+	app = &MetricsApp{Listen: "not-an-address"}
+	if err := app.Provision(mockContext{}); err == nil {
+		t.Error("expected an invalid listen address to fail")
+	}
+}
+
+func TestMetricsApp_ServesMetrics(t *testing.T) {
+	// The registry is shared by every test in the process, so expect the
+	// counter's current value rather than assume it starts at zero
+	counter := mightydns.NewCounter("mightydns_metrics_app_test_total", "Test counter.", "label")
+	counter.Inc("value")
+	want := fmt.Sprintf(`mightydns_metrics_app_test_total{label="value"} %v`, counter.Value("value"))
+
+	app := &MetricsApp{Listen: "127.0.0.1:0"}
+	if err := app.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if err := app.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer func() { _ = app.Stop() }()
+
+	resp, err := http.Get("http://" + app.listener.addr + "/metrics")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("expected Prometheus text content type, got %s", got)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if !strings.Contains(string(body), want) {
+		t.Errorf("expected test counter in metrics, got:\n%s", body)
+	}
+}
+
+func TestMetricsApp_Reload(t *testing.T) {
+	defer func() { _ = mightydns.Stop() }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	for i, path := range []string{"/metrics", "/prometheus"} {
+		cfg := fmt.Sprintf(`{"logging": {"level": "ERROR"}, "apps": {"metrics": {"listen": %q, "path": %q}}}`, addr, path)
+		if err := mightydns.Load([]byte(cfg), true); err != nil {
+			t.Fatalf("load %d failed: %v", i, err)
+		}
+
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatalf("request after load %d failed: %v", i, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200 on %s after load %d, got %d", path, i, resp.StatusCode)
+		}
+	}
+}
+
+func TestMetricsApp_DuplicateListenAddressFails(t *testing.T) {
+	first := &MetricsApp{Listen: "127.0.0.1:0"}
+	if err := first.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if err := first.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer func() { _ = first.Stop() }()
+
+	second := &MetricsApp{Listen: first.listener.addr}
+	if err := second.Provision(mockContext{}); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if err := second.Start(); err == nil {
+		_ = second.Stop()
+		t.Fatal("expected a second app on the same address to fail")
+	}
+}
@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readHeaderTimeout bounds how long a scraper may take to send a request's
+// headers, so that slow clients cannot hold the listener's connections open.
+const readHeaderTimeout = 10 * time.Second
+
+// listeners holds the socket of every running metrics app, so that a config
+// reload keeping the same listen address takes the socket over instead of
+// failing to bind it while the old config is still running.
+var listeners = &listenerPool{
+	listeners: make(map[string]*sharedListener),
+}
+
+type listenerPool struct {
+	mu        sync.Mutex
+	listeners map[string]*sharedListener
+}
+
+// sharedListener serves metrics on a single address for the most recent
+// app holding it.
+type sharedListener struct {
+	key    string
+	addr   string
+	server *http.Server
+
+	holders []*MetricsApp
+	mu      sync.RWMutex
+}
+
+// acquire returns the listener for addr, binding it if no running app holds
+// it yet. A listener is only shared with an app from a newer config than
+// all of its holders, which are about to be stopped.
+func (p *listenerPool) acquire(addr string, app *MetricsApp) (*sharedListener, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := addr
+	if l, exists := p.listeners[key]; exists && !isEphemeral(addr) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, holder := range l.holders {
+			if holder.generation >= app.generation {
+				return nil, fmt.Errorf("listen address %s already in use", addr)
+			}
+		}
+		l.holders = append(l.holders, app)
+		return l, nil
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", addr, err)
+	}
+
+	l := &sharedListener{
+		addr:    ln.Addr().String(),
+		holders: []*MetricsApp{app},
+	}
+	l.server = &http.Server{
+		Handler:           l,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
+	// Listeners on an ephemeral port are never shared, so key them by the
+	// address actually bound
+	if isEphemeral(addr) {
+		key = l.addr
+	}
+	l.key = key
+	p.listeners[key] = l
+
+	app.logger.Info("starting metrics listener", "addr", l.addr, "path", app.Path)
+	go func() {
+		if err := l.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			app.logger.Error("metrics server error", "addr", l.addr, "error", err)
+		}
+	}()
+
+	return l, nil
+}
+
+// release drops app as a holder of l, shutting the listener down once no
+// app holds it.
+func (p *listenerPool) release(l *sharedListener, app *MetricsApp) error {
+	p.mu.Lock()
+	l.mu.Lock()
+	if len(l.holders) > 1 {
+		for i, holder := range l.holders {
+			if holder == app {
+				l.holders = append(l.holders[:i], l.holders[i+1:]...)
+				break
+			}
+		}
+		l.mu.Unlock()
+		p.mu.Unlock()
+		return nil
+	}
+	l.mu.Unlock()
+	delete(p.listeners, l.key)
+	p.mu.Unlock()
+
+	return l.server.Shutdown(context.Background())
+}
+
+// ServeHTTP implements http.Handler by dispatching to the most recent app
+// holding the listener.
+func (l *sharedListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.RLock()
+	app := l.holders[len(l.holders)-1]
+	l.mu.RUnlock()
+
+	if r.URL.Path != app.Path {
+		http.NotFound(w, r)
+		return
+	}
+	app.serveMetrics(w, r)
+}
+
+// isEphemeral reports whether addr asks for a system-assigned port.
+func isEphemeral(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port == "0"
+}
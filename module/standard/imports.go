@@ -2,5 +2,7 @@ package standard
 
 import (
 	_ "github.com/kusold/mightydns/module/dns"
+	_ "github.com/kusold/mightydns/module/dns/middleware"
 	_ "github.com/kusold/mightydns/module/log/handler"
+	_ "github.com/kusold/mightydns/module/metrics"
 )
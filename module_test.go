@@ -1,6 +1,7 @@
 package mightydns
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -49,3 +50,76 @@ func (t *testModuleImpl) MightyModule() ModuleInfo {
 		New: func() Module { return new(testModuleImpl) },
 	}
 }
+
+func TestModuleInfoNamespace(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{id: "dns.resolver.upstream", want: "dns.resolver"},
+		{id: "logger.text", want: "logger"},
+		{id: "dns", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := (ModuleInfo{ID: tt.id}).Namespace(); got != tt.want {
+			t.Errorf("expected namespace '%s' for '%s', got '%s'", tt.want, tt.id, got)
+		}
+	}
+}
+
+func TestModulesByCategory(t *testing.T) {
+	defer func() {
+		delete(modules, "test.module")
+	}()
+
+	RegisterModule(&testModuleImpl{})
+
+	categories := ModulesByCategory()
+
+	var found bool
+	for _, info := range categories["test"] {
+		if info.ID == "test.module" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected test.module in the 'test' category, got %v", categories["test"])
+	}
+
+	for ns, infos := range categories {
+		for i, info := range infos {
+			if info.Namespace() != ns {
+				t.Errorf("module '%s' listed under category '%s'", info.ID, ns)
+			}
+			if i > 0 && infos[i-1].ID > info.ID {
+				t.Errorf("category '%s' is not sorted by ID", ns)
+			}
+		}
+	}
+}
+
+func TestNewModule(t *testing.T) {
+	defer func() {
+		delete(modules, "test.module")
+	}()
+
+	RegisterModule(&testModuleImpl{})
+
+	mod, err := NewModule("test.module")
+	if err != nil {
+		t.Fatalf("failed to create module: %v", err)
+	}
+	if _, ok := mod.(*testModuleImpl); !ok {
+		t.Errorf("expected *testModuleImpl, got %T", mod)
+	}
+
+	info, _ := GetModule("test.module")
+	if typ := info.ConfigType(); typ != reflect.TypeOf(testModuleImpl{}) {
+		t.Errorf("expected config type testModuleImpl, got %v", typ)
+	}
+
+	if _, err := NewModule("does.not.exist"); err == nil {
+		t.Error("expected error for unknown module")
+	}
+}
@@ -0,0 +1,239 @@
+package mightydns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWebhookTimeout    = 5 * time.Second
+	defaultWebhookRetries    = 3
+	defaultWebhookRetryDelay = time.Second
+)
+
+// EventConfigLoaded is sent once a config has been loaded and all of its
+// apps have started.
+const EventConfigLoaded = "config.loaded"
+
+// notifier delivers events to the webhooks of the running config, if it
+// configures any. It is replaced along with the config.
+var (
+	notifier   *webhookNotifier
+	notifierMu sync.Mutex
+)
+
+// NotificationsConfig configures where events about the server's state
+// are sent.
+type NotificationsConfig struct {
+	Webhooks []*WebhookConfig `json:"webhooks,omitempty"`
+}
+
+// WebhookConfig describes a URL that events are POSTed to as JSON.
+type WebhookConfig struct {
+	URL string `json:"url,omitempty"`
+	// Events lists the event types sent to the webhook. All events are
+	// sent when it is empty.
+	Events []string `json:"events,omitempty"`
+	// Headers are added to every request, e.g. for authentication.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Timeout is how long each delivery attempt may take. Defaults to 5s.
+	Timeout string `json:"timeout,omitempty"`
+	// Retries is how many times a failed delivery is retried. Defaults
+	// to 3.
+	Retries int `json:"retries,omitempty"`
+	// RetryDelay is the delay before the first retry, doubled for each
+	// retry after it. Defaults to 1s.
+	RetryDelay string `json:"retry_delay,omitempty"`
+
+	timeout    time.Duration
+	retryDelay time.Duration
+}
+
+// Event is the JSON document POSTed to webhooks.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data,omitempty"`
+}
+
+type webhookNotifier struct {
+	webhooks []*WebhookConfig
+	client   *http.Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	pending  sync.WaitGroup
+}
+
+// newNotifier validates cfg and returns a notifier for its webhooks, or
+// nil if it has none.
+func newNotifier(cfg *NotificationsConfig) (*webhookNotifier, error) {
+	if cfg == nil || len(cfg.Webhooks) == 0 {
+		return nil, nil
+	}
+
+	for i, webhook := range cfg.Webhooks {
+		if err := webhook.provision(); err != nil {
+			return nil, fmt.Errorf("webhook %d: %w", i, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &webhookNotifier{
+		webhooks: cfg.Webhooks,
+		client:   &http.Client{},
+		ctx:      ctx,
+		cancel:   cancel,
+	}, nil
+}
+
+func (w *WebhookConfig) provision() error {
+	if w == nil {
+		return fmt.Errorf("webhook is empty")
+	}
+
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+
+	if w.Timeout == "" {
+		w.Timeout = defaultWebhookTimeout.String()
+	}
+	w.timeout, err = time.ParseDuration(w.Timeout)
+	if err != nil {
+		return fmt.Errorf("invalid timeout duration: %w", err)
+	}
+
+	if w.Retries < 0 {
+		return fmt.Errorf("retries must not be negative: %d", w.Retries)
+	}
+	if w.Retries == 0 {
+		w.Retries = defaultWebhookRetries
+	}
+
+	if w.RetryDelay == "" {
+		w.RetryDelay = defaultWebhookRetryDelay.String()
+	}
+	w.retryDelay, err = time.ParseDuration(w.RetryDelay)
+	if err != nil {
+		return fmt.Errorf("invalid retry_delay duration: %w", err)
+	}
+
+	return nil
+}
+
+// Notify sends an event of the given type to the webhooks of the running
+// config that accept it. Delivery happens in the background, so Notify
+// never blocks on a slow or unreachable webhook.
+func Notify(eventType string, data any) {
+	notifierMu.Lock()
+	n := notifier
+	notifierMu.Unlock()
+
+	if n != nil {
+		n.notify(Event{Type: eventType, Time: time.Now().UTC(), Data: data})
+	}
+}
+
+func (n *webhookNotifier) notify(event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		Logger().Error("encoding event", "type", event.Type, "error", err)
+		return
+	}
+
+	for _, webhook := range n.webhooks {
+		if len(webhook.Events) > 0 && !slices.Contains(webhook.Events, event.Type) {
+			continue
+		}
+
+		n.pending.Add(1)
+		go func() {
+			defer n.pending.Done()
+			n.deliver(webhook, event.Type, body)
+		}()
+	}
+}
+
+// deliver POSTs body to the webhook, retrying with exponential backoff
+// until it accepts it with a 2xx status or the retries run out.
+func (n *webhookNotifier) deliver(webhook *WebhookConfig, eventType string, body []byte) {
+	delay := webhook.retryDelay
+	for attempt := 0; ; attempt++ {
+		err := n.post(webhook, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhook.Retries || n.ctx.Err() != nil {
+			Logger().Warn("failed to deliver event to webhook",
+				"type", eventType,
+				"url", webhook.URL,
+				"attempts", attempt+1,
+				"error", err)
+			return
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-n.ctx.Done():
+			timer.Stop()
+		}
+		delay *= 2
+	}
+}
+
+func (n *webhookNotifier) post(webhook *WebhookConfig, body []byte) error {
+	ctx, cancel := context.WithTimeout(n.ctx, webhook.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range webhook.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// close abandons retries of undelivered events and waits for the
+// deliveries in progress to give up.
+func (n *webhookNotifier) close() {
+	n.cancel()
+	n.pending.Wait()
+}
+
+// swapNotifier makes next the notifier for events, closing the previous
+// one if it is being replaced.
+func swapNotifier(next *webhookNotifier) {
+	notifierMu.Lock()
+	prev := notifier
+	notifier = next
+	notifierMu.Unlock()
+
+	if prev != nil && prev != next {
+		prev.close()
+	}
+}
@@ -0,0 +1,125 @@
+package mightydns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func notifyConfig(webhook string) []byte {
+	return []byte(fmt.Sprintf(`{
+		"logging": {"handler": "test.logger"},
+		"apps": {
+			"test.app": {"label": "notify"}
+		},
+		"notifications": {"webhooks": [%s]}
+	}`, webhook))
+}
+
+func TestNotify_ConfigLoaded(t *testing.T) {
+	defer func() { _ = Stop() }()
+
+	events := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Expected the configured header, got %q", r.Header.Get("Authorization"))
+		}
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("decoding event: %v", err)
+		}
+		events <- event
+	}))
+	defer server.Close()
+
+	webhook := fmt.Sprintf(`{"url": %q, "headers": {"Authorization": "Bearer secret"}}`, server.URL)
+	if err := Load(notifyConfig(webhook), true); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	select {
+	case event := <-events:
+		if event.Type != EventConfigLoaded {
+			t.Errorf("Expected a %s event, got %s", EventConfigLoaded, event.Type)
+		}
+		data, _ := event.Data.(map[string]any)
+		if apps, _ := data["apps"].([]any); len(apps) != 1 || apps[0] != "test.app" {
+			t.Errorf("Expected the started apps in the event, got %v", event.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the webhook to be called")
+	}
+}
+
+func TestNotify_Retries(t *testing.T) {
+	defer func() { _ = Stop() }()
+
+	var attempts atomic.Int32
+	delivered := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		close(delivered)
+	}))
+	defer server.Close()
+
+	webhook := fmt.Sprintf(`{"url": %q, "retry_delay": "10ms"}`, server.URL)
+	if err := Load(notifyConfig(webhook), true); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a retry to succeed, got %d attempts", attempts.Load())
+	}
+}
+
+func TestNotify_EventFilter(t *testing.T) {
+	defer func() { _ = Stop() }()
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer server.Close()
+
+	webhook := fmt.Sprintf(`{"url": %q, "events": ["zone.updated"]}`, server.URL)
+	if err := Load(notifyConfig(webhook), true); err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	// Waits for any deliveries in progress
+	swapNotifier(nil)
+
+	if got := calls.Load(); got != 0 {
+		t.Errorf("Expected no events for a webhook that does not accept them, got %d", got)
+	}
+}
+
+func TestNotify_InvalidWebhook(t *testing.T) {
+	defer func() { _ = Stop() }()
+
+	tests := []struct {
+		name    string
+		webhook string
+	}{
+		{name: "missing url", webhook: `{}`},
+		{name: "not http", webhook: `{"url": "ftp://example.com/hook"}`},
+		{name: "invalid timeout", webhook: `{"url": "http://example.com/hook", "timeout": "soon"}`},
+		{name: "negative retries", webhook: `{"url": "http://example.com/hook", "retries": -1}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Load(notifyConfig(tt.webhook), true); err == nil {
+				t.Error("Expected loading the config to fail")
+			}
+		})
+	}
+}